@@ -1,142 +1,199 @@
-package main
-
-import (
-	"fmt"
-
-	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
-	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
-	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
-	amqp "github.com/rabbitmq/amqp091-go"
-)
-
-/* Create a new function called handlerPause in the cmd/client application package. It accepts 
-a game state struct and returns a new handler function that accepts a routing.PlayingState struct. 
-This will be the handler we pass into SubscribeJSON that will be called each time a new message 
-is consumed. Here's my signature: */
-// - takes a pointer to a gamelogic.GameState and returns another function
-// - The returned function has the signature func(routing.PlayingState)
-// - Because it closes over gs, the inner function can use that game state when a routing.PlayingState 
-//   message arrives
-//	 (In other words, the returned function forms a closure: its environment includes gs, so you don’t 
-//   need to pass gs each time)
-// Update your client's "move" and "pause" handlers to return an "acktype":
-func handlerPause(gs *gamelogic.GameState) func(routing.PlayingState) pubsub.Acktype {
-	return func(ps routing.PlayingState) pubsub.Acktype {
-		// defer a print statement that gives the user a new prompt: defer fmt.Print("> "):
-		defer fmt.Print("> ")
-		// Use the game state's HandlePause method to pause the game for the client:
-		gs.HandlePause(ps)
-		// The "pause" handler should always Ack:
-		return pubsub.Ack
-	}
-}
-
-// The handler for new messages should use the GameState's HandleMove method and then print 
-// a new > prompt for the user:
-// (explanations above)
-// Update your client's "move" and "pause" handlers to return an "acktype":
-func handlerMove(gs *gamelogic.GameState, publishCh *amqp.Channel) func(gamelogic.ArmyMove) pubsub.Acktype {
-// func handlerMove(gs *gamelogic.GameState) func(gamelogic.ArmyMove) pubsub.Acktype {
-	return func(move gamelogic.ArmyMove) pubsub.Acktype {
-		defer fmt.Print("> ")
-		moveOutcome := gs.HandleMove(move)
-		switch moveOutcome {
-		// The "move" handler should "NackDiscard" if:
-			// The move outcome was "same player":
-		case gamelogic.MoveOutcomeSamePlayer:
-			return pubsub.Ack
-		// The "move" handler should only "Ack" if:
-			// The move outcome was "safe":
-		case gamelogic.MoveOutComeSafe:
-			return pubsub.Ack
-			// Update the "move" handler so that when detects MoveOutcomeMakeWar:
-		case gamelogic.MoveOutcomeMakeWar:
-			err := pubsub.PublishJSON(
-				publishCh,
-				routing.ExchangePerilTopic,
-				// Publish a message to the "topic" exchange with the routing key:
-				routing.WarRecognitionsPrefix+"."+gs.GetUsername(),	// $WARPREFIX.$USERNAME
-				gamelogic.RecognitionOfWar{
-					Attacker: move.Player,
-					Defender: gs.GetPlayerSnap(),
-				},
-			)
-			if err != nil {
-				fmt.Printf("error: %s\n", err)
-				// If publishing the war declaration fails, "NackRequeue" the message:
-				return pubsub.NackRequeue
-			}
-			// Otherwise, "Ack" the message:
-			return pubsub.Ack
-		}
-		//  "NackDiscard" if the move outcome was anything else:
-		fmt.Println("error: unknown move outcome")
-		return pubsub.NackDiscard
-	}
-}
-
-// Create a new handler that consumes all the war messages that the "move" handler publishes, 
-// no matter the username in the routing key.
-// Update the war handler function in the client to publish game logs
-func handlerWar(gs *gamelogic.GameState, publishCh *amqp.Channel) func(dw gamelogic.RecognitionOfWar) pubsub.Acktype {
-	return func(dw gamelogic.RecognitionOfWar) pubsub.Acktype {
-		// defer fmt.Print("> ") to ensure a new prompt is printed after the handler is done:
-		defer fmt.Print("> ")
-		// Call the gamestate's HandleWar method with the message's body:
-		warOutcome, winner, loser := gs.HandleWar(dw)
-		switch warOutcome {
-		// If the outcome is gamelogic.WarOutcomeNotInvolved: NackRequeue the message so another 
-		// client can try to consume it:
-		case gamelogic.WarOutcomeNotInvolved:
-			return pubsub.NackRequeue
-		// If the outcome is gamelogic.WarOutcomeNoUnits: NackDiscard the message:
-		case gamelogic.WarOutcomeNoUnits:
-			return pubsub.NackDiscard
-		// If the outcome is gamelogic.WarOutcomeOpponentWon: Ack the message:
-		// If the outcome is that the opponent won, the message should say "{winner} won 
-		// a war against {loser}"
-		case gamelogic.WarOutcomeOpponentWon:
-			err := publishGameLog(
-				publishCh,
-				gs.GetUsername(),
-				fmt.Sprintf("%s won a war against %s", winner, loser),
-			)
-			if err != nil {
-				fmt.Printf("error: %s\n", err)
-				return pubsub.NackRequeue
-			}
-			return pubsub.Ack
-		// If the outcome is gamelogic.WarOutcomeYouWon: Ack the message:
-		// If the outcome is that the player won, the message should also say "{winner} won 
-		// a war against {loser}"
-		case gamelogic.WarOutcomeYouWon:
-			err := publishGameLog(
-				publishCh,
-				gs.GetUsername(),
-				fmt.Sprintf("%s won a war against %s", winner, loser),
-			)
-			if err != nil {
-				fmt.Printf("error: %s\n", err)
-				return pubsub.NackRequeue
-			}
-			return pubsub.Ack
-		// If the outcome is gamelogic.WarOutcomeDraw: Ack the message:
-		// If the outcome is a draw, the message should say "A war between {winner} and 
-		// {loser} resulted in a draw"
-		case gamelogic.WarOutcomeDraw:
-			err := publishGameLog(
-				publishCh,
-				gs.GetUsername(),
-				fmt.Sprintf("A war between %s and %s resulted in a draw", winner, loser),
-			)
-			if err != nil {
-				fmt.Printf("error: %s\n", err)
-				return pubsub.NackRequeue
-			}
-			return pubsub.Ack
-		}
-		// If it's anything else, print an error and NackDiscard the message:
-		fmt.Println("error: unknown war outcome")
-		return pubsub.NackDiscard
-	}
-}
\ No newline at end of file
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+/* Create a new function called handlerPause in the cmd/client application package. It accepts 
+a game state struct and returns a new handler function that accepts a routing.PlayingState struct. 
+This will be the handler we pass into SubscribeJSON that will be called each time a new message 
+is consumed. Here's my signature: */
+// - takes a pointer to a gamelogic.GameState and returns another function
+// - The returned function has the signature func(routing.PlayingState)
+// - Because it closes over gs, the inner function can use that game state when a routing.PlayingState 
+//   message arrives
+//	 (In other words, the returned function forms a closure: its environment includes gs, so you don’t 
+//   need to pass gs each time)
+// Update your client's "move" and "pause" handlers to return an "acktype":
+func handlerPause(gs *gamelogic.GameState) func(routing.PlayingState) pubsub.Acktype {
+	return func(ps routing.PlayingState) pubsub.Acktype {
+		// defer a print statement that gives the user a new prompt: defer fmt.Print("> "):
+		defer fmt.Print("> ")
+		// Use the game state's HandlePause method to pause the game for the client:
+		gs.HandlePause(ps)
+		// The "pause" handler should always Ack:
+		return pubsub.Ack
+	}
+}
+
+// The handler for new messages should use the GameState's HandleMove method and then print 
+// a new > prompt for the user:
+// (explanations above)
+// Update your client's "move" and "pause" handlers to return an "acktype":
+func handlerMove(gs *gamelogic.GameState, publishCh pubsub.Sender, logger *slog.Logger) func(pubsub.Message[gamelogic.ArmyMove]) pubsub.Acktype {
+// func handlerMove(gs *gamelogic.GameState) func(gamelogic.ArmyMove) pubsub.Acktype {
+	return func(msg pubsub.Message[gamelogic.ArmyMove]) pubsub.Acktype {
+		defer fmt.Print("> ")
+		move := msg.Body
+		// A redelivered move may have been half handled by a client that went away, so say so:
+		if msg.Redelivered {
+			fmt.Printf("(redelivered move from %s)\n", publisher(msg.Header(routing.HeaderPlayer), move.Player.Username))
+		}
+		moveOutcome := gs.HandleMove(move)
+		switch moveOutcome {
+		// The "move" handler should "NackDiscard" if:
+			// The move outcome was "same player":
+		case gamelogic.MoveOutcomeSamePlayer:
+			return pubsub.Ack
+		// The "move" handler should only "Ack" if:
+			// The move outcome was "safe":
+		case gamelogic.MoveOutComeSafe:
+			return pubsub.Ack
+			// Update the "move" handler so that when detects MoveOutcomeMakeWar:
+		case gamelogic.MoveOutcomeMakeWar:
+			err := pubsub.PublishJSON(
+				publishCh,
+				routing.ExchangePerilTopic,
+				// Publish a message to the "topic" exchange with the routing key:
+				routing.WarRecognitionsPrefix+"."+gs.GetUsername(),	// $WARPREFIX.$USERNAME
+				gamelogic.RecognitionOfWar{
+					Attacker: move.Player,
+					Defender: gs.GetPlayerSnap(),
+				},
+			)
+			if err != nil {
+				logger.Error("could not declare war", "username", gs.GetUsername(), "attacker", move.Player.Username, "err", err)
+				// If publishing the war declaration fails, "NackRequeue" the message:
+				return pubsub.NackRequeue
+			}
+			// Otherwise, "Ack" the message:
+			return pubsub.Ack
+		}
+		//  "NackDiscard" if the move outcome was anything else:
+		logger.Error("unknown move outcome", "username", gs.GetUsername(), "outcome", moveOutcome)
+		return pubsub.NackDiscard
+	}
+}
+
+// Create a new handler that consumes all the war messages that the "move" handler publishes, 
+// no matter the username in the routing key.
+// Update the war handler function in the client to publish game logs
+func handlerWar(gs *gamelogic.GameState, publishCh pubsub.Sender, logger *slog.Logger) func(pubsub.Message[gamelogic.RecognitionOfWar]) pubsub.Acktype {
+	return func(msg pubsub.Message[gamelogic.RecognitionOfWar]) pubsub.Acktype {
+		// defer fmt.Print("> ") to ensure a new prompt is printed after the handler is done:
+		defer fmt.Print("> ")
+		dw := msg.Body
+		// Wars that uninvolved clients passed on come back as retries:
+		if msg.Redelivered || msg.Retries > 0 {
+			fmt.Printf("(war declared by %s, delivered again after %d retries)\n", publisher(msg.Header(routing.HeaderPlayer), dw.Defender.Username), msg.Retries)
+		}
+		// Call the gamestate's HandleWar method with the message's body:
+		warOutcome, winner, loser := gs.HandleWar(dw)
+		switch warOutcome {
+		// If the outcome is gamelogic.WarOutcomeNotInvolved: put the message back so another 
+		// client can try to consume it. NackRetryLater rather than NackRequeue, so it doesn't 
+		// bounce between uninvolved clients forever:
+		case gamelogic.WarOutcomeNotInvolved:
+			return pubsub.NackRetryLater
+		// If the outcome is gamelogic.WarOutcomeNoUnits: NackDiscard the message:
+		case gamelogic.WarOutcomeNoUnits:
+			return pubsub.NackDiscard
+		// If the outcome is gamelogic.WarOutcomeOpponentWon: Ack the message:
+		// If the outcome is that the opponent won, the message should say "{winner} won 
+		// a war against {loser}"
+		case gamelogic.WarOutcomeOpponentWon:
+			err := publishGameLog(
+				publishCh,
+				gs.GetUsername(),
+				fmt.Sprintf("%s won a war against %s", winner, loser),
+			)
+			if err != nil {
+				logger.Error("could not publish game log", "username", gs.GetUsername(), "outcome", warOutcome, "err", err)
+				return pubsub.NackRequeue
+			}
+			return pubsub.Ack
+		// If the outcome is gamelogic.WarOutcomeYouWon: Ack the message:
+		// If the outcome is that the player won, the message should also say "{winner} won 
+		// a war against {loser}"
+		case gamelogic.WarOutcomeYouWon:
+			err := publishGameLog(
+				publishCh,
+				gs.GetUsername(),
+				fmt.Sprintf("%s won a war against %s", winner, loser),
+			)
+			if err != nil {
+				logger.Error("could not publish game log", "username", gs.GetUsername(), "outcome", warOutcome, "err", err)
+				return pubsub.NackRequeue
+			}
+			return pubsub.Ack
+		// If the outcome is gamelogic.WarOutcomeDraw: Ack the message:
+		// If the outcome is a draw, the message should say "A war between {winner} and 
+		// {loser} resulted in a draw"
+		case gamelogic.WarOutcomeDraw:
+			err := publishGameLog(
+				publishCh,
+				gs.GetUsername(),
+				fmt.Sprintf("A war between %s and %s resulted in a draw", winner, loser),
+			)
+			if err != nil {
+				logger.Error("could not publish game log", "username", gs.GetUsername(), "outcome", warOutcome, "err", err)
+				return pubsub.NackRequeue
+			}
+			return pubsub.Ack
+		}
+		// If it's anything else, print an error and NackDiscard the message:
+		logger.Error("unknown war outcome", "username", gs.GetUsername(), "outcome", warOutcome)
+		return pubsub.NackDiscard
+	}
+}
+
+// publisher names the player who published a message: the one in its player header, or 
+// fallback for messages from clients that don't stamp it.
+func publisher(header, fallback string) string {
+	if header != "" {
+		return header
+	}
+	return fallback
+}
+
+// armyMovesQueue drops moves that have waited too long, or that too many newer ones have 
+// arrived behind, rather than letting the queue grow while the player is paused:
+var armyMovesQueue = pubsub.QueueOptions{
+	MessageTTL: routing.ArmyMovesTTL,
+	MaxLength:  routing.ArmyMovesMaxLength,
+	Overflow:   pubsub.OverflowDropHead,
+}
+
+// handlerTimeout is how long a handler can run before it's reported as stuck. The handlers 
+// only wait for the outbox to write what they publish to disk, not for the broker, so this is 
+// plenty:
+const handlerTimeout = 5 * time.Second
+
+// dedupWindow is how many message IDs each subscription remembers, to drop the copies of a 
+// move, war or game log that an outbox replays after a crash:
+const dedupWindow = 10000
+
+// withMiddleware wraps a handler so that a panic in it dead-letters the message rather than 
+// crashing the client, every message is logged, and slow or stuck handlers are called out. 
+// A stuck handler isn't given up on for a retry: the move and war handlers change the game 
+// state and publish, and would do both again on the redelivered message. For the same reason 
+// a message that has already been handled once is dropped:
+func withMiddleware[T any](logger *slog.Logger, handler pubsub.Handler[T]) pubsub.Handler[T] {
+	return pubsub.Chain(handler,
+		pubsub.Recover[T](logger),
+		pubsub.Logging[T](logger),
+		pubsub.Timing(func(msg pubsub.Message[T], ack pubsub.Acktype, elapsed time.Duration) {
+			if elapsed > time.Second {
+				logger.Warn("slow handler", "routing_key", msg.RoutingKey, "took", elapsed)
+			}
+		}),
+		pubsub.Dedup[T](dedupWindow, logger),
+		pubsub.WarnAfter[T](handlerTimeout, logger),
+	)
+}
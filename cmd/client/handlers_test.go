@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// testGame is a MemoryBroker with the default topology, and a consumer of
+// the game logs the clients publish in place of the server.
+type testGame struct {
+	ctx  context.Context
+	conn pubsub.Connection
+	logs chan routing.GameLog
+}
+
+func newTestGame(t *testing.T) *testGame {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	conn, err := pubsub.NewMemoryBroker().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := pubsub.ApplyTopology(conn, pubsub.DefaultTopology()); err != nil {
+		t.Fatal(err)
+	}
+	g := &testGame{ctx: ctx, conn: conn, logs: make(chan routing.GameLog, 10)}
+	sub, err := pubsub.SubscribeMessages(ctx, conn, routing.ExchangePerilTopic,
+		routing.GameLogSlug, routing.GameLogSlug+".*", pubsub.SimpleQueueQuorum,
+		pubsub.BodyHandler(func(gl routing.GameLog) pubsub.Acktype {
+			g.logs <- gl
+			return pubsub.Ack
+		}),
+		pubsub.WithCodec(pubsub.Gob),
+		pubsub.WithDeliveryLimit(routing.DeliveryLimit),
+		pubsub.WithLogger(discardLogger),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+	return g
+}
+
+// join subscribes a player to moves and wars the way main does, with
+// units spawned as "<location> <rank>" pairs, and returns their game state
+// and the channel they publish on.
+func (g *testGame) join(t *testing.T, username string, units ...[2]string) (*gamelogic.GameState, pubsub.Sender) {
+	t.Helper()
+	gs := gamelogic.NewGameState(username)
+	gs.SetLogger(discardLogger)
+	for _, u := range units {
+		if err := gs.CommandSpawn([]string{"spawn", u[0], u[1]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publishCh, err := g.conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { publishCh.Close() })
+
+	movesSub, err := pubsub.SubscribeMessages(g.ctx, g.conn, routing.ExchangePerilTopic,
+		routing.ArmyMovesPrefix+"."+username, routing.ArmyMovesPrefix+".*", pubsub.SimpleQueueTransient,
+		withMiddleware(discardLogger, handlerMove(gs, publishCh, discardLogger)),
+		pubsub.WithQueueOptions(armyMovesQueue),
+		pubsub.WithLogger(discardLogger),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { movesSub.Close() })
+	warSub, err := pubsub.SubscribeMessages(g.ctx, g.conn, routing.ExchangePerilTopic,
+		routing.WarRecognitionsPrefix, routing.WarRecognitionsPrefix+".*", pubsub.SimpleQueueQuorum,
+		withMiddleware(discardLogger, handlerWar(gs, publishCh, discardLogger)),
+		pubsub.WithDeliveryLimit(routing.DeliveryLimit),
+		// So that a war an uninvolved player passes on comes back quickly
+		pubsub.WithRetryPolicy(pubsub.RetryPolicy{InitialDelay: 10 * time.Millisecond}),
+		pubsub.WithLogger(discardLogger),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { warSub.Close() })
+	return gs, publishCh
+}
+
+func (g *testGame) nextLog(t *testing.T) routing.GameLog {
+	t.Helper()
+	select {
+	case gl := <-g.logs:
+		return gl
+	case <-time.After(5 * time.Second):
+		t.Fatal("no game log published")
+		return routing.GameLog{}
+	}
+}
+
+// move runs the move command and publishes the move, as the REPL does.
+func move(t *testing.T, gs *gamelogic.GameState, publishCh pubsub.Sender, words string, opts ...pubsub.PublishOption) gamelogic.ArmyMove {
+	t.Helper()
+	mv, err := gs.CommandMove(strings.Fields("move " + words))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pubsub.PublishJSON(publishCh, routing.ExchangePerilTopic, routing.ArmyMovesPrefix+"."+mv.Player.Username, mv, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mv
+}
+
+// A move into a player's territory makes them declare war, which the
+// attacker fights, and the outcome ends up in the game log.
+func TestMoveWarGameLog(t *testing.T) {
+	g := newTestGame(t)
+	alice, aliceCh := g.join(t, "alice", [2]string{"asia", "artillery"})
+	g.join(t, "bob", [2]string{"europe", "infantry"})
+	// A bystander, who passes the war on
+	g.join(t, "carol", [2]string{"africa", "infantry"})
+
+	move(t, alice, aliceCh, "europe 1")
+
+	gl := g.nextLog(t)
+	if gl.Username != "alice" || gl.Message != "alice won a war against bob" {
+		t.Fatalf("game log from %s: %q, want alice: alice won a war against bob", gl.Username, gl.Message)
+	}
+	select {
+	case gl := <-g.logs:
+		t.Fatalf("another game log from %s: %q", gl.Username, gl.Message)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// A move an outbox replays after a crash has the same message ID, and
+// must not start a second war.
+func TestReplayedMoveHandledOnce(t *testing.T) {
+	g := newTestGame(t)
+	alice, aliceCh := g.join(t, "alice", [2]string{"asia", "artillery"})
+	g.join(t, "bob", [2]string{"europe", "infantry"})
+
+	mv := move(t, alice, aliceCh, "europe 1", pubsub.WithMessageID("move-1"))
+	err := pubsub.PublishJSON(aliceCh, routing.ExchangePerilTopic, routing.ArmyMovesPrefix+".alice", mv, pubsub.WithMessageID("move-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g.nextLog(t)
+	select {
+	case gl := <-g.logs:
+		t.Fatalf("the replayed move started another war: %s: %q", gl.Username, gl.Message)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/config"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// The gateway lets browsers play Peril. Each browser opens a WebSocket to
+// /play?user=<name> and becomes a player just like a terminal client: it
+// gets its own army_moves and pause queues, sends the REPL's spawn, move
+// and status commands as JSON and is sent the moves, wars and pauses that
+// reach it. See session.go for the frames.
+func main() {
+	addr := flag.String("addr", ":8080", "address to serve WebSockets on")
+	origins := flag.String("origins", "", "comma-separated origins browsers may connect from (default: the gateway's own host)")
+	cfgFlags := config.AddFlags(flag.CommandLine)
+	flag.Parse()
+	cfg, err := cfgFlags.Load()
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	if cfgFlags.PrintConfig {
+		cfg.Print(os.Stdout)
+		return
+	}
+	cfg.Apply()
+	logger := cfg.Logger(slog.LevelInfo)
+	slog.SetDefault(logger)
+
+	fmt.Println("Starting Peril gateway...")
+	// ctx is cancelled on ctrl+c, which closes every session and stops the server:
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	conn, err := cfg.Dial()
+	if err != nil {
+		log.Fatalf("could not connect to RabbitMQ: %v", err)
+	}
+	defer conn.Close()
+	// Sessions' queues dead-letter to peril_dlx; declare it in case the server hasn't yet:
+	err = pubsub.DeclareDeadLetterQueue(conn)
+	if err != nil {
+		log.Fatalf("could not declare dead-letter queue: %v", err)
+	}
+	// Every session publishes through the same pools. As in the client, the handlers publish
+	// in confirm mode so that a lost war or game log means the message is requeued:
+	publisher, err := pubsub.NewPublisher(conn, pubsub.PublisherConfig{})
+	if err != nil {
+		log.Fatalf("could not create publisher: %v", err)
+	}
+	defer publisher.Close()
+	confirmPublisher, err := pubsub.NewPublisher(conn, pubsub.PublisherConfig{ConfirmTimeout: 5 * time.Second})
+	if err != nil {
+		log.Fatalf("could not create confirming publisher: %v", err)
+	}
+	defer confirmPublisher.Close()
+
+	g := &gateway{
+		ctx:              ctx,
+		conn:             conn,
+		publisher:        publisher,
+		confirmPublisher: confirmPublisher,
+		logger:           logger,
+		consumerLogger:   cfg.ConsumerLogger(slog.LevelInfo),
+		prefetch:         cfg.PrefetchOr(pubsub.DefaultPrefetch),
+		origins:          map[string]bool{},
+		players:          map[string]bool{},
+	}
+	for _, o := range strings.Split(*origins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			g.origins[strings.ToLower(o)] = true
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/play", g)
+	srv := &http.Server{Addr: *addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	fmt.Printf("Peril gateway listening on %s\n", *addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("gateway stopped", "err", err)
+	}
+	// The server doesn't wait for WebSockets, which it has handed over, so wait for the
+	// sessions to close before their connection goes:
+	g.close()
+	fmt.Println("Peril gateway stopped")
+}
+
+// gateway serves the sessions.
+type gateway struct {
+	ctx              context.Context
+	conn             pubsub.Connection
+	publisher        pubsub.Sender
+	confirmPublisher pubsub.Sender
+	logger           *slog.Logger
+	consumerLogger   *slog.Logger // for the sessions' subscriptions
+	prefetch         int
+	// origins browsers may connect from. If empty, only pages served by the same host may.
+	origins map[string]bool
+
+	mu       sync.Mutex
+	players  map[string]bool
+	closing  bool
+	sessions sync.WaitGroup
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("user")
+	if !routing.ValidUsername(username) {
+		http.Error(w, "user must be 1 to 32 letters, digits, - or _", http.StatusBadRequest)
+		return
+	}
+	// One session per player, as a player's queues are exclusive to the session that declared them
+	if !g.join(username) {
+		http.Error(w, username+" is already playing", http.StatusConflict)
+		return
+	}
+	defer g.leave(username)
+
+	ws, err := upgradeWebSocket(w, r, g.checkOrigin)
+	if err != nil {
+		g.logger.Info("rejected websocket", "username", username, "remote", r.RemoteAddr, "err", err)
+		return
+	}
+	g.serveSession(ws, username)
+}
+
+// join claims a player's name for a new session. It fails if the name is taken, or the
+// gateway is shutting down.
+func (g *gateway) join(username string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closing || g.players[username] {
+		return false
+	}
+	g.players[username] = true
+	g.sessions.Add(1)
+	return true
+}
+
+func (g *gateway) leave(username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.players, username)
+	g.sessions.Done()
+}
+
+// close stops new sessions and waits for the ones there are to end. The sessions end
+// themselves when g.ctx is cancelled.
+func (g *gateway) close() {
+	g.mu.Lock()
+	g.closing = true
+	g.mu.Unlock()
+	g.sessions.Wait()
+}
+
+// checkOrigin stops other sites' pages from playing as the browser's user. Requests without
+// an Origin aren't from a browser page, so they're let through.
+func (g *gateway) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(g.origins) > 0 {
+		return g.origins[strings.ToLower(origin)]
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// request is a command from the browser: the words the terminal client's
+// REPL takes, split into the command and its arguments. For example
+//
+//	{"id": 1, "command": "move", "args": ["europe", "1"]}
+//
+// The reply carries the same ID, so the browser can match them up.
+type request struct {
+	ID      int      `json:"id"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+// event is a frame we push to the browser. Type is "reply" for the answer
+// to a request, or "welcome", "move", "war" or "pause" for something that
+// happened in the game.
+type event struct {
+	Type  string `json:"type"`
+	ID    int    `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+	Data  any    `json:"data,omitempty"`
+}
+
+// status is the player's side of the game, as "welcome" and "status"
+// report it.
+type status struct {
+	Paused bool             `json:"paused"`
+	Player gamelogic.Player `json:"player"`
+}
+
+// moveEvent is another player's move. Outcome is "safe", or "war" if it
+// started one.
+type moveEvent struct {
+	Move    gamelogic.ArmyMove `json:"move"`
+	Outcome string             `json:"outcome"`
+}
+
+// warEvent is a war the player fought. Outcome is "won", "lost", "draw" or
+// "no_units".
+type warEvent struct {
+	War     gamelogic.RecognitionOfWar `json:"war"`
+	Outcome string                     `json:"outcome"`
+	Winner  string                     `json:"winner,omitempty"`
+	Loser   string                     `json:"loser,omitempty"`
+}
+
+// pauseEvent is the server pausing or resuming the game.
+type pauseEvent struct {
+	Paused bool `json:"paused"`
+}
+
+// handlerTimeout is how long a handler can run before it's reported as stuck. The war
+// handler waits up to 5s for the broker to confirm its game log, so allow for that.
+const handlerTimeout = 15 * time.Second
+
+// dedupWindow is how many message IDs each subscription remembers, to drop the copies of a
+// move or war that a client's outbox replays after a crash.
+const dedupWindow = 10000
+
+// session is one browser playing the game. It holds the player's game state, as the
+// terminal client does, and plays the client's part on the broker for it.
+type session struct {
+	ws        *wsConn
+	gs        *gamelogic.GameState
+	publishCh pubsub.Sender
+	handlerCh pubsub.Sender
+	logger    *slog.Logger
+	// consumerLogger is for the subscriptions and their middleware, which
+	// -log-consumer-level can make louder than the rest
+	consumerLogger *slog.Logger
+}
+
+// serveSession runs a session until the browser goes away or the gateway shuts down.
+func (g *gateway) serveSession(ws *wsConn, username string) {
+	defer ws.CloseNow()
+	ctx, cancel := context.WithCancel(g.ctx)
+	defer cancel()
+
+	// Stamp everything we publish with who sent it, as the terminal client does:
+	stamp := []pubsub.PublishOption{
+		pubsub.WithAppID(routing.AppGateway),
+		pubsub.WithHeader(routing.HeaderPlayer, username),
+	}
+	s := &session{
+		ws:             ws,
+		gs:             gamelogic.NewGameState(username),
+		publishCh:      pubsub.Stamp(g.publisher, stamp...),
+		handlerCh:      pubsub.Stamp(g.confirmPublisher, stamp...),
+		logger:         g.logger.With("username", username),
+		consumerLogger: g.consumerLogger.With("username", username),
+	}
+	// The game state adds the username itself
+	s.gs.SetLogger(g.logger)
+
+	subs, err := s.subscribe(ctx, g.conn, g.prefetch)
+	if err != nil {
+		s.logger.Error("could not subscribe", "err", err)
+		ws.Close(closeInternalError, "could not join the game")
+		return
+	}
+	// Closing a subscription waits for its handler, which may be pushing to the browser. Once
+	// the session ends that push fails straight away, so this doesn't hold things up:
+	defer func() {
+		for _, sub := range subs {
+			sub.Close()
+		}
+	}()
+
+	go s.keepAlive(ctx)
+	s.push(event{Type: "welcome", Data: s.status()})
+	s.logger.Info("player joined")
+	for {
+		op, data, err := ws.ReadMessage()
+		if err != nil {
+			var ce *wsCloseError
+			if !errors.As(err, &ce) && ctx.Err() == nil {
+				s.logger.Warn("browser went away", "err", err)
+			}
+			s.logger.Info("player left")
+			return
+		}
+		if op != opText {
+			ws.Close(closeUnsupportedData, "send requests as JSON text")
+			continue
+		}
+		var req request
+		if err := json.Unmarshal(data, &req); err != nil {
+			s.push(event{Type: "reply", Error: fmt.Sprintf("bad request: %v", err)})
+			continue
+		}
+		reply := event{Type: "reply", ID: req.ID}
+		reply.Data, err = s.handle(ctx, req)
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		s.push(reply)
+	}
+}
+
+// keepAlive pings the browser while the session is quiet, and closes it when the gateway
+// shuts down.
+func (s *session) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.ws.Ping(); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			s.ws.Close(closeGoingAway, "gateway shutting down")
+			return
+		}
+	}
+}
+
+// subscribe gives the session the same queues as a terminal client: its own army_moves and
+// pause queues, which go away with it, and a place on the shared war queue.
+func (s *session) subscribe(ctx context.Context, conn pubsub.Connection, prefetch int) ([]*pubsub.Subscription, error) {
+	username := s.gs.GetUsername()
+	var subs []*pubsub.Subscription
+	fail := func(what string, err error) ([]*pubsub.Subscription, error) {
+		for _, sub := range subs {
+			sub.Close()
+		}
+		return nil, fmt.Errorf("subscribe to %s: %w", what, err)
+	}
+
+	movesSub, err := pubsub.SubscribeMessages(
+		ctx,
+		conn,
+		routing.ExchangePerilTopic,
+		routing.ArmyMovesPrefix+"."+username,
+		routing.ArmyMovesPrefix+".*",
+		pubsub.SimpleQueueTransient,
+		withMiddleware(s.consumerLogger, s.handlerMove),
+		pubsub.WithQueueOptions(armyMovesQueue),
+		pubsub.WithPrefetch(prefetch),
+		pubsub.WithLogger(s.consumerLogger),
+	)
+	if err != nil {
+		return fail("army moves", err)
+	}
+	subs = append(subs, movesSub)
+
+	warSub, err := pubsub.SubscribeMessages(
+		ctx,
+		conn,
+		routing.ExchangePerilTopic,
+		routing.WarRecognitionsPrefix,
+		routing.WarRecognitionsPrefix+".*",
+		pubsub.SimpleQueueQuorum,
+		withMiddleware(s.consumerLogger, s.handlerWar),
+		pubsub.WithDeliveryLimit(routing.DeliveryLimit),
+		pubsub.WithPrefetch(prefetch),
+		pubsub.WithLogger(s.consumerLogger),
+	)
+	if err != nil {
+		return fail("war declarations", err)
+	}
+	subs = append(subs, warSub)
+
+	pauseSub, err := pubsub.SubscribeMessages(
+		ctx,
+		conn,
+		routing.ExchangePerilDirect,
+		routing.PauseKey+"."+username,
+		routing.PauseKey,
+		pubsub.SimpleQueueTransient,
+		withMiddleware(s.consumerLogger, pubsub.BodyHandler(s.handlerPause)),
+		pubsub.WithCodec(pubsub.JSON),
+		pubsub.WithPrefetch(prefetch),
+		pubsub.WithLogger(s.consumerLogger),
+	)
+	if err != nil {
+		return fail("pause", err)
+	}
+	return append(subs, pauseSub), nil
+}
+
+// handle runs a request from the browser and returns what to reply with.
+func (s *session) handle(ctx context.Context, req request) (any, error) {
+	// The game logic takes the words as the REPL reads them, command first
+	words := append([]string{req.Command}, req.Args...)
+	switch req.Command {
+	case "spawn":
+		if err := s.gs.CommandSpawn(words); err != nil {
+			return nil, err
+		}
+		return s.status(), nil
+	case "move":
+		mv, err := s.gs.CommandMove(words)
+		if err != nil {
+			return nil, err
+		}
+		err = pubsub.PublishJSONWithContext(
+			ctx,
+			s.publishCh,
+			routing.ExchangePerilTopic,
+			routing.ArmyMovesPrefix+"."+mv.Player.Username,
+			mv,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("could not publish move: %w", err)
+		}
+		return mv, nil
+	case "status":
+		return s.status(), nil
+	}
+	return nil, fmt.Errorf("unknown command %q", req.Command)
+}
+
+// status is the player's game state as it stands.
+func (s *session) status() status {
+	return status{Paused: s.gs.IsPaused(), Player: s.gs.GetPlayerSnap()}
+}
+
+// push sends an event to the browser. If the browser has gone it is dropped: the session is
+// ending anyway.
+func (s *session) push(e event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		s.logger.Error("could not encode event", "type", e.Type, "err", err)
+		return
+	}
+	if err := s.ws.WriteText(data); err != nil && !errors.Is(err, errWSClosed) {
+		s.logger.Warn("could not push event", "type", e.Type, "err", err)
+	}
+}
+
+// handlerMove applies another player's move, as the terminal client's move handler does,
+// and tells the browser about it.
+func (s *session) handlerMove(msg pubsub.Message[gamelogic.ArmyMove]) pubsub.Acktype {
+	move := msg.Body
+	switch s.gs.HandleMove(move) {
+	case gamelogic.MoveOutcomeSamePlayer:
+		// The browser already knows about its own moves
+		return pubsub.Ack
+	case gamelogic.MoveOutComeSafe:
+		s.push(event{Type: "move", Data: moveEvent{Move: move, Outcome: "safe"}})
+		return pubsub.Ack
+	case gamelogic.MoveOutcomeMakeWar:
+		err := pubsub.PublishJSON(
+			s.handlerCh,
+			routing.ExchangePerilTopic,
+			routing.WarRecognitionsPrefix+"."+s.gs.GetUsername(),
+			gamelogic.RecognitionOfWar{
+				Attacker: move.Player,
+				Defender: s.gs.GetPlayerSnap(),
+			},
+		)
+		if err != nil {
+			s.logger.Warn("could not declare war", "err", err)
+			return pubsub.NackRequeue
+		}
+		s.push(event{Type: "move", Data: moveEvent{Move: move, Outcome: "war"}})
+		return pubsub.Ack
+	}
+	s.logger.Error("unknown move outcome")
+	return pubsub.NackDiscard
+}
+
+// handlerWar fights the wars the player is in, as the terminal client's war handler does,
+// and tells the browser how they went.
+func (s *session) handlerWar(msg pubsub.Message[gamelogic.RecognitionOfWar]) pubsub.Acktype {
+	rw := msg.Body
+	outcome, winner, loser := s.gs.HandleWar(rw)
+	e := warEvent{War: rw, Winner: winner, Loser: loser}
+	var gamelog string
+	switch outcome {
+	case gamelogic.WarOutcomeNotInvolved:
+		// Someone else's war: let another client have it
+		return pubsub.NackRetryLater
+	case gamelogic.WarOutcomeNoUnits:
+		s.push(event{Type: "war", Data: warEvent{War: rw, Outcome: "no_units"}})
+		return pubsub.NackDiscard
+	case gamelogic.WarOutcomeYouWon:
+		e.Outcome = "won"
+		gamelog = fmt.Sprintf("%s won a war against %s", winner, loser)
+	case gamelogic.WarOutcomeOpponentWon:
+		e.Outcome = "lost"
+		gamelog = fmt.Sprintf("%s won a war against %s", winner, loser)
+	case gamelogic.WarOutcomeDraw:
+		e.Outcome = "draw"
+		gamelog = fmt.Sprintf("A war between %s and %s resulted in a draw", winner, loser)
+	default:
+		s.logger.Error("unknown war outcome")
+		return pubsub.NackDiscard
+	}
+	if err := publishGameLog(s.handlerCh, s.gs.GetUsername(), gamelog); err != nil {
+		s.logger.Warn("could not publish game log", "err", err)
+		return pubsub.NackRequeue
+	}
+	s.push(event{Type: "war", Data: e})
+	return pubsub.Ack
+}
+
+// handlerPause pauses or resumes the player's game and tells the browser.
+func (s *session) handlerPause(ps routing.PlayingState) pubsub.Acktype {
+	s.gs.HandlePause(ps)
+	s.push(event{Type: "pause", Data: pauseEvent{Paused: ps.IsPaused}})
+	return pubsub.Ack
+}
+
+// publishGameLog publishes a game log from username, as the terminal client does.
+func publishGameLog(publishCh pubsub.Sender, username, msg string) error {
+	return pubsub.PublishGob(
+		publishCh,
+		routing.ExchangePerilTopic,
+		routing.GameLogSlug+"."+username,
+		routing.GameLog{
+			Username:    username,
+			CurrentTime: time.Now(),
+			Message:     msg,
+		},
+	)
+}
+
+// armyMovesQueue drops moves that have waited too long, or that too many newer ones have
+// arrived behind, as the terminal client's queue does. Both declare the same arguments.
+var armyMovesQueue = pubsub.QueueOptions{
+	MessageTTL: routing.ArmyMovesTTL,
+	MaxLength:  routing.ArmyMovesMaxLength,
+	Overflow:   pubsub.OverflowDropHead,
+}
+
+// withMiddleware wraps a handler so that a panic in it dead-letters the message rather than
+// taking the gateway down, every message is logged and one that hangs is called out. It isn't
+// given up on for a retry, as the move and war handlers change the game state and publish,
+// and would do both again on the redelivered message. For the same reason a message that has
+// already been handled once is dropped.
+func withMiddleware[T any](logger *slog.Logger, handler pubsub.Handler[T]) pubsub.Handler[T] {
+	return pubsub.Chain(handler,
+		pubsub.Recover[T](logger),
+		pubsub.Logging[T](logger),
+		pubsub.Dedup[T](dedupWindow, logger),
+		pubsub.WarnAfter[T](handlerTimeout, logger),
+	)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// newTestGateway serves a gateway on a MemoryBroker with the default
+// topology. It returns the server, a channel on the broker and a function
+// that shuts the gateway down as main does.
+func newTestGateway(t *testing.T) (*httptest.Server, pubsub.Channel, func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := pubsub.NewMemoryBroker().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := pubsub.ApplyTopology(conn, pubsub.DefaultTopology()); err != nil {
+		t.Fatal(err)
+	}
+	publisher, err := pubsub.NewPublisher(conn, pubsub.PublisherConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { publisher.Close() })
+	confirmPublisher, err := pubsub.NewPublisher(conn, pubsub.PublisherConfig{ConfirmTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { confirmPublisher.Close() })
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ch.Close() })
+
+	g := &gateway{
+		ctx:              ctx,
+		conn:             conn,
+		publisher:        publisher,
+		confirmPublisher: confirmPublisher,
+		logger:           discardLogger,
+		consumerLogger:   discardLogger,
+		prefetch:         pubsub.DefaultPrefetch,
+		origins:          map[string]bool{},
+		players:          map[string]bool{},
+	}
+	srv := httptest.NewServer(g)
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			srv.Close()
+			cancel()
+			g.close()
+		})
+	}
+	t.Cleanup(stop)
+	return srv, ch, stop
+}
+
+// testEvent is an event as the browser reads it.
+type testEvent struct {
+	Type  string          `json:"type"`
+	ID    int             `json:"id"`
+	Error string          `json:"error"`
+	Data  json.RawMessage `json:"data"`
+}
+
+func (b *testBrowser) readEvent(t *testing.T) testEvent {
+	t.Helper()
+	op, payload := b.read(t)
+	if op != opText {
+		t.Fatalf("got frame %#x %q, want an event", op, payload)
+	}
+	var e testEvent
+	if err := json.Unmarshal(payload, &e); err != nil {
+		t.Fatalf("event %s: %v", payload, err)
+	}
+	return e
+}
+
+func (b *testBrowser) request(t *testing.T, req string) testEvent {
+	t.Helper()
+	b.send(frame(true, opText, []byte(req)))
+	e := b.readEvent(t)
+	if e.Type != "reply" {
+		t.Fatalf("got a %s event for %s, want a reply", e.Type, req)
+	}
+	return e
+}
+
+func TestSession(t *testing.T) {
+	srv, ch, _ := newTestGateway(t)
+	if _, err := ch.QueueDeclare("moves", false, true, true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("moves", routing.ArmyMovesPrefix+".*", routing.ExchangePerilTopic, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	moves, err := ch.Consume("moves", "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := dialTestBrowser(t, srv.Listener.Addr().String(), "/play?user=alice")
+	welcome := b.readEvent(t)
+	var st status
+	if err := json.Unmarshal(welcome.Data, &st); err != nil || welcome.Type != "welcome" || st.Player.Username != "alice" {
+		t.Fatalf("first event %+v (%v), want a welcome for alice", welcome, err)
+	}
+
+	if e := b.request(t, `{"id": 1, "command": "spawn", "args": ["europe", "infantry"]}`); e.ID != 1 || e.Error != "" {
+		t.Fatalf("spawn replied %+v", e)
+	}
+	if err := json.Unmarshal(b.request(t, `{"id": 2, "command": "status"}`).Data, &st); err != nil || len(st.Player.Units) != 1 {
+		t.Fatalf("status after spawning is %+v (%v), want one unit", st, err)
+	}
+	if e := b.request(t, `{"id": 3, "command": "fly"}`); e.ID != 3 || !strings.Contains(e.Error, `unknown command "fly"`) {
+		t.Fatalf("unknown command replied %+v", e)
+	}
+	if e := b.request(t, `{"id": 4`); !strings.Contains(e.Error, "bad request") {
+		t.Fatalf("bad JSON replied %+v", e)
+	}
+
+	// A move is published for the other players, stamped with who made it
+	if e := b.request(t, `{"id": 5, "command": "move", "args": ["asia", "1"]}`); e.ID != 5 || e.Error != "" {
+		t.Fatalf("move replied %+v", e)
+	}
+	select {
+	case d := <-moves:
+		var mv gamelogic.ArmyMove
+		if err := json.Unmarshal(d.Body, &mv); err != nil || mv.ToLocation != "asia" || d.RoutingKey != routing.ArmyMovesPrefix+".alice" {
+			t.Fatalf("published move %s with key %s (%v)", d.Body, d.RoutingKey, err)
+		}
+		if d.AppId != routing.AppGateway || d.Headers[routing.HeaderPlayer] != "alice" {
+			t.Fatalf("move from app %q, player %v", d.AppId, d.Headers[routing.HeaderPlayer])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the move wasn't published")
+	}
+
+	// What happens in the game is pushed to the browser
+	err = pubsub.PublishJSON(ch, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{IsPaused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := b.readEvent(t); e.Type != "pause" || string(e.Data) != `{"paused":true}` {
+		t.Fatalf("got %+v, want a pause", e)
+	}
+	if e := b.request(t, `{"id": 6, "command": "move", "args": ["africa", "1"]}`); !strings.Contains(e.Error, "paused") {
+		t.Fatalf("move while paused replied %+v", e)
+	}
+
+	// Requests are JSON text
+	b.send(frame(true, opBinary, []byte{1}))
+	if code := b.readClose(t); code != closeUnsupportedData {
+		t.Fatalf("binary request closed with %d, want %d", code, closeUnsupportedData)
+	}
+}
+
+func TestSessionRejects(t *testing.T) {
+	srv, _, _ := newTestGateway(t)
+	dialTestBrowser(t, srv.Listener.Addr().String(), "/play?user=alice").readEvent(t)
+
+	for _, tt := range []struct {
+		user   string
+		status int
+	}{
+		{"alice", http.StatusConflict},
+		{"", http.StatusBadRequest},
+		{"al ice", http.StatusBadRequest},
+		// Not a websocket
+		{"bob", http.StatusBadRequest},
+	} {
+		resp, err := http.Get(srv.URL + "/play?user=" + strings.ReplaceAll(tt.user, " ", "%20"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("user %q: status %d, want %d", tt.user, resp.StatusCode, tt.status)
+		}
+	}
+	// bob's name is free again after the failed handshake
+	dialTestBrowser(t, srv.Listener.Addr().String(), "/play?user=bob").readEvent(t)
+}
+
+// When the gateway shuts down, sessions are closed with "going away" and
+// it waits for them to end.
+func TestSessionShutdown(t *testing.T) {
+	srv, _, stop := newTestGateway(t)
+	b := dialTestBrowser(t, srv.Listener.Addr().String(), "/play?user=alice")
+	b.readEvent(t)
+
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	if code := b.readClose(t); code != closeGoingAway {
+		t.Fatalf("closed with %d, want %d", code, closeGoingAway)
+	}
+	select {
+	case <-stopped:
+		t.Fatal("the gateway stopped before the browser answered its close")
+	case <-time.After(20 * time.Millisecond):
+	}
+	b.send(frame(true, opClose, closePayload(closeGoingAway, "")))
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the gateway didn't stop")
+	}
+}
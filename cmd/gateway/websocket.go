@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// A small server side of RFC 6455: the handshake, framing, fragmented
+// messages, ping/pong and the closing handshake. Extensions and
+// subprotocols aren't negotiated, so browsers don't use any.
+
+// websocketGUID is appended to the client's key to make the accept key.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close status codes we send or look at.
+const (
+	closeNormal          = 1000
+	closeGoingAway       = 1001
+	closeProtocolError   = 1002
+	closeUnsupportedData = 1003
+	closeNoStatus        = 1005
+	closeInvalidPayload  = 1007
+	closeTooBig          = 1009
+	closeInternalError   = 1011
+)
+
+const (
+	// wsMaxMessage is the biggest message we read, after reassembling
+	// fragments. Requests are a few words of JSON.
+	wsMaxMessage = 64 << 10
+	// wsReadTimeout is how long a connection may go without sending us
+	// anything, pongs included. It is more than wsPingInterval, so a
+	// browser that answers our pings stays connected.
+	wsReadTimeout = 60 * time.Second
+	// wsPingInterval is how often we ping an otherwise quiet browser.
+	wsPingInterval = 25 * time.Second
+	// wsWriteTimeout is how long a write may block on a slow browser.
+	wsWriteTimeout = 10 * time.Second
+	// wsCloseTimeout is how long we wait for the browser to answer our
+	// close frame before dropping the connection.
+	wsCloseTimeout = 5 * time.Second
+)
+
+// errWSClosed is returned by writes after a close frame has been sent.
+var errWSClosed = errors.New("websocket: connection closed")
+
+// wsCloseError is how a connection ended: the status code the browser
+// closed it with, or the one we closed it with after a protocol error.
+type wsCloseError struct {
+	code   int
+	reason string
+}
+
+func (e *wsCloseError) Error() string {
+	if e.reason == "" {
+		return fmt.Sprintf("websocket: closed with status %d", e.code)
+	}
+	return fmt.Sprintf("websocket: closed with status %d: %s", e.code, e.reason)
+}
+
+// wsConn is an upgraded connection. ReadMessage must only be called from
+// one goroutine; the write methods can be called from any.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+// upgradeWebSocket answers a WebSocket handshake and takes over its
+// connection. If the request isn't an acceptable handshake it writes an
+// HTTP error and returns why.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, checkOrigin func(*http.Request) bool) (*wsConn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("handshake with method %s", r.Method)
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "expected a websocket handshake", http.StatusBadRequest)
+		return nil, errors.New("not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("websocket version %q", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		http.Error(w, "bad Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, fmt.Errorf("bad key %q", key)
+	}
+	if !checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return nil, fmt.Errorf("origin %q not allowed", r.Header.Get("Origin"))
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("response writer can't be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("hijack: %w", err)
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+acceptKey(key)+"\r\n\r\n")
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("write handshake: %w", err)
+	}
+	// Keep the hijacked reader, in case the browser has already sent its first frame
+	return &wsConn{conn: conn, br: rw.Reader}, nil
+}
+
+// acceptKey is the Sec-WebSocket-Accept for a Sec-WebSocket-Key.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken reports whether a comma-separated header lists token,
+// ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage returns the next text or binary message, reassembling
+// fragments and answering pings on the way. Once the connection is closed,
+// by either side, it returns a *wsCloseError or the network error.
+func (c *wsConn) ReadMessage() (op byte, data []byte, err error) {
+	fail := func(code int, reason string) (byte, []byte, error) {
+		c.Close(code, reason)
+		return 0, nil, &wsCloseError{code: code, reason: reason}
+	}
+	var msgOp byte
+	var msg []byte
+	for {
+		fin, frameOp, payload, err := c.readFrame()
+		if err != nil {
+			var ce *wsCloseError
+			if errors.As(err, &ce) {
+				return fail(ce.code, ce.reason)
+			}
+			return 0, nil, err
+		}
+		switch frameOp {
+		case opPing:
+			c.writeFrame(opPong, payload)
+			continue
+		case opPong:
+			continue
+		case opClose:
+			code, reason := closeNoStatus, ""
+			switch {
+			case len(payload) == 1:
+				return fail(closeProtocolError, "truncated close status")
+			case len(payload) >= 2:
+				code = int(binary.BigEndian.Uint16(payload))
+				reason = string(payload[2:])
+			}
+			// Echo the close, as the closing handshake asks. If we started it, our close has
+			// already gone and this does nothing
+			echo := code
+			if echo == closeNoStatus {
+				echo = closeNormal
+			}
+			c.Close(echo, "")
+			return 0, nil, &wsCloseError{code: code, reason: reason}
+		case opText, opBinary:
+			if msg != nil {
+				return fail(closeProtocolError, "new message inside a fragmented one")
+			}
+			msgOp, msg = frameOp, payload
+		case opContinuation:
+			if msg == nil {
+				return fail(closeProtocolError, "continuation without a message")
+			}
+			if len(msg)+len(payload) > wsMaxMessage {
+				return fail(closeTooBig, "message too big")
+			}
+			msg = append(msg, payload...)
+		default:
+			return fail(closeProtocolError, fmt.Sprintf("unknown opcode %#x", frameOp))
+		}
+		if fin {
+			if msgOp == opText && !utf8.Valid(msg) {
+				return fail(closeInvalidPayload, "text is not UTF-8")
+			}
+			return msgOp, msg, nil
+		}
+	}
+}
+
+// readFrame reads one frame and unmasks its payload. A frame that breaks
+// the protocol comes back as a *wsCloseError.
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	// Once we've sent a close, the browser only has wsCloseTimeout left to answer it
+	c.wmu.Lock()
+	if !c.closeSent {
+		c.conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	}
+	c.wmu.Unlock()
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = head[0]&0x80 != 0
+	op = head[0] & 0x0f
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, &wsCloseError{code: closeProtocolError, reason: "reserved bits set"}
+	}
+	// Browsers must mask what they send, so an unmasked frame isn't from one
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, &wsCloseError{code: closeProtocolError, reason: "unmasked frame"}
+	}
+
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= opClose && (!fin || n > 125) {
+		return false, 0, nil, &wsCloseError{code: closeProtocolError, reason: "bad control frame"}
+	}
+	if n > wsMaxMessage {
+		return false, 0, nil, &wsCloseError{code: closeTooBig, reason: "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// WriteText sends data as a single text message.
+func (c *wsConn) WriteText(data []byte) error {
+	return c.writeFrame(opText, data)
+}
+
+// Ping sends a ping, which the browser answers with a pong.
+func (c *wsConn) Ping() error {
+	return c.writeFrame(opPing, nil)
+}
+
+// Close starts the closing handshake, or finishes one the browser started.
+// ReadMessage returns once the browser answers, or after wsCloseTimeout.
+// It doesn't close the network connection; CloseNow does that.
+func (c *wsConn) Close(code int, reason string) error {
+	// A close frame is a control frame, so it holds at most 125 bytes
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	copy(payload[2:], reason)
+	err := c.writeFrame(opClose, payload)
+	if errors.Is(err, errWSClosed) {
+		// Already closing
+		return nil
+	}
+	c.conn.SetReadDeadline(time.Now().Add(wsCloseTimeout))
+	return err
+}
+
+// CloseNow closes the network connection.
+func (c *wsConn) CloseNow() error {
+	return c.conn.Close()
+}
+
+// writeFrame sends one unfragmented, unmasked frame. Nothing is sent
+// after a close frame.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return errWSClosed
+	}
+	if op == opClose {
+		c.closeSent = true
+	}
+
+	head := make([]byte, 2, 10)
+	head[0] = 0x80 | op
+	switch n := len(payload); {
+	case n <= 125:
+		head[1] = byte(n)
+	case n <= 0xffff:
+		head[1] = 126
+		head = binary.BigEndian.AppendUint16(head, uint16(n))
+	default:
+		head[1] = 127
+		head = binary.BigEndian.AppendUint64(head, uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	bufs := net.Buffers{head, payload}
+	_, err := bufs.WriteTo(c.conn)
+	return err
+}
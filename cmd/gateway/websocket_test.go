@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The example from RFC 6455, section 1.3.
+func TestAcceptKey(t *testing.T) {
+	if got := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("acceptKey = %s", got)
+	}
+}
+
+func handshakeRequest() *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://peril.example/play?user=alice", nil)
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	r.Header.Set("Origin", "http://peril.example")
+	return r
+}
+
+func TestUpgradeRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(r *http.Request)
+		status int
+	}{
+		{"POST", func(r *http.Request) { r.Method = http.MethodPost }, http.StatusMethodNotAllowed},
+		{"no upgrade", func(r *http.Request) { r.Header.Del("Upgrade") }, http.StatusBadRequest},
+		{"upgrade to something else", func(r *http.Request) { r.Header.Set("Upgrade", "h2c") }, http.StatusBadRequest},
+		{"no connection upgrade", func(r *http.Request) { r.Header.Set("Connection", "keep-alive") }, http.StatusBadRequest},
+		{"old version", func(r *http.Request) { r.Header.Set("Sec-WebSocket-Version", "8") }, http.StatusUpgradeRequired},
+		{"no key", func(r *http.Request) { r.Header.Del("Sec-WebSocket-Key") }, http.StatusBadRequest},
+		{"key not base64", func(r *http.Request) { r.Header.Set("Sec-WebSocket-Key", "not a key!") }, http.StatusBadRequest},
+		{"short key", func(r *http.Request) { r.Header.Set("Sec-WebSocket-Key", "c2hvcnQ=") }, http.StatusBadRequest},
+		{"other origin", func(r *http.Request) { r.Header.Set("Origin", "http://evil.example") }, http.StatusForbidden},
+	}
+	g := &gateway{}
+	for _, tt := range tests {
+		r := handshakeRequest()
+		tt.change(r)
+		w := httptest.NewRecorder()
+		if ws, err := upgradeWebSocket(w, r, g.checkOrigin); err == nil {
+			ws.CloseNow()
+			t.Errorf("%s: upgraded", tt.name)
+			continue
+		}
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+	// A client on an old version is told which one we speak
+	r := handshakeRequest()
+	r.Header.Set("Sec-WebSocket-Version", "8")
+	w := httptest.NewRecorder()
+	upgradeWebSocket(w, r, g.checkOrigin)
+	if v := w.Header().Get("Sec-WebSocket-Version"); v != "13" {
+		t.Errorf("Sec-WebSocket-Version %q in the refusal, want 13", v)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	same := &gateway{}
+	listed := &gateway{origins: map[string]bool{"https://peril.example": true}}
+	tests := []struct {
+		g      *gateway
+		origin string
+		ok     bool
+	}{
+		{same, "", true},
+		{same, "http://peril.example", true},
+		{same, "http://PERIL.example", true},
+		{same, "http://evil.example", false},
+		{same, "http://peril.example:8080", false},
+		{listed, "https://peril.example", true},
+		{listed, "HTTPS://Peril.Example", true},
+		{listed, "http://peril.example", false},
+		{listed, "", true},
+	}
+	for _, tt := range tests {
+		r := handshakeRequest()
+		r.Header.Set("Origin", tt.origin)
+		if ok := tt.g.checkOrigin(r); ok != tt.ok {
+			t.Errorf("origin %q with %v allowed = %v, want %v", tt.origin, tt.g.origins, ok, tt.ok)
+		}
+	}
+}
+
+// testBrowser is the browser's end of a WebSocket: it sends masked frames
+// and reads the unmasked ones we send.
+type testBrowser struct {
+	conn net.Conn
+	br   *bufio.Reader
+	out  chan []byte
+}
+
+// dialTestWebSocket upgrades a connection to a test server and returns
+// both ends of it.
+func dialTestWebSocket(t *testing.T) (*wsConn, *testBrowser) {
+	t.Helper()
+	upgraded := make(chan *wsConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgradeWebSocket(w, r, func(*http.Request) bool { return true })
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		upgraded <- ws
+	}))
+	t.Cleanup(srv.Close)
+
+	b := dialTestBrowser(t, srv.Listener.Addr().String(), "/")
+	select {
+	case ws := <-upgraded:
+		t.Cleanup(func() { ws.CloseNow() })
+		return ws, b
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server didn't upgrade the connection")
+		return nil, nil
+	}
+}
+
+// dialTestBrowser makes the handshake a browser would for path.
+func dialTestBrowser(t *testing.T, addr, path string) *testBrowser {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: %s\r\n\r\n", path, addr, key)
+	b := &testBrowser{conn: conn, br: bufio.NewReader(conn), out: make(chan []byte, 10)}
+	go func() {
+		for data := range b.out {
+			conn.Write(data)
+		}
+	}()
+	t.Cleanup(func() { close(b.out) })
+	resp, err := http.ReadResponse(b.br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("handshake answered %s: %s", resp.Status, body)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != acceptKey(key) {
+		t.Fatalf("Sec-WebSocket-Accept %s, want %s", got, acceptKey(key))
+	}
+	return b
+}
+
+// frame is a frame as the browser sends it, masked.
+func frame(fin bool, op byte, payload []byte) []byte {
+	var f []byte
+	head := op
+	if fin {
+		head |= 0x80
+	}
+	f = append(f, head)
+	switch n := len(payload); {
+	case n <= 125:
+		f = append(f, 0x80|byte(n))
+	case n <= 0xffff:
+		f = append(f, 0x80|126)
+		f = binary.BigEndian.AppendUint16(f, uint16(n))
+	default:
+		f = append(f, 0x80|127)
+		f = binary.BigEndian.AppendUint64(f, uint64(n))
+	}
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	f = append(f, mask[:]...)
+	for i, c := range payload {
+		f = append(f, c^mask[i%4])
+	}
+	return f
+}
+
+func closePayload(code int, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+// send writes frames, in order, without waiting for them to be read, as
+// a big one may not fit in the socket's buffers.
+func (b *testBrowser) send(frames ...[]byte) {
+	b.out <- bytes.Join(frames, nil)
+}
+
+// read returns the next frame we sent the browser.
+func (b *testBrowser) read(t *testing.T) (op byte, payload []byte) {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(b.br, head[:]); err != nil {
+		t.Fatalf("reading a frame: %v", err)
+	}
+	if head[0]&0x80 == 0 || head[1]&0x80 != 0 {
+		t.Fatalf("frame head %x: we send whole, unmasked frames", head)
+	}
+	n := uint64(head[1])
+	switch n {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(b.br, ext[:])
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(b.br, ext[:])
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(b.br, payload); err != nil {
+		t.Fatalf("reading a frame: %v", err)
+	}
+	return head[0] & 0x0f, payload
+}
+
+// readClose reads a close frame and returns its status.
+func (b *testBrowser) readClose(t *testing.T) int {
+	t.Helper()
+	op, payload := b.read(t)
+	if op != opClose || len(payload) < 2 {
+		t.Fatalf("got frame %#x %q, want a close", op, payload)
+	}
+	return int(binary.BigEndian.Uint16(payload))
+}
+
+func TestWebSocketMessages(t *testing.T) {
+	ws, b := dialTestWebSocket(t)
+	b.send(
+		frame(true, opText, []byte(`{"command":"status"}`)),
+		frame(true, opBinary, []byte{0, 1, 2}),
+		// A 200 byte message has a 16-bit length
+		frame(true, opText, bytes.Repeat([]byte("a"), 200)),
+	)
+	for _, want := range []struct {
+		op   byte
+		data string
+	}{
+		{opText, `{"command":"status"}`},
+		{opBinary, "\x00\x01\x02"},
+		{opText, strings.Repeat("a", 200)},
+	} {
+		op, data, err := ws.ReadMessage()
+		if err != nil || op != want.op || string(data) != want.data {
+			t.Fatalf("ReadMessage = %#x %q %v, want %#x %q", op, data, err, want.op, want.data)
+		}
+	}
+
+	if err := ws.WriteText([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	big := bytes.Repeat([]byte("b"), 70000)
+	if err := ws.WriteText(big); err != nil {
+		t.Fatal(err)
+	}
+	if op, payload := b.read(t); op != opText || string(payload) != "hello" {
+		t.Fatalf("browser got %#x %q, want text hello", op, payload)
+	}
+	if op, payload := b.read(t); op != opText || !bytes.Equal(payload, big) {
+		t.Fatalf("browser got %#x with %d bytes, want text with 70000", op, len(payload))
+	}
+}
+
+// A message can come in fragments, with control frames between them, and
+// a character can be split across fragments.
+func TestWebSocketFragmented(t *testing.T) {
+	ws, b := dialTestWebSocket(t)
+	e := []byte("é")
+	b.send(
+		frame(false, opText, []byte("caf")),
+		frame(false, opContinuation, e[:1]),
+		frame(true, opPing, []byte("are you there")),
+		frame(false, opContinuation, e[1:]),
+		frame(true, opPong, nil),
+		frame(true, opContinuation, []byte("!")),
+	)
+	op, data, err := ws.ReadMessage()
+	if err != nil || op != opText || string(data) != "café!" {
+		t.Fatalf("ReadMessage = %#x %q %v, want text café!", op, data, err)
+	}
+	if op, payload := b.read(t); op != opPong || string(payload) != "are you there" {
+		t.Fatalf("browser got %#x %q, want the ping's pong", op, payload)
+	}
+}
+
+// Breaking the protocol gets the connection closed with the status for
+// what went wrong.
+func TestWebSocketProtocolErrors(t *testing.T) {
+	reserved := frame(true, opText, []byte("x"))
+	reserved[0] |= 0x40
+	unmasked := []byte{0x80 | opText, 1, 'x'}
+	tests := []struct {
+		name   string
+		frames [][]byte
+		code   int
+	}{
+		{"reserved bits", [][]byte{reserved}, closeProtocolError},
+		{"unmasked", [][]byte{unmasked}, closeProtocolError},
+		{"unknown opcode", [][]byte{frame(true, 0x3, nil)}, closeProtocolError},
+		{"continuation first", [][]byte{frame(true, opContinuation, []byte("x"))}, closeProtocolError},
+		{"message inside a message", [][]byte{frame(false, opText, []byte("x")), frame(true, opText, []byte("y"))}, closeProtocolError},
+		{"fragmented ping", [][]byte{frame(false, opPing, nil)}, closeProtocolError},
+		{"long ping", [][]byte{frame(true, opPing, make([]byte, 126))}, closeProtocolError},
+		{"truncated close", [][]byte{frame(true, opClose, []byte{3})}, closeProtocolError},
+		{"invalid UTF-8", [][]byte{frame(true, opText, []byte{'a', 0xff})}, closeInvalidPayload},
+		{"invalid UTF-8 in fragments", [][]byte{frame(false, opText, []byte("a")), frame(true, opContinuation, []byte{0xc3})}, closeInvalidPayload},
+		{"too big", [][]byte{frame(true, opBinary, make([]byte, wsMaxMessage+1))}, closeTooBig},
+		{"too big in fragments", [][]byte{
+			frame(false, opText, make([]byte, wsMaxMessage/2)),
+			frame(false, opContinuation, make([]byte, wsMaxMessage/2)),
+			frame(true, opContinuation, []byte("x")),
+		}, closeTooBig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, b := dialTestWebSocket(t)
+			b.send(tt.frames...)
+			_, _, err := ws.ReadMessage()
+			var ce *wsCloseError
+			if !errors.As(err, &ce) || ce.code != tt.code {
+				t.Fatalf("ReadMessage = %v, want closing with %d", err, tt.code)
+			}
+			if code := b.readClose(t); code != tt.code {
+				t.Fatalf("browser got close %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
+
+// A message of exactly wsMaxMessage is fine.
+func TestWebSocketBiggestMessage(t *testing.T) {
+	ws, b := dialTestWebSocket(t)
+	b.send(
+		frame(false, opBinary, make([]byte, wsMaxMessage-1)),
+		frame(true, opContinuation, []byte{1}),
+	)
+	if _, data, err := ws.ReadMessage(); err != nil || len(data) != wsMaxMessage {
+		t.Fatalf("ReadMessage = %d bytes, %v, want %d", len(data), err, wsMaxMessage)
+	}
+}
+
+// The browser closing gets an echo of its status, and nothing is sent
+// after it.
+func TestWebSocketBrowserCloses(t *testing.T) {
+	ws, b := dialTestWebSocket(t)
+	b.send(frame(true, opClose, closePayload(closeGoingAway, "tab closed")))
+	_, _, err := ws.ReadMessage()
+	var ce *wsCloseError
+	if !errors.As(err, &ce) || ce.code != closeGoingAway || ce.reason != "tab closed" {
+		t.Fatalf("ReadMessage = %v, want closed with 1001 and the reason", err)
+	}
+	if code := b.readClose(t); code != closeGoingAway {
+		t.Fatalf("echoed close %d, want 1001", code)
+	}
+	if err := ws.WriteText([]byte("hello")); !errors.Is(err, errWSClosed) {
+		t.Fatalf("WriteText after the close = %v, want errWSClosed", err)
+	}
+
+	// A close without a status is answered as a normal one
+	ws, b = dialTestWebSocket(t)
+	b.send(frame(true, opClose, nil))
+	if _, _, err := ws.ReadMessage(); !errors.As(err, &ce) || ce.code != closeNoStatus {
+		t.Fatalf("ReadMessage = %v, want closed with 1005", err)
+	}
+	if code := b.readClose(t); code != closeNormal {
+		t.Fatalf("echoed close %d, want 1000", code)
+	}
+}
+
+// When we close, ReadMessage waits for the browser's answer.
+func TestWebSocketServerCloses(t *testing.T) {
+	ws, b := dialTestWebSocket(t)
+	if err := ws.Close(closeGoingAway, "gateway shutting down"); err != nil {
+		t.Fatal(err)
+	}
+	if code := b.readClose(t); code != closeGoingAway {
+		t.Fatalf("browser got close %d, want 1001", code)
+	}
+	// Closing again sends nothing more
+	if err := ws.Close(closeNormal, ""); err != nil {
+		t.Fatal(err)
+	}
+	// Messages the browser sent before it saw our close still arrive
+	b.send(
+		frame(true, opText, []byte("late")),
+		frame(true, opClose, closePayload(closeGoingAway, "")),
+	)
+	if _, data, err := ws.ReadMessage(); err != nil || string(data) != "late" {
+		t.Fatalf("ReadMessage = %q %v, want the message sent before the close", data, err)
+	}
+	_, _, err := ws.ReadMessage()
+	var ce *wsCloseError
+	if !errors.As(err, &ce) || ce.code != closeGoingAway {
+		t.Fatalf("ReadMessage = %v, want the browser's close", err)
+	}
+}
+
+func TestWebSocketPing(t *testing.T) {
+	ws, b := dialTestWebSocket(t)
+	if err := ws.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if op, _ := b.read(t); op != opPing {
+		t.Fatalf("browser got %#x, want a ping", op)
+	}
+	b.send(frame(true, opPong, nil), frame(true, opText, []byte("after")))
+	if _, data, err := ws.ReadMessage(); err != nil || string(data) != "after" {
+		t.Fatalf("ReadMessage = %q %v, want the message after the pong", data, err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/config"
+)
+
+// perilctl pokes at a running game from the command line:
+//
+//	perilctl publish <type> [flags]   publish a game message built from flags or JSON
+//	perilctl tail [flags] [pattern]   print the messages published with matching keys
+//	perilctl topology show|apply|verify [-file topology.json]
+//
+// Each also takes the configuration flags that the client and server do.
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	// ctx is cancelled on ctrl+c, which ends a tail:
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "publish":
+		err = runPublish(ctx, args)
+	case "tail":
+		err = runTail(ctx, args)
+	case "topology":
+		err = runTopology(args)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "perilctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: perilctl publish|tail|topology [flags] (see perilctl <command> -h)")
+	os.Exit(2)
+}
+
+// loadConfig adds the configuration flags to fs, parses args and resolves
+// the configuration. It reports whether to carry on, which is false once
+// -print-config has printed it.
+func loadConfig(fs *flag.FlagSet, args []string) (config.Config, bool, error) {
+	cfgFlags := config.AddFlags(fs)
+	fs.Parse(args)
+	cfg, err := cfgFlags.Load()
+	if err != nil {
+		return config.Config{}, false, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if cfgFlags.PrintConfig {
+		cfg.Print(os.Stdout)
+		return cfg, false, nil
+	}
+	cfg.Apply()
+	// Diagnostics go to stderr, and only problems unless asked for more
+	slog.SetDefault(cfg.Logger(slog.LevelWarn))
+	return cfg, true, nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/config"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// messageType is a kind of message perilctl can publish: where the game
+// sends it, what it is encoded with, and how to build one from flags.
+type messageType struct {
+	name string
+	// exchange points at the routing package's name for the exchange, as
+	// the configuration can change it
+	exchange *string
+	codec    pubsub.Codec
+	// flags adds the type's flags to fs, and returns a function that builds
+	// the message from them once they're parsed, along with its routing key
+	// and the player it's on behalf of.
+	flags func(fs *flag.FlagSet) func() (msg any, key, player string, err error)
+	// fromJSON decodes a message given with -json.
+	fromJSON func(data []byte) (msg any, key, player string, err error)
+}
+
+var messageTypes = []messageType{
+	{
+		name:     "pause",
+		exchange: &routing.ExchangePerilDirect,
+		codec:    pubsub.JSON,
+		flags: func(fs *flag.FlagSet) func() (any, string, string, error) {
+			paused := fs.Bool("paused", true, "whether the game is paused (-paused=false resumes it)")
+			return func() (any, string, string, error) {
+				return routing.PlayingState{IsPaused: *paused}, routing.PauseKey, "", nil
+			}
+		},
+		fromJSON: func(data []byte) (any, string, string, error) {
+			var ps routing.PlayingState
+			err := decodeJSON(data, &ps)
+			return ps, routing.PauseKey, "", err
+		},
+	},
+	{
+		name:     "move",
+		exchange: &routing.ExchangePerilTopic,
+		codec:    pubsub.JSON,
+		flags: func(fs *flag.FlagSet) func() (any, string, string, error) {
+			player := fs.String("player", "", "the player making the move")
+			to := fs.String("to", "", "the location the units move to")
+			units := fs.String("units", "", "comma-separated ranks of the units moving, numbered from 1")
+			return func() (any, string, string, error) {
+				if *player == "" || *to == "" {
+					return nil, "", "", errors.New("a move needs -player and -to")
+				}
+				move := gamelogic.ArmyMove{
+					Player:     gamelogic.Player{Username: *player, Units: map[int]gamelogic.Unit{}},
+					Units:      parseUnits(*units, gamelogic.Location(*to)),
+					ToLocation: gamelogic.Location(*to),
+				}
+				for _, u := range move.Units {
+					move.Player.Units[u.ID] = u
+				}
+				return move, routing.ArmyMovesPrefix + "." + *player, *player, nil
+			}
+		},
+		fromJSON: func(data []byte) (any, string, string, error) {
+			var move gamelogic.ArmyMove
+			err := decodeJSON(data, &move)
+			return move, routing.ArmyMovesPrefix + "." + move.Player.Username, move.Player.Username, err
+		},
+	},
+	{
+		name:     "war",
+		exchange: &routing.ExchangePerilTopic,
+		codec:    pubsub.JSON,
+		flags: func(fs *flag.FlagSet) func() (any, string, string, error) {
+			attacker := fs.String("attacker", "", "the player declaring war")
+			defender := fs.String("defender", "", "the player war is declared on")
+			at := fs.String("at", "", "the location the war is fought in")
+			attackerUnits := fs.String("attacker-units", "", "comma-separated ranks of the attacker's units there")
+			defenderUnits := fs.String("defender-units", "", "comma-separated ranks of the defender's units there")
+			return func() (any, string, string, error) {
+				if *attacker == "" || *defender == "" || *at == "" {
+					return nil, "", "", errors.New("a war needs -attacker, -defender and -at")
+				}
+				rw := gamelogic.RecognitionOfWar{
+					Attacker: playerWith(*attacker, parseUnits(*attackerUnits, gamelogic.Location(*at))),
+					Defender: playerWith(*defender, parseUnits(*defenderUnits, gamelogic.Location(*at))),
+				}
+				// The defender's client is the one that notices a war and publishes it
+				return rw, routing.WarRecognitionsPrefix + "." + *defender, *defender, nil
+			}
+		},
+		fromJSON: func(data []byte) (any, string, string, error) {
+			var rw gamelogic.RecognitionOfWar
+			err := decodeJSON(data, &rw)
+			return rw, routing.WarRecognitionsPrefix + "." + rw.Defender.Username, rw.Defender.Username, err
+		},
+	},
+	{
+		name:     "gamelog",
+		exchange: &routing.ExchangePerilTopic,
+		codec:    pubsub.Gob,
+		flags: func(fs *flag.FlagSet) func() (any, string, string, error) {
+			user := fs.String("user", "", "the player the log is about")
+			message := fs.String("message", "", "the log message")
+			at := fs.String("time", "", "when it happened, RFC 3339 (default: now)")
+			return func() (any, string, string, error) {
+				if *user == "" || *message == "" {
+					return nil, "", "", errors.New("a game log needs -user and -message")
+				}
+				gl := routing.GameLog{CurrentTime: time.Now(), Message: *message, Username: *user}
+				if *at != "" {
+					t, err := time.Parse(time.RFC3339, *at)
+					if err != nil {
+						return nil, "", "", fmt.Errorf("invalid -time: %w", err)
+					}
+					gl.CurrentTime = t
+				}
+				return gl, routing.GameLogSlug + "." + *user, *user, nil
+			}
+		},
+		fromJSON: func(data []byte) (any, string, string, error) {
+			var gl routing.GameLog
+			err := decodeJSON(data, &gl)
+			if gl.CurrentTime.IsZero() {
+				gl.CurrentTime = time.Now()
+			}
+			return gl, routing.GameLogSlug + "." + gl.Username, gl.Username, err
+		},
+	},
+}
+
+func findMessageType(name string) (messageType, bool) {
+	for _, mt := range messageTypes {
+		if mt.name == name {
+			return mt, true
+		}
+	}
+	return messageType{}, false
+}
+
+func messageTypeNames() string {
+	names := make([]string, len(messageTypes))
+	for i, mt := range messageTypes {
+		names[i] = mt.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// publication is a message perilctl has been asked to publish, and where.
+type publication struct {
+	mt       messageType
+	msg      any
+	exchange string
+	key      string
+	// player the message is on behalf of, if any
+	player string
+}
+
+// runPublish builds a message of one of the game's types, from its flags or
+// from -json, and publishes it where the game would, with the codec the game
+// uses for it. The broker has to confirm it, and perilctl warns if no queue
+// was bound to take it.
+func runPublish(ctx context.Context, args []string) error {
+	pub, cfg, ok, err := parsePublish(args)
+	if !ok {
+		return err
+	}
+
+	conn, err := cfg.Dial()
+	if err != nil {
+		return fmt.Errorf("could not connect to RabbitMQ: %w", err)
+	}
+	defer conn.Close()
+	sender, err := pubsub.NewConfirmingSender(conn, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("could not open channel: %w", err)
+	}
+	defer sender.Close()
+
+	err = pub.send(ctx, sender)
+	var unroutable *pubsub.UnroutableError
+	if errors.As(err, &unroutable) {
+		fmt.Fprintf(os.Stderr, "warning: no queue is bound to %s for %s, so nobody got it\n", pub.exchange, pub.key)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not publish %s: %w", pub.mt.name, err)
+	}
+	fmt.Printf("Published %s to %s with key %s\n", pub.mt.name, pub.exchange, pub.key)
+	return nil
+}
+
+// parsePublish parses publish's arguments into the message to publish and
+// the configuration to connect with. It reports whether to carry on, as
+// loadConfig does.
+func parsePublish(args []string) (publication, config.Config, bool, error) {
+	var pub publication
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return pub, config.Config{}, false, fmt.Errorf("usage: perilctl publish <type> [flags], where the type is one of %s", messageTypeNames())
+	}
+	mt, ok := findMessageType(args[0])
+	if !ok {
+		return pub, config.Config{}, false, fmt.Errorf("unknown message type %q, want one of %s", args[0], messageTypeNames())
+	}
+	pub.mt = mt
+	fs := flag.NewFlagSet("publish "+mt.name, flag.ExitOnError)
+	build := mt.flags(fs)
+	jsonArg := fs.String("json", "", "the message as JSON instead of flags: inline, @file, or - for stdin")
+	exchange := fs.String("exchange", "", "publish to this exchange instead of the usual one")
+	keyOverride := fs.String("key", "", "publish with this routing key instead of the usual one")
+	cfg, ok, err := loadConfig(fs, args[1:])
+	if !ok {
+		return pub, cfg, false, err
+	}
+
+	if *jsonArg != "" {
+		data, err := readJSONArg(*jsonArg)
+		if err != nil {
+			return pub, cfg, false, err
+		}
+		pub.msg, pub.key, pub.player, err = mt.fromJSON(data)
+		if err != nil {
+			return pub, cfg, false, fmt.Errorf("invalid %s: %w", mt.name, err)
+		}
+	} else if pub.msg, pub.key, pub.player, err = build(); err != nil {
+		return pub, cfg, false, err
+	}
+	if *keyOverride != "" {
+		pub.key = *keyOverride
+	}
+	// Read now that loadConfig has applied the configured names
+	pub.exchange = *mt.exchange
+	if *exchange != "" {
+		pub.exchange = *exchange
+	}
+	return pub, cfg, true, nil
+}
+
+// send publishes the message with the message type's codec, stamped as
+// coming from perilctl on behalf of its player.
+func (p publication) send(ctx context.Context, sender pubsub.Sender) error {
+	opts := []pubsub.PublishOption{pubsub.WithAppID(routing.AppCtl)}
+	if p.player != "" {
+		opts = append(opts, pubsub.WithHeader(routing.HeaderPlayer, p.player))
+	}
+	return pubsub.Publish(ctx, sender, p.mt.codec, p.exchange, p.key, p.msg, opts...)
+}
+
+// readJSONArg returns what -json was given: the JSON itself, the contents
+// of a file for @file, or stdin for -.
+func readJSONArg(arg string) ([]byte, error) {
+	switch {
+	case arg == "-":
+		return io.ReadAll(os.Stdin)
+	case strings.HasPrefix(arg, "@"):
+		return os.ReadFile(arg[1:])
+	}
+	return []byte(arg), nil
+}
+
+// decodeJSON is strict about fields, so that a typo in a field name is an
+// error rather than a message with it left out.
+func decodeJSON(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// parseUnits turns comma-separated ranks into units at a location,
+// numbered from 1. The ranks aren't checked, so that what the handlers do
+// with ones they don't know can be tried out too.
+func parseUnits(ranks string, at gamelogic.Location) []gamelogic.Unit {
+	var units []gamelogic.Unit
+	for _, rank := range strings.Split(ranks, ",") {
+		if rank = strings.TrimSpace(rank); rank != "" {
+			units = append(units, gamelogic.Unit{ID: len(units) + 1, Rank: gamelogic.UnitRank(rank), Location: at})
+		}
+	}
+	return units
+}
+
+func playerWith(name string, units []gamelogic.Unit) gamelogic.Player {
+	p := gamelogic.Player{Username: name, Units: map[int]gamelogic.Unit{}}
+	for _, u := range units {
+		p.Units[u.ID] = u
+	}
+	return p
+}
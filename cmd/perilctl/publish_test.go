@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// parseTestPublish runs parsePublish, and puts back the exchange names
+// the configuration it loads may change.
+func parseTestPublish(t *testing.T, args ...string) (publication, error) {
+	t.Helper()
+	direct, topic, dlx, quarantine := routing.ExchangePerilDirect, routing.ExchangePerilTopic, routing.ExchangePerilDLX, routing.ExchangePerilQuarantine
+	logsFile := gamelogic.LogsFile
+	t.Cleanup(func() {
+		routing.ExchangePerilDirect, routing.ExchangePerilTopic, routing.ExchangePerilDLX, routing.ExchangePerilQuarantine = direct, topic, dlx, quarantine
+		gamelogic.LogsFile = logsFile
+	})
+	pub, _, ok, err := parsePublish(args)
+	if err == nil && !ok {
+		t.Fatalf("parsePublish(%q) didn't carry on", args)
+	}
+	return pub, err
+}
+
+func TestParsePublishFlags(t *testing.T) {
+	at := gamelogic.Location("asia")
+	tests := []struct {
+		args     []string
+		msg      any
+		exchange string
+		key      string
+		player   string
+	}{
+		{
+			args:     []string{"pause"},
+			msg:      routing.PlayingState{IsPaused: true},
+			exchange: routing.ExchangePerilDirect, key: routing.PauseKey,
+		},
+		{
+			args:     []string{"pause", "-paused=false"},
+			msg:      routing.PlayingState{IsPaused: false},
+			exchange: routing.ExchangePerilDirect, key: routing.PauseKey,
+		},
+		{
+			args: []string{"move", "-player", "alice", "-to", "asia", "-units", "infantry, cavalry,"},
+			msg: gamelogic.ArmyMove{
+				Player: gamelogic.Player{Username: "alice", Units: map[int]gamelogic.Unit{
+					1: {ID: 1, Rank: "infantry", Location: at},
+					2: {ID: 2, Rank: "cavalry", Location: at},
+				}},
+				Units:      []gamelogic.Unit{{ID: 1, Rank: "infantry", Location: at}, {ID: 2, Rank: "cavalry", Location: at}},
+				ToLocation: at,
+			},
+			exchange: routing.ExchangePerilTopic, key: routing.ArmyMovesPrefix + ".alice", player: "alice",
+		},
+		{
+			args: []string{"war", "-attacker", "alice", "-defender", "bob", "-at", "asia", "-attacker-units", "artillery"},
+			msg: gamelogic.RecognitionOfWar{
+				Attacker: gamelogic.Player{Username: "alice", Units: map[int]gamelogic.Unit{1: {ID: 1, Rank: "artillery", Location: at}}},
+				Defender: gamelogic.Player{Username: "bob", Units: map[int]gamelogic.Unit{}},
+			},
+			// Published as the defender's client would
+			exchange: routing.ExchangePerilTopic, key: routing.WarRecognitionsPrefix + ".bob", player: "bob",
+		},
+		{
+			args: []string{"gamelog", "-user", "alice", "-message", "hello", "-time", "2026-03-10T12:00:00Z"},
+			msg: routing.GameLog{
+				CurrentTime: time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC),
+				Message:     "hello",
+				Username:    "alice",
+			},
+			exchange: routing.ExchangePerilTopic, key: routing.GameLogSlug + ".alice", player: "alice",
+		},
+		{
+			args:     []string{"pause", "-exchange", "other", "-key", "pause.alice"},
+			msg:      routing.PlayingState{IsPaused: true},
+			exchange: "other", key: "pause.alice",
+		},
+	}
+	for _, tt := range tests {
+		pub, err := parseTestPublish(t, tt.args...)
+		if err != nil {
+			t.Errorf("%q: %v", tt.args, err)
+			continue
+		}
+		if pub.exchange != tt.exchange || pub.key != tt.key || pub.player != tt.player {
+			t.Errorf("%q: to %s with key %s for %q, want %s, %s and %q", tt.args, pub.exchange, pub.key, pub.player, tt.exchange, tt.key, tt.player)
+		}
+		if !reflect.DeepEqual(pub.msg, tt.msg) {
+			t.Errorf("%q: message %+v, want %+v", tt.args, pub.msg, tt.msg)
+		}
+	}
+}
+
+// The usual exchange is the configured one.
+func TestParsePublishConfiguredExchange(t *testing.T) {
+	pub, err := parseTestPublish(t, "move", "-exchange-topic", "peril_topic_test", "-player", "alice", "-to", "asia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub.exchange != "peril_topic_test" {
+		t.Fatalf("published to %s, want the configured topic exchange", pub.exchange)
+	}
+}
+
+func TestParsePublishJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "war.json")
+	err := os.WriteFile(path, []byte(`{"Attacker": {"Username": "alice"}, "Defender": {"Username": "bob"}}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := parseTestPublish(t, "war", "-json", "@"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw, ok := pub.msg.(gamelogic.RecognitionOfWar)
+	if !ok || rw.Attacker.Username != "alice" || pub.key != routing.WarRecognitionsPrefix+".bob" || pub.player != "bob" {
+		t.Fatalf("parsed %+v with key %s for %q", pub.msg, pub.key, pub.player)
+	}
+
+	pub, err = parseTestPublish(t, "gamelog", "-json", `{"Username": "alice", "Message": "hello"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gl := pub.msg.(routing.GameLog)
+	if gl.Message != "hello" || time.Since(gl.CurrentTime) > time.Minute {
+		t.Fatalf("parsed %+v, want the time to default to now", gl)
+	}
+}
+
+func TestParsePublishErrors(t *testing.T) {
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{nil, "usage"},
+		{[]string{"-json", "{}"}, "usage"},
+		{[]string{"nuke"}, `unknown message type "nuke"`},
+		{[]string{"move", "-to", "asia"}, "a move needs -player and -to"},
+		{[]string{"war", "-attacker", "alice", "-defender", "bob"}, "a war needs -attacker, -defender and -at"},
+		{[]string{"gamelog", "-user", "alice"}, "a game log needs -user and -message"},
+		{[]string{"gamelog", "-user", "alice", "-message", "hi", "-time", "noon"}, "invalid -time"},
+		// A typo in a field is caught rather than left out
+		{[]string{"pause", "-json", `{"IsPasued": true}`}, "invalid pause"},
+		{[]string{"move", "-json", `{"Player": `}, "invalid move"},
+		{[]string{"pause", "-json", "@" + filepath.Join(t.TempDir(), "missing.json")}, "missing.json"},
+	}
+	for _, tt := range tests {
+		_, err := parseTestPublish(t, tt.args...)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: %v, want an error mentioning %q", tt.args, err, tt.err)
+		}
+	}
+}
+
+// A message is published with the codec the game uses for its type, and
+// stamped as coming from perilctl on behalf of its player.
+func TestPublicationSend(t *testing.T) {
+	conn, err := pubsub.NewMemoryBroker().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := pubsub.ApplyTopology(conn, pubsub.DefaultTopology()); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if _, err := ch.QueueDeclare("all", false, true, true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range [][2]string{{routing.ExchangePerilTopic, "#"}, {routing.ExchangePerilDirect, routing.PauseKey}} {
+		if err := ch.QueueBind("all", b[1], b[0], false, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliveries, err := ch.Consume("all", "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args        []string
+		contentType string
+		decode      func([]byte) (any, error)
+	}{
+		{[]string{"pause", "-paused=false"}, "application/json", func(b []byte) (any, error) {
+			var ps routing.PlayingState
+			err := pubsub.JSON.Unmarshal(b, &ps)
+			return ps, err
+		}},
+		{[]string{"move", "-player", "alice", "-to", "asia", "-units", "infantry"}, "application/json", func(b []byte) (any, error) {
+			var mv gamelogic.ArmyMove
+			err := pubsub.JSON.Unmarshal(b, &mv)
+			return mv, err
+		}},
+		{[]string{"gamelog", "-user", "alice", "-message", "hello", "-time", "2026-03-10T12:00:00Z"}, pubsub.Gob.ContentType(), func(b []byte) (any, error) {
+			var gl routing.GameLog
+			err := pubsub.Gob.Unmarshal(b, &gl)
+			return gl, err
+		}},
+	}
+	for _, tt := range tests {
+		pub, err := parseTestPublish(t, tt.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pub.send(context.Background(), ch); err != nil {
+			t.Fatalf("%q: %v", tt.args, err)
+		}
+		var d amqp.Delivery
+		select {
+		case d = <-deliveries:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q: nothing was published", tt.args)
+		}
+		if d.ContentType != tt.contentType || d.AppId != routing.AppCtl || d.Exchange != pub.exchange || d.RoutingKey != pub.key {
+			t.Errorf("%q: published %s from %s to %s with key %s", tt.args, d.ContentType, d.AppId, d.Exchange, d.RoutingKey)
+		}
+		from, stamped := d.Headers[routing.HeaderPlayer]
+		if stamped != (pub.player != "") || stamped && from != pub.player {
+			t.Errorf("%q: %s header %v, want %q", tt.args, routing.HeaderPlayer, from, pub.player)
+		}
+		msg, err := tt.decode(d.Body)
+		if err != nil || !reflect.DeepEqual(msg, pub.msg) {
+			t.Errorf("%q: published %+v (%v), want %+v", tt.args, msg, err, pub.msg)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// maxRawBody is how much of a body tail prints when it can't decode it.
+const maxRawBody = 512
+
+// runTail binds a queue of its own to a pattern and prints each message that
+// arrives: when, where and by whom it was published, and its body decoded
+// into the game's type for its routing key.
+func runTail(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	exchange := fs.String("exchange", routing.ExchangePerilTopic, "the exchange to tail (a direct exchange needs an exact key)")
+	compact := fs.Bool("compact", false, "print each body on one line")
+	cfg, ok, err := loadConfig(fs, args)
+	if !ok {
+		return err
+	}
+	pattern := "#"
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		pattern = fs.Arg(0)
+	default:
+		return errors.New("usage: perilctl tail [flags] [pattern]")
+	}
+
+	conn, err := cfg.Dial()
+	if err != nil {
+		return fmt.Errorf("could not connect to RabbitMQ: %w", err)
+	}
+	defer conn.Close()
+
+	// The queue is transient, so it goes away when we do
+	host, _ := os.Hostname()
+	sub, err := pubsub.SubscribeMessages(
+		ctx,
+		conn,
+		*exchange,
+		fmt.Sprintf("perilctl.%s.%d", host, os.Getpid()),
+		pattern,
+		pubsub.SimpleQueueTransient,
+		func(msg pubsub.Message[pubsub.Raw]) pubsub.Acktype {
+			printMessage(msg, *compact)
+			return pubsub.Ack
+		},
+		pubsub.WithPrefetch(cfg.PrefetchOr(100)),
+	)
+	if err != nil {
+		return fmt.Errorf("could not bind %s on %s: %w", pattern, *exchange, err)
+	}
+	defer sub.Close()
+
+	fmt.Fprintf(os.Stderr, "Tailing %s on %s, ctrl+c to stop\n", pattern, *exchange)
+	<-ctx.Done()
+	return nil
+}
+
+// bodyFor returns a pointer to decode a message with a routing key into:
+// the type the game publishes with it, or nil for keys it doesn't use.
+func bodyFor(key string) any {
+	switch key {
+	case routing.PauseKey:
+		return &routing.PlayingState{}
+	case routing.RPCWhoKey:
+		return &routing.WhoRequest{}
+	case routing.RPCPauseStateKey:
+		return &routing.PauseStateRequest{}
+	}
+	prefix, _, _ := strings.Cut(key, ".")
+	switch prefix {
+	case routing.ArmyMovesPrefix:
+		return &gamelogic.ArmyMove{}
+	case routing.WarRecognitionsPrefix:
+		return &gamelogic.RecognitionOfWar{}
+	case routing.GameLogSlug:
+		return &routing.GameLog{}
+	}
+	return nil
+}
+
+// printMessage prints a heading line for a message, then its body as JSON
+// if it decodes, or as it is if it doesn't.
+func printMessage(msg pubsub.Message[pubsub.Raw], compact bool) {
+	at := msg.Timestamp
+	if at.IsZero() {
+		at = time.Now()
+	}
+	heading := fmt.Sprintf("%s %s %s", at.Format("15:04:05.000"), msg.Exchange, msg.RoutingKey)
+	if from := strings.TrimSpace(msg.AppID + " " + msg.Header(routing.HeaderPlayer)); from != "" {
+		heading += " (" + from + ")"
+	}
+
+	body, err := decodeBody(msg, compact)
+	if err != nil {
+		fmt.Printf("%s [%s: %v]\n%s\n", heading, msg.ContentType, err, rawBody(msg.Body))
+		return
+	}
+	fmt.Printf("%s\n%s\n", heading, body)
+}
+
+func decodeBody(msg pubsub.Message[pubsub.Raw], compact bool) (string, error) {
+	v := bodyFor(msg.RoutingKey)
+	if v == nil {
+		return "", errors.New("not a key the game uses")
+	}
+	codec, err := pubsub.CodecFor(msg.ContentType)
+	if err != nil {
+		return "", err
+	}
+	if err := codec.Unmarshal(msg.Body, v); err != nil {
+		return "", err
+	}
+	var out []byte
+	if compact {
+		out, err = json.Marshal(v)
+	} else {
+		out, err = json.MarshalIndent(v, "  ", "  ")
+		out = append([]byte("  "), out...)
+	}
+	return string(out), err
+}
+
+// rawBody is a body tail couldn't decode: the text if it is text, or just
+// its size if it isn't.
+func rawBody(body []byte) string {
+	if !utf8.Valid(body) {
+		return fmt.Sprintf("  <%d bytes>", len(body))
+	}
+	if len(body) > maxRawBody {
+		return fmt.Sprintf("  %s... <%d bytes>", body[:maxRawBody], len(body))
+	}
+	return "  " + string(body)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/config"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+// runTopology prints, declares or checks the exchanges, queues and bindings
+// the game needs: the built-in topology, or the one in -file.
+func runTopology(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: perilctl topology show|apply|verify [-file topology.json]")
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("topology "+action, flag.ExitOnError)
+	file := fs.String("file", "", "JSON file describing the topology (default: the built-in one)")
+	cfg, ok, err := loadConfig(fs, args[1:])
+	if !ok {
+		return err
+	}
+	// The exchange names in the built-in topology come from the configuration,
+	// so it is only built once that has been applied
+	topology := pubsub.DefaultTopology()
+	if *file != "" {
+		if topology, err = pubsub.LoadTopology(*file); err != nil {
+			return fmt.Errorf("could not load topology: %w", err)
+		}
+	}
+
+	switch action {
+	case "show":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(topology)
+	case "apply":
+		return applyTopology(cfg, topology)
+	case "verify":
+		return verifyTopology(cfg, topology)
+	}
+	return fmt.Errorf("unknown topology command %q, want show, apply or verify", action)
+}
+
+func applyTopology(cfg config.Config, topology pubsub.Topology) error {
+	conn, err := cfg.Dial()
+	if err != nil {
+		return fmt.Errorf("could not connect to RabbitMQ: %w", err)
+	}
+	defer conn.Close()
+	if err := pubsub.ApplyTopology(conn, topology); err != nil {
+		return fmt.Errorf("could not apply topology: %w", err)
+	}
+	fmt.Printf("Declared %d exchanges, %d queues and %d bindings\n", len(topology.Exchanges), len(topology.Queues), len(topology.Bindings))
+	return nil
+}
+
+// verifyTopology prints where the broker differs from the topology, and
+// fails if it does anywhere.
+func verifyTopology(cfg config.Config, topology pubsub.Topology) error {
+	conn, err := cfg.Dial()
+	if err != nil {
+		return fmt.Errorf("could not connect to RabbitMQ: %w", err)
+	}
+	defer conn.Close()
+	drift, err := pubsub.VerifyTopology(conn, topology)
+	if err != nil {
+		return fmt.Errorf("could not verify topology: %w", err)
+	}
+	if len(drift) == 0 {
+		fmt.Println("The broker matches the topology (bindings are not checked)")
+		return nil
+	}
+	for _, d := range drift {
+		fmt.Println(d)
+	}
+	return fmt.Errorf("the broker differs from the topology in %d places", len(drift))
+}
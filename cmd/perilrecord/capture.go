@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// A capture file is captureMagic followed by records, appended one after
+// another. A record is its length as a uvarint, then:
+//
+//	at            varint, Unix nanoseconds when it was recorded
+//	exchange      string
+//	routing key   string
+//	content type  string
+//	app ID        string
+//	message ID    string
+//	timestamp     varint, Unix seconds of the message's timestamp, 0 if none
+//	headers       table
+//	body          bytes
+//
+// Strings and bytes are a uvarint length and then the bytes. A table is a
+// uvarint count of key (string) and value pairs, and each value is a type
+// byte and then the value (see appendValue).
+const captureMagic = "PERILREC1\n"
+
+// maxRecordSize is the most a record can hold, well over the largest
+// message RabbitMQ accepts (512MiB). A length beyond it means the file is
+// corrupt, rather than something to allocate.
+const maxRecordSize = 1 << 30
+
+// record is one delivery in a capture.
+type record struct {
+	At          time.Time
+	Exchange    string
+	RoutingKey  string
+	ContentType string
+	AppID       string
+	MessageID   string
+	Timestamp   time.Time
+	Headers     amqp.Table
+	Body        []byte
+}
+
+// errTruncated means a capture ends part way through a record, as it does
+// if the recorder was killed while writing one.
+var errTruncated = errors.New("capture ends part way through a record")
+
+// captureWriter appends records to a capture file. It is safe to use from
+// several goroutines.
+type captureWriter struct {
+	mu sync.Mutex
+	f  *os.File
+
+	// dropped is how many bytes of a record cut short at the end of the
+	// file were removed when it was opened
+	dropped int64
+}
+
+// appendCapture opens a capture file to add records to, creating it if it
+// doesn't exist. A record cut short at the end, as a crash leaves it, is
+// removed first, or the records after it would be read as part of it.
+func appendCapture(path string) (*captureWriter, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var end int64
+	if info.Size() == 0 {
+		_, err = f.WriteString(captureMagic)
+		end = int64(len(captureMagic))
+	} else {
+		end, err = completeLength(f, info.Size(), path)
+	}
+	if err == nil && end < info.Size() {
+		err = f.Truncate(end)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &captureWriter{f: f, dropped: max(info.Size()-end, 0)}, nil
+}
+
+// completeLength returns how much of a capture file of size bytes is made
+// up of whole records.
+func completeLength(f *os.File, size int64, path string) (int64, error) {
+	br := bufio.NewReader(io.NewSectionReader(f, 0, size))
+	if err := checkMagic(br, path); err != nil {
+		return 0, err
+	}
+	end := int64(len(captureMagic))
+	for {
+		payload, err := readFrame(br)
+		if err == io.EOF || errors.Is(err, errTruncated) {
+			return end, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", path, err)
+		}
+		end += int64(len(binary.AppendUvarint(nil, uint64(len(payload))))) + int64(len(payload))
+	}
+}
+
+// write appends a record. It goes in a single write, so that a crash
+// leaves at most the last record cut short.
+func (w *captureWriter) write(r record) error {
+	payload, err := appendRecord(nil, r)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxRecordSize {
+		return fmt.Errorf("record of %d bytes is over the %d byte limit", len(payload), maxRecordSize)
+	}
+	buf := binary.AppendUvarint(make([]byte, 0, len(payload)+binary.MaxVarintLen64), uint64(len(payload)))
+	buf = append(buf, payload...)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.f.Write(buf)
+	return err
+}
+
+func (w *captureWriter) Close() error {
+	return w.f.Close()
+}
+
+// captureReader reads the records in a capture file in order.
+type captureReader struct {
+	f  *os.File
+	br *bufio.Reader
+}
+
+func openCapture(path string) (*captureReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	if err := checkMagic(br, path); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &captureReader{f: f, br: br}, nil
+}
+
+// next returns the next record, io.EOF after the last one, or errTruncated
+// if the file ends in the middle of one.
+func (r *captureReader) next() (record, error) {
+	payload, err := readFrame(r.br)
+	if err != nil {
+		return record{}, err
+	}
+	rec, err := parseRecord(payload)
+	if err != nil {
+		return record{}, fmt.Errorf("corrupt record: %w", err)
+	}
+	return rec, nil
+}
+
+func (r *captureReader) Close() error {
+	return r.f.Close()
+}
+
+// readFrame reads the next record's payload, without parsing it. The
+// payload grows as it's read, so a length torn by a crash can't make it
+// allocate more than the file holds.
+func readFrame(br *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, errTruncated
+	}
+	if n > maxRecordSize {
+		return nil, fmt.Errorf("corrupt record: %d bytes long, over the %d byte limit", n, maxRecordSize)
+	}
+	var payload bytes.Buffer
+	if _, err := io.CopyN(&payload, br, int64(n)); err != nil {
+		return nil, errTruncated
+	}
+	return payload.Bytes(), nil
+}
+
+func checkMagic(r io.Reader, path string) error {
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != captureMagic {
+		return fmt.Errorf("%s is not a Peril capture", path)
+	}
+	return nil
+}
+
+func appendRecord(b []byte, r record) ([]byte, error) {
+	b = binary.AppendVarint(b, r.At.UnixNano())
+	for _, s := range []string{r.Exchange, r.RoutingKey, r.ContentType, r.AppID, r.MessageID} {
+		b = appendString(b, s)
+	}
+	var ts int64
+	if !r.Timestamp.IsZero() {
+		ts = r.Timestamp.Unix()
+	}
+	b = binary.AppendVarint(b, ts)
+	b, err := appendTable(b, r.Headers)
+	if err != nil {
+		return nil, err
+	}
+	return appendString(b, string(r.Body)), nil
+}
+
+func parseRecord(payload []byte) (record, error) {
+	d := &decoder{r: bytes.NewReader(payload)}
+	var r record
+	r.At = time.Unix(0, d.varint())
+	r.Exchange = d.string()
+	r.RoutingKey = d.string()
+	r.ContentType = d.string()
+	r.AppID = d.string()
+	r.MessageID = d.string()
+	if ts := d.varint(); ts != 0 {
+		r.Timestamp = time.Unix(ts, 0)
+	}
+	r.Headers = d.table()
+	r.Body = []byte(d.string())
+	if d.err == nil && d.r.Len() != 0 {
+		d.err = errors.New("trailing bytes")
+	}
+	return r, d.err
+}
+
+// Types of header values.
+const (
+	valueNil     = 'n'
+	valueFalse   = 'f'
+	valueTrue    = 't'
+	valueInt     = 'i'
+	valueFloat   = 'd'
+	valueString  = 's'
+	valueBytes   = 'x'
+	valueTime    = 'T'
+	valueDecimal = 'D'
+	valueTable   = 'F'
+	valueArray   = 'A'
+)
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendTable(b []byte, t amqp.Table) ([]byte, error) {
+	b = binary.AppendUvarint(b, uint64(len(t)))
+	for k, v := range t {
+		b = appendString(b, k)
+		var err error
+		if b, err = appendValue(b, v); err != nil {
+			return nil, fmt.Errorf("header %s: %w", k, err)
+		}
+	}
+	return b, nil
+}
+
+// appendValue encodes the types a header value can have. Integers of every
+// size come back as int64, which is how the broker delivers them anyway.
+func appendValue(b []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, valueNil), nil
+	case bool:
+		if v {
+			return append(b, valueTrue), nil
+		}
+		return append(b, valueFalse), nil
+	case byte:
+		return binary.AppendVarint(append(b, valueInt), int64(v)), nil
+	case int8:
+		return binary.AppendVarint(append(b, valueInt), int64(v)), nil
+	case int16:
+		return binary.AppendVarint(append(b, valueInt), int64(v)), nil
+	case int32:
+		return binary.AppendVarint(append(b, valueInt), int64(v)), nil
+	case int:
+		return binary.AppendVarint(append(b, valueInt), int64(v)), nil
+	case int64:
+		return binary.AppendVarint(append(b, valueInt), v), nil
+	case float32:
+		return binary.BigEndian.AppendUint64(append(b, valueFloat), math.Float64bits(float64(v))), nil
+	case float64:
+		return binary.BigEndian.AppendUint64(append(b, valueFloat), math.Float64bits(v)), nil
+	case string:
+		return appendString(append(b, valueString), v), nil
+	case []byte:
+		return appendString(append(b, valueBytes), string(v)), nil
+	case time.Time:
+		return binary.AppendVarint(append(b, valueTime), v.Unix()), nil
+	case amqp.Decimal:
+		b = append(b, valueDecimal, v.Scale)
+		return binary.AppendVarint(b, int64(v.Value)), nil
+	case amqp.Table:
+		return appendTable(append(b, valueTable), v)
+	case []interface{}:
+		b = binary.AppendUvarint(append(b, valueArray), uint64(len(v)))
+		for _, item := range v {
+			var err error
+			if b, err = appendValue(b, item); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("can't record a %T", v)
+}
+
+// decoder reads the parts of a record, remembering the first error so
+// that the caller only has to check once.
+type decoder struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *decoder) varint() int64 {
+	v, err := binary.ReadVarint(d.r)
+	if err != nil {
+		d.fail(err)
+	}
+	return v
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		d.fail(err)
+	}
+	return v
+}
+
+func (d *decoder) byte() byte {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		d.fail(err)
+	}
+	return c
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(d.r.Len()) {
+		d.fail(io.ErrUnexpectedEOF)
+		return ""
+	}
+	buf := make([]byte, n)
+	d.r.Read(buf)
+	return string(buf)
+}
+
+func (d *decoder) table() amqp.Table {
+	n := d.uvarint()
+	t := amqp.Table{}
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		k := d.string()
+		t[k] = d.value()
+	}
+	return t
+}
+
+func (d *decoder) value() any {
+	switch kind := d.byte(); kind {
+	case valueNil:
+		return nil
+	case valueFalse:
+		return false
+	case valueTrue:
+		return true
+	case valueInt:
+		return d.varint()
+	case valueFloat:
+		var buf [8]byte
+		if _, err := io.ReadFull(d.r, buf[:]); err != nil {
+			d.fail(err)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(buf[:]))
+	case valueString:
+		return d.string()
+	case valueBytes:
+		return []byte(d.string())
+	case valueTime:
+		return time.Unix(d.varint(), 0)
+	case valueDecimal:
+		scale := d.byte()
+		return amqp.Decimal{Scale: scale, Value: int32(d.varint())}
+	case valueTable:
+		return d.table()
+	case valueArray:
+		n := d.uvarint()
+		var items []interface{}
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			items = append(items, d.value())
+		}
+		return items
+	default:
+		if d.err == nil {
+			d.fail(fmt.Errorf("unknown value type %q", kind))
+		}
+		return nil
+	}
+}
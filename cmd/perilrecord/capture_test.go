@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func testRecord(id string) record {
+	return record{
+		At:          time.Unix(1700000000, 123456789),
+		Exchange:    "peril_topic",
+		RoutingKey:  "army_moves.alice",
+		ContentType: "application/json",
+		AppID:       "peril-client",
+		MessageID:   id,
+		Timestamp:   time.Unix(1700000000, 0),
+		Headers: amqp.Table{
+			"nil":     nil,
+			"false":   false,
+			"true":    true,
+			"int":     int64(-42),
+			"float":   1.5,
+			"string":  "hello",
+			"bytes":   []byte{0, 1, 2},
+			"time":    time.Unix(1600000000, 0),
+			"decimal": amqp.Decimal{Scale: 2, Value: 314},
+			"table":   amqp.Table{"nested": "yes"},
+			"array":   []interface{}{int64(1), "two"},
+		},
+		Body: []byte(`{"player":"alice"}`),
+	}
+}
+
+func writeCapture(t *testing.T, path string, recs ...record) {
+	t.Helper()
+	w, err := appendCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for _, r := range recs {
+		if err := w.write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readCapture returns the records in a capture and what next said after
+// the last of them.
+func readCapture(t *testing.T, path string) ([]record, error) {
+	t.Helper()
+	r, err := openCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var recs []record
+	for {
+		rec, err := r.next()
+		if err != nil {
+			return recs, err
+		}
+		recs = append(recs, rec)
+	}
+}
+
+func TestCaptureRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peril.rec")
+	want := []record{testRecord("1"), {At: time.Unix(0, 1), Headers: amqp.Table{}, Body: []byte{}}}
+	writeCapture(t, path, want...)
+
+	got, err := readCapture(t, path)
+	if err != io.EOF {
+		t.Fatalf("reading the capture ended with %v, want io.EOF", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("read back\n%#v\nwant\n%#v", got, want)
+	}
+}
+
+func TestCaptureIntegerHeaders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peril.rec")
+	rec := record{Headers: amqp.Table{"byte": byte(1), "int8": int8(-2), "int16": int16(3), "int32": int32(-4), "int": 5}}
+	writeCapture(t, path, rec)
+
+	got, _ := readCapture(t, path)
+	want := amqp.Table{"byte": int64(1), "int8": int64(-2), "int16": int64(3), "int32": int64(-4), "int": int64(5)}
+	if len(got) != 1 || !reflect.DeepEqual(got[0].Headers, want) {
+		t.Fatalf("read back %v, want every integer as an int64: %v", got, want)
+	}
+}
+
+func TestCaptureRejectsUnknownHeaderType(t *testing.T) {
+	w, err := appendCapture(filepath.Join(t.TempDir(), "peril.rec"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.write(record{Headers: amqp.Table{"bad": struct{}{}}}); err == nil {
+		t.Fatal("recorded a header of a type that can't be read back")
+	}
+}
+
+func TestCaptureNotACapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peril.rec")
+	if err := os.WriteFile(path, []byte("something else entirely"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appendCapture(path); err == nil || !strings.Contains(err.Error(), "not a Peril capture") {
+		t.Fatalf("appending to something else = %v, want an error", err)
+	}
+	if _, err := openCapture(path); err == nil || !strings.Contains(err.Error(), "not a Peril capture") {
+		t.Fatalf("opening something else = %v, want an error", err)
+	}
+}
+
+// A crash part way through writing a record leaves it cut short. Reading
+// stops at it, and appending drops it so that the next record reads back.
+func TestCaptureTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	whole := filepath.Join(dir, "whole.rec")
+	writeCapture(t, whole, testRecord("1"), testRecord("2"))
+	data, err := os.ReadFile(whole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := filepath.Join(dir, "first.rec")
+	writeCapture(t, first, testRecord("1"))
+	info, err := os.Stat(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every cut part way through the second record, length included
+	for cut := info.Size() + 1; cut < int64(len(data)); cut++ {
+		path := filepath.Join(dir, "torn.rec")
+		if err := os.WriteFile(path, data[:cut], 0644); err != nil {
+			t.Fatal(err)
+		}
+		recs, err := readCapture(t, path)
+		if !errors.Is(err, errTruncated) || len(recs) != 1 {
+			t.Fatalf("cut at %d: read %d records then %v, want 1 then errTruncated", cut, len(recs), err)
+		}
+
+		w, err := appendCapture(path)
+		if err != nil {
+			t.Fatalf("cut at %d: %v", cut, err)
+		}
+		if w.dropped != cut-info.Size() {
+			t.Fatalf("cut at %d: dropped %d bytes, want %d", cut, w.dropped, cut-info.Size())
+		}
+		if err := w.write(testRecord("3")); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		recs, err = readCapture(t, path)
+		if err != io.EOF || len(recs) != 2 || recs[1].MessageID != "3" {
+			t.Fatalf("cut at %d: after appending read %d records then %v, want 1 and 3 then io.EOF", cut, len(recs), err)
+		}
+	}
+}
+
+func TestCaptureWholeRecordsKept(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peril.rec")
+	writeCapture(t, path, testRecord("1"))
+	w, err := appendCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.dropped != 0 {
+		t.Fatalf("dropped %d bytes of a capture with nothing cut short", w.dropped)
+	}
+	w.Close()
+	writeCapture(t, path, testRecord("2"))
+	recs, err := readCapture(t, path)
+	if err != io.EOF || len(recs) != 2 {
+		t.Fatalf("read %d records then %v, want 2 then io.EOF", len(recs), err)
+	}
+}
+
+// A length no record could have is corruption, and neither reading nor
+// appending tries to allocate it.
+func TestCaptureOversizedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peril.rec")
+	data := binary.AppendUvarint([]byte(captureMagic), 1<<62)
+	if err := os.WriteFile(path, append(data, "short"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := readCapture(t, path)
+	if err == nil || errors.Is(err, errTruncated) || !strings.Contains(err.Error(), "limit") {
+		t.Fatalf("reading an oversized record = %v, want a corrupt record error", err)
+	}
+	if _, err := appendCapture(path); err == nil {
+		t.Fatal("appended to a corrupt capture")
+	}
+}
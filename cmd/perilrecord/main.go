@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/config"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+// perilrecord records what is published to the game's exchanges, and
+// publishes it again later, so that a game can be replayed against the
+// handlers without running the clients that played it:
+//
+//	perilrecord record [-o file] [-key pattern]...
+//	perilrecord replay [-speed n] [-key pattern]... file
+//	perilrecord show [-key pattern]... file
+//
+// Each also takes the configuration flags that the client and server do.
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	// ctx is cancelled on ctrl+c, which stops recording or replaying:
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "record":
+		err = runRecord(ctx, args)
+	case "replay":
+		err = runReplay(ctx, args)
+	case "show":
+		err = runShow(args)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "perilrecord: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: perilrecord record|replay|show [flags] (see perilrecord <command> -h)")
+	os.Exit(2)
+}
+
+// loadConfig adds the configuration flags to fs, parses args and resolves
+// the configuration. It reports whether to carry on, which is false once
+// -print-config has printed it.
+func loadConfig(fs *flag.FlagSet, args []string) (config.Config, bool, error) {
+	cfgFlags := config.AddFlags(fs)
+	fs.Parse(args)
+	cfg, err := cfgFlags.Load()
+	if err != nil {
+		return config.Config{}, false, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if cfgFlags.PrintConfig {
+		cfg.Print(os.Stdout)
+		return cfg, false, nil
+	}
+	cfg.Apply()
+	// Diagnostics go to stderr, and only problems unless asked for more
+	slog.SetDefault(cfg.Logger(slog.LevelWarn))
+	return cfg, true, nil
+}
+
+// keyPatterns are the -key flags: topic patterns, one of which a routing key
+// must match. With none, every key matches.
+type keyPatterns []string
+
+func (p *keyPatterns) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *keyPatterns) Set(pattern string) error {
+	*p = append(*p, pattern)
+	return nil
+}
+
+func (p keyPatterns) match(key string) bool {
+	if len(p) == 0 {
+		return true
+	}
+	for _, pattern := range p {
+		if pubsub.MatchTopic(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
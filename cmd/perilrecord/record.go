@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// defaultDirectKeys are the routing keys published to peril_direct. A
+// direct exchange has no wildcards, so each one needs a binding of its own.
+var defaultDirectKeys = []string{routing.PauseKey, routing.RPCWhoKey, routing.RPCPauseStateKey}
+
+// brokerHeaders are added by the broker on the way through, rather than
+// by whoever published the message, so they aren't recorded.
+var brokerHeaders = []string{
+	"x-death",
+	"x-first-death-exchange", "x-first-death-queue", "x-first-death-reason",
+	"x-last-death-exchange", "x-last-death-queue", "x-last-death-reason",
+	"x-delivery-count",
+}
+
+// runRecord binds its own queues to # on peril_topic and to the direct keys on peril_direct,
+// and appends everything that arrives to a capture file until it's interrupted.
+func runRecord(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	out := fs.String("o", "peril.rec", "capture file to append to")
+	directKeys := fs.String("direct-keys", strings.Join(defaultDirectKeys, ","), "comma-separated routing keys to record from the direct exchange")
+	var keys keyPatterns
+	fs.Var(&keys, "key", "only record routing keys matching this topic pattern (repeatable)")
+	cfg, ok, err := loadConfig(fs, args)
+	if !ok {
+		return err
+	}
+
+	w, err := appendCapture(*out)
+	if err != nil {
+		return fmt.Errorf("could not open capture: %w", err)
+	}
+	defer w.Close()
+	if w.dropped > 0 {
+		fmt.Fprintf(os.Stderr, "warning: removed an incomplete record (%d bytes) from the end of %s\n", w.dropped, *out)
+	}
+	conn, err := cfg.Dial()
+	if err != nil {
+		return fmt.Errorf("could not connect to RabbitMQ: %w", err)
+	}
+	defer conn.Close()
+
+	var recorded atomic.Int64
+	ctx, cancel := context.WithCancelCause(ctx)
+	handler := func(msg pubsub.Message[pubsub.Raw]) pubsub.Acktype {
+		if !keys.match(msg.RoutingKey) {
+			return pubsub.Ack
+		}
+		headers := msg.Headers
+		for _, h := range brokerHeaders {
+			delete(headers, h)
+		}
+		err := w.write(record{
+			At:          time.Now(),
+			Exchange:    msg.Exchange,
+			RoutingKey:  msg.RoutingKey,
+			ContentType: msg.ContentType,
+			AppID:       msg.AppID,
+			MessageID:   msg.MessageID,
+			Timestamp:   msg.Timestamp,
+			Headers:     headers,
+			Body:        msg.Body,
+		})
+		if err != nil {
+			// A capture with gaps in it is no use, so stop
+			cancel(fmt.Errorf("could not write capture: %w", err))
+			return pubsub.NackRequeue
+		}
+		recorded.Add(1)
+		return pubsub.Ack
+	}
+
+	bindings := [][2]string{{routing.ExchangePerilTopic, "#"}}
+	for _, key := range strings.Split(*directKeys, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			bindings = append(bindings, [2]string{routing.ExchangePerilDirect, key})
+		}
+	}
+	// Each binding gets a transient queue of its own, which goes away when we do
+	host, _ := os.Hostname()
+	prefix := fmt.Sprintf("perilrecord.%s.%d", host, os.Getpid())
+	for i, b := range bindings {
+		sub, err := pubsub.SubscribeMessages(
+			ctx,
+			conn,
+			b[0],
+			fmt.Sprintf("%s.%d", prefix, i),
+			b[1],
+			pubsub.SimpleQueueTransient,
+			handler,
+			pubsub.WithPrefetch(cfg.PrefetchOr(100)),
+		)
+		if err != nil {
+			return fmt.Errorf("could not bind %s on %s: %w", b[1], b[0], err)
+		}
+		defer sub.Close()
+	}
+
+	fmt.Printf("Recording to %s, ctrl+c to stop\n", *out)
+	<-ctx.Done()
+	fmt.Printf("Recorded %d messages\n", recorded.Load())
+	if err := context.Cause(ctx); err != context.Canceled {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+// runReplay publishes a capture again, to the exchanges and with the routing keys it was
+// recorded from, keeping the gaps between messages (scaled by -speed).
+func runReplay(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "how much faster than recorded to replay: 2 is twice as fast, 0 as fast as possible")
+	var keys keyPatterns
+	fs.Var(&keys, "key", "only replay routing keys matching this topic pattern (repeatable)")
+	cfg, ok, err := loadConfig(fs, args)
+	if !ok {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: perilrecord replay [flags] <capture file>")
+	}
+	if *speed < 0 {
+		return fmt.Errorf("speed must not be negative, got %v", *speed)
+	}
+
+	r, err := openCapture(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	conn, err := cfg.Dial()
+	if err != nil {
+		return fmt.Errorf("could not connect to RabbitMQ: %w", err)
+	}
+	defer conn.Close()
+	// Wait for the broker to confirm each message, so that a replay that finishes has really
+	// been published:
+	publisher, err := pubsub.NewPublisher(conn, pubsub.PublisherConfig{ConfirmTimeout: 5 * time.Second})
+	if err != nil {
+		return fmt.Errorf("could not create publisher: %w", err)
+	}
+	defer publisher.Close()
+
+	var first time.Time
+	started := time.Now()
+	replayed := 0
+	for {
+		rec, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, errTruncated) {
+			fmt.Fprintln(os.Stderr, "warning: the capture's last record is incomplete, skipping it")
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !keys.match(rec.RoutingKey) {
+			continue
+		}
+		// Timing is relative to the first message replayed, so that filtered-out ones don't
+		// leave a silence at the start
+		if first.IsZero() {
+			first = rec.At
+		}
+		if *speed > 0 {
+			due := started.Add(time.Duration(float64(rec.At.Sub(first)) / *speed))
+			select {
+			case <-time.After(time.Until(due)):
+			case <-ctx.Done():
+				fmt.Printf("Replayed %d messages before being interrupted\n", replayed)
+				return nil
+			}
+		}
+		err = publisher.PublishWithContext(ctx, rec.Exchange, rec.RoutingKey, false, false, amqp.Publishing{
+			ContentType: rec.ContentType,
+			AppId:       rec.AppID,
+			MessageId:   rec.MessageID,
+			Timestamp:   rec.Timestamp,
+			Headers:     rec.Headers,
+			Body:        rec.Body,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				fmt.Printf("Replayed %d messages before being interrupted\n", replayed)
+				return nil
+			}
+			return fmt.Errorf("could not publish %s to %s: %w", rec.RoutingKey, rec.Exchange, err)
+		}
+		replayed++
+	}
+	fmt.Printf("Replayed %d messages in %s\n", replayed, time.Since(started).Round(time.Millisecond))
+	return nil
+}
+
+// runShow lists what a capture holds, one message per line.
+func runShow(args []string) error {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	var keys keyPatterns
+	fs.Var(&keys, "key", "only show routing keys matching this topic pattern (repeatable)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: perilrecord show [flags] <capture file>")
+	}
+	r, err := openCapture(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for {
+		rec, err := r.next()
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, errTruncated) {
+			fmt.Println("(incomplete record at the end)")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !keys.match(rec.RoutingKey) {
+			continue
+		}
+		fmt.Printf("%s %s %s %s %dB", rec.At.Format(time.RFC3339Nano), rec.Exchange, rec.RoutingKey, rec.ContentType, len(rec.Body))
+		if rec.AppID != "" {
+			fmt.Printf(" from %s", rec.AppID)
+		}
+		fmt.Println()
+	}
+}
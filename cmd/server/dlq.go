@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// handleDLQ runs the "dlq" REPL command against the peril_dlq queue:
+//
+//	dlq list             one line per dead-lettered message
+//	dlq show <n>         the nth message, decoded
+//	dlq replay <n|all>   send messages back to the queue they died in
+//	dlq purge            drop everything in the dead-letter queue
+func handleDLQ(ctx context.Context, conn pubsub.Connection, args []string) {
+	if len(args) == 0 {
+		printDLQUsage()
+		return
+	}
+	switch args[0] {
+	case "list":
+		letters, err := pubsub.InspectDeadLetters(conn, routing.QueuePerilDLQ)
+		if err != nil {
+			fmt.Printf("could not read dead letters: %v\n", err)
+			return
+		}
+		if len(letters) == 0 {
+			fmt.Println("The dead-letter queue is empty")
+			return
+		}
+		for i, letter := range letters {
+			fmt.Printf("%d. %s\n", i+1, describeDeadLetter(letter))
+		}
+	case "show":
+		n, ok := dlqPosition(args)
+		if !ok {
+			return
+		}
+		letters, err := pubsub.InspectDeadLetters(conn, routing.QueuePerilDLQ)
+		if err != nil {
+			fmt.Printf("could not read dead letters: %v\n", err)
+			return
+		}
+		if n > len(letters) {
+			fmt.Printf("there are only %d dead letters\n", len(letters))
+			return
+		}
+		letter := letters[n-1]
+		fmt.Println(describeDeadLetter(letter))
+		fmt.Printf("  content type: %s\n", letter.ContentType)
+		fmt.Printf("  body: %s\n", decodeDeadLetter(letter))
+	case "replay":
+		if len(args) < 2 {
+			printDLQUsage()
+			return
+		}
+		var positions []int
+		if args[1] != "all" {
+			n, ok := dlqPosition(args)
+			if !ok {
+				return
+			}
+			positions = append(positions, n)
+		}
+		replayed, err := pubsub.ReplayDeadLetters(ctx, conn, routing.QueuePerilDLQ, positions...)
+		if err != nil {
+			fmt.Printf("could not replay dead letters: %v\n", err)
+		}
+		fmt.Printf("Replayed %d dead letters\n", replayed)
+	case "purge":
+		purged, err := pubsub.PurgeDeadLetters(conn, routing.QueuePerilDLQ)
+		if err != nil {
+			fmt.Printf("could not purge dead letters: %v\n", err)
+			return
+		}
+		fmt.Printf("Purged %d dead letters\n", purged)
+	default:
+		printDLQUsage()
+	}
+}
+
+func printDLQUsage() {
+	fmt.Println("usage: dlq list | dlq show <n> | dlq replay <n|all> | dlq purge")
+}
+
+// dlqPosition parses the 1-based message number in args[1].
+func dlqPosition(args []string) (int, bool) {
+	if len(args) < 2 {
+		printDLQUsage()
+		return 0, false
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 1 {
+		fmt.Printf("error: %s is not a valid message number\n", args[1])
+		return 0, false
+	}
+	return n, true
+}
+
+func describeDeadLetter(letter pubsub.DeadLetter) string {
+	return fmt.Sprintf(
+		"%s via %s from queue %s: %s x%d at %s",
+		letter.RoutingKey,
+		letter.Exchange,
+		letter.Queue,
+		letter.Reason,
+		letter.Count,
+		letter.Time.Format(time.RFC3339),
+	)
+}
+
+// decodeDeadLetter decodes a dead letter into the type that is published
+// under its routing key, so that gob bodies can be shown too.
+func decodeDeadLetter(letter pubsub.DeadLetter) string {
+	return decodeBody(letter.RoutingKey, letter.Body, letter.Decode)
+}
+
+// decodeBody decodes a message body with decode into the type that is
+// published under key.
+func decodeBody(key string, body []byte, decode func(any) error) string {
+	var target any
+	switch strings.Split(key, ".")[0] {
+	case routing.ArmyMovesPrefix:
+		target = &gamelogic.ArmyMove{}
+	case routing.WarRecognitionsPrefix:
+		target = &gamelogic.RecognitionOfWar{}
+	case routing.PauseKey:
+		target = &routing.PlayingState{}
+	case routing.GameLogSlug:
+		target = &routing.GameLog{}
+	default:
+		return fmt.Sprintf("%q", body)
+	}
+	if err := decode(target); err != nil {
+		return fmt.Sprintf("could not decode (%v): %q", err, body)
+	}
+	return fmt.Sprintf("%+v", reflect.ValueOf(target).Elem().Interface())
+}
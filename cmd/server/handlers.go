@@ -1,7 +1,8 @@
 package main
 
 import (
-	"fmt"
+	"log/slog"
+	"time"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
@@ -17,20 +18,46 @@ So it’s a higher-order function that produces a handler. The returned handler:
 	- Returns a pubsub.Acktype (e.g., Ack/Nack) to tell the consumer how to acknowledge the message
 Typical use: you call handlerLogs() to get the handler function, then pass that handler into your 
 subscribe function so each incoming message is processed and acknowledged appropriately */
-	func handlerLogs() func(gamelog routing.GameLog) pubsub.Acktype {
+	func handlerLogs(logger *slog.Logger) func(gamelog routing.GameLog) pubsub.Acktype {
 	/* creates a function literal with signature func(gamelog routing.GameLog) pubsub.Acktype.
 	Because it’s inside another function, it can capture variables from the outer scope.
 	The caller receives this function and can invoke it later with a routing.GameLog, and it must 
 	return a pubsub.Acktype */
 	return func(gamelog routing.GameLog) pubsub.Acktype {
-		// Defer printing a new prompt to the console:
-		defer fmt.Print("> ")
-		// Use the gamelogic.WriteLog function to write the log to disk:
-		err := gamelogic.WriteLog(gamelog)
+		// Use the gamelogic.WriteLog function to write the log to disk. It only logs to stderr, 
+		// so there's no need to print a new prompt afterwards:
+		err := gamelogic.WriteLog(logger, gamelog)
 		if err != nil {
-			fmt.Printf("error writing log: %v\n", err)
-			return pubsub.NackRequeue
+			logger.Error("could not write game log", "username", gamelog.Username, "err", err)
+			// Give the disk a moment rather than retrying straight away:
+			return pubsub.NackRetryLater
 		}
 		return pubsub.Ack
 	}
-}
\ No newline at end of file
+}
+
+// handlerTimeout is how long a handler can run before it's reported as stuck. Writing a log to 
+// a slow disk is the longest any of them should take:
+const handlerTimeout = 30 * time.Second
+
+// dedupWindow is how many message IDs each subscription remembers, to drop the copies of a 
+// game log that a client's outbox replays after a crash:
+const dedupWindow = 10000
+
+// withMiddleware wraps a handler so that a panic in it dead-letters the message rather than 
+// crashing the server, every message is logged (to logger), one already handled is dropped, 
+// and slow or stuck handlers are called out. A stuck handler isn't given up on for a retry: 
+// it would still write its game log, and the retry would write it again:
+func withMiddleware[T any](logger *slog.Logger, handler pubsub.Handler[T]) pubsub.Handler[T] {
+	return pubsub.Chain(handler,
+		pubsub.Recover[T](logger),
+		pubsub.Logging[T](logger),
+		pubsub.Timing(func(msg pubsub.Message[T], ack pubsub.Acktype, elapsed time.Duration) {
+			if elapsed > time.Second {
+				logger.Warn("slow handler", "routing_key", msg.RoutingKey, "took", elapsed)
+			}
+		}),
+		pubsub.Dedup[T](dedupWindow, logger),
+		pubsub.WarnAfter[T](handlerTimeout, logger),
+	)
+}
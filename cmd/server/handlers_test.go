@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// A game log a client publishes is written to the logs file once, even
+// when its outbox replays it.
+func TestGameLogWritten(t *testing.T) {
+	logsFile := filepath.Join(t.TempDir(), "game.log")
+	defer func(old string) { gamelogic.LogsFile = old }(gamelogic.LogsFile)
+	gamelogic.LogsFile = logsFile
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn, err := pubsub.NewMemoryBroker().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := pubsub.ApplyTopology(conn, pubsub.DefaultTopology()); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := pubsub.SubscribeMessages(ctx, conn, routing.ExchangePerilTopic,
+		routing.GameLogSlug, routing.GameLogSlug+".*", pubsub.SimpleQueueQuorum,
+		withMiddleware(discardLogger, pubsub.BodyHandler(handlerLogs(discardLogger))),
+		pubsub.WithCodec(pubsub.Gob),
+		pubsub.WithDeliveryLimit(routing.DeliveryLimit),
+		pubsub.WithLogger(discardLogger),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	publishCh, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publishCh.Close()
+	gl := routing.GameLog{
+		Username:    "alice",
+		CurrentTime: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Message:     "alice won a war against bob",
+	}
+	for range 2 {
+		err := pubsub.PublishGob(publishCh, routing.ExchangePerilTopic, routing.GameLogSlug+".alice", gl, pubsub.WithMessageID("log-1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := "2026-01-02T03:04:05Z alice: alice won a war against bob\n"
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(logsFile)
+		if string(data) == want {
+			break
+		}
+		if strings.Count(string(data), "\n") > 1 || time.Now().After(deadline) {
+			t.Fatalf("logs file holds %q, want %q", data, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The replay is dropped rather than waiting its turn to be written
+	sub.Close()
+	if data, _ := os.ReadFile(logsFile); string(data) != want {
+		t.Fatalf("logs file holds %q after the replay, want %q", data, want)
+	}
+}
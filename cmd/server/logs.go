@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// logsIdle is how long "logs" waits for another message before deciding it
+// has read everything in the stream.
+const logsIdle = 500 * time.Millisecond
+
+// handleLogs runs the "logs" REPL command, which re-reads the game logs
+// stream from a point in time and prints what it finds:
+//
+//	logs <duration>   for example "logs 10m", everything from that long ago
+//	logs <time>       everything since an RFC 3339 time
+//
+// The stream keeps every log ever published, whether or not game_logs has
+// already consumed it, so this doesn't take anything away from the writer.
+func handleLogs(ctx context.Context, conn pubsub.Connection, args []string) {
+	if len(args) != 1 {
+		fmt.Println("usage: logs <duration|RFC 3339 time>")
+		return
+	}
+	since, err := parseSince(args[0])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	started := time.Now()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	logs := make(chan routing.GameLog)
+	sub, err := pubsub.SubscribeMessages(
+		ctx,
+		conn,
+		routing.ExchangePerilTopic,
+		routing.QueueGameLogStream,
+		routing.GameLogSlug+".*",
+		pubsub.SimpleQueueStream,
+		func(msg pubsub.Message[routing.GameLog]) pubsub.Acktype {
+			select {
+			case logs <- msg.Body:
+			case <-ctx.Done():
+			}
+			return pubsub.Ack
+		},
+		pubsub.WithCodec(pubsub.Gob),
+		pubsub.WithStreamOffset(pubsub.StreamFrom(since)),
+		pubsub.WithPrefetch(100),
+	)
+	if err != nil {
+		fmt.Printf("could not read the game logs stream: %v\n", err)
+		return
+	}
+	defer sub.Close()
+	// Deferred calls run in reverse, so this unblocks a handler waiting to hand over a log
+	// before Close waits for it to finish
+	defer cancel()
+
+	// A stream never ends, so stop once we've caught up: at the first log written after the
+	// command started, or when nothing more arrives for a moment
+	count := 0
+	idle := time.NewTimer(logsIdle)
+	defer idle.Stop()
+	for {
+		select {
+		case gamelog := <-logs:
+			if gamelog.CurrentTime.After(started) {
+				fmt.Printf("%d logs\n", count)
+				return
+			}
+			// Offsets by time are approximate, so the stream may start a little early
+			if !gamelog.CurrentTime.Before(since) {
+				fmt.Printf("%s %s: %s\n", gamelog.CurrentTime.Format(time.RFC3339), gamelog.Username, gamelog.Message)
+				count++
+			}
+			idle.Reset(logsIdle)
+		case <-idle.C:
+			fmt.Printf("%d logs\n", count)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// parseSince reads the argument to "logs": a duration back from now, or an
+// absolute time.
+func parseSince(arg string) (time.Time, error) {
+	if d, err := time.ParseDuration(arg); err == nil {
+		if d < 0 {
+			return time.Time{}, fmt.Errorf("%s is in the future", arg)
+		}
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, arg)
+	if err != nil {
+		if strings.ContainsAny(arg, "-:T") {
+			return time.Time{}, fmt.Errorf("could not parse %q as an RFC 3339 time, for example 2006-01-02T15:04:05Z", arg)
+		}
+		return time.Time{}, fmt.Errorf("could not parse %q as a duration, for example 10m or 2h", arg)
+	}
+	return t, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// gameState is what the server has seen of the game, for answering the
+// clients' RPC queries. It watches pause messages (whichever server sent
+// them) and army moves rather than relying on its own REPL, so every
+// server started by multiserver.sh gives the same answers.
+type gameState struct {
+	mu      sync.Mutex
+	paused  bool
+	players map[string]routing.PlayerSummary
+}
+
+func newGameState() *gameState {
+	return &gameState{players: map[string]routing.PlayerSummary{}}
+}
+
+// seen records that a player was active, and how many units they have if
+// we know.
+func (s *gameState) seen(username string, units int) {
+	if username == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.players[username]
+	p.Username = username
+	if units >= 0 {
+		p.Units = units
+	}
+	p.LastSeen = time.Now()
+	s.players[username] = p
+}
+
+// serveRPC starts watching the game and answering the who and pausestate
+// queries, logging to logger. The returned subscriptions should be closed on
+// shutdown.
+func serveRPC(ctx context.Context, conn pubsub.Connection, logger *slog.Logger) ([]*pubsub.Subscription, error) {
+	state := newGameState()
+	var subs []*pubsub.Subscription
+	fail := func(err error) ([]*pubsub.Subscription, error) {
+		for _, sub := range subs {
+			sub.Close()
+		}
+		return nil, err
+	}
+	// Queues of our own (named after the process, as several servers may be running) so that
+	// we see every message rather than competing for them:
+	watchQueue := fmt.Sprintf("server.%d", os.Getpid())
+
+	sub, err := pubsub.SubscribeMessages(
+		ctx,
+		conn,
+		routing.ExchangePerilDirect,
+		routing.PauseKey+"."+watchQueue,
+		routing.PauseKey,
+		pubsub.SimpleQueueTransient,
+		withMiddleware(logger, pubsub.BodyHandler(func(ps routing.PlayingState) pubsub.Acktype {
+			state.mu.Lock()
+			state.paused = ps.IsPaused
+			state.mu.Unlock()
+			return pubsub.Ack
+		})),
+		pubsub.WithCodec(pubsub.JSON),
+		pubsub.WithLogger(logger),
+	)
+	if err != nil {
+		return fail(fmt.Errorf("could not watch pause state: %v", err))
+	}
+	subs = append(subs, sub)
+
+	sub, err = pubsub.SubscribeMessages(
+		ctx,
+		conn,
+		routing.ExchangePerilTopic,
+		routing.ArmyMovesPrefix+"."+watchQueue,
+		routing.ArmyMovesPrefix+".*",
+		pubsub.SimpleQueueTransient,
+		withMiddleware(logger, pubsub.BodyHandler(func(move gamelogic.ArmyMove) pubsub.Acktype {
+			state.seen(move.Player.Username, len(move.Player.Units))
+			return pubsub.Ack
+		})),
+		pubsub.WithCodec(pubsub.JSON),
+		pubsub.WithLogger(logger),
+		// Like a client's, the queue only keeps moves that are still recent
+		pubsub.WithQueueOptions(pubsub.QueueOptions{
+			MessageTTL: routing.ArmyMovesTTL,
+			MaxLength:  routing.ArmyMovesMaxLength,
+		}),
+	)
+	if err != nil {
+		return fail(fmt.Errorf("could not watch army moves: %v", err))
+	}
+	subs = append(subs, sub)
+
+	sub, err = pubsub.ServeRPC(ctx, conn, routing.ExchangePerilDirect, routing.RPCWhoKey,
+		func(msg pubsub.Message[routing.WhoRequest]) (routing.WhoResponse, error) {
+			// Asking counts as being active, though we don't learn anything about units
+			state.seen(msg.Header(routing.HeaderPlayer), -1)
+			state.mu.Lock()
+			defer state.mu.Unlock()
+			resp := routing.WhoResponse{Players: []routing.PlayerSummary{}}
+			for _, p := range state.players {
+				resp.Players = append(resp.Players, p)
+			}
+			sort.Slice(resp.Players, func(i, j int) bool {
+				return resp.Players[i].Username < resp.Players[j].Username
+			})
+			return resp, nil
+		},
+		pubsub.WithLogger(logger),
+	)
+	if err != nil {
+		return fail(fmt.Errorf("could not serve %s: %v", routing.RPCWhoKey, err))
+	}
+	subs = append(subs, sub)
+
+	sub, err = pubsub.ServeRPC(ctx, conn, routing.ExchangePerilDirect, routing.RPCPauseStateKey,
+		func(msg pubsub.Message[routing.PauseStateRequest]) (routing.PlayingState, error) {
+			state.seen(msg.Header(routing.HeaderPlayer), -1)
+			state.mu.Lock()
+			defer state.mu.Unlock()
+			return routing.PlayingState{IsPaused: state.paused}, nil
+		},
+		pubsub.WithLogger(logger),
+	)
+	if err != nil {
+		return fail(fmt.Errorf("could not serve %s: %v", routing.RPCPauseStateKey, err))
+	}
+	return append(subs, sub), nil
+}
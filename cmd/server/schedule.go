@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// handlePauseFor runs "pause for <duration>": it pauses the game now and
+// schedules the resume, which the broker delivers even if the server has
+// gone by then.
+func handlePauseFor(ctx context.Context, publishCh, scheduleCh pubsub.Sender, args []string) {
+	if len(args) != 2 || args[0] != "for" {
+		fmt.Println("usage: pause [for <duration>]")
+		return
+	}
+	d, err := time.ParseDuration(args[1])
+	if err != nil || d <= 0 {
+		fmt.Printf("could not parse %q as a duration, for example 30s or 5m\n", args[1])
+		return
+	}
+	if err := publishPlayingState(ctx, publishCh, true); err != nil {
+		fmt.Printf("could not pause the game: %v\n", err)
+		return
+	}
+	fmt.Println("Pause message sent!")
+	if err := publishPlayingState(ctx, scheduleCh, false, pubsub.WithDelay(d)); err != nil {
+		fmt.Printf("could not schedule the resume, so the game stays paused: %v\n", err)
+		return
+	}
+	fmt.Printf("The game resumes at %s\n", time.Now().Add(d).Format(time.TimeOnly))
+}
+
+// handleResumeAt runs "resume at <time>", which schedules a resume for a
+// time of day (the next one to come round) or an RFC 3339 time.
+func handleResumeAt(ctx context.Context, scheduleCh pubsub.Sender, args []string) {
+	if len(args) != 2 || args[0] != "at" {
+		fmt.Println("usage: resume [at <time>]")
+		return
+	}
+	at, err := parseAt(args[1], time.Now())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := publishPlayingState(ctx, scheduleCh, false, pubsub.WithDeliverAt(at)); err != nil {
+		fmt.Printf("could not schedule the resume: %v\n", err)
+		return
+	}
+	fmt.Printf("The game resumes at %s\n", at.Format(time.DateTime))
+}
+
+// handleScheduled runs "scheduled", which lists the messages waiting to be
+// delivered, with the IDs that "cancel" takes.
+func handleScheduled(scheduler *pubsub.Scheduler) {
+	scheduled, err := scheduler.Scheduled()
+	if err != nil {
+		fmt.Printf("could not read scheduled messages: %v\n", err)
+		return
+	}
+	if len(scheduled) == 0 {
+		fmt.Println("Nothing is scheduled")
+		return
+	}
+	for _, m := range scheduled {
+		fmt.Printf(
+			"%s: %s via %s at %s (in %s): %s\n",
+			m.ID,
+			m.RoutingKey,
+			m.Exchange,
+			m.At.Format(time.DateTime),
+			time.Until(m.At).Round(time.Second),
+			decodeBody(m.RoutingKey, m.Body, m.Decode),
+		)
+	}
+}
+
+// handleCancel runs "cancel <id>...", which stops scheduled messages from
+// being delivered.
+func handleCancel(scheduler *pubsub.Scheduler, ids []string) {
+	if len(ids) == 0 {
+		fmt.Println("usage: cancel <id>... (see scheduled)")
+		return
+	}
+	n, err := scheduler.Cancel(ids...)
+	if err != nil {
+		fmt.Printf("could not cancel scheduled messages: %v\n", err)
+	}
+	fmt.Printf("Cancelled %d of %d scheduled messages\n", n, len(ids))
+}
+
+// publishPlayingState tells the clients whether the game is paused.
+func publishPlayingState(ctx context.Context, ch pubsub.Sender, paused bool, opts ...pubsub.PublishOption) error {
+	return pubsub.PublishJSONWithContext(
+		ctx,
+		ch,
+		routing.ExchangePerilDirect,
+		routing.PauseKey,
+		routing.PlayingState{IsPaused: paused},
+		opts...,
+	)
+}
+
+// parseAt parses a time of day, such as 18:30, as the next time it comes
+// round after now, or else an RFC 3339 time, which must be in the future.
+func parseAt(arg string, now time.Time) (time.Time, error) {
+	for _, layout := range []string{"15:04", time.TimeOnly} {
+		clock, err := time.ParseInLocation(layout, arg, now.Location())
+		if err != nil {
+			continue
+		}
+		at := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), clock.Second(), 0, now.Location())
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+		return at, nil
+	}
+	at, err := time.Parse(time.RFC3339, arg)
+	if err != nil {
+		if strings.Contains(arg, "T") {
+			return time.Time{}, fmt.Errorf("could not parse %q as an RFC 3339 time, for example 2006-01-02T15:04:05Z", arg)
+		}
+		return time.Time{}, fmt.Errorf("could not parse %q as a time of day, for example 18:30", arg)
+	}
+	if !at.After(now) {
+		return time.Time{}, fmt.Errorf("%s is in the past", arg)
+	}
+	return at, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestParseAt(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		arg  string
+		want time.Time
+		err  string
+	}{
+		{arg: "18:30", want: time.Date(2026, 3, 10, 18, 30, 0, 0, time.UTC)},
+		{arg: "12:00:30", want: time.Date(2026, 3, 10, 12, 0, 30, 0, time.UTC)},
+		// A time of day that has gone by today is tomorrow's
+		{arg: "11:00", want: time.Date(2026, 3, 11, 11, 0, 0, 0, time.UTC)},
+		{arg: "12:00", want: time.Date(2026, 3, 11, 12, 0, 0, 0, time.UTC)},
+		{arg: "00:00", want: time.Date(2026, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{arg: "2026-03-10T12:00:01Z", want: time.Date(2026, 3, 10, 12, 0, 1, 0, time.UTC)},
+		{arg: "2026-03-10T13:00:00+02:00", err: "in the past"},
+		{arg: "2026-03-10T12:00:00Z", err: "in the past"},
+		{arg: "2025-01-01T00:00:00Z", err: "in the past"},
+		{arg: "2026-13-01T00:00:00Z", err: "RFC 3339"},
+		{arg: "25:00", err: "time of day"},
+		{arg: "6pm", err: "time of day"},
+		{arg: "", err: "time of day"},
+	}
+	for _, tt := range tests {
+		got, err := parseAt(tt.arg, now)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseAt(%q) = %v, %v, want an error mentioning %q", tt.arg, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("parseAt(%q) = %v, %v, want %v", tt.arg, got, err, tt.want)
+		}
+	}
+}
+
+// testPauses is a broker with the default topology, a scheduler on it and
+// a queue that gets every pause message.
+type testPauses struct {
+	ch        pubsub.Channel
+	scheduler *pubsub.Scheduler
+	states    <-chan amqp.Delivery
+}
+
+func newTestPauses(t *testing.T) *testPauses {
+	t.Helper()
+	conn, err := pubsub.NewMemoryBroker().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := pubsub.ApplyTopology(conn, pubsub.DefaultTopology()); err != nil {
+		t.Fatal(err)
+	}
+	scheduler, err := pubsub.NewScheduler(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { scheduler.Close() })
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ch.Close() })
+	if _, err := ch.QueueDeclare("pauses", false, true, true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("pauses", routing.PauseKey, routing.ExchangePerilDirect, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	states, err := ch.Consume("pauses", "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testPauses{ch: ch, scheduler: scheduler, states: states}
+}
+
+// next returns whether the next pause message pauses the game, waiting up
+// to within.
+func (p *testPauses) next(t *testing.T, within time.Duration) (bool, bool) {
+	t.Helper()
+	select {
+	case d := <-p.states:
+		return strings.Contains(string(d.Body), "true"), true
+	case <-time.After(within):
+		return false, false
+	}
+}
+
+// "pause for" pauses now and resumes once the time is up.
+func TestPauseFor(t *testing.T) {
+	p := newTestPauses(t)
+	start := time.Now()
+	handlePauseFor(context.Background(), p.ch, p.scheduler, []string{"for", "1s"})
+
+	if paused, ok := p.next(t, time.Second); !ok || !paused {
+		t.Fatal("the game wasn't paused straight away")
+	}
+	scheduled, err := p.scheduler.Scheduled()
+	if err != nil || len(scheduled) != 1 || scheduled[0].RoutingKey != routing.PauseKey {
+		t.Fatalf("scheduled %+v (%v), want the resume", scheduled, err)
+	}
+	if paused, ok := p.next(t, 5*time.Second); !ok || paused {
+		t.Fatal("the game wasn't resumed")
+	}
+	if took := time.Since(start); took < time.Second {
+		t.Fatalf("resumed after %v, want a second", took)
+	}
+
+	// Nothing is published for bad arguments
+	for _, args := range [][]string{{"for"}, {"until", "1s"}, {"for", "soon"}, {"for", "-1s"}} {
+		handlePauseFor(context.Background(), p.ch, p.scheduler, args)
+	}
+	if _, ok := p.next(t, 20*time.Millisecond); ok {
+		t.Fatal("pause with bad arguments published")
+	}
+}
+
+// A resume scheduled with "resume at" is listed by "scheduled", and
+// "cancel" stops it being delivered.
+func TestResumeAtCancel(t *testing.T) {
+	p := newTestPauses(t)
+	at := time.Now().Add(time.Hour).Format(time.RFC3339)
+	handleResumeAt(context.Background(), p.scheduler, []string{"at", at})
+	handleResumeAt(context.Background(), p.scheduler, []string{"at", "yesterday"})
+
+	scheduled, err := p.scheduler.Scheduled()
+	if err != nil || len(scheduled) != 1 {
+		t.Fatalf("scheduled %+v (%v), want one resume", scheduled, err)
+	}
+	if got := scheduled[0].At.Format(time.RFC3339); got != at {
+		t.Fatalf("resume scheduled at %s, want %s", got, at)
+	}
+	handleScheduled(p.scheduler)
+
+	handleCancel(p.scheduler, []string{scheduled[0].ID})
+	if scheduled, err := p.scheduler.Scheduled(); err != nil || len(scheduled) != 0 {
+		t.Fatalf("scheduled %+v (%v) after cancelling, want nothing", scheduled, err)
+	}
+	if _, ok := p.next(t, 20*time.Millisecond); ok {
+		t.Fatal("resume at published straight away")
+	}
+}
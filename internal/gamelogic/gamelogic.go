@@ -21,6 +21,8 @@ func PrintClientHelp() {
 	fmt.Println("* spam <n>")
 	fmt.Println("    example:")
 	fmt.Println("    spam 5")
+	fmt.Println("* who")
+	fmt.Println("* pausestate")
 	fmt.Println("* quit")
 	fmt.Println("* help")
 }
@@ -40,8 +42,20 @@ func ClientWelcome() (string, error) {
 
 func PrintServerHelp() {
 	fmt.Println("Possible commands:")
-	fmt.Println("* pause")
-	fmt.Println("* resume")
+	fmt.Println("* pause [for <duration>]")
+	fmt.Println("* resume [at <time>]")
+	fmt.Println("    example:")
+	fmt.Println("    pause for 5m")
+	fmt.Println("    resume at 18:30")
+	fmt.Println("* scheduled")
+	fmt.Println("* cancel <id>")
+	fmt.Println("* dlq list")
+	fmt.Println("* dlq show <n>")
+	fmt.Println("* dlq replay <n|all>")
+	fmt.Println("* dlq purge")
+	fmt.Println("* logs <duration|time>")
+	fmt.Println("    example:")
+	fmt.Println("    logs 10m")
 	fmt.Println("* quit")
 	fmt.Println("* help")
 }
@@ -58,6 +72,23 @@ func GetInput() []string {
 	return strings.Fields(line)
 }
 
+// ReadInput calls GetInput in a loop on its own goroutine and sends each
+// line of words on the returned channel, so a REPL can wait for input and
+// for shutdown at the same time. Once stdin is closed nothing more is sent.
+func ReadInput() <-chan []string {
+	inputs := make(chan []string)
+	go func() {
+		for {
+			words := GetInput()
+			if words == nil {
+				return
+			}
+			inputs <- words
+		}
+	}()
+	return inputs
+}
+
 func GetMaliciousLog() string {
 	possibleLogs := []string{
 		"Never interrupt your enemy when he is making a mistake.",
@@ -1,6 +1,7 @@
 package gamelogic
 
 import (
+	"log/slog"
 	"sync"
 )
 
@@ -8,6 +9,7 @@ type GameState struct {
 	Player Player
 	Paused bool
 	mu     *sync.RWMutex
+	logger *slog.Logger
 }
 
 func NewGameState(username string) *GameState {
@@ -21,6 +23,25 @@ func NewGameState(username string) *GameState {
 	}
 }
 
+// SetLogger sets where the handlers log what they made of each move, war
+// and pause, apart from what they print for the player. Every record has
+// the player's username. The default is slog.Default().
+func (gs *GameState) SetLogger(logger *slog.Logger) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.logger = logger
+}
+
+func (gs *GameState) log() *slog.Logger {
+	gs.mu.RLock()
+	logger := gs.logger
+	gs.mu.RUnlock()
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return logger.With(slog.String("username", gs.Player.Username))
+}
+
 func (gs *GameState) resumeGame() {
 	gs.mu.Lock()
 	defer gs.mu.Unlock()
@@ -39,6 +60,10 @@ func (gs *GameState) isPaused() bool {
 	return gs.Paused
 }
 
+func (gs *GameState) IsPaused() bool {
+	return gs.isPaused()
+}
+
 func (gs *GameState) addUnit(u Unit) {
 	gs.mu.Lock()
 	defer gs.mu.Unlock()
@@ -2,22 +2,28 @@ package gamelogic
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"time"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
 )
 
-const logsFile = "game.log"
+// LogsFile is where WriteLog appends game logs.
+var LogsFile = "game.log"
 
 const writeToDiskSleep = 1 * time.Second
 
-func WriteLog(gamelog routing.GameLog) error {
-	log.Printf("received game log...")
+// WriteLog appends a game log to LogsFile. It notes each one at debug
+// level on logger, slog.Default() if nil.
+func WriteLog(logger *slog.Logger, gamelog routing.GameLog) error {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.Debug("writing game log", slog.String("username", gamelog.Username), slog.String("file", LogsFile))
 	time.Sleep(writeToDiskSleep)
 
-	f, err := os.OpenFile(logsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := os.OpenFile(LogsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return fmt.Errorf("could not open logs file: %v", err)
 	}
@@ -3,6 +3,7 @@ package gamelogic
 import (
 	"errors"
 	"fmt"
+	"log/slog"
 	"strconv"
 )
 
@@ -14,8 +15,28 @@ const (
 	MoveOutcomeMakeWar
 )
 
-func (gs *GameState) HandleMove(move ArmyMove) MoveOutcome {
+func (o MoveOutcome) String() string {
+	switch o {
+	case MoveOutcomeSamePlayer:
+		return "same-player"
+	case MoveOutComeSafe:
+		return "safe"
+	case MoveOutcomeMakeWar:
+		return "make-war"
+	}
+	return fmt.Sprintf("MoveOutcome(%d)", int(o))
+}
+
+func (gs *GameState) HandleMove(move ArmyMove) (outcome MoveOutcome) {
 	defer fmt.Println("------------------------")
+	defer func() {
+		gs.log().Debug("handled move",
+			slog.String("from", move.Player.Username),
+			slog.String("to", string(move.ToLocation)),
+			slog.Int("units", len(move.Units)),
+			slog.String("outcome", outcome.String()),
+		)
+	}()
 	player := gs.GetPlayerSnap()
 
 	fmt.Println()
@@ -2,12 +2,14 @@ package gamelogic
 
 import (
 	"fmt"
+	"log/slog"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
 )
 
 func (gs *GameState) HandlePause(ps routing.PlayingState) {
 	defer fmt.Println("------------------------")
+	gs.log().Info("handled pause", slog.Bool("paused", ps.IsPaused))
 	fmt.Println()
 	if ps.IsPaused {
 		fmt.Println("==== Pause Detected ====")
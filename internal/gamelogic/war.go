@@ -2,6 +2,7 @@ package gamelogic
 
 import (
 	"fmt"
+	"log/slog"
 )
 
 type WarOutcome int
@@ -14,8 +15,33 @@ const (
 	WarOutcomeDraw
 )
 
+func (o WarOutcome) String() string {
+	switch o {
+	case WarOutcomeNotInvolved:
+		return "not-involved"
+	case WarOutcomeNoUnits:
+		return "no-units"
+	case WarOutcomeYouWon:
+		return "you-won"
+	case WarOutcomeOpponentWon:
+		return "opponent-won"
+	case WarOutcomeDraw:
+		return "draw"
+	}
+	return fmt.Sprintf("WarOutcome(%d)", int(o))
+}
+
 func (gs *GameState) HandleWar(rw RecognitionOfWar) (outcome WarOutcome, winner string, loser string) {
 	defer fmt.Println("------------------------")
+	defer func() {
+		gs.log().Info("handled war",
+			slog.String("attacker", rw.Attacker.Username),
+			slog.String("defender", rw.Defender.Username),
+			slog.String("outcome", outcome.String()),
+			slog.String("winner", winner),
+			slog.String("loser", loser),
+		)
+	}()
 	fmt.Println()
 	fmt.Println("==== War Declared ====")
 	fmt.Printf("%s has declared war on %s!\n", rw.Attacker.Username, rw.Defender.Username)
@@ -0,0 +1,124 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Connection is the part of a broker connection that this package needs.
+// A RabbitMQ connection from Dial satisfies it, and so does a connection
+// from MemoryBroker.Dial, which lets the handlers in cmd/client and
+// cmd/server run without a live server.
+type Connection interface {
+	Channel() (Channel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	IsClosed() bool
+	Close() error
+}
+
+// Sender is anything a message can be published through. Publishing only
+// needs this one method, so PublishJSON and PublishGob accept it rather than
+// a whole Channel.
+type Sender interface {
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// Channel mirrors the methods of *amqp.Channel that we call. The method
+// sets are identical, so a real channel is used as-is.
+type Channel interface {
+	Sender
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// Make sure the real client keeps matching the interface:
+var _ Channel = (*amqp.Channel)(nil)
+
+// Dial connects to RabbitMQ at the given URL and returns the connection
+// behind the Connection interface.
+func Dial(url string) (Connection, error) {
+	return DialWith(url, DialOptions{})
+}
+
+// DialOptions are how to connect beyond what the URL says. The zero value
+// uses the URL alone.
+type DialOptions struct {
+	// TLS is used for amqps:// URLs instead of a default that trusts the
+	// system's CAs and sends no client certificate. See TLSFiles.
+	TLS *tls.Config
+	// Username and Password replace the ones in the URL where they're set,
+	// so that credentials can be kept out of it.
+	Username string
+	Password string
+	// External authenticates with the client certificate in TLS rather
+	// than a password, using RabbitMQ's EXTERNAL mechanism (the
+	// rabbitmq_auth_mechanism_ssl plugin).
+	External bool
+	// Logger is where a connection from DialReconnectingWith reports
+	// losing the broker and getting it back. The default is slog.Default().
+	Logger *slog.Logger
+}
+
+// DialWith connects to RabbitMQ at the given URL with opts.
+func DialWith(url string, opts DialOptions) (Connection, error) {
+	config, err := dialConfig(url, opts)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := amqp.DialConfig(url, config)
+	if err != nil {
+		return nil, err
+	}
+	return amqpConnection{conn}, nil
+}
+
+// dialConfig is what amqp.Dial would use for url, plus opts.
+func dialConfig(url string, opts DialOptions) (amqp.Config, error) {
+	config := amqp.Config{
+		Heartbeat:       10 * time.Second,
+		Locale:          "en_US",
+		TLSClientConfig: opts.TLS,
+	}
+	switch {
+	case opts.External:
+		config.SASL = []amqp.Authentication{&amqp.ExternalAuth{}}
+	case opts.Username != "" || opts.Password != "":
+		uri, err := amqp.ParseURI(url)
+		if err != nil {
+			return amqp.Config{}, err
+		}
+		if opts.Username != "" {
+			uri.Username = opts.Username
+		}
+		if opts.Password != "" {
+			uri.Password = opts.Password
+		}
+		config.SASL = []amqp.Authentication{uri.PlainAuth()}
+	}
+	return config, nil
+}
+
+// amqpConnection adapts *amqp.Connection, whose Channel method returns the
+// concrete *amqp.Channel type instead of our interface.
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+func (c amqpConnection) Channel() (Channel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		// Don't wrap a nil *amqp.Channel in a non-nil interface
+		return nil, err
+	}
+	return ch, nil
+}
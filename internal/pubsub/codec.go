@@ -0,0 +1,122 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"sync"
+)
+
+// Codec turns values into message bodies and back. Whatever a codec
+// encodes is published with its content type, and consumers use the
+// content type of each delivery to pick the codec that decodes it.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// The codecs that are registered out of the box.
+var (
+	JSON    Codec = jsonCodec{}
+	Gob     Codec = gobCodec{}
+	MsgPack Codec = msgpackCodec{}
+)
+
+// ErrUnknownContentType is returned when a message's content type has no
+// registered codec.
+var ErrUnknownContentType = errors.New("no codec registered for content type")
+
+var codecs = struct {
+	sync.RWMutex
+	byType map[string]Codec
+}{
+	byType: map[string]Codec{
+		JSON.ContentType():    JSON,
+		Gob.ContentType():     Gob,
+		MsgPack.ContentType(): MsgPack,
+	},
+}
+
+// RegisterCodec makes c available to consumers for messages with its
+// content type, replacing any codec registered for it before.
+func RegisterCodec(c Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.byType[c.ContentType()] = c
+}
+
+// CodecFor returns the codec registered for a content type. Parameters
+// such as "; charset=utf-8" are ignored.
+func CodecFor(contentType string) (Codec, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+	codecs.RLock()
+	defer codecs.RUnlock()
+	c, ok := codecs.byType[mediaType]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownContentType, contentType)
+	}
+	return c, nil
+}
+
+// Raw is a message body as it arrived. Subscribe with Raw as the body type
+// to handle messages of any content type without decoding them.
+type Raw []byte
+
+// decode unmarshals body with the codec for contentType, or with fallback
+// when the message doesn't say what it is. A Raw target gets the body as is.
+func decode[T any](contentType string, body []byte, fallback Codec) (T, error) {
+	var target T
+	if raw, ok := any(&target).(*Raw); ok {
+		*raw = body
+		return target, nil
+	}
+	codec := fallback
+	if contentType != "" {
+		c, err := CodecFor(contentType)
+		if err != nil {
+			return target, err
+		}
+		codec = c
+	}
+	if err := codec.Unmarshal(body, &target); err != nil {
+		return target, fmt.Errorf("could not decode %s: %w", codec.ContentType(), err)
+	}
+	return target, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return "application/json" }
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return "application/gob" }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	// Create a bytes buffer to collect the encoded data:
+	var buffer bytes.Buffer
+	// Build a gob encoder that writes into that buffer, and serialize v into gob format:
+	if err := gob.NewEncoder(&buffer).Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,204 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrPublishNacked means the broker refused to take responsibility for a
+// published message.
+var ErrPublishNacked = errors.New("broker nacked the publish")
+
+// ErrConfirmTimeout means the broker did not confirm a publish before the
+// ConfirmingSender's deadline.
+var ErrConfirmTimeout = errors.New("timed out waiting for publish confirmation")
+
+// UnroutableError is returned when the broker hands a mandatory message
+// back because no queue is bound to receive it.
+type UnroutableError struct {
+	Exchange  string
+	Key       string
+	ReplyCode uint16
+	ReplyText string
+}
+
+func (e *UnroutableError) Error() string {
+	return fmt.Sprintf("message to exchange %q with key %q was returned: %d %s", e.Exchange, e.Key, e.ReplyCode, e.ReplyText)
+}
+
+// confirmChannel is a channel that supports publisher confirms. Both
+// *amqp.Channel and the memory broker's channels provide it.
+type confirmChannel interface {
+	Channel
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+}
+
+// ConfirmingSender publishes with the mandatory flag set, on a channel in
+// confirm mode, and only returns once the broker has dealt with the message:
+//   - nil when the broker acked it and it reached at least one queue
+//   - an *UnroutableError when it was returned as unroutable
+//   - ErrPublishNacked when the broker nacked it
+//   - ErrConfirmTimeout when no answer came in time
+//
+// It is safe for concurrent use; publishes go out one at a time. It never
+// buffers, so on a ReconnectingConnection a publish during an outage fails
+// with ErrDisconnected and the caller decides what to do.
+type ConfirmingSender struct {
+	conn    Connection
+	timeout time.Duration
+
+	mu       sync.Mutex
+	ch       confirmChannel // opened on first use and after a failure
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	seq      uint64 // delivery tag of the last publish on ch
+}
+
+var _ Sender = (*ConfirmingSender)(nil)
+
+// NewConfirmingSender returns a sender that opens its own channel on conn
+// and waits up to timeout for each confirmation.
+func NewConfirmingSender(conn Connection, timeout time.Duration) (*ConfirmingSender, error) {
+	s := &ConfirmingSender{conn: conn, timeout: timeout}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Open the channel now so a broker without confirm support fails early
+	if _, err := s.channel(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// PublishWithContext publishes msg and waits for the broker's verdict. The
+// mandatory argument is ignored, as every publish is mandatory.
+func (s *ConfirmingSender) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch, err := s.channel()
+	if err != nil {
+		return err
+	}
+	if err := ch.PublishWithContext(ctx, exchange, key, true, immediate, msg); err != nil {
+		s.reset()
+		return err
+	}
+	s.seq++
+
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	returns := s.returns
+	var returned *amqp.Return
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				// Closed along with the channel; the confirms case reports it
+				returns = nil
+				continue
+			}
+			returned = &r
+		case c, ok := <-s.confirms:
+			if !ok {
+				s.reset()
+				return fmt.Errorf("channel closed before the publish was confirmed: %w", amqp.ErrClosed)
+			}
+			if c.DeliveryTag < s.seq {
+				continue
+			}
+			if !c.Ack {
+				return ErrPublishNacked
+			}
+			// The return for a message always arrives before its ack, so if
+			// there is one it is already waiting
+			if returned == nil && returns != nil {
+				select {
+				case r, ok := <-returns:
+					if ok {
+						returned = &r
+					}
+				default:
+				}
+			}
+			if returned != nil {
+				return &UnroutableError{
+					Exchange:  returned.Exchange,
+					Key:       returned.RoutingKey,
+					ReplyCode: returned.ReplyCode,
+					ReplyText: returned.ReplyText,
+				}
+			}
+			return nil
+		case <-timer.C:
+			// A late confirm would be mistaken for the next publish's, so
+			// start over on a new channel
+			s.reset()
+			return ErrConfirmTimeout
+		case <-ctx.Done():
+			s.reset()
+			return ctx.Err()
+		}
+	}
+}
+
+// Close closes the sender's channel.
+func (s *ConfirmingSender) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch == nil {
+		return nil
+	}
+	err := s.ch.Close()
+	s.ch = nil
+	return err
+}
+
+// channel returns the open confirm-mode channel, opening one if needed.
+// The caller holds s.mu.
+func (s *ConfirmingSender) channel() (confirmChannel, error) {
+	if s.ch != nil {
+		return s.ch, nil
+	}
+	raw, err := openDirectChannel(s.conn)
+	if err != nil {
+		return nil, fmt.Errorf("could not open channel: %w", err)
+	}
+	ch, ok := raw.(confirmChannel)
+	if !ok {
+		raw.Close()
+		return nil, fmt.Errorf("channel type %T does not support publisher confirms", raw)
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("could not put channel in confirm mode: %w", err)
+	}
+	s.ch = ch
+	s.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	s.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	s.seq = 0
+	return ch, nil
+}
+
+func (s *ConfirmingSender) reset() {
+	if s.ch != nil {
+		s.ch.Close()
+		s.ch = nil
+	}
+}
+
+// openDirectChannel opens a channel straight on the broker connection. For
+// a ReconnectingConnection that means the current underlying connection
+// rather than a managed channel, which would buffer during outages.
+func openDirectChannel(conn Connection) (Channel, error) {
+	if rc, ok := conn.(*ReconnectingConnection); ok {
+		return rc.directChannel()
+	}
+	return conn.Channel()
+}
@@ -0,0 +1,158 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func newTestConfirmingSender(t *testing.T, conn Connection, timeout time.Duration) *ConfirmingSender {
+	t.Helper()
+	s, err := NewConfirmingSender(conn, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestConfirmingSenderAck(t *testing.T) {
+	broker := NewMemoryBroker()
+	ch := memTestChannel(t, broker)
+	declareQueue(t, ch, "moves", nil, [2]string{"amq.topic", "moves.*"})
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s := newTestConfirmingSender(t, conn, time.Second)
+
+	for range 3 {
+		if err := PublishJSON(s, "amq.topic", "moves.alice", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := queueLength(t, broker, "moves"); n != 3 {
+		t.Fatalf("moves has %d messages, want 3", n)
+	}
+}
+
+// A publish no queue is bound for comes back as an UnroutableError, and
+// doesn't throw the next publish's confirm out of step.
+func TestConfirmingSenderReturn(t *testing.T) {
+	broker := NewMemoryBroker()
+	ch := memTestChannel(t, broker)
+	declareQueue(t, ch, "moves", nil, [2]string{"amq.topic", "moves.*"})
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s := newTestConfirmingSender(t, conn, time.Second)
+
+	// mandatory is set whatever the caller says
+	err = s.PublishWithContext(context.Background(), "amq.topic", "wars.alice", false, false, amqp.Publishing{})
+	var unroutable *UnroutableError
+	if !errors.As(err, &unroutable) {
+		t.Fatalf("unroutable publish = %v, want an UnroutableError", err)
+	}
+	if unroutable.Exchange != "amq.topic" || unroutable.Key != "wars.alice" || unroutable.ReplyCode != amqp.NoRoute {
+		t.Fatalf("returned %+v", unroutable)
+	}
+	if err := PublishJSON(s, "amq.topic", "moves.alice", 1); err != nil {
+		t.Fatalf("publish after a return: %v", err)
+	}
+	if n := queueLength(t, broker, "moves"); n != 1 {
+		t.Fatalf("moves has %d messages, want 1", n)
+	}
+}
+
+// A queue that's full and rejects publishes makes the broker nack them.
+func TestConfirmingSenderNack(t *testing.T) {
+	broker := NewMemoryBroker()
+	ch := memTestChannel(t, broker)
+	declareQueue(t, ch, "full", amqp.Table{"x-max-length": int64(1), "x-overflow": "reject-publish"})
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s := newTestConfirmingSender(t, conn, time.Second)
+
+	if err := PublishJSON(s, "", "full", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := PublishJSON(s, "", "full", 2); !errors.Is(err, ErrPublishNacked) {
+		t.Fatalf("publish to a full queue = %v, want ErrPublishNacked", err)
+	}
+	// The channel is still good once there's room
+	get(t, ch, "full").Ack(false)
+	if err := PublishJSON(s, "", "full", 3); err != nil {
+		t.Fatalf("publish after a nack: %v", err)
+	}
+}
+
+// A publish that closes the channel fails, and the next one opens a new
+// channel.
+func TestConfirmingSenderChannelClosed(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s := newTestConfirmingSender(t, conn, time.Second)
+
+	err = s.PublishWithContext(context.Background(), "no-such-exchange", "x", true, false, amqp.Publishing{})
+	if err == nil {
+		t.Fatal("publish to a missing exchange succeeded")
+	}
+	declareQueue(t, memTestChannel(t, broker), "q", nil)
+	if err := PublishJSON(s, "", "q", 1); err != nil {
+		t.Fatalf("publish after the channel closed: %v", err)
+	}
+}
+
+// silentConnection hands out channels whose confirms never arrive.
+type silentConnection struct {
+	Connection
+}
+
+func (c silentConnection) Channel() (Channel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return silentChannel{ch.(*memChannel)}, nil
+}
+
+type silentChannel struct {
+	*memChannel
+}
+
+func (ch silentChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	return confirm
+}
+
+func TestConfirmingSenderTimeout(t *testing.T) {
+	broker := NewMemoryBroker()
+	declareQueue(t, memTestChannel(t, broker), "q", nil)
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s := newTestConfirmingSender(t, silentConnection{conn}, 20*time.Millisecond)
+
+	if err := PublishJSON(s, "", "q", 1); !errors.Is(err, ErrConfirmTimeout) {
+		t.Fatalf("publish without a confirm = %v, want ErrConfirmTimeout", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := PublishJSONWithContext(ctx, s, "", "q", 1); !errors.Is(err, context.Canceled) {
+		t.Fatalf("publish with a cancelled context = %v, want context.Canceled", err)
+	}
+}
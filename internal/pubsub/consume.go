@@ -1,191 +1,467 @@
-package pubsub
-
-import (
-	"fmt"
-	"encoding/json"
-	"bytes"
-	"encoding/gob"
-
-	amqp "github.com/rabbitmq/amqp091-go"
-)
-
-// Define AckType:
-type Acktype int
-
-// Define your SimpleQueueType
-type SimpleQueueType int
-
-// Define the constants for your enum:
-const (
-	SimpleQueueDurable SimpleQueueType = iota
-	SimpleQueueTransient
-)
-
-// declares a named type Acktype:
-// iota auto-increments starting at 0 within the block
-const (
-	Ack Acktype = iota	// 0
-	NackDiscard			// 1
-	NackRequeue			// 2
-)
-
-/* In your internal/pubsub package, create a new function called SubscribeJSON, here's my 
-function signature: */
-func SubscribeJSON[T any](
-    conn *amqp.Connection,
-    exchange,
-    queueName,
-    key string,
-    queueType SimpleQueueType, // an enum to represent "durable" or "transient"
-	// Update your internal/pubsub.SubscribeJSON function's handler parameter to return an 
-	// "acktype" instead of nothing:
-    handler func(T) Acktype,
-	) error {
-	return subscribe[T](
-		conn,
-		exchange,
-		queueName,
-		key,
-		queueType,
-		handler,
-		func(data []byte) (T, error) {
-			var target T
-			err := json.Unmarshal(data, &target)
-			return target, err
-		},
-	)
-}
-
-func SubscribeGob[T any](
-	conn *amqp.Connection,
-	exchange,
-	queueName,
-	key string,
-	queueType SimpleQueueType,
-	handler func(T) Acktype,
-) error {
-	return subscribe[T](
-		conn,
-		exchange,
-		queueName,
-		key,
-		queueType,
-		handler,
-		// an anonymous “unmarshaller” function. It takes raw bytes and returns a value of 
-		// generic type T plus an error:
-		func(data []byte) (T, error) {			
-			buffer := bytes.NewBuffer(data)		// Create a buffer over the bytes	 
-			decoder := gob.NewDecoder(buffer)	// Builds a gob decoder on that buffer
-			var target T						// Declares zero value var target T
-			err := decoder.Decode(&target)		// Decodes the gob bytes into target via decoder.Decode(&target)
-			return target, err					// Returns the decoded value and the decode error
-		},
-	)
-}
-
-func subscribe[T any](
-	conn *amqp.Connection,
-	exchange,
-	queueName,
-	key string,
-	queueType SimpleQueueType,
-	handler func(T) Acktype,
-	unmarshaller func([]byte) (T, error),
-) error {
-	// Call DeclareAndBind to make sure that the given queue exists and is bound to the exchange:
-	ch, queue, err := DeclareAndBind(conn, exchange, queueName, key, queueType)
-	if err != nil {
-		return fmt.Errorf("could not declare and bind queue: %v", err)
-	}
-	ch.Qos(10, 0, false)
-	/* Get a new chan of amqp.Delivery structs by using the channel.Consume method.
-		- Use an empty string for the consumer name so that it will be auto-generated
-		- Set all other parameters to false/nil */
-	msgs, err := ch.Consume(
-		queue.Name, // queue
-		"",         // consumer
-		false,      // auto-ack
-		false,      // exclusive
-		false,      // no-local
-		false,      // no-wait
-		nil,        // args
-	)
-	if err != nil {
-		return fmt.Errorf("could not consume messages: %v", err)
-	}
-	// Start a goroutine that ranges over the channel of deliveries:
-	go func() {
-		// make sure to close the channel when the goroutine ends:
-		defer ch.Close()
-		for msg := range msgs {
-			// Unmarshal the body (raw bytes) of each message delivery into the (generic) T type:
-			target, err := unmarshaller(msg.Body)
-			if err != nil {
-				fmt.Printf("could not unmarshal message: %v\n", err)
-				continue
-			}
-			// Call the given handler function with the unmarshaled message:
-			// (handler is passed in as a function parameter)
-			// For testing/debugging purposes, add a log statement alongside each Ack/Nack call 
-			// to indicate which action occurred
-			switch handler(target) {
-			// Ack: msg.Ack(false):
-			// Processed successfully
-			case Ack:
-				msg.Ack(false)
-			// NackDiscard: msg.Nack(false, false):
-			// Not processed successfully, and should be discarded (to a dead-letter queue 
-			// if configured or just deleted entirely)
-			case NackDiscard:
-				msg.Nack(false, false)
-			// msg.Nack(false, true):
-			// Not processed successfully, but should be requeued on the same queue to be 
-			// processed again (retry)
-			case NackRequeue:
-				msg.Nack(false, true)
-			}
-		}
-	}()
-	// return nil, since there was no error:
-	return nil
-}
-
-	// Declare and bind a transient queue by creating and using a new function in the 
-	// internal/pubsub package:
-	func DeclareAndBind(
-	conn *amqp.Connection,
-	exchange,
-	queueName,
-	key string,
-	queueType SimpleQueueType, // an enum to represent "durable" or "transient"
-) (*amqp.Channel, amqp.Queue, error){
-	// Create a new .Channel() on the connection:
-	ch, err := conn.Channel()
-	if err != nil {
-		return nil, amqp.Queue{}, fmt.Errorf("could not create channel: %v", err)
-	}
-
-	//Declare a new queue using .QueueDeclare():
-	queue, err := ch.QueueDeclare(
-		queueName,	// name
-		queueType == SimpleQueueDurable, 	// The durable parameter should only be true if queueType is durable
-		queueType != SimpleQueueDurable,	// The autoDelete parameter should be true if queueType is transient
-		queueType != SimpleQueueDurable,	// The exclusive parameter should be true if queueType is transient
-		false,		// The noWait parameter should be false
-		// RabbitMQ routes any rejected/expired messages from this queue to the specified 
-		// dead-letter exchange, which is bound to your dead-letter queue:
-		amqp.Table{
-			"x-dead-letter-exchange": "peril_dlx",	// Dead-letter exchange
-		}, 		
-	)
-	if err != nil {
-		return nil, amqp.Queue{}, fmt.Errorf("could not declare queue: %v", err)
-	}
-	// Bind the queue to the exchange using .QueueBind():
-	err = ch.QueueBind(queue.Name, key, exchange, false, nil)
-	if err != nil {
-		return nil, amqp.Queue{}, fmt.Errorf("could not bind queue: %v", err)
-	}
-	// Return the channel and queue
-	return ch, queue, nil
-}
\ No newline at end of file
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Define AckType:
+type Acktype int
+
+// Define your SimpleQueueType
+type SimpleQueueType int
+
+// Define the constants for your enum:
+const (
+	SimpleQueueDurable SimpleQueueType = iota
+	SimpleQueueTransient
+	// A replicated queue that survives losing a broker node. WithDeliveryLimit caps how many 
+	// times a message can come back unsettled before it is dead-lettered:
+	SimpleQueueQuorum
+	// An append-only log. Messages stay in it after they are acked, and every subscriber 
+	// reads all of them from the position WithStreamOffset gives (new messages only, by 
+	// default). Nacks neither requeue nor dead-letter, so stream handlers should just Ack:
+	SimpleQueueStream
+	// A non-durable queue that any number of consumers share, deleted once the last of them
+	// goes. Nothing piles up in it while nobody is listening, and a mandatory publish to it
+	// comes back unroutable instead:
+	SimpleQueueShared
+)
+
+// declares a named type Acktype:
+// iota auto-increments starting at 0 within the block
+const (
+	Ack Acktype = iota	// 0
+	NackDiscard			// 1
+	NackRequeue			// 2
+	// Not processed successfully, try again after a delay. Once the retries run out the 
+	// message is dead-lettered (see RetryPolicy):
+	NackRetryLater		// 3
+)
+
+func (a Acktype) String() string {
+	switch a {
+	case Ack:
+		return "ack"
+	case NackDiscard:
+		return "nack-discard"
+	case NackRequeue:
+		return "nack-requeue"
+	case NackRetryLater:
+		return "nack-retry-later"
+	}
+	return fmt.Sprintf("Acktype(%d)", int(a))
+}
+
+/* In your internal/pubsub package, create a new function called SubscribeJSON, here's my 
+function signature: */
+// SubscribeJSON runs until the process exits; use SubscribeJSONWithContext to be able to 
+// stop it:
+func SubscribeJSON[T any](
+    conn Connection,
+    exchange,
+    queueName,
+    key string,
+    queueType SimpleQueueType, // an enum to represent "durable" or "transient"
+	// Update your internal/pubsub.SubscribeJSON function's handler parameter to return an 
+	// "acktype" instead of nothing:
+    handler func(T) Acktype,
+	opts ...SubscribeOption,
+	) error {
+	_, err := SubscribeJSONWithContext(context.Background(), conn, exchange, queueName, key, queueType, handler, opts...)
+	return err
+}
+
+// SubscribeJSONWithContext is SubscribeJSON with a handle: cancelling ctx (or calling Close on 
+// the returned Subscription) stops consuming, lets the running handler finish and settles its 
+// ack before the channel is closed:
+func SubscribeJSONWithContext[T any](
+	ctx context.Context,
+	conn Connection,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(T) Acktype,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	// Messages are decoded according to their content type; JSON is only assumed for ones 
+	// that don't have one:
+	return Subscribe(ctx, conn, exchange, queueName, key, queueType, handler, append([]SubscribeOption{WithCodec(JSON)}, opts...)...)
+}
+
+func SubscribeGob[T any](
+	conn Connection,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(T) Acktype,
+	opts ...SubscribeOption,
+) error {
+	_, err := SubscribeGobWithContext(context.Background(), conn, exchange, queueName, key, queueType, handler, opts...)
+	return err
+}
+
+// SubscribeGobWithContext is the gob counterpart of SubscribeJSONWithContext:
+func SubscribeGobWithContext[T any](
+	ctx context.Context,
+	conn Connection,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(T) Acktype,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return Subscribe(ctx, conn, exchange, queueName, key, queueType, handler, append([]SubscribeOption{WithCodec(Gob)}, opts...)...)
+}
+
+// Subscribe consumes queueName, decoding each delivery into a T with the codec registered for 
+// its content type (see RegisterCodec), and settles it according to what handler returns. 
+// Deliveries without a content type are decoded with the WithCodec option's codec, JSON by 
+// default:
+func Subscribe[T any](
+	ctx context.Context,
+	conn Connection,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(T) Acktype,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return SubscribeMessages(ctx, conn, exchange, queueName, key, queueType, BodyHandler(handler), opts...)
+}
+
+// SubscribeMessages is Subscribe for handlers that need more than the decoded body: the 
+// message ID and timestamp, who published it, its headers and routing key, and whether it 
+// has been delivered before:
+func SubscribeMessages[T any](
+	ctx context.Context,
+	conn Connection,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(Message[T]) Acktype,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	o, err := newSubscribeOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.checkQueueType(queueType); err != nil {
+		return nil, err
+	}
+	sub := newSubscription(ctx, queueName, o.logger)
+	_, reconnecting := conn.(*ReconnectingConnection)
+	// After a reconnect, a stream consumer carries on after the last message it acked rather 
+	// than going back to where it first started:
+	streamResume := &streamPosition{next: -1}
+	// start declares the queue and begins consuming from it. It is a closure so that a
+	// reconnecting connection can run it again after the broker comes back:
+	start := func(conn Connection) error {
+		// Nothing to (re)start once the subscription is shutting down:
+		if !sub.enter() {
+			return nil
+		}
+		// Call DeclareAndBind to make sure that the given queue exists and is bound to the exchange:
+		ch, queue, err := declareAndBind(conn, exchange, queueName, key, queueType, o.queueArgs())
+		if err != nil {
+			sub.exit()
+			return fmt.Errorf("could not declare and bind queue: %v", err)
+		}
+		// Publishing to an exchange that doesn't exist would close the channel, so make sure 
+		// the quarantine exchange is there:
+		if o.decodeFailure == DecodeFailureQuarantine {
+			err := ch.ExchangeDeclare(o.quarantine, amqp.ExchangeTopic, true, false, false, false, nil)
+			if err != nil {
+				ch.Close()
+				sub.exit()
+				return fmt.Errorf("could not declare quarantine exchange: %v", err)
+			}
+		}
+		// Limit how many unacked deliveries the broker pushes at us, so they don't all pile up
+		// in memory while the workers are busy:
+		if err := ch.Qos(o.prefetch, 0, false); err != nil {
+			ch.Close()
+			sub.exit()
+			return fmt.Errorf("could not set prefetch: %v", err)
+		}
+		// Ask to hear about the channel closing before consuming, so that if the consumer 
+		// stops we can tell why:
+		closes := ch.NotifyClose(make(chan *amqp.Error, 1))
+		// Name the consumer ourselves so that it can be cancelled on shutdown:
+		tag := "ctag-" + queue.Name
+		/* Get a new chan of amqp.Delivery structs by using the channel.Consume method.
+			- Set all other parameters to false/nil */
+		msgs, err := ch.Consume(
+			queue.Name, // queue
+			tag,        // consumer
+			false,      // auto-ack
+			false,      // exclusive
+			false,      // no-local
+			false,      // no-wait
+			o.consumeArgs(streamResume), // args
+		)
+		if err != nil {
+			ch.Close()
+			sub.exit()
+			return fmt.Errorf("could not consume messages: %v", err)
+		}
+		// NackRetryLater parks messages in delay queues, published through this channel:
+		retry := &retrier{
+			ch:      ch,
+			queue:   queue.Name,
+			durable: !queueType.temporary(),
+			policy:  o.retry,
+			logger:  sub.logger,
+		}
+		// And messages that can't be decoded are dealt with according to the policy:
+		poison := &poisonHandler{
+			ch:       ch,
+			queue:    queue.Name,
+			policy:   o.decodeFailure,
+			exchange: o.quarantine,
+			callback: o.onDecodeFailure,
+			retry:    retry,
+			counts:   &sub.decodeFailures,
+			logger:   sub.logger,
+		}
+		sub.logger.Debug("consuming",
+			slog.String("exchange", exchange),
+			slog.String("key", key),
+			slog.Int("prefetch", o.prefetch),
+			slog.Int("workers", o.workers),
+		)
+		// Start the workers. Each one reads deliveries until the subscription is stopped or 
+		// the deliveries run out:
+		var workers sync.WaitGroup
+		for i := 0; i < o.workers; i++ {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				for {
+					select {
+					case <-sub.ctx.Done():
+						return
+					case msg, ok := <-msgs:
+						// select picks at random when both are ready, so check again rather than 
+						// start on something new after being stopped. Unhandled deliveries are 
+						// requeued when the channel closes:
+						if !ok || sub.ctx.Err() != nil {
+							return
+						}
+						// A stream consumer that starts again carries on after the last message that 
+						// was acked. One that wasn't is read again, as a queue would redeliver it:
+						acked := handleDelivery(sub.logger, msg, handler, o.codec, retry, poison)
+						if offset, ok := tableInt(msg.Headers, streamOffsetHeader); ok && acked {
+							streamResume.seen(offset)
+						}
+					}
+				}
+			}()
+		}
+		stopped := make(chan struct{})
+		go func() {
+			workers.Wait()
+			close(stopped)
+		}()
+		// And one more goroutine to shut the consumer down once they're done:
+		go func() {
+			// make sure to close the channel when the goroutine ends. Anything delivered but not 
+			// yet handled goes back to the queue at that point:
+			defer sub.exit()
+			defer ch.Close()
+			select {
+			case <-sub.ctx.Done():
+				// Stop the broker sending us more, then wait for the handlers that are still 
+				// running to finish and settle their acks before the channel is closed:
+				ch.Cancel(tag, false)
+				<-stopped
+			case <-stopped:
+				// The deliveries ran out. If the connection went away and a ReconnectingConnection 
+				// is going to run start again, this is just a pause. Otherwise the subscription 
+				// is dead:
+				if sub.ctx.Err() == nil && (!reconnecting || !conn.IsClosed()) {
+					sub.fail(consumerStopped(queue.Name, closes))
+				}
+			}
+		}()
+		// return nil, since there was no error:
+		return nil
+	}
+	// A ReconnectingConnection keeps start and calls it again with every new connection,
+	// so the queue gets re-declared and re-bound and the consumer restarted:
+	if rc, ok := conn.(*ReconnectingConnection); ok {
+		unregister, err := rc.register(start)
+		if err != nil {
+			sub.Close()
+			return nil, err
+		}
+		sub.onStop(unregister)
+	} else if err := start(conn); err != nil {
+		sub.Close()
+		return nil, err
+	}
+	return sub, nil
+}
+
+// handleDelivery decodes one delivery, runs the handler on it and acks or nacks it as the 
+// handler asks. It reports whether the handler acked it:
+func handleDelivery[T any](logger *slog.Logger, msg amqp.Delivery, handler func(Message[T]) Acktype, fallback Codec, retry *retrier, poison *poisonHandler) bool {
+	// Unmarshal the body (raw bytes) of each message delivery into the (generic) T type, with 
+	// the codec its content type calls for:
+	target, err := decode[T](msg.ContentType, msg.Body, fallback)
+	if err != nil {
+		// It won't decode any better next time, so it mustn't stay unacked or go back on the 
+		// queue:
+		logger.Warn("could not decode delivery",
+			deliveryAttrs(msg),
+			slog.String("content_type", msg.ContentType),
+			slog.String("policy", poison.policy.String()),
+			slog.Any("err", err),
+		)
+		poison.handle(msg, err)
+		return false
+	}
+	// Call the given handler function with the unmarshaled message:
+	// (handler is passed in as a function parameter)
+	ack := handler(newMessage(target, msg))
+	settle(logger, msg, ack, retry)
+	return ack == Ack
+}
+
+// settle acks or nacks a delivery the way an Acktype says, and logs how it went:
+func settle(logger *slog.Logger, msg amqp.Delivery, ack Acktype, retry *retrier) {
+	var err error
+	// For testing/debugging purposes, add a log statement alongside each Ack/Nack call 
+	// to indicate which action occurred
+	switch ack {
+	// Ack: msg.Ack(false):
+	// Processed successfully
+	case Ack:
+		err = msg.Ack(false)
+	// NackDiscard: msg.Nack(false, false):
+	// Not processed successfully, and should be discarded (to a dead-letter queue 
+	// if configured or just deleted entirely)
+	case NackDiscard:
+		err = msg.Nack(false, false)
+	// msg.Nack(false, true):
+	// Not processed successfully, but should be requeued on the same queue to be 
+	// processed again (retry)
+	case NackRequeue:
+		err = msg.Nack(false, true)
+	// Not processed successfully, come back to it later (or give up on it):
+	case NackRetryLater:
+		// retry settles it, and says if that goes wrong
+		retry.retry(msg)
+	}
+	if err != nil {
+		// The channel has gone, and the broker will deliver it again
+		logger.Warn("could not settle delivery", deliveryAttrs(msg), slog.String("ack", ack.String()), slog.Any("err", err))
+		return
+	}
+	logger.Debug("settled delivery", deliveryAttrs(msg), slog.String("ack", ack.String()))
+}
+
+// deliveryAttrs describe a delivery in a log record, as messageAttrs do a
+// decoded Message, plus its delivery tag. As with a Message, a retried one
+// has where it was first published rather than the delay queue's hop.
+func deliveryAttrs(msg amqp.Delivery) slog.Attr {
+	exchange, key := msg.Exchange, msg.RoutingKey
+	if ex, ok := msg.Headers[originalExchangeHeader].(string); ok {
+		exchange = ex
+		key, _ = msg.Headers[originalRoutingKeyHeader].(string)
+	}
+	return slog.Group("message",
+		slog.String("id", msg.MessageId),
+		slog.String("exchange", exchange),
+		slog.String("routing_key", key),
+		slog.Uint64("delivery_tag", msg.DeliveryTag),
+		slog.Bool("redelivered", msg.Redelivered),
+	)
+}
+
+	// Declare and bind a transient queue by creating and using a new function in the 
+	// internal/pubsub package:
+	func DeclareAndBind(
+	conn Connection,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType, // an enum to represent "durable" or "transient"
+) (Channel, amqp.Queue, error){
+	return declareAndBind(conn, exchange, queueName, key, queueType, nil)
+}
+
+// declareAndBind is DeclareAndBind with extra queue arguments, such as the delivery limit of 
+// a quorum queue:
+func declareAndBind(
+	conn Connection,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	extraArgs amqp.Table,
+) (Channel, amqp.Queue, error) {
+	// Create a new .Channel() on the connection:
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, amqp.Queue{}, fmt.Errorf("could not create channel: %v", err)
+	}
+
+	//Declare a new queue using .QueueDeclare():
+	queue, err := ch.QueueDeclare(
+		queueName,	// name
+		!queueType.temporary(), 	// The durable parameter should only be true if queueType is durable (quorum queues and streams always are)
+		queueType.temporary(),	// The autoDelete parameter should be true if queueType is transient or shared
+		queueType == SimpleQueueTransient,	// The exclusive parameter should be true if queueType is transient
+		false,		// The noWait parameter should be false
+		queueArgs(queueType, extraArgs),
+	)
+	if err != nil {
+		ch.Close()
+		return nil, amqp.Queue{}, declareQueueError(queueName, err)
+	}
+	// Bind the queue to the exchange using .QueueBind():
+	err = ch.QueueBind(queue.Name, key, exchange, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, amqp.Queue{}, fmt.Errorf("could not bind queue: %v", err)
+	}
+	// Return the channel and queue
+	return ch, queue, nil
+}
+// temporary reports whether queues of this type go away when nothing is using them:
+func (t SimpleQueueType) temporary() bool {
+	return t == SimpleQueueTransient || t == SimpleQueueShared
+}
+
+// queueArgs are the arguments DeclareAndBind declares a queue of queueType with, plus extra. 
+// DeclareAndBind has to be given the same ones every time, or the broker refuses the declare:
+func queueArgs(queueType SimpleQueueType, extra amqp.Table) amqp.Table {
+	args := amqp.Table{}
+	switch queueType {
+	case SimpleQueueQuorum:
+		args["x-queue-type"] = "quorum"
+	case SimpleQueueStream:
+		args["x-queue-type"] = "stream"
+	}
+	// RabbitMQ routes any rejected/expired messages from this queue to the specified 
+	// dead-letter exchange, which is bound to your dead-letter queue. Streams never 
+	// dead-letter anything:
+	if queueType != SimpleQueueStream {
+		args["x-dead-letter-exchange"] = routing.ExchangePerilDLX	// Dead-letter exchange (see DeclareDeadLetterQueue)
+	}
+	for k, v := range extra {
+		args[k] = v
+	}
+	return args
+}
@@ -0,0 +1,258 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DeclareDeadLetterQueue declares the dead-letter exchange that every queue
+// from DeclareAndBind points at, plus a durable queue bound to it, so that
+// nacked messages are kept instead of dropped. It is safe to call more than
+// once. On a ReconnectingConnection it is declared again after every
+// reconnect, in case the broker came back empty.
+func DeclareDeadLetterQueue(conn Connection) error {
+	return provision(conn, func(ch Channel) error {
+		// Fanout, so that whatever the dead-lettered message's routing key was, it ends up in
+		// the queue:
+		err := ch.ExchangeDeclare(routing.ExchangePerilDLX, amqp.ExchangeFanout, true, false, false, false, nil)
+		if err != nil {
+			return fmt.Errorf("could not declare exchange %s: %v", routing.ExchangePerilDLX, err)
+		}
+		_, err = ch.QueueDeclare(routing.QueuePerilDLQ, true, false, false, false, nil)
+		if err != nil {
+			return fmt.Errorf("could not declare queue %s: %v", routing.QueuePerilDLQ, err)
+		}
+		err = ch.QueueBind(routing.QueuePerilDLQ, "", routing.ExchangePerilDLX, false, nil)
+		if err != nil {
+			return fmt.Errorf("could not bind queue %s: %v", routing.QueuePerilDLQ, err)
+		}
+		return nil
+	})
+}
+
+// provision runs declare on a fresh channel. On a ReconnectingConnection it
+// runs again after every reconnect, before the subscriptions are restored.
+func provision(conn Connection, declare func(Channel) error) error {
+	run := func(conn Connection) error {
+		ch, err := conn.Channel()
+		if err != nil {
+			return fmt.Errorf("could not create channel: %v", err)
+		}
+		defer ch.Close()
+		return declare(ch)
+	}
+	if rc, ok := conn.(*ReconnectingConnection); ok {
+		_, err := rc.register(run)
+		return err
+	}
+	return run(conn)
+}
+
+// DeadLetter is a message waiting in a dead-letter queue, with what its
+// most recent x-death entry says about how it got there.
+type DeadLetter struct {
+	ContentType string
+	Body        []byte
+	Headers     amqp.Table
+
+	Exchange   string    // exchange it was originally published to
+	RoutingKey string    // routing key it was originally published with
+	Queue      string    // queue it was dead-lettered from
+	Reason     string    // rejected, expired, maxlen or delivery_limit
+	Count      int64     // times it died in Queue for Reason
+	Time       time.Time // when that last happened
+}
+
+// Decode unmarshals the body into v with the codec registered for its
+// content type.
+func (d DeadLetter) Decode(v any) error {
+	codec, err := CodecFor(d.ContentType)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(d.Body, v)
+}
+
+// InspectDeadLetters returns the messages in a dead-letter queue, oldest
+// first, without removing them.
+func InspectDeadLetters(conn Connection, queue string) ([]DeadLetter, error) {
+	ch, deliveries, err := getAll(conn, queue)
+	if err != nil {
+		return nil, err
+	}
+	// Closing the channel puts everything back where it was
+	defer ch.Close()
+	letters := make([]DeadLetter, len(deliveries))
+	for i, d := range deliveries {
+		letters[i] = newDeadLetter(d)
+	}
+	return letters, nil
+}
+
+// ReplayDeadLetters moves messages from a dead-letter queue back to the
+// queues they were dead-lettered from. positions are 1-based, in the order
+// InspectDeadLetters lists them; with none, every message is replayed. A
+// message is only removed from the dead-letter queue once the broker has
+// confirmed the replay, so on error the ones not yet replayed stay put. It
+// returns how many messages were replayed.
+func ReplayDeadLetters(ctx context.Context, conn Connection, queue string, positions ...int) (int, error) {
+	ch, deliveries, err := getAll(conn, queue)
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	selected := deliveries
+	if len(positions) > 0 {
+		selected = nil
+		seen := map[int]bool{}
+		for _, n := range positions {
+			if n < 1 || n > len(deliveries) {
+				return 0, fmt.Errorf("no dead letter at position %d, there are %d", n, len(deliveries))
+			}
+			if seen[n] {
+				continue
+			}
+			seen[n] = true
+			selected = append(selected, deliveries[n-1])
+		}
+	}
+	sender, err := NewConfirmingSender(conn, 5*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer sender.Close()
+
+	replayed := 0
+	for _, d := range selected {
+		letter := newDeadLetter(d)
+		if letter.Queue == "" {
+			return replayed, fmt.Errorf("a message with routing key %s has no x-death header, so there is nowhere to replay it to", d.RoutingKey)
+		}
+		// The default exchange routes straight to the queue it died in, so the other queues
+		// bound to the original exchange don't get it a second time
+		err := sender.PublishWithContext(ctx, "", letter.Queue, true, false, publishingFromDelivery(d))
+		if err != nil {
+			return replayed, fmt.Errorf("could not replay message to queue %s: %w", letter.Queue, err)
+		}
+		if err := d.Ack(false); err != nil {
+			return replayed, fmt.Errorf("message replayed to %s but could not be removed from %s: %v", letter.Queue, queue, err)
+		}
+		replayed++
+	}
+	return replayed, nil
+}
+
+// PurgeDeadLetters empties a dead-letter queue and returns how many
+// messages it dropped.
+func PurgeDeadLetters(conn Connection, queue string) (int, error) {
+	ch, err := openInspectChannel(conn)
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+	return ch.QueuePurge(queue, false)
+}
+
+// inspectChannel is a channel that can fetch and purge messages without a
+// consumer. Both *amqp.Channel and the memory broker's channels provide it.
+type inspectChannel interface {
+	Channel
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	QueuePurge(name string, noWait bool) (int, error)
+}
+
+func openInspectChannel(conn Connection) (inspectChannel, error) {
+	raw, err := openDirectChannel(conn)
+	if err != nil {
+		return nil, fmt.Errorf("could not open channel: %w", err)
+	}
+	ch, ok := raw.(inspectChannel)
+	if !ok {
+		raw.Close()
+		return nil, fmt.Errorf("channel type %T does not support basic.get", raw)
+	}
+	return ch, nil
+}
+
+// getAll takes every message in queue without acking any of them. They go
+// back to the queue, in order, when the returned channel is closed.
+func getAll(conn Connection, queue string) (inspectChannel, []amqp.Delivery, error) {
+	ch, err := openInspectChannel(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	var deliveries []amqp.Delivery
+	for {
+		d, ok, err := ch.Get(queue, false)
+		if err != nil {
+			ch.Close()
+			return nil, nil, fmt.Errorf("could not read queue %s: %w", queue, err)
+		}
+		if !ok {
+			return ch, deliveries, nil
+		}
+		deliveries = append(deliveries, d)
+	}
+}
+
+func newDeadLetter(d amqp.Delivery) DeadLetter {
+	letter := DeadLetter{
+		ContentType: d.ContentType,
+		Body:        d.Body,
+		Headers:     d.Headers,
+		Exchange:    d.Exchange,
+		RoutingKey:  d.RoutingKey,
+	}
+	// x-death has an entry per queue and reason, most recent first
+	deaths, _ := d.Headers["x-death"].([]interface{})
+	if len(deaths) == 0 {
+		return letter
+	}
+	last, ok := deaths[0].(amqp.Table)
+	if !ok {
+		return letter
+	}
+	letter.Queue, _ = last["queue"].(string)
+	letter.Reason, _ = last["reason"].(string)
+	letter.Count, _ = last["count"].(int64)
+	letter.Time, _ = last["time"].(time.Time)
+	if ex, ok := last["exchange"].(string); ok {
+		letter.Exchange = ex
+	}
+	if keys, ok := last["routing-keys"].([]interface{}); ok && len(keys) > 0 {
+		if key, ok := keys[0].(string); ok {
+			letter.RoutingKey = key
+		}
+	}
+	// Retries travel through the default exchange and delay queues
+	if ex, ok := d.Headers[originalExchangeHeader].(string); ok {
+		letter.Exchange = ex
+		letter.RoutingKey, _ = d.Headers[originalRoutingKeyHeader].(string)
+	}
+	return letter
+}
+
+// publishingFromDelivery copies a delivery's properties and body into a
+// publishing, for sending it on again. UserId is left out, since the broker
+// rejects one that doesn't match the publishing connection's user.
+func publishingFromDelivery(d amqp.Delivery) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         d.Headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
@@ -0,0 +1,167 @@
+package pubsub
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// deadLetterTest returns a broker with the dead-letter queue and two
+// queues, "moves" and "spectators", bound to amq.topic for moves.*. A
+// message published for each of keys is dead-lettered from "moves".
+func deadLetterTest(t *testing.T, keys ...string) (*MemoryBroker, Connection, *memChannel) {
+	t.Helper()
+	broker := NewMemoryBroker()
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := DeclareDeadLetterQueue(conn); err != nil {
+		t.Fatal(err)
+	}
+	ch := memTestChannel(t, broker)
+	dlx := amqp.Table{"x-dead-letter-exchange": routing.ExchangePerilDLX}
+	declareQueue(t, ch, "moves", dlx, [2]string{"amq.topic", "moves.*"})
+	declareQueue(t, ch, "spectators", nil, [2]string{"amq.topic", "moves.*"})
+	for _, key := range keys {
+		if err := PublishJSON(ch, "amq.topic", key, key); err != nil {
+			t.Fatal(err)
+		}
+		if err := get(t, ch, "moves").Nack(false, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ch.QueuePurge("spectators", false); err != nil {
+		t.Fatal(err)
+	}
+	return broker, conn, ch
+}
+
+func TestInspectDeadLetters(t *testing.T) {
+	broker, conn, _ := deadLetterTest(t, "moves.alice", "moves.bob")
+
+	letters, err := InspectDeadLetters(conn, routing.QueuePerilDLQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 {
+		t.Fatalf("got %d dead letters, want 2", len(letters))
+	}
+	letter := letters[0]
+	if letter.Queue != "moves" || letter.Reason != "rejected" || letter.Count != 1 ||
+		letter.Exchange != "amq.topic" || letter.RoutingKey != "moves.alice" ||
+		time.Since(letter.Time) > time.Minute {
+		t.Fatalf("first dead letter is %+v", letter)
+	}
+	var body string
+	if err := letter.Decode(&body); err != nil || body != "moves.alice" {
+		t.Fatalf("decoded %q (%v), want moves.alice", body, err)
+	}
+	if letters[1].RoutingKey != "moves.bob" {
+		t.Fatalf("second dead letter has key %s, want them oldest first", letters[1].RoutingKey)
+	}
+	// Looking doesn't take them off the queue
+	if n := queueLength(t, broker, routing.QueuePerilDLQ); n != 2 {
+		t.Fatalf("%d left in the dead-letter queue after inspecting it, want 2", n)
+	}
+}
+
+// Replaying sends a message back to the queue it died in, and only that
+// queue, and takes it off the dead-letter queue.
+func TestReplayDeadLetters(t *testing.T) {
+	broker, conn, ch := deadLetterTest(t, "moves.alice", "moves.bob")
+	ctx := context.Background()
+
+	n, err := ReplayDeadLetters(ctx, conn, routing.QueuePerilDLQ, 2, 2)
+	if err != nil || n != 1 {
+		t.Fatalf("replayed %d (%v), want 1", n, err)
+	}
+	if got := queueLength(t, broker, "moves"); got != 1 {
+		t.Fatalf("moves has %d messages after the replay, want 1", got)
+	}
+	if got := queueLength(t, broker, "spectators"); got != 0 {
+		t.Fatalf("another queue bound to the key got %d replayed messages", got)
+	}
+	d := get(t, ch, "moves")
+	if string(d.Body) != `"moves.bob"` {
+		t.Fatalf("replayed %s, want the second dead letter", d.Body)
+	}
+	// It keeps its history, so if it dies again the count goes up
+	if err := d.Nack(false, false); err != nil {
+		t.Fatal(err)
+	}
+	letters, err := InspectDeadLetters(conn, routing.QueuePerilDLQ)
+	if err != nil || len(letters) != 2 || letters[1].Count != 2 {
+		t.Fatalf("dead letters after dying again: %+v (%v), want the second with count 2", letters, err)
+	}
+
+	if _, err := ReplayDeadLetters(ctx, conn, routing.QueuePerilDLQ, 3); err == nil {
+		t.Fatal("replaying a position past the end succeeded")
+	}
+	n, err = ReplayDeadLetters(ctx, conn, routing.QueuePerilDLQ)
+	if err != nil || n != 2 {
+		t.Fatalf("replayed %d (%v), want 2", n, err)
+	}
+	if got := queueLength(t, broker, routing.QueuePerilDLQ); got != 0 {
+		t.Fatalf("%d left in the dead-letter queue after replaying everything", got)
+	}
+	if got := queueLength(t, broker, "moves"); got != 2 {
+		t.Fatalf("moves has %d messages after replaying everything, want 2", got)
+	}
+}
+
+// A message that reached the dead-letter queue some other way has nowhere
+// to go back to, and stays put.
+func TestReplayDeadLetterWithoutHistory(t *testing.T) {
+	broker, conn, ch := deadLetterTest(t, "moves.alice")
+	publishText(t, ch, "", routing.QueuePerilDLQ, "stray")
+
+	n, err := ReplayDeadLetters(context.Background(), conn, routing.QueuePerilDLQ)
+	if err == nil || !strings.Contains(err.Error(), "x-death") || n != 1 {
+		t.Fatalf("replayed %d (%v), want 1 and an error about the stray", n, err)
+	}
+	if got := queueLength(t, broker, routing.QueuePerilDLQ); got != 1 {
+		t.Fatalf("%d left in the dead-letter queue, want the stray", got)
+	}
+}
+
+// A retried message's dead letter says where it was first published, not
+// the delay queue it went through.
+func TestDeadLetterAfterRetries(t *testing.T) {
+	_, conn, ch := deadLetterTest(t)
+	err := ch.PublishWithContext(context.Background(), "", "moves", false, false, amqp.Publishing{
+		Headers: amqp.Table{originalExchangeHeader: "amq.topic", originalRoutingKeyHeader: "moves.carol"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(t, ch, "moves").Nack(false, false); err != nil {
+		t.Fatal(err)
+	}
+	letters, err := InspectDeadLetters(conn, routing.QueuePerilDLQ)
+	if err != nil || len(letters) != 1 {
+		t.Fatalf("dead letters %+v (%v)", letters, err)
+	}
+	if l := letters[0]; l.Exchange != "amq.topic" || l.RoutingKey != "moves.carol" || l.Queue != "moves" {
+		t.Fatalf("dead letter via %s/%s from %s, want amq.topic/moves.carol from moves", l.Exchange, l.RoutingKey, l.Queue)
+	}
+}
+
+func TestPurgeDeadLetters(t *testing.T) {
+	broker, conn, _ := deadLetterTest(t, "moves.alice", "moves.bob")
+	n, err := PurgeDeadLetters(conn, routing.QueuePerilDLQ)
+	if err != nil || n != 2 {
+		t.Fatalf("purged %d (%v), want 2", n, err)
+	}
+	if got := queueLength(t, broker, routing.QueuePerilDLQ); got != 0 {
+		t.Fatalf("%d left in the dead-letter queue after purging it", got)
+	}
+	if _, err := InspectDeadLetters(conn, "no-such-queue"); err == nil {
+		t.Fatal("inspecting a queue that doesn't exist succeeded")
+	}
+}
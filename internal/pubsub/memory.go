@@ -0,0 +1,743 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrBrokerStopped is returned by MemoryBroker.Dial while the broker is
+// stopped, the same way a real dial fails while RabbitMQ is down.
+var ErrBrokerStopped = errors.New("memory broker is stopped")
+
+// MemoryBroker is an in-process stand-in for RabbitMQ. It implements the
+// slice of AMQP 0-9-1 that Peril relies on:
+//   - the default, direct, topic (with * and # wildcards) and fanout exchanges
+//   - durable and transient (auto-delete, exclusive) queues
+//   - per-consumer prefetch, ack, nack and requeue
+//   - basic.get and queue purges
+//   - dead-lettering through the x-dead-letter-exchange queue argument
+//   - message TTLs, from the x-message-ttl queue argument or a message's
+//     Expiration, checked at the head of the queue like RabbitMQ does
+//   - queue expiry (x-expires), length limits (x-max-length and
+//     x-max-length-bytes, counting ready messages) with the x-overflow
+//     behaviours, and single active consumers
+//   - quorum queues (x-queue-type), with the x-delivery-count header and
+//     dead-lettering past x-delivery-limit
+//   - streams, which keep every message and let each consumer start from
+//     the x-stream-offset it asks for: first, last, next, an offset or a
+//     timestamp; they don't enforce x-max-length-bytes, and keep everything
+//
+// x-queue-mode is checked but makes no difference, as everything is in
+// memory anyway. Errors are reported the way the server reports them: a channel-level
+// problem returns an *amqp.Error and closes the channel.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	stopped   bool
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	conns     map[*memConnection]struct{}
+	serial    int // used for generated queue names and consumer tags
+}
+
+type memExchange struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	bindings   []memBinding
+}
+
+type memBinding struct {
+	queue string
+	key   string
+}
+
+type memQueue struct {
+	name       string
+	kind       string // classic, quorum or stream
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	args       amqp.Table
+	owner      *memConnection // set for exclusive queues
+	ready      []*memMessage  // for a stream, every message it has ever had
+	consumers  []*memConsumer
+	cursor     int       // round-robin position among consumers
+	consumed   bool      // auto-delete only kicks in once a consumer has come and gone
+	lastUsed   time.Time // for x-expires
+}
+
+type memMessage struct {
+	exchange    string
+	key         string
+	pub         amqp.Publishing
+	redelivered bool
+	expires     time.Time // zero if the message never expires
+	published   time.Time // when the broker received it
+	returned    int64     // times a quorum queue got it back unsettled
+	stream      bool      // it is in a stream, at offset
+	offset      int64
+}
+
+// Queue types, from the x-queue-type argument.
+const (
+	queueClassic = "classic"
+	queueQuorum  = "quorum"
+	queueStream  = "stream"
+)
+
+// NewMemoryBroker returns a running broker with the default exchange and
+// the amq.* exchanges RabbitMQ always declares.
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		exchanges: map[string]*memExchange{},
+		queues:    map[string]*memQueue{},
+		conns:     map[*memConnection]struct{}{},
+	}
+	b.declareBuiltinExchanges()
+	return b
+}
+
+func (b *MemoryBroker) declareBuiltinExchanges() {
+	builtin := map[string]string{
+		"":           amqp.ExchangeDirect,
+		"amq.direct": amqp.ExchangeDirect,
+		"amq.topic":  amqp.ExchangeTopic,
+		"amq.fanout": amqp.ExchangeFanout,
+	}
+	for name, kind := range builtin {
+		if _, ok := b.exchanges[name]; !ok {
+			b.exchanges[name] = &memExchange{name: name, kind: kind, durable: true}
+		}
+	}
+}
+
+// Dial opens a new connection to the broker.
+func (b *MemoryBroker) Dial() (Connection, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stopped {
+		return nil, ErrBrokerStopped
+	}
+	c := &memConnection{
+		broker:   b,
+		channels: map[*memChannel]struct{}{},
+	}
+	b.conns[c] = struct{}{}
+	return c, nil
+}
+
+// Stop simulates the broker going down. Every connection is closed with
+// CONNECTION_FORCED, unacknowledged messages are requeued, and everything a
+// restarted RabbitMQ would have forgotten is dropped: non-durable exchanges
+// and queues, and transient messages sitting in durable queues.
+func (b *MemoryBroker) Stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stopped {
+		return
+	}
+	b.stopped = true
+	for c := range b.conns {
+		b.closeConnection(c, &amqp.Error{
+			Code:    amqp.ConnectionForced,
+			Reason:  "CONNECTION_FORCED - broker forced connection closure with reason 'shutdown'",
+			Server:  true,
+			Recover: true,
+		})
+	}
+	for name, ex := range b.exchanges {
+		if !ex.durable {
+			delete(b.exchanges, name)
+		}
+	}
+	for _, q := range b.queues {
+		if !q.durable {
+			b.deleteQueue(q)
+			continue
+		}
+		if q.kind == queueStream {
+			// Streams are on disk, whatever the delivery mode
+			continue
+		}
+		kept := q.ready[:0]
+		for _, msg := range q.ready {
+			if msg.pub.DeliveryMode == amqp.Persistent {
+				kept = append(kept, msg)
+			}
+		}
+		q.ready = kept
+		q.cursor = 0
+	}
+	// Bindings pointing at queues that no longer exist go away with them
+	for _, ex := range b.exchanges {
+		kept := ex.bindings[:0]
+		for _, bnd := range ex.bindings {
+			if _, ok := b.queues[bnd.queue]; ok {
+				kept = append(kept, bnd)
+			}
+		}
+		ex.bindings = kept
+	}
+}
+
+// Start brings a stopped broker back up so Dial works again.
+func (b *MemoryBroker) Start() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stopped = false
+	b.declareBuiltinExchanges()
+	// Messages whose TTL ran out while the broker was down expire now, and
+	// queues with an expiry get a fresh start
+	for _, q := range b.queues {
+		b.expire(q)
+		b.touch(q)
+	}
+}
+
+// Restart is Stop followed by Start.
+func (b *MemoryBroker) Restart() {
+	b.Stop()
+	b.Start()
+}
+
+// QueueLength reports how many messages are ready in a queue (not counting
+// ones that are delivered but unacknowledged), and whether the queue exists.
+// For a stream it is how many messages the stream holds.
+func (b *MemoryBroker) QueueLength(name string) (int, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, false
+	}
+	return len(q.ready), true
+}
+
+func (b *MemoryBroker) nextSerial() int {
+	b.serial++
+	return b.serial
+}
+
+// route delivers a message to every queue bound to the exchange with a
+// matching key and returns how many queues it was routed to, and whether
+// any of them rejected it because they were full.
+func (b *MemoryBroker) route(exchange, key string, pub amqp.Publishing) (int, bool, *amqp.Error) {
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return 0, false, notFound("no exchange '%s' in vhost '/'", exchange)
+	}
+	targets := map[string]*memQueue{}
+	if exchange == "" {
+		// The default exchange routes straight to the queue named by the key
+		if q, ok := b.queues[key]; ok {
+			targets[q.name] = q
+		}
+	}
+	for _, bnd := range ex.bindings {
+		var match bool
+		switch ex.kind {
+		case amqp.ExchangeDirect:
+			match = bnd.key == key
+		case amqp.ExchangeTopic:
+			match = MatchTopic(bnd.key, key)
+		case amqp.ExchangeFanout:
+			match = true
+		}
+		if match {
+			targets[bnd.queue] = b.queues[bnd.queue]
+		}
+	}
+	rejected := false
+	for _, q := range targets {
+		if !b.enqueue(q, &memMessage{exchange: exchange, key: key, pub: pub, published: time.Now()}) {
+			rejected = true
+		}
+	}
+	return len(targets), rejected, nil
+}
+
+// enqueue adds a message to a queue, and reports false if the queue was
+// full and its overflow behaviour is to reject new messages.
+func (b *MemoryBroker) enqueue(q *memQueue, msg *memMessage) bool {
+	if q.kind == queueStream {
+		msg.stream, msg.offset = true, int64(len(q.ready))
+		q.ready = append(q.ready, msg)
+		b.dispatch(q)
+		return true
+	}
+	overflow, _ := q.args["x-overflow"].(string)
+	if overflow == string(OverflowRejectPublish) || overflow == string(OverflowRejectPublishDLX) {
+		b.expire(q)
+		if q.overLimit(1, len(msg.pub.Body)) {
+			if overflow == string(OverflowRejectPublishDLX) {
+				b.deadLetter(q, msg, "maxlen")
+			}
+			return false
+		}
+	}
+	if ttl, ok := messageTTL(q, msg.pub); ok {
+		msg.expires = time.Now().Add(ttl)
+		b.scheduleExpiry(q, msg.expires)
+	}
+	q.ready = append(q.ready, msg)
+	b.dispatch(q)
+	// Anything the consumers couldn't take counts towards the limits. The default is to make
+	// room by dropping the oldest
+	if overflow == "" || overflow == string(OverflowDropHead) {
+		for len(q.ready) > 0 && q.overLimit(0, 0) {
+			head := q.ready[0]
+			q.ready = q.ready[1:]
+			b.deadLetter(q, head, "maxlen")
+		}
+	}
+	return true
+}
+
+// overLimit reports whether the queue's ready messages, plus extra more
+// messages of extraBytes in all, would be more than its x-max-length or
+// x-max-length-bytes allow.
+func (q *memQueue) overLimit(extra, extraBytes int) bool {
+	if max, ok := tableInt(q.args, "x-max-length"); ok && int64(len(q.ready)+extra) > max {
+		return true
+	}
+	if max, ok := tableInt(q.args, "x-max-length-bytes"); ok {
+		size := int64(extraBytes)
+		for _, msg := range q.ready {
+			size += int64(len(msg.pub.Body))
+		}
+		return size > max
+	}
+	return false
+}
+
+// messageTTL is the shorter of the queue's x-message-ttl and the message's
+// own Expiration, if either is set.
+func messageTTL(q *memQueue, pub amqp.Publishing) (time.Duration, bool) {
+	ttl, ok := tableInt(q.args, "x-message-ttl")
+	if pub.Expiration != "" {
+		if ms, err := strconv.ParseInt(pub.Expiration, 10, 64); err == nil && (!ok || ms < ttl) {
+			ttl, ok = ms, true
+		}
+	}
+	return time.Duration(ttl) * time.Millisecond, ok
+}
+
+// scheduleExpiry checks the queue again once the message expiring at at is
+// due, so that it is dead-lettered even if nothing else happens to the
+// queue in the meantime.
+func (b *MemoryBroker) scheduleExpiry(q *memQueue, at time.Time) {
+	time.AfterFunc(time.Until(at), func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.stopped || b.queues[q.name] != q {
+			return
+		}
+		b.dispatch(q)
+	})
+}
+
+// expire dead-letters expired messages at the head of the queue. As in
+// RabbitMQ, an expired message behind one that hasn't expired yet waits
+// until it reaches the head.
+func (b *MemoryBroker) expire(q *memQueue) {
+	now := time.Now()
+	for len(q.ready) > 0 {
+		msg := q.ready[0]
+		if msg.expires.IsZero() || now.Before(msg.expires) {
+			return
+		}
+		q.ready = q.ready[1:]
+		b.deadLetter(q, msg, "expired")
+	}
+}
+
+// touch records that a queue was used: declared, consumed from or read
+// with basic.get. A queue with an x-expires argument is deleted once it
+// has gone that long unused with no consumers.
+func (b *MemoryBroker) touch(q *memQueue) {
+	q.lastUsed = time.Now()
+	if _, ok := tableInt(q.args, "x-expires"); ok && len(q.consumers) == 0 {
+		b.scheduleQueueExpiry(q, q.lastUsed)
+	}
+}
+
+func (b *MemoryBroker) scheduleQueueExpiry(q *memQueue, used time.Time) {
+	ms, _ := tableInt(q.args, "x-expires")
+	time.AfterFunc(time.Until(used.Add(time.Duration(ms)*time.Millisecond)), func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		// A later touch has scheduled another check, and Start touches every queue
+		if b.stopped || b.queues[q.name] != q || !q.lastUsed.Equal(used) || len(q.consumers) > 0 {
+			return
+		}
+		b.deleteQueue(q)
+	})
+}
+
+// requeue puts a message back at the head of its queue, if the queue still
+// exists, and marks it as redelivered. Messages never leave a stream, so
+// there is nothing to put back.
+func (b *MemoryBroker) requeue(q *memQueue, msgs ...*memMessage) {
+	if b.queues[q.name] != q || q.kind == queueStream {
+		return
+	}
+	for _, msg := range msgs {
+		msg.redelivered = true
+	}
+	q.ready = append(append([]*memMessage{}, msgs...), q.ready...)
+	b.dispatch(q)
+}
+
+// giveBack requeues messages that were delivered and came back unsettled,
+// because they were nacked or their channel closed. A quorum queue counts
+// these returns, and dead-letters a message once they exceed its
+// x-delivery-limit.
+func (b *MemoryBroker) giveBack(q *memQueue, msgs ...*memMessage) {
+	if q.kind != queueQuorum {
+		b.requeue(q, msgs...)
+		return
+	}
+	limit, limited := tableInt(q.args, "x-delivery-limit")
+	var kept []*memMessage
+	for _, msg := range msgs {
+		msg.returned++
+		if limited && msg.returned > limit && b.queues[q.name] == q {
+			b.deadLetter(q, msg, "delivery_limit")
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	b.requeue(q, kept...)
+}
+
+// dispatch hands ready messages to consumers that have prefetch capacity,
+// round-robin, until either runs out.
+func (b *MemoryBroker) dispatch(q *memQueue) {
+	if q.kind == queueStream {
+		b.dispatchStream(q)
+		return
+	}
+	b.expire(q)
+	for len(q.ready) > 0 {
+		c := q.nextConsumer()
+		if c == nil {
+			return
+		}
+		msg := q.ready[0]
+		q.ready = q.ready[1:]
+		c.deliver(msg)
+	}
+}
+
+// dispatchStream gives every consumer of a stream the messages from its
+// own position onwards, as far as its prefetch allows.
+func (b *MemoryBroker) dispatchStream(q *memQueue) {
+	for _, c := range q.consumers {
+		for c.offset < int64(len(q.ready)) && c.hasCapacity() {
+			msg := q.ready[c.offset]
+			c.offset++
+			c.deliver(msg)
+		}
+	}
+}
+
+func (q *memQueue) nextConsumer() *memConsumer {
+	if active, _ := q.args["x-single-active-consumer"].(bool); active {
+		// The oldest consumer gets everything until it goes away
+		if len(q.consumers) > 0 && q.consumers[0].hasCapacity() {
+			return q.consumers[0]
+		}
+		return nil
+	}
+	for i := 0; i < len(q.consumers); i++ {
+		c := q.consumers[(q.cursor+i)%len(q.consumers)]
+		if c.hasCapacity() {
+			q.cursor = (q.cursor + i + 1) % len(q.consumers)
+			return c
+		}
+	}
+	return nil
+}
+
+// deadLetter republishes a message to the queue's dead-letter exchange,
+// recording why in the x-death header like RabbitMQ does. Without a
+// dead-letter exchange the message is simply dropped. Streams don't
+// dead-letter.
+func (b *MemoryBroker) deadLetter(q *memQueue, msg *memMessage, reason string) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok || q.kind == queueStream {
+		return
+	}
+	key := msg.key
+	if k, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = k
+	}
+	pub := msg.pub
+	pub.Headers = deathHeaders(msg, q.name, reason)
+	// A per-message TTL would expire the message again in the next queue
+	pub.Expiration = ""
+	// An unknown dead-letter exchange drops the message, it is not an error
+	b.route(dlx, key, pub)
+}
+
+func deathHeaders(msg *memMessage, queue, reason string) amqp.Table {
+	headers := amqp.Table{}
+	for k, v := range msg.pub.Headers {
+		headers[k] = v
+	}
+	deaths, _ := headers["x-death"].([]interface{})
+	// Entries are kept per (queue, reason), newest first, with a count
+	count := int64(1)
+	rest := make([]interface{}, 0, len(deaths))
+	for _, d := range deaths {
+		entry, ok := d.(amqp.Table)
+		if ok && entry["queue"] == queue && entry["reason"] == reason {
+			if n, ok := entry["count"].(int64); ok {
+				count = n + 1
+			}
+			continue
+		}
+		rest = append(rest, d)
+	}
+	entry := amqp.Table{
+		"count":        count,
+		"reason":       reason,
+		"queue":        queue,
+		"time":         time.Now(),
+		"exchange":     msg.exchange,
+		"routing-keys": []interface{}{msg.key},
+	}
+	headers["x-death"] = append([]interface{}{entry}, rest...)
+	if _, ok := headers["x-first-death-reason"]; !ok {
+		headers["x-first-death-reason"] = reason
+		headers["x-first-death-queue"] = queue
+		headers["x-first-death-exchange"] = msg.exchange
+	}
+	return headers
+}
+
+func (b *MemoryBroker) deleteQueue(q *memQueue) {
+	if b.queues[q.name] != q {
+		return
+	}
+	delete(b.queues, q.name)
+	for _, ex := range b.exchanges {
+		kept := ex.bindings[:0]
+		for _, bnd := range ex.bindings {
+			if bnd.queue != q.name {
+				kept = append(kept, bnd)
+			}
+		}
+		ex.bindings = kept
+	}
+	for _, c := range append([]*memConsumer{}, q.consumers...) {
+		b.cancelConsumer(c)
+	}
+}
+
+func (b *MemoryBroker) cancelConsumer(c *memConsumer) {
+	ch := c.channel
+	if _, ok := ch.consumers[c.tag]; !ok {
+		return
+	}
+	delete(ch.consumers, c.tag)
+	q := c.queue
+	for i, other := range q.consumers {
+		if other == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	if q.cursor >= len(q.consumers) {
+		q.cursor = 0
+	}
+	// Deliveries still buffered in the consumer never reached the
+	// application, so give them back to the queue right away
+	undelivered := c.stop()
+	var msgs []*memMessage
+	for _, d := range undelivered {
+		if p, ok := ch.unacked[d.DeliveryTag]; ok {
+			delete(ch.unacked, d.DeliveryTag)
+			msgs = append(msgs, p.msg)
+		}
+	}
+	if len(msgs) > 0 {
+		b.requeue(q, msgs...)
+	}
+	if q.autoDelete && q.consumed && len(q.consumers) == 0 {
+		b.deleteQueue(q)
+		return
+	}
+	if b.queues[q.name] != q {
+		return
+	}
+	if len(q.consumers) == 0 {
+		b.touch(q)
+	}
+	// With a single active consumer, the next one in line takes over
+	b.dispatch(q)
+}
+
+func (b *MemoryBroker) closeChannel(ch *memChannel, reason *amqp.Error) {
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+	delete(ch.conn.channels, ch)
+	// Listeners hear why the channel closed before its deliveries stop,
+	// the same order the real client uses
+	notifyClose(ch.notify, reason)
+	ch.notify = nil
+	for _, c := range ch.consumers {
+		b.cancelConsumer(c)
+	}
+	// Unacknowledged messages go back to their queues, oldest first
+	tags := make([]uint64, 0, len(ch.unacked))
+	for tag := range ch.unacked {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	for _, tag := range tags {
+		p := ch.unacked[tag]
+		delete(ch.unacked, tag)
+		b.giveBack(p.queue, p.msg)
+	}
+	// Confirm and return listeners are closed once pending notifications
+	// have been delivered
+	confirms, returns := ch.confirms, ch.returns
+	ch.confirms, ch.returns = nil, nil
+	ch.events.post(func() {
+		for _, l := range confirms {
+			close(l)
+		}
+		for _, l := range returns {
+			close(l)
+		}
+	})
+	ch.events.post(nil)
+}
+
+func (b *MemoryBroker) closeConnection(c *memConnection, reason *amqp.Error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	delete(b.conns, c)
+	for ch := range c.channels {
+		b.closeChannel(ch, reason)
+	}
+	for _, q := range b.queues {
+		if q.owner == c {
+			b.deleteQueue(q)
+		}
+	}
+	notifyClose(c.notify, reason)
+	c.notify = nil
+}
+
+// notifyClose follows amqp091's contract for NotifyClose listeners: send the
+// error if there is one, then close. Buffered listeners (the documented way
+// to use NotifyClose) are served right away; anything else is served in the
+// background so a slow listener can't hold up the broker.
+func notifyClose(receivers []chan *amqp.Error, reason *amqp.Error) {
+	for _, r := range receivers {
+		if reason == nil {
+			close(r)
+			continue
+		}
+		select {
+		case r <- reason:
+			close(r)
+		default:
+			go func(r chan *amqp.Error) {
+				r <- reason
+				close(r)
+			}(r)
+		}
+	}
+}
+
+// MatchTopic reports whether a routing key matches a topic binding pattern,
+// as a topic exchange decides it. Words are separated by dots; * matches
+// exactly one word and # matches zero or more.
+func MatchTopic(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(key); i++ {
+			if matchWords(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(key) > 0 && matchWords(pattern[1:], key[1:])
+	}
+	return len(key) > 0 && pattern[0] == key[0] && matchWords(pattern[1:], key[1:])
+}
+
+// tableInt reads an integer argument, which arrives as int, int32 or int64
+// depending on the caller.
+func tableInt(t amqp.Table, key string) (int64, bool) {
+	switch v := t[key].(type) {
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+func equalTables(a, b amqp.Table) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		other, ok := b[k]
+		// Numbers arrive as int, int32 or int64 depending on the caller
+		if !ok || fmt.Sprint(v) != fmt.Sprint(other) {
+			return false
+		}
+	}
+	return true
+}
+
+func preconditionFailed(format string, args ...interface{}) *amqp.Error {
+	return &amqp.Error{
+		Code:   amqp.PreconditionFailed,
+		Reason: "PRECONDITION_FAILED - " + fmt.Sprintf(format, args...),
+		Server: true,
+	}
+}
+
+func notFound(format string, args ...interface{}) *amqp.Error {
+	return &amqp.Error{
+		Code:   amqp.NotFound,
+		Reason: "NOT_FOUND - " + fmt.Sprintf(format, args...),
+		Server: true,
+	}
+}
+
+func resourceLocked(format string, args ...interface{}) *amqp.Error {
+	return &amqp.Error{
+		Code:   amqp.ResourceLocked,
+		Reason: "RESOURCE_LOCKED - " + fmt.Sprintf(format, args...),
+		Server: true,
+	}
+}
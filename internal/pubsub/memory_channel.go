@@ -0,0 +1,855 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type memConnection struct {
+	broker   *MemoryBroker
+	channels map[*memChannel]struct{}
+	closed   bool
+	notify   []chan *amqp.Error
+}
+
+var _ Connection = (*memConnection)(nil)
+
+func (c *memConnection) Channel() (Channel, error) {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &memChannel{
+		conn:      c,
+		unacked:   map[uint64]*memPending{},
+		consumers: map[string]*memConsumer{},
+		events:    newMemEvents(),
+	}
+	c.channels[ch] = struct{}{}
+	return ch, nil
+}
+
+// NotifyClose registers a listener for the connection closing, with the
+// same semantics as (*amqp.Connection).NotifyClose.
+func (c *memConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+	c.notify = append(c.notify, receiver)
+	return receiver
+}
+
+func (c *memConnection) IsClosed() bool {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return c.closed
+}
+
+func (c *memConnection) Close() error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	b.closeConnection(c, nil)
+	return nil
+}
+
+// memChannel is a channel on a memConnection. It is also the Acknowledger
+// for every delivery it hands out, so Delivery.Ack and friends land here.
+type memChannel struct {
+	conn      *memConnection
+	closed    bool
+	prefetch  int
+	lastTag   uint64
+	unacked   map[uint64]*memPending
+	consumers map[string]*memConsumer
+	notify    []chan *amqp.Error
+
+	// Publisher confirms and returned (unroutable) messages
+	confirming bool
+	publishSeq uint64
+	confirms   []chan amqp.Confirmation
+	returns    []chan amqp.Return
+	events     *memEvents
+}
+
+// memPending is a delivery waiting for its ack.
+type memPending struct {
+	msg      *memMessage
+	queue    *memQueue
+	consumer *memConsumer
+}
+
+var (
+	_ Channel           = (*memChannel)(nil)
+	_ amqp.Acknowledger = (*memChannel)(nil)
+)
+
+// fail closes the channel with a server-side error and returns it, which
+// is how RabbitMQ reacts to a bad declare, bind or publish.
+func (ch *memChannel) fail(err *amqp.Error) error {
+	ch.conn.broker.closeChannel(ch, err)
+	return err
+}
+
+// lock takes the broker lock and checks that the channel is still usable.
+// The caller must unlock the broker when err is nil.
+func (ch *memChannel) lock() (*MemoryBroker, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		return nil, amqp.ErrClosed
+	}
+	return b, nil
+}
+
+func (ch *memChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeTopic, amqp.ExchangeFanout:
+	default:
+		return ch.fail(&amqp.Error{
+			Code:   amqp.CommandInvalid,
+			Reason: fmt.Sprintf("COMMAND_INVALID - unknown exchange type '%s'", kind),
+			Server: true,
+		})
+	}
+	if ex, ok := b.exchanges[name]; ok {
+		if ex.kind != kind || ex.durable != durable || ex.autoDelete != autoDelete {
+			return ch.fail(preconditionFailed("inequivalent arg for exchange '%s' in vhost '/'", name))
+		}
+		return nil
+	}
+	b.exchanges[name] = &memExchange{name: name, kind: kind, durable: durable, autoDelete: autoDelete}
+	return nil
+}
+
+func (ch *memChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b, err := ch.lock()
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	defer b.mu.Unlock()
+	if name == "" {
+		name = fmt.Sprintf("amq.gen-%d", b.nextSerial())
+	}
+	if q, ok := b.queues[name]; ok {
+		if q.exclusive && q.owner != ch.conn {
+			return amqp.Queue{}, ch.fail(resourceLocked("cannot obtain exclusive access to locked queue '%s' in vhost '/'", name))
+		}
+		if kind, _ := args["x-queue-type"].(string); kind != q.kind && !(kind == "" && q.kind == queueClassic) {
+			return amqp.Queue{}, ch.fail(preconditionFailed("inequivalent arg 'x-queue-type' for queue '%s' in vhost '/': received '%v' but current is '%s'", name, args["x-queue-type"], q.kind))
+		}
+		if q.durable != durable {
+			return amqp.Queue{}, ch.fail(preconditionFailed("inequivalent arg 'durable' for queue '%s' in vhost '/': received '%t' but current is '%t'", name, durable, q.durable))
+		}
+		if q.autoDelete != autoDelete || q.exclusive != exclusive || !equalTables(q.args, args) {
+			return amqp.Queue{}, ch.fail(preconditionFailed("inequivalent arg for queue '%s' in vhost '/'", name))
+		}
+		b.touch(q)
+		return amqp.Queue{Name: name, Messages: len(q.ready), Consumers: len(q.consumers)}, nil
+	}
+	kind := queueClassic
+	if v, ok := args["x-queue-type"]; ok {
+		kind, _ = v.(string)
+		switch kind {
+		case queueClassic:
+		case queueQuorum, queueStream:
+			// Replicated queues have to be durable, and can't belong to one connection
+			switch {
+			case !durable:
+				return amqp.Queue{}, ch.fail(preconditionFailed("invalid property 'non-durable' for queue '%s' in vhost '/'", name))
+			case autoDelete:
+				return amqp.Queue{}, ch.fail(preconditionFailed("invalid property 'auto-delete' for queue '%s' in vhost '/'", name))
+			case exclusive:
+				return amqp.Queue{}, ch.fail(preconditionFailed("invalid property 'exclusive-owner' for queue '%s' in vhost '/'", name))
+			}
+		default:
+			return amqp.Queue{}, ch.fail(preconditionFailed("invalid arg 'x-queue-type' for queue '%s' in vhost '/': %v", name, v))
+		}
+	}
+	if err := checkQueueArgs(name, kind, args); err != nil {
+		return amqp.Queue{}, ch.fail(err)
+	}
+	q := &memQueue{
+		name:       name,
+		kind:       kind,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       args,
+	}
+	if exclusive {
+		q.owner = ch.conn
+	}
+	b.queues[name] = q
+	b.touch(q)
+	return amqp.Queue{Name: name}, nil
+}
+
+// checkQueueArgs checks the arguments of a queue of the given kind that is
+// being declared.
+func checkQueueArgs(name, kind string, args amqp.Table) *amqp.Error {
+	invalid := func(arg string) *amqp.Error {
+		return preconditionFailed("invalid arg '%s' for queue '%s' in vhost '/': %v", arg, name, args[arg])
+	}
+	for _, arg := range []string{"x-message-ttl", "x-delivery-limit", "x-max-length", "x-max-length-bytes"} {
+		if _, ok := args[arg]; !ok {
+			continue
+		}
+		if n, ok := tableInt(args, arg); !ok || n < 0 {
+			return invalid(arg)
+		}
+	}
+	if _, ok := args["x-expires"]; ok {
+		if ms, ok := tableInt(args, "x-expires"); !ok || ms <= 0 {
+			return invalid("x-expires")
+		}
+	}
+	if v, ok := args["x-overflow"]; ok {
+		switch v {
+		case string(OverflowDropHead), string(OverflowRejectPublish):
+		case string(OverflowRejectPublishDLX):
+			if kind == queueQuorum {
+				return invalid("x-overflow")
+			}
+		default:
+			return invalid("x-overflow")
+		}
+	}
+	if v, ok := args["x-single-active-consumer"]; ok {
+		if _, ok := v.(bool); !ok {
+			return invalid("x-single-active-consumer")
+		}
+	}
+	if v, ok := args["x-queue-mode"]; ok {
+		if (v != "default" && v != "lazy") || kind != queueClassic {
+			return invalid("x-queue-mode")
+		}
+	}
+	if kind == queueStream {
+		// Streams keep everything, up to their retention limits
+		for _, arg := range []string{"x-message-ttl", "x-expires", "x-max-length", "x-overflow", "x-single-active-consumer"} {
+			if _, ok := args[arg]; ok {
+				return invalid(arg)
+			}
+		}
+	}
+	return nil
+}
+
+// ExchangeDeclarePassive checks that an exchange exists without declaring
+// it, failing the channel with NOT_FOUND if it doesn't.
+func (ch *memChannel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+	if _, ok := b.exchanges[name]; !ok {
+		return ch.fail(notFound("no exchange '%s' in vhost '/'", name))
+	}
+	return nil
+}
+
+// QueueDeclarePassive checks that a queue exists without declaring it,
+// failing the channel with NOT_FOUND if it doesn't.
+func (ch *memChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b, err := ch.lock()
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return amqp.Queue{}, ch.fail(notFound("no queue '%s' in vhost '/'", name))
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return amqp.Queue{}, ch.fail(resourceLocked("cannot obtain exclusive access to locked queue '%s' in vhost '/'", name))
+	}
+	return amqp.Queue{Name: name, Messages: len(q.ready), Consumers: len(q.consumers)}, nil
+}
+
+func (ch *memChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return ch.fail(notFound("no queue '%s' in vhost '/'", name))
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return ch.fail(resourceLocked("cannot obtain exclusive access to locked queue '%s' in vhost '/'", name))
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok || exchange == "" {
+		// Binding to the default exchange is forbidden, same as RabbitMQ
+		return ch.fail(notFound("no exchange '%s' in vhost '/'", exchange))
+	}
+	for _, bnd := range ex.bindings {
+		if bnd.queue == name && bnd.key == key {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, memBinding{queue: name, key: key})
+	return nil
+}
+
+func (ch *memChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+	if prefetchCount < 0 {
+		return ch.fail(preconditionFailed("prefetch count must not be negative"))
+	}
+	// The prefetch applies to consumers started after this call, which is
+	// what RabbitMQ does when global is false
+	ch.prefetch = prefetchCount
+	return nil
+}
+
+func (ch *memChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b, err := ch.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer b.mu.Unlock()
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, ch.fail(notFound("no queue '%s' in vhost '/'", queue))
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return nil, ch.fail(resourceLocked("cannot obtain exclusive access to locked queue '%s' in vhost '/'", queue))
+	}
+	var offset int64
+	if q.kind == queueStream {
+		// Stream consumers need a prefetch, and acks to go with it
+		if autoAck {
+			return nil, ch.fail(preconditionFailed("noAck not supported for stream queue '%s' in vhost '/'", queue))
+		}
+		if ch.prefetch == 0 {
+			return nil, ch.fail(preconditionFailed("consumer prefetch count is not set for stream queue '%s' in vhost '/'", queue))
+		}
+		var ok bool
+		if offset, ok = streamOffset(q, args["x-stream-offset"]); !ok {
+			return nil, ch.fail(preconditionFailed("invalid arg 'x-stream-offset' for consumer of queue '%s' in vhost '/': %v", queue, args["x-stream-offset"]))
+		}
+	}
+	if consumer == "" {
+		consumer = fmt.Sprintf("ctag-%d", b.nextSerial())
+	}
+	if _, ok := ch.consumers[consumer]; ok {
+		return nil, ch.fail(&amqp.Error{
+			Code:   amqp.NotAllowed,
+			Reason: fmt.Sprintf("NOT_ALLOWED - attempt to reuse consumer tag '%s'", consumer),
+			Server: true,
+		})
+	}
+	c := &memConsumer{
+		tag:      consumer,
+		queue:    q,
+		channel:  ch,
+		autoAck:  autoAck,
+		prefetch: ch.prefetch,
+		offset:   offset,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		out:      make(chan amqp.Delivery),
+	}
+	ch.consumers[consumer] = c
+	q.consumers = append(q.consumers, c)
+	q.consumed = true
+	go c.run()
+	b.dispatch(q)
+	return c.out, nil
+}
+
+func (ch *memChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+	if msg.Expiration != "" {
+		if ms, err := strconv.ParseInt(msg.Expiration, 10, 64); err != nil || ms < 0 {
+			return ch.fail(preconditionFailed("invalid expiration '%s'", msg.Expiration))
+		}
+	}
+	// Copy the body so the caller is free to reuse its buffer
+	msg.Body = append([]byte(nil), msg.Body...)
+	routed, rejected, rerr := b.route(exchange, key, msg)
+	if rerr != nil {
+		return ch.fail(rerr)
+	}
+	// Like the server, send the return before the confirm for the same message
+	if mandatory && routed == 0 {
+		ret := amqp.Return{
+			ReplyCode:       amqp.NoRoute,
+			ReplyText:       "NO_ROUTE",
+			Exchange:        exchange,
+			RoutingKey:      key,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			Headers:         msg.Headers,
+			DeliveryMode:    msg.DeliveryMode,
+			Priority:        msg.Priority,
+			CorrelationId:   msg.CorrelationId,
+			ReplyTo:         msg.ReplyTo,
+			Expiration:      msg.Expiration,
+			MessageId:       msg.MessageId,
+			Timestamp:       msg.Timestamp,
+			Type:            msg.Type,
+			UserId:          msg.UserId,
+			AppId:           msg.AppId,
+			Body:            msg.Body,
+		}
+		listeners := ch.returns
+		ch.events.post(func() {
+			for _, l := range listeners {
+				l <- ret
+			}
+		})
+	}
+	if ch.confirming {
+		ch.publishSeq++
+		// A queue that was full and rejects publishes nacks the message
+		confirmation := amqp.Confirmation{DeliveryTag: ch.publishSeq, Ack: !rejected}
+		listeners := ch.confirms
+		ch.events.post(func() {
+			for _, l := range listeners {
+				l <- confirmation
+			}
+		})
+	}
+	return nil
+}
+
+// Confirm puts the channel into confirm mode. Every publish after this
+// is acknowledged on the NotifyPublish listeners.
+func (ch *memChannel) Confirm(noWait bool) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+	ch.confirming = true
+	return nil
+}
+
+func (ch *memChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(confirm)
+		return confirm
+	}
+	ch.confirms = append(ch.confirms, confirm)
+	return confirm
+}
+
+func (ch *memChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(c)
+		return c
+	}
+	ch.returns = append(ch.returns, c)
+	return c
+}
+
+// Get takes the message at the head of a queue without a consumer, the
+// way basic.get does. ok is false when the queue is empty.
+func (ch *memChannel) Get(queue string, autoAck bool) (msg amqp.Delivery, ok bool, err error) {
+	b, err := ch.lock()
+	if err != nil {
+		return amqp.Delivery{}, false, err
+	}
+	defer b.mu.Unlock()
+	q, found := b.queues[queue]
+	if !found {
+		return amqp.Delivery{}, false, ch.fail(notFound("no queue '%s' in vhost '/'", queue))
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return amqp.Delivery{}, false, ch.fail(resourceLocked("cannot obtain exclusive access to locked queue '%s' in vhost '/'", queue))
+	}
+	if q.kind == queueStream {
+		return amqp.Delivery{}, false, ch.fail(preconditionFailed("queue '%s' in vhost '/' does not support basic.get", queue))
+	}
+	b.touch(q)
+	if len(q.ready) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	m := q.ready[0]
+	q.ready = q.ready[1:]
+	msg = ch.delivery(m, "")
+	msg.MessageCount = uint32(len(q.ready))
+	if !autoAck {
+		ch.unacked[msg.DeliveryTag] = &memPending{msg: m, queue: q}
+	}
+	return msg, true, nil
+}
+
+// QueuePurge drops the messages waiting in a queue and returns how many
+// there were. Deliveries that are out with consumers are left alone.
+func (ch *memChannel) QueuePurge(name string, noWait bool) (int, error) {
+	b, err := ch.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, ch.fail(notFound("no queue '%s' in vhost '/'", name))
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return 0, ch.fail(resourceLocked("cannot obtain exclusive access to locked queue '%s' in vhost '/'", name))
+	}
+	if q.kind == queueStream {
+		return 0, ch.fail(preconditionFailed("queue '%s' in vhost '/' does not support purging", name))
+	}
+	n := len(q.ready)
+	q.ready = nil
+	return n, nil
+}
+
+// Cancel stops a consumer. Deliveries it had not handed to the application
+// yet go straight back to the queue.
+func (ch *memChannel) Cancel(consumer string, noWait bool) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+	if c, ok := ch.consumers[consumer]; ok {
+		b.cancelConsumer(c)
+	}
+	return nil
+}
+
+func (ch *memChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(receiver)
+		return receiver
+	}
+	ch.notify = append(ch.notify, receiver)
+	return receiver
+}
+
+func (ch *memChannel) Close() error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+	b.closeChannel(ch, nil)
+	return nil
+}
+
+// Ack, Nack and Reject implement amqp.Acknowledger.
+
+func (ch *memChannel) Ack(tag uint64, multiple bool) error {
+	return ch.settle(tag, multiple, func(b *MemoryBroker, p *memPending) {})
+}
+
+func (ch *memChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	return ch.settle(tag, multiple, func(b *MemoryBroker, p *memPending) {
+		if requeue {
+			b.giveBack(p.queue, p.msg)
+			return
+		}
+		if b.queues[p.queue.name] == p.queue {
+			b.deadLetter(p.queue, p.msg, "rejected")
+		}
+	})
+}
+
+func (ch *memChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// settle removes one delivery (or, with multiple, every delivery up to and
+// including tag) from the unacked set and applies fn to each of them.
+func (ch *memChannel) settle(tag uint64, multiple bool, fn func(*MemoryBroker, *memPending)) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+	var tags []uint64
+	if multiple {
+		for t := range ch.unacked {
+			if t <= tag {
+				tags = append(tags, t)
+			}
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	} else if _, ok := ch.unacked[tag]; ok {
+		tags = []uint64{tag}
+	}
+	if len(tags) == 0 && !(multiple && tag == 0) {
+		return ch.fail(preconditionFailed("unknown delivery tag %d", tag))
+	}
+	for _, t := range tags {
+		p := ch.unacked[t]
+		delete(ch.unacked, t)
+		if p.consumer != nil {
+			p.consumer.release()
+		}
+		fn(b, p)
+		// A freed prefetch slot may let the consumer take the next message
+		b.dispatch(p.queue)
+	}
+	return nil
+}
+
+// memConsumer forwards deliveries to the application from its own
+// goroutine, so the broker never blocks on a slow handler.
+type memConsumer struct {
+	tag      string
+	queue    *memQueue
+	channel  *memChannel
+	autoAck  bool
+	prefetch int
+	inflight int
+	offset   int64 // next message to deliver, for a stream consumer
+
+	mu      sync.Mutex
+	pending []amqp.Delivery
+	stopped bool
+	wake    chan struct{}
+	done    chan struct{}
+	out     chan amqp.Delivery
+}
+
+func (c *memConsumer) hasCapacity() bool {
+	return c.autoAck || c.prefetch == 0 || c.inflight < c.prefetch
+}
+
+func (c *memConsumer) release() {
+	if c.inflight > 0 {
+		c.inflight--
+	}
+}
+
+// deliver is called with the broker lock held.
+func (c *memConsumer) deliver(msg *memMessage) {
+	d := c.channel.delivery(msg, c.tag)
+	if !c.autoAck {
+		c.channel.unacked[d.DeliveryTag] = &memPending{msg: msg, queue: c.queue, consumer: c}
+		c.inflight++
+	}
+	c.mu.Lock()
+	c.pending = append(c.pending, d)
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// delivery hands msg out on ch under the next delivery tag. The caller
+// holds the broker lock.
+func (ch *memChannel) delivery(msg *memMessage, consumerTag string) amqp.Delivery {
+	ch.lastTag++
+	pub := msg.pub
+	headers := pub.Headers
+	// Quorum queues say how often a message came back, and streams where it is
+	var extra amqp.Table
+	if msg.returned > 0 {
+		extra = amqp.Table{"x-delivery-count": msg.returned}
+	}
+	if msg.stream {
+		extra = amqp.Table{"x-stream-offset": msg.offset}
+	}
+	if extra != nil {
+		headers = amqp.Table{}
+		for k, v := range pub.Headers {
+			headers[k] = v
+		}
+		for k, v := range extra {
+			headers[k] = v
+		}
+	}
+	return amqp.Delivery{
+		Acknowledger:    ch,
+		Headers:         headers,
+		ContentType:     pub.ContentType,
+		ContentEncoding: pub.ContentEncoding,
+		DeliveryMode:    pub.DeliveryMode,
+		Priority:        pub.Priority,
+		CorrelationId:   pub.CorrelationId,
+		ReplyTo:         pub.ReplyTo,
+		Expiration:      pub.Expiration,
+		MessageId:       pub.MessageId,
+		Timestamp:       pub.Timestamp,
+		Type:            pub.Type,
+		UserId:          pub.UserId,
+		AppId:           pub.AppId,
+		ConsumerTag:     consumerTag,
+		DeliveryTag:     ch.lastTag,
+		Redelivered:     msg.redelivered,
+		Exchange:        msg.exchange,
+		RoutingKey:      msg.key,
+		Body:            pub.Body,
+	}
+}
+
+// stop shuts the forwarding goroutine down and returns the deliveries it
+// never got to hand over.
+func (c *memConsumer) stop() []amqp.Delivery {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return nil
+	}
+	c.stopped = true
+	close(c.done)
+	left := c.pending
+	c.pending = nil
+	return left
+}
+
+func (c *memConsumer) run() {
+	defer close(c.out)
+	for {
+		c.mu.Lock()
+		if c.stopped {
+			c.mu.Unlock()
+			return
+		}
+		if len(c.pending) == 0 {
+			c.mu.Unlock()
+			select {
+			case <-c.wake:
+			case <-c.done:
+				return
+			}
+			continue
+		}
+		d := c.pending[0]
+		c.pending = c.pending[1:]
+		c.mu.Unlock()
+		select {
+		case c.out <- d:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// memEvents runs one channel's confirm and return notifications in order on
+// a goroutine of its own, so listeners are served the way the real client's
+// reader goroutine serves them.
+type memEvents struct {
+	mu    sync.Mutex
+	queue []func()
+	wake  chan struct{}
+}
+
+func newMemEvents() *memEvents {
+	e := &memEvents{wake: make(chan struct{}, 1)}
+	go e.run()
+	return e
+}
+
+// post queues fn to run after everything posted before it. Posting nil
+// stops the goroutine once the queue ahead of it has drained.
+func (e *memEvents) post(fn func()) {
+	e.mu.Lock()
+	e.queue = append(e.queue, fn)
+	e.mu.Unlock()
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (e *memEvents) run() {
+	for {
+		e.mu.Lock()
+		if len(e.queue) == 0 {
+			e.mu.Unlock()
+			<-e.wake
+			continue
+		}
+		fn := e.queue[0]
+		e.queue = e.queue[1:]
+		e.mu.Unlock()
+		if fn == nil {
+			return
+		}
+		fn()
+	}
+}
+
+// streamOffset works out where a new consumer of a stream starts from its
+// x-stream-offset argument. ok is false if the argument is not valid.
+func streamOffset(q *memQueue, arg any) (offset int64, ok bool) {
+	end := int64(len(q.ready))
+	switch v := arg.(type) {
+	case nil:
+		return end, true
+	case string:
+		switch v {
+		case "first":
+			return 0, true
+		case "last":
+			if end == 0 {
+				return 0, true
+			}
+			return end - 1, true
+		case "next":
+			return end, true
+		}
+		return 0, false
+	case time.Time:
+		// AMQP timestamps only have whole seconds
+		for i, msg := range q.ready {
+			if msg.published.Unix() >= v.Unix() {
+				return int64(i), true
+			}
+		}
+		return end, true
+	}
+	n, ok := tableInt(amqp.Table{"offset": arg}, "offset")
+	if !ok || n < 0 {
+		return 0, false
+	}
+	if n > end {
+		n = end
+	}
+	return n, true
+}
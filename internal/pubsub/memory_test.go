@@ -0,0 +1,391 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// memTestChannel dials broker and opens a channel on it.
+func memTestChannel(t *testing.T, broker *MemoryBroker) *memChannel {
+	t.Helper()
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch.(*memChannel)
+}
+
+func declareQueue(t *testing.T, ch Channel, name string, args amqp.Table, bindings ...[2]string) {
+	t.Helper()
+	if _, err := ch.QueueDeclare(name, true, false, false, false, args); err != nil {
+		t.Fatalf("declare %s: %v", name, err)
+	}
+	for _, b := range bindings {
+		if err := ch.QueueBind(name, b[1], b[0], false, nil); err != nil {
+			t.Fatalf("bind %s to %s with %s: %v", name, b[0], b[1], err)
+		}
+	}
+}
+
+func publishText(t *testing.T, ch Channel, exchange, key, body string) {
+	t.Helper()
+	err := ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{Body: []byte(body)})
+	if err != nil {
+		t.Fatalf("publish to %s with %s: %v", exchange, key, err)
+	}
+}
+
+// get takes the next message off queue, failing if there isn't one.
+func get(t *testing.T, ch *memChannel, queue string) amqp.Delivery {
+	t.Helper()
+	d, ok, err := ch.Get(queue, false)
+	if err != nil || !ok {
+		t.Fatalf("get from %s: ok %v, %v", queue, ok, err)
+	}
+	return d
+}
+
+func queueLength(t *testing.T, broker *MemoryBroker, name string) int {
+	t.Helper()
+	n, ok := broker.QueueLength(name)
+	if !ok {
+		t.Fatalf("queue %s doesn't exist", name)
+	}
+	return n
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"army_moves.*", "army_moves.alice", true},
+		{"army_moves.*", "army_moves", false},
+		{"army_moves.*", "army_moves.alice.bob", false},
+		{"war.#", "war", true},
+		{"war.#", "war.alice.bob", true},
+		{"#", "anything.at.all", true},
+		{"#.bob", "war.alice.bob", true},
+		{"*.alice.#", "war.alice", true},
+		{"*.alice.#", "war.bob", false},
+		{"game_logs.alice", "game_logs.alice", true},
+		{"game_logs.alice", "game_logs.bob", false},
+	}
+	for _, tt := range tests {
+		if got := MatchTopic(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("MatchTopic(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryRouting(t *testing.T) {
+	broker := NewMemoryBroker()
+	ch := memTestChannel(t, broker)
+	if err := ch.ExchangeDeclare("fan", amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	declareQueue(t, ch, "moves", nil, [2]string{"amq.topic", "army_moves.*"})
+	declareQueue(t, ch, "everything", nil, [2]string{"amq.topic", "#"}, [2]string{"fan", ""})
+	declareQueue(t, ch, "pause", nil, [2]string{"amq.direct", "pause"})
+
+	publishText(t, ch, "amq.topic", "army_moves.alice", "move")
+	publishText(t, ch, "amq.topic", "war.alice", "war")
+	publishText(t, ch, "amq.direct", "pause", "pause")
+	publishText(t, ch, "amq.direct", "resume", "nobody hears this")
+	publishText(t, ch, "fan", "ignored", "fanned")
+	publishText(t, ch, "", "moves", "straight to the queue")
+
+	want := map[string]int{"moves": 2, "everything": 3, "pause": 1}
+	for q, n := range want {
+		if got := queueLength(t, broker, q); got != n {
+			t.Errorf("%s has %d messages, want %d", q, got, n)
+		}
+	}
+	if d := get(t, ch, "moves"); string(d.Body) != "move" || d.Exchange != "amq.topic" || d.RoutingKey != "army_moves.alice" {
+		t.Errorf("first move is %q via %s with %s", d.Body, d.Exchange, d.RoutingKey)
+	}
+}
+
+func TestMemoryMandatoryReturn(t *testing.T) {
+	broker := NewMemoryBroker()
+	ch := memTestChannel(t, broker)
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	err := ch.PublishWithContext(context.Background(), "amq.direct", "nowhere", true, false, amqp.Publishing{MessageId: "lost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-returns:
+		if r.ReplyCode != amqp.NoRoute || r.MessageId != "lost" {
+			t.Fatalf("returned %d for %s, want NO_ROUTE for lost", r.ReplyCode, r.MessageId)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("unroutable mandatory publish wasn't returned")
+	}
+}
+
+func TestMemoryUnknownExchangeClosesChannel(t *testing.T) {
+	broker := NewMemoryBroker()
+	ch := memTestChannel(t, broker)
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	err := ch.PublishWithContext(context.Background(), "missing", "key", false, false, amqp.Publishing{})
+	var aerr *amqp.Error
+	if !errors.As(err, &aerr) || aerr.Code != amqp.NotFound {
+		t.Fatalf("publish to a missing exchange = %v, want NOT_FOUND", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("channel stayed open after a channel error")
+	}
+	if _, _, err := ch.Get("anything", false); err == nil {
+		t.Fatal("used a closed channel")
+	}
+}
+
+func TestMemoryAckNackRequeue(t *testing.T) {
+	broker := NewMemoryBroker()
+	ch := memTestChannel(t, broker)
+	declareQueue(t, ch, "q", nil)
+	publishText(t, ch, "", "q", "first")
+	publishText(t, ch, "", "q", "second")
+
+	d := get(t, ch, "q")
+	if d.Redelivered {
+		t.Fatal("first delivery marked redelivered")
+	}
+	if err := d.Nack(false, true); err != nil {
+		t.Fatal(err)
+	}
+	// Requeued messages go back where they were, at the head
+	d = get(t, ch, "q")
+	if string(d.Body) != "first" || !d.Redelivered {
+		t.Fatalf("after requeue got %q, redelivered %v, want first, redelivered", d.Body, d.Redelivered)
+	}
+	if err := d.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+
+	second := get(t, ch, "q")
+	if err := second.Reject(false); err != nil {
+		t.Fatal(err)
+	}
+	if n := queueLength(t, broker, "q"); n != 0 {
+		t.Fatalf("%d messages left, want none", n)
+	}
+	// Settling a delivery twice is a channel error, as it is on RabbitMQ
+	if err := d.Ack(false); err == nil {
+		t.Fatal("acked the same delivery twice")
+	}
+}
+
+func TestMemoryUnackedReturnOnClose(t *testing.T) {
+	broker := NewMemoryBroker()
+	ch := memTestChannel(t, broker)
+	declareQueue(t, ch, "q", nil)
+	publishText(t, ch, "", "q", "held")
+	get(t, ch, "q")
+	if n := queueLength(t, broker, "q"); n != 0 {
+		t.Fatalf("%d ready while the message is unacked, want 0", n)
+	}
+	ch.Close()
+	if n := queueLength(t, broker, "q"); n != 1 {
+		t.Fatalf("%d ready after closing the channel, want the unacked message back", n)
+	}
+}
+
+func TestMemoryConsumePrefetch(t *testing.T) {
+	broker := NewMemoryBroker()
+	ch := memTestChannel(t, broker)
+	declareQueue(t, ch, "q", nil)
+	for _, body := range []string{"1", "2", "3"} {
+		publishText(t, ch, "", "q", body)
+	}
+	if err := ch.Qos(1, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := ch.Consume("q", "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"1", "2", "3"} {
+		var d amqp.Delivery
+		select {
+		case d = <-deliveries:
+		case <-time.After(time.Second):
+			t.Fatalf("nothing delivered, want %s", want)
+		}
+		if string(d.Body) != want {
+			t.Fatalf("got %s, want %s", d.Body, want)
+		}
+		// With a prefetch of 1 nothing else comes until this is acked
+		select {
+		case extra := <-deliveries:
+			t.Fatalf("got %s past the prefetch", extra.Body)
+		case <-time.After(20 * time.Millisecond):
+		}
+		if err := d.Ack(false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMemoryDeadLettering(t *testing.T) {
+	broker := NewMemoryBroker()
+	ch := memTestChannel(t, broker)
+	if err := ch.ExchangeDeclare("dlx", amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	declareQueue(t, ch, "dlq", nil, [2]string{"dlx", ""})
+	declareQueue(t, ch, "q", amqp.Table{"x-dead-letter-exchange": "dlx"}, [2]string{"amq.topic", "war.*"})
+
+	publishText(t, ch, "amq.topic", "war.alice", "rejected")
+	if err := get(t, ch, "q").Nack(false, false); err != nil {
+		t.Fatal(err)
+	}
+	d := get(t, ch, "dlq")
+	if string(d.Body) != "rejected" || d.RoutingKey != "war.alice" {
+		t.Fatalf("dead-lettered %q with %s, want rejected with war.alice", d.Body, d.RoutingKey)
+	}
+	deaths, _ := d.Headers["x-death"].([]interface{})
+	if len(deaths) != 1 {
+		t.Fatalf("x-death is %v, want one entry", d.Headers["x-death"])
+	}
+	death := deaths[0].(amqp.Table)
+	if death["queue"] != "q" || death["reason"] != "rejected" || death["exchange"] != "amq.topic" || death["count"] != int64(1) {
+		t.Fatalf("x-death entry is %v", death)
+	}
+	if d.Headers["x-first-death-reason"] != "rejected" || d.Headers["x-first-death-queue"] != "q" {
+		t.Fatalf("first death headers are %v", d.Headers)
+	}
+
+	// Dying the same way again bumps the count rather than adding an entry
+	if err := d.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+	err := ch.PublishWithContext(context.Background(), "", "q", false, false, amqp.Publishing{Headers: d.Headers, Body: d.Body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(t, ch, "q").Reject(false); err != nil {
+		t.Fatal(err)
+	}
+	deaths, _ = get(t, ch, "dlq").Headers["x-death"].([]interface{})
+	if len(deaths) != 1 || deaths[0].(amqp.Table)["count"] != int64(2) {
+		t.Fatalf("x-death after dying twice is %v, want one entry with count 2", deaths)
+	}
+}
+
+func TestMemoryDeadLetterRequeueIsNotDeath(t *testing.T) {
+	broker := NewMemoryBroker()
+	ch := memTestChannel(t, broker)
+	declareQueue(t, ch, "dlq", nil, [2]string{"amq.fanout", ""})
+	declareQueue(t, ch, "q", amqp.Table{"x-dead-letter-exchange": "amq.fanout"})
+	publishText(t, ch, "", "q", "back")
+	if err := get(t, ch, "q").Nack(false, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := queueLength(t, broker, "dlq"); n != 0 {
+		t.Fatalf("requeued message was dead-lettered too (%d in dlq)", n)
+	}
+}
+
+func TestMemoryMessageTTL(t *testing.T) {
+	broker := NewMemoryBroker()
+	ch := memTestChannel(t, broker)
+	declareQueue(t, ch, "dlq", nil, [2]string{"amq.fanout", ""})
+	declareQueue(t, ch, "q", amqp.Table{"x-dead-letter-exchange": "amq.fanout", "x-message-ttl": int64(20)})
+	publishText(t, ch, "", "q", "stale")
+	waitFor(t, "the message to expire", func() bool {
+		n, _ := broker.QueueLength("dlq")
+		return n == 1
+	})
+	if reason := get(t, ch, "dlq").Headers["x-first-death-reason"]; reason != "expired" {
+		t.Fatalf("dead-lettered as %v, want expired", reason)
+	}
+}
+
+func TestMemoryQuorumDeliveryLimit(t *testing.T) {
+	broker := NewMemoryBroker()
+	ch := memTestChannel(t, broker)
+	declareQueue(t, ch, "dlq", nil, [2]string{"amq.fanout", ""})
+	declareQueue(t, ch, "q", amqp.Table{
+		"x-queue-type":           "quorum",
+		"x-delivery-limit":       int64(2),
+		"x-dead-letter-exchange": "amq.fanout",
+	})
+	publishText(t, ch, "", "q", "poison")
+	for i := int64(0); i < 3; i++ {
+		d := get(t, ch, "q")
+		if count, _ := tableInt(d.Headers, "x-delivery-count"); count != i {
+			t.Fatalf("delivery %d has x-delivery-count %d", i, count)
+		}
+		if err := d.Nack(false, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := queueLength(t, broker, "q"); n != 0 {
+		t.Fatalf("%d left in the queue past the delivery limit", n)
+	}
+	if reason := get(t, ch, "dlq").Headers["x-first-death-reason"]; reason != "delivery_limit" {
+		t.Fatalf("dead-lettered as %v, want delivery_limit", reason)
+	}
+}
+
+func TestMemoryExclusiveAutoDelete(t *testing.T) {
+	broker := NewMemoryBroker()
+	owner := memTestChannel(t, broker)
+	if _, err := owner.QueueDeclare("mine", false, true, true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	other := memTestChannel(t, broker)
+	_, err := other.QueueDeclare("mine", false, true, true, false, nil)
+	var aerr *amqp.Error
+	if !errors.As(err, &aerr) || aerr.Code != amqp.ResourceLocked {
+		t.Fatalf("declaring someone else's exclusive queue = %v, want RESOURCE_LOCKED", err)
+	}
+
+	if _, err := owner.Consume("mine", "c", false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.Cancel("c", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := broker.QueueLength("mine"); ok {
+		t.Fatal("auto-delete queue outlived its last consumer")
+	}
+}
+
+func TestMemoryRestartKeepsDurable(t *testing.T) {
+	broker := NewMemoryBroker()
+	ch := memTestChannel(t, broker)
+	declareQueue(t, ch, "kept", nil)
+	if _, err := ch.QueueDeclare("lost", false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	publishText(t, ch, "", "kept", "transient")
+	err := ch.PublishWithContext(context.Background(), "", "kept", false, false, amqp.Publishing{DeliveryMode: amqp.Persistent})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker.Restart()
+	if _, err := ch.QueueDeclare("kept", true, false, false, false, nil); err == nil {
+		t.Fatal("a channel survived the broker restarting")
+	}
+	if _, ok := broker.QueueLength("lost"); ok {
+		t.Fatal("non-durable queue survived a restart")
+	}
+	if n := queueLength(t, broker, "kept"); n != 1 {
+		t.Fatalf("durable queue has %d messages after a restart, want just the persistent one", n)
+	}
+}
@@ -0,0 +1,187 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Message is a decoded delivery together with its metadata, for handlers
+// registered with SubscribeMessages.
+type Message[T any] struct {
+	Body T
+
+	MessageID     string
+	CorrelationID string
+	ReplyTo       string
+	Timestamp     time.Time
+	AppID         string
+	ContentType   string
+	Headers       amqp.Table
+
+	// Where the message was published. For a retried message these are
+	// the original exchange and routing key, not the delay queue's.
+	Exchange   string
+	RoutingKey string
+
+	// Redelivered is set when the broker delivered the message before
+	// without it being acked, for example to a consumer that went away.
+	Redelivered bool
+	// Retries counts how many times NackRetryLater has sent it round.
+	Retries int
+	// DeliveryCount is how many times a quorum queue has had the message
+	// back unsettled before this delivery (see WithDeliveryLimit).
+	DeliveryCount int
+}
+
+// deliveryCountHeader is set by quorum queues on messages they deliver
+// again.
+const deliveryCountHeader = "x-delivery-count"
+
+func newMessage[T any](body T, d amqp.Delivery) Message[T] {
+	m := Message[T]{
+		Body:          body,
+		MessageID:     d.MessageId,
+		CorrelationID: d.CorrelationId,
+		ReplyTo:       d.ReplyTo,
+		Timestamp:     d.Timestamp,
+		AppID:         d.AppId,
+		ContentType:   d.ContentType,
+		Headers:       d.Headers,
+		Exchange:      d.Exchange,
+		RoutingKey:    d.RoutingKey,
+		Redelivered:   d.Redelivered,
+		Retries:       retryCount(d.Headers),
+	}
+	if n, ok := tableInt(d.Headers, deliveryCountHeader); ok {
+		m.DeliveryCount = int(n)
+	}
+	if ex, ok := d.Headers[originalExchangeHeader].(string); ok {
+		m.Exchange = ex
+		m.RoutingKey, _ = d.Headers[originalRoutingKeyHeader].(string)
+	}
+	return m
+}
+
+// Header returns a string header, or "" if it is missing or not a string.
+func (m Message[T]) Header(key string) string {
+	s, _ := m.Headers[key].(string)
+	return s
+}
+
+// PublishOption sets a property of a message published with Publish (or
+// PublishJSON and PublishGob). Every message gets a random message ID and
+// the current time as its timestamp unless an option says otherwise.
+type PublishOption func(*amqp.Publishing)
+
+// WithMessageID replaces the generated message ID.
+func WithMessageID(id string) PublishOption {
+	return func(p *amqp.Publishing) {
+		p.MessageId = id
+	}
+}
+
+// WithTimestamp replaces the publish time as the message's timestamp.
+func WithTimestamp(t time.Time) PublishOption {
+	return func(p *amqp.Publishing) {
+		p.Timestamp = t
+	}
+}
+
+// WithAppID names the application that published the message.
+func WithAppID(id string) PublishOption {
+	return func(p *amqp.Publishing) {
+		p.AppId = id
+	}
+}
+
+// WithHeader sets one header.
+func WithHeader(key string, value any) PublishOption {
+	return func(p *amqp.Publishing) {
+		if p.Headers == nil {
+			p.Headers = amqp.Table{}
+		}
+		p.Headers[key] = value
+	}
+}
+
+// WithHeaders sets several headers, keeping any set before.
+func WithHeaders(headers amqp.Table) PublishOption {
+	return func(p *amqp.Publishing) {
+		for k, v := range headers {
+			WithHeader(k, v)(p)
+		}
+	}
+}
+
+// newPublishing stamps a message body with a fresh ID and timestamp, then
+// applies opts.
+func newPublishing(contentType string, body []byte, opts []PublishOption) amqp.Publishing {
+	pub := amqp.Publishing{
+		ContentType: contentType,
+		Body:        body,
+		MessageId:   newMessageID(),
+		Timestamp:   time.Now(),
+	}
+	for _, opt := range opts {
+		opt(&pub)
+	}
+	return pub
+}
+
+// newMessageID returns a random version 4 UUID.
+func newMessageID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// crypto/rand doesn't fail on any platform we run on
+		panic(fmt.Sprintf("could not generate message ID: %v", err))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// Stamp returns a Sender that applies opts to every message published
+// through ch, so that for example a whole program's messages carry its app
+// ID. What a message already has (its own app ID, or a header of the same
+// name) takes precedence.
+func Stamp(ch Sender, opts ...PublishOption) Sender {
+	return &stampingSender{Sender: ch, opts: opts}
+}
+
+type stampingSender struct {
+	Sender
+	opts []PublishOption
+}
+
+func (s *stampingSender) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	var defaults amqp.Publishing
+	for _, opt := range s.opts {
+		opt(&defaults)
+	}
+	if msg.MessageId == "" {
+		msg.MessageId = defaults.MessageId
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = defaults.Timestamp
+	}
+	if msg.AppId == "" {
+		msg.AppId = defaults.AppId
+	}
+	if len(defaults.Headers) > 0 {
+		headers := amqp.Table{}
+		for k, v := range defaults.Headers {
+			headers[k] = v
+		}
+		for k, v := range msg.Headers {
+			headers[k] = v
+		}
+		msg.Headers = headers
+	}
+	return s.Sender.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
@@ -0,0 +1,268 @@
+package pubsub
+
+import (
+	"context"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Handler handles one decoded message, as passed to SubscribeMessages.
+type Handler[T any] func(Message[T]) Acktype
+
+// Middleware wraps a Handler with behaviour of its own, such as recovering
+// from panics or logging. It can act before and after calling next, change
+// what it returns, or not call it at all.
+type Middleware[T any] func(next Handler[T]) Handler[T]
+
+// Chain wraps handler in middleware. The first middleware is the outermost,
+// so it sees every message first and has the last word on how it is
+// settled; put Recover first so that it also catches panics in the rest:
+//
+//	pubsub.Chain(handler, pubsub.Recover[T](nil), pubsub.Logging[T](nil))
+func Chain[T any](handler Handler[T], mw ...Middleware[T]) Handler[T] {
+	for i := len(mw) - 1; i >= 0; i-- {
+		handler = mw[i](handler)
+	}
+	return handler
+}
+
+// BodyHandler adapts a handler that only needs the message body, like the
+// ones passed to Subscribe, so that middleware can be chained onto it.
+func BodyHandler[T any](handler func(T) Acktype) Handler[T] {
+	return func(msg Message[T]) Acktype {
+		return handler(msg.Body)
+	}
+}
+
+// Recover stops a panicking handler from taking the process down with it.
+// The panic and its stack are logged to logger (slog.Default() if nil) and
+// the message is nacked without requeueing, which sends it to the
+// dead-letter exchange: redelivering it would most likely panic again.
+func Recover[T any](logger *slog.Logger) Middleware[T] {
+	logger = loggerOrDefault(logger)
+	return func(next Handler[T]) Handler[T] {
+		return func(msg Message[T]) (ack Acktype) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Error("handler panicked",
+						messageAttrs(msg),
+						slog.Any("panic", r),
+						slog.String("stack", string(debug.Stack())),
+					)
+					ack = NackDiscard
+				}
+			}()
+			return next(msg)
+		}
+	}
+}
+
+// Logging logs every message to logger (slog.Default() if nil) once it
+// has been handled, with its ID, exchange, routing key, delivery count, how
+// it was settled and how long it took. Acked messages are logged at debug
+// level, ones that will be tried again at info level, and discarded ones
+// at warn level.
+func Logging[T any](logger *slog.Logger) Middleware[T] {
+	logger = loggerOrDefault(logger)
+	return func(next Handler[T]) Handler[T] {
+		return func(msg Message[T]) Acktype {
+			start := time.Now()
+			ack := next(msg)
+			level := slog.LevelDebug
+			switch ack {
+			case NackRequeue, NackRetryLater:
+				level = slog.LevelInfo
+			case NackDiscard:
+				level = slog.LevelWarn
+			}
+			logger.LogAttrs(context.Background(), level, "handled message",
+				messageAttrs(msg),
+				slog.String("ack", ack.String()),
+				slog.Duration("took", time.Since(start)),
+			)
+			return ack
+		}
+	}
+}
+
+// Timing measures how long the rest of the chain takes to handle each
+// message and passes it to observe, along with the message and how it was
+// settled, for example to feed a histogram or flag slow handlers.
+func Timing[T any](observe func(msg Message[T], ack Acktype, elapsed time.Duration)) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(msg Message[T]) Acktype {
+			start := time.Now()
+			ack := next(msg)
+			observe(msg, ack, time.Since(start))
+			return ack
+		}
+	}
+}
+
+// Timeout gives up on a handler that hasn't returned within d and settles
+// the message with onTimeout instead (NackRetryLater is usually the right
+// choice). Go can't stop the handler, so it carries on in the background
+// and whatever it returns is ignored; it must be safe for it to run
+// again, on the redelivered message, at the same time. So it's no use for
+// handlers that change state or publish, which would do it twice; use
+// WarnAfter for those. A panic in time is
+// passed on to the middleware outside, and one after the timeout is
+// logged to logger (slog.Default() if nil), as is the timeout itself.
+func Timeout[T any](d time.Duration, onTimeout Acktype, logger *slog.Logger) Middleware[T] {
+	logger = loggerOrDefault(logger)
+	return func(next Handler[T]) Handler[T] {
+		return func(msg Message[T]) Acktype {
+			type result struct {
+				ack      Acktype
+				panicked any
+			}
+			// Buffered, so the handler can finish after we've stopped waiting
+			done := make(chan result, 1)
+			go func() {
+				defer func() {
+					if r := recover(); r != nil {
+						done <- result{panicked: r}
+					}
+				}()
+				done <- result{ack: next(msg)}
+			}()
+
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			select {
+			case res := <-done:
+				if res.panicked != nil {
+					panic(res.panicked)
+				}
+				return res.ack
+			case <-timer.C:
+				logger.Warn("handler timed out", messageAttrs(msg), slog.Duration("after", d), slog.String("ack", onTimeout.String()))
+				go func() {
+					if res := <-done; res.panicked != nil {
+						logger.Error("handler panicked after timing out", messageAttrs(msg), slog.Any("panic", res.panicked))
+					}
+				}()
+				return onTimeout
+			}
+		}
+	}
+}
+
+// WarnAfter logs a warning to logger (slog.Default() if nil) when a
+// handler is still running d after it started. Unlike Timeout it goes on
+// waiting for the handler, and settles the message however it says.
+func WarnAfter[T any](d time.Duration, logger *slog.Logger) Middleware[T] {
+	logger = loggerOrDefault(logger)
+	return func(next Handler[T]) Handler[T] {
+		return func(msg Message[T]) Acktype {
+			timer := time.AfterFunc(d, func() {
+				logger.Warn("handler is still running", messageAttrs(msg), slog.Duration("after", d))
+			})
+			defer timer.Stop()
+			return next(msg)
+		}
+	}
+}
+
+// Dedup drops a message whose ID it has already seen, acking it without
+// calling the handler, so that a message published twice is only handled
+// once. That happens when a publisher can't tell whether its first try got
+// through, as when an Outbox replays what it hadn't marked sent before a
+// crash. It remembers the last size IDs it has handled, and logs the
+// duplicates to logger (slog.Default() if nil). Messages without an ID
+// always go through.
+//
+// A message counts as handled once the handler acks it, and a copy that
+// arrives while it's still being handled is dropped too. One that's
+// discarded, requeued, retried later or panics is forgotten, so that it's
+// handled again when it comes back, whether from its queue or replayed
+// from the dead-letter queue.
+func Dedup[T any](size int, logger *slog.Logger) Middleware[T] {
+	logger = loggerOrDefault(logger)
+	return func(next Handler[T]) Handler[T] {
+		seen := newSeenSet(size)
+		return func(msg Message[T]) Acktype {
+			if msg.MessageID == "" {
+				return next(msg)
+			}
+			if !seen.add(msg.MessageID) {
+				logger.Info("dropping duplicate message", messageAttrs(msg))
+				return Ack
+			}
+			handled := false
+			defer func() {
+				if !handled {
+					seen.remove(msg.MessageID)
+				}
+			}()
+			ack := next(msg)
+			handled = ack == Ack
+			return ack
+		}
+	}
+}
+
+// seenSet remembers the last IDs added to it, up to a fixed number.
+type seenSet struct {
+	mu    sync.Mutex
+	ids   map[string]bool
+	order []string // a ring of the IDs in ids, oldest at next
+	next  int
+}
+
+func newSeenSet(size int) *seenSet {
+	if size < 1 {
+		size = 1
+	}
+	return &seenSet{ids: map[string]bool{}, order: make([]string, size)}
+}
+
+// add remembers id, forgetting the oldest if need be, and reports false if
+// it was already there.
+func (s *seenSet) add(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ids[id] {
+		return false
+	}
+	if old := s.order[s.next]; old != "" {
+		delete(s.ids, old)
+	}
+	s.order[s.next] = id
+	s.next = (s.next + 1) % len(s.order)
+	s.ids[id] = true
+	return true
+}
+
+// remove forgets id. Messages are rarely put back, so it's fine to look
+// through the ring for it.
+func (s *seenSet) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.ids, id)
+	for i, other := range s.order {
+		if other == id {
+			s.order[i] = ""
+		}
+	}
+}
+
+// messageAttrs groups what the middleware log about a message.
+func messageAttrs[T any](msg Message[T]) slog.Attr {
+	return slog.Group("message",
+		slog.String("id", msg.MessageID),
+		slog.String("exchange", msg.Exchange),
+		slog.String("routing_key", msg.RoutingKey),
+		slog.Bool("redelivered", msg.Redelivered),
+		slog.Int("retries", msg.Retries),
+	)
+}
+
+func loggerOrDefault(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
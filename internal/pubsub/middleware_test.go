@@ -0,0 +1,135 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestDedup(t *testing.T) {
+	calls := map[string]int{}
+	ack := Ack
+	handler := Chain(func(msg Message[int]) Acktype {
+		calls[msg.MessageID]++
+		return ack
+	}, Dedup[int](2, discardLogger))
+	handle := func(id string) Acktype {
+		return handler(Message[int]{MessageID: id})
+	}
+
+	handle("a")
+	if got := handle("a"); got != Ack || calls["a"] != 1 {
+		t.Fatalf("duplicate: settled %v, handled %d times, want Ack and once", got, calls["a"])
+	}
+	// Messages without an ID can't be told apart, so they all go through
+	handle("")
+	handle("")
+	if calls[""] != 2 {
+		t.Fatalf("messages without an ID handled %d times, want 2", calls[""])
+	}
+	// Only the last two IDs are remembered
+	handle("b")
+	handle("c")
+	handle("a")
+	if calls["a"] != 2 {
+		t.Fatalf("a handled %d times after being forgotten, want 2", calls["a"])
+	}
+
+	// A message that's put back is handled again when it returns
+	ack = NackRetryLater
+	handle("d")
+	ack = Ack
+	handle("d")
+	handle("d")
+	if calls["d"] != 2 {
+		t.Fatalf("retried message handled %d times, want 2", calls["d"])
+	}
+	// So is one that's discarded, since it can be replayed from the
+	// dead-letter queue
+	ack = NackDiscard
+	handle("e")
+	ack = Ack
+	handle("e")
+	if calls["e"] != 2 {
+		t.Fatalf("discarded message handled %d times, want 2", calls["e"])
+	}
+}
+
+// A message the handler discards and that's then replayed from the
+// dead-letter queue has the same ID, and must reach the handler again.
+func TestDedupReplayedDeadLetter(t *testing.T) {
+	conn, err := NewMemoryBroker().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := DeclareDeadLetterQueue(conn); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	calls := 0
+	sub, err := SubscribeMessages(ctx, conn, "amq.topic", "moves", "moves.*", SimpleQueueDurable,
+		Chain(func(msg Message[int]) Acktype {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			if calls == 1 {
+				return NackDiscard
+			}
+			return Ack
+		}, Dedup[int](100, discardLogger)),
+		WithLogger(discardLogger),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if err := PublishJSON(ch, "amq.topic", "moves.alice", 1, WithMessageID("move-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	var letters []DeadLetter
+	waitFor(t, "the message to be dead-lettered", func() bool {
+		letters, err = InspectDeadLetters(conn, routing.QueuePerilDLQ)
+		return err == nil && len(letters) == 1
+	})
+	n, err := ReplayDeadLetters(ctx, conn, routing.QueuePerilDLQ)
+	if err != nil || n != 1 {
+		t.Fatalf("replayed %d dead letters: %v, want 1", n, err)
+	}
+	waitFor(t, "the replay to be handled", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls == 2
+	})
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 {
+		t.Fatalf("handler called %d times, want 2", calls)
+	}
+}
+
+func TestSeenSetRemoveFreesSlot(t *testing.T) {
+	s := newSeenSet(3)
+	s.add("a")
+	s.remove("a")
+	s.add("b")
+	s.add("a")
+	// c takes the slot a had first, which mustn't take the second a with it
+	s.add("c")
+	if s.add("a") {
+		t.Fatal("a was forgotten when its old slot was reused")
+	}
+}
@@ -0,0 +1,808 @@
+package pubsub
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// msgpackCodec encodes values as MessagePack (https://msgpack.org), which
+// is usually a good deal smaller than JSON and, unlike gob, doesn't repeat
+// type information in every message. Structs are written as maps keyed by
+// field name, or by the name in a `msgpack:"name"` tag ("-" skips the
+// field). time.Time uses the standard timestamp extension.
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string { return "application/msgpack" }
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	var e msgpackEncoder
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("msgpack: Unmarshal needs a non-nil pointer, got %T", v)
+	}
+	d := msgpackDecoder{data: data}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return fmt.Errorf("msgpack: %d bytes left over after the value", len(d.data)-d.pos)
+	}
+	return nil
+}
+
+// timestampExt is the extension type MessagePack reserves for timestamps.
+const timestampExt = -1
+
+var timeType = reflect.TypeOf(time.Time{})
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) byte(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *msgpackEncoder) uint16(n uint16) {
+	e.buf = binary.BigEndian.AppendUint16(e.buf, n)
+}
+
+func (e *msgpackEncoder) uint32(n uint32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, n)
+}
+
+func (e *msgpackEncoder) uint64(n uint64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, n)
+}
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.byte(0xc0)
+		return nil
+	}
+	if v.Type() == timeType {
+		e.encodeTime(v.Interface().(time.Time))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			e.byte(0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.byte(0xc3)
+		} else {
+			e.byte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.byte(0xca)
+		e.uint32(math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.byte(0xcb)
+		e.uint64(math.Float64bits(v.Float()))
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.byte(0xc0)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.encodeBytes(v.Bytes())
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Array:
+		return e.encodeArray(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.byte(0xc0)
+			return nil
+		}
+		e.mapHeader(v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := e.encode(iter.Key()); err != nil {
+				return err
+			}
+			if err := e.encode(iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fields := msgpackFields(v.Type())
+		e.mapHeader(len(fields))
+		for _, f := range fields {
+			e.encodeString(f.name)
+			if err := e.encode(v.Field(f.index)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: cannot encode %s", v.Type())
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) encodeInt(n int64) {
+	switch {
+	case n >= 0:
+		e.encodeUint(uint64(n))
+	case n >= -32:
+		e.byte(byte(int8(n)))
+	case n >= math.MinInt8:
+		e.byte(0xd0)
+		e.byte(byte(int8(n)))
+	case n >= math.MinInt16:
+		e.byte(0xd1)
+		e.uint16(uint16(int16(n)))
+	case n >= math.MinInt32:
+		e.byte(0xd2)
+		e.uint32(uint32(int32(n)))
+	default:
+		e.byte(0xd3)
+		e.uint64(uint64(n))
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(n uint64) {
+	switch {
+	case n < 0x80:
+		e.byte(byte(n))
+	case n <= math.MaxUint8:
+		e.byte(0xcc)
+		e.byte(byte(n))
+	case n <= math.MaxUint16:
+		e.byte(0xcd)
+		e.uint16(uint16(n))
+	case n <= math.MaxUint32:
+		e.byte(0xce)
+		e.uint32(uint32(n))
+	default:
+		e.byte(0xcf)
+		e.uint64(n)
+	}
+}
+
+func (e *msgpackEncoder) encodeString(s string) {
+	switch n := len(s); {
+	case n < 32:
+		e.byte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		e.byte(0xd9)
+		e.byte(byte(n))
+	case n <= math.MaxUint16:
+		e.byte(0xda)
+		e.uint16(uint16(n))
+	default:
+		e.byte(0xdb)
+		e.uint32(uint32(n))
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) encodeBytes(b []byte) {
+	switch n := len(b); {
+	case n <= math.MaxUint8:
+		e.byte(0xc4)
+		e.byte(byte(n))
+	case n <= math.MaxUint16:
+		e.byte(0xc5)
+		e.uint16(uint16(n))
+	default:
+		e.byte(0xc6)
+		e.uint32(uint32(n))
+	}
+	e.buf = append(e.buf, b...)
+}
+
+func (e *msgpackEncoder) encodeArray(v reflect.Value) error {
+	switch n := v.Len(); {
+	case n < 16:
+		e.byte(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		e.byte(0xdc)
+		e.uint16(uint16(n))
+	default:
+		e.byte(0xdd)
+		e.uint32(uint32(n))
+	}
+	for i := 0; i < v.Len(); i++ {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) mapHeader(n int) {
+	switch {
+	case n < 16:
+		e.byte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		e.byte(0xde)
+		e.uint16(uint16(n))
+	default:
+		e.byte(0xdf)
+		e.uint32(uint32(n))
+	}
+}
+
+// encodeTime writes the 96-bit form of the timestamp extension, which
+// covers every time.Time.
+func (e *msgpackEncoder) encodeTime(t time.Time) {
+	e.byte(0xc7)
+	e.byte(12)
+	e.byte(0xff) // timestampExt as a signed byte
+	e.uint32(uint32(t.Nanosecond()))
+	e.uint64(uint64(t.Unix()))
+}
+
+type msgpackField struct {
+	name  string
+	index int
+}
+
+// msgpackFields lists the exported fields of a struct type and the names
+// they are written under.
+func msgpackFields(t reflect.Type) []msgpackField {
+	var fields []msgpackField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("msgpack"); ok {
+			tag, _, _ = strings.Cut(tag, ",")
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+		fields = append(fields, msgpackField{name: name, index: i})
+	}
+	return fields
+}
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+// msgpackMaxDepth is how deeply arrays, maps and pointers can nest, so
+// that a message made of nothing but array headers can't overflow the
+// stack.
+const msgpackMaxDepth = 10000
+
+type msgpackDecoder struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+// enter counts a level of nesting, failing past msgpackMaxDepth. Each call
+// must be paired with a deferred leave.
+func (d *msgpackDecoder) enter() error {
+	d.depth++
+	if d.depth > msgpackMaxDepth {
+		return fmt.Errorf("msgpack: nested more than %d deep", msgpackMaxDepth)
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) leave() {
+	d.depth--
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) byte() (byte, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// size reads an n-byte big-endian length or number.
+func (d *msgpackDecoder) size(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// decode reads the next value into v, which must be settable.
+func (d *msgpackDecoder) decode(v reflect.Value) error {
+	defer d.leave()
+	if err := d.enter(); err != nil {
+		return err
+	}
+	if d.pos >= len(d.data) {
+		return errMsgpackShort
+	}
+	if d.data[d.pos] == 0xc0 {
+		d.pos++
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("msgpack: cannot decode into %s", v.Type())
+		}
+		val, err := d.decodeAny()
+		if err != nil {
+			return err
+		}
+		if val != nil {
+			v.Set(reflect.ValueOf(val))
+		}
+		return nil
+	}
+	if v.Type() == timeType {
+		t, err := d.decodeTime()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	c := d.data[d.pos]
+	switch {
+	case c <= 0x7f || c >= 0xe0 || (c >= 0xca && c <= 0xd3):
+		return d.decodeNumber(v)
+	case c == 0xc2 || c == 0xc3:
+		d.pos++
+		if v.Kind() != reflect.Bool {
+			return fmt.Errorf("msgpack: cannot decode a bool into %s", v.Type())
+		}
+		v.SetBool(c == 0xc3)
+		return nil
+	case c&0xe0 == 0xa0 || (c >= 0xd9 && c <= 0xdb), c >= 0xc4 && c <= 0xc6:
+		raw, err := d.decodeRaw()
+		if err != nil {
+			return err
+		}
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(string(raw))
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(append([]byte(nil), raw...))
+		default:
+			return fmt.Errorf("msgpack: cannot decode a string into %s", v.Type())
+		}
+		return nil
+	case c&0xf0 == 0x90 || c == 0xdc || c == 0xdd:
+		n, err := d.arrayHeader()
+		if err != nil {
+			return err
+		}
+		return d.decodeArray(v, n)
+	case c&0xf0 == 0x80 || c == 0xde || c == 0xdf:
+		n, err := d.mapHeader()
+		if err != nil {
+			return err
+		}
+		switch v.Kind() {
+		case reflect.Map:
+			return d.decodeMap(v, n)
+		case reflect.Struct:
+			return d.decodeStruct(v, n)
+		}
+		return fmt.Errorf("msgpack: cannot decode a map into %s", v.Type())
+	}
+	return fmt.Errorf("msgpack: cannot decode type byte 0x%02x into %s", c, v.Type())
+}
+
+func (d *msgpackDecoder) decodeNumber(v reflect.Value) error {
+	n, err := d.decodeAny()
+	if err != nil {
+		return err
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch n := n.(type) {
+		case int64:
+			i = n
+		case uint64:
+			if n > math.MaxInt64 {
+				return fmt.Errorf("msgpack: %d overflows %s", n, v.Type())
+			}
+			i = int64(n)
+		default:
+			return fmt.Errorf("msgpack: cannot decode %v into %s", n, v.Type())
+		}
+		if v.OverflowInt(i) {
+			return fmt.Errorf("msgpack: %d overflows %s", i, v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		switch n := n.(type) {
+		case uint64:
+			u = n
+		case int64:
+			if n < 0 {
+				return fmt.Errorf("msgpack: %d overflows %s", n, v.Type())
+			}
+			u = uint64(n)
+		default:
+			return fmt.Errorf("msgpack: cannot decode %v into %s", n, v.Type())
+		}
+		if v.OverflowUint(u) {
+			return fmt.Errorf("msgpack: %d overflows %s", u, v.Type())
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		switch n := n.(type) {
+		case float64:
+			v.SetFloat(n)
+		case float32:
+			v.SetFloat(float64(n))
+		case int64:
+			v.SetFloat(float64(n))
+		case uint64:
+			v.SetFloat(float64(n))
+		}
+	default:
+		return fmt.Errorf("msgpack: cannot decode a number into %s", v.Type())
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) decodeArray(v reflect.Value, n int) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		s := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n; i++ {
+			if err := d.decode(s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Array:
+		for i := 0; i < n; i++ {
+			if i >= v.Len() {
+				if err := d.skip(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: cannot decode an array into %s", v.Type())
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) decodeMap(v reflect.Value, n int) error {
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(v.Type(), n))
+	}
+	for i := 0; i < n; i++ {
+		key := reflect.New(v.Type().Key()).Elem()
+		if err := d.decode(key); err != nil {
+			return err
+		}
+		val := reflect.New(v.Type().Elem()).Elem()
+		if err := d.decode(val); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, val)
+	}
+	return nil
+}
+
+// decodeStruct fills in the fields named by the map's keys. Keys without a
+// matching field are skipped, so old consumers can read newer messages.
+func (d *msgpackDecoder) decodeStruct(v reflect.Value, n int) error {
+	fields := msgpackFields(v.Type())
+	for i := 0; i < n; i++ {
+		var name string
+		if err := d.decode(reflect.ValueOf(&name).Elem()); err != nil {
+			return err
+		}
+		index := -1
+		for _, f := range fields {
+			if f.name == name {
+				index = f.index
+				break
+			}
+		}
+		if index < 0 {
+			if err := d.skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.decode(v.Field(index)); err != nil {
+			return fmt.Errorf("%s.%s: %w", v.Type(), name, err)
+		}
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) skip() error {
+	_, err := d.decodeAny()
+	return err
+}
+
+// decodeAny reads the next value into the Go type closest to it: nil,
+// bool, int64, uint64, float32, float64, string, []byte, time.Time,
+// []any or map[any]any.
+func (d *msgpackDecoder) decodeAny() (any, error) {
+	defer d.leave()
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	c, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0, c >= 0xd9 && c <= 0xdb, c >= 0xc4 && c <= 0xc6:
+		d.pos--
+		raw, err := d.decodeRaw()
+		if err != nil {
+			return nil, err
+		}
+		if c >= 0xc4 && c <= 0xc6 {
+			return append([]byte(nil), raw...), nil
+		}
+		return string(raw), nil
+	case c&0xf0 == 0x90, c == 0xdc, c == 0xdd:
+		d.pos--
+		n, err := d.arrayHeader()
+		if err != nil {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = d.decodeAny(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case c&0xf0 == 0x80, c == 0xde, c == 0xdf:
+		d.pos--
+		n, err := d.mapHeader()
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[any]any, n)
+		for i := 0; i < n; i++ {
+			k, err := d.decodeAny()
+			if err != nil {
+				return nil, err
+			}
+			val, err := d.decodeAny()
+			if err != nil {
+				return nil, err
+			}
+			// Slices and maps can't be map keys in Go
+			switch k.(type) {
+			case []byte, []any, map[any]any:
+				k = fmt.Sprint(k)
+			}
+			m[k] = val
+		}
+		return m, nil
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.size(1 << (c - 0xcc))
+		return u, err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		u, err := d.size(size)
+		if err != nil {
+			return nil, err
+		}
+		// Sign-extend from the encoded width
+		shift := 64 - 8*size
+		return int64(u<<shift) >> shift, nil
+	case 0xca:
+		u, err := d.size(4)
+		return math.Float32frombits(uint32(u)), err
+	case 0xcb:
+		u, err := d.size(8)
+		return math.Float64frombits(u), err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xc7, 0xc8, 0xc9:
+		d.pos--
+		typ, data, err := d.decodeExt()
+		if err != nil {
+			return nil, err
+		}
+		if typ == timestampExt {
+			return parseTimestamp(data)
+		}
+		// Unknown extensions come back as their raw bytes
+		return append([]byte(nil), data...), nil
+	}
+	return nil, fmt.Errorf("msgpack: invalid type byte 0x%02x", c)
+}
+
+// decodeRaw reads a str or bin value and returns its bytes.
+func (d *msgpackDecoder) decodeRaw() ([]byte, error) {
+	c, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	var n uint64
+	switch {
+	case c&0xe0 == 0xa0:
+		n = uint64(c & 0x1f)
+	case c == 0xd9, c == 0xc4:
+		n, err = d.size(1)
+	case c == 0xda, c == 0xc5:
+		n, err = d.size(2)
+	case c == 0xdb, c == 0xc6:
+		n, err = d.size(4)
+	default:
+		return nil, fmt.Errorf("msgpack: expected a string, got type byte 0x%02x", c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.next(int(n))
+}
+
+func (d *msgpackDecoder) arrayHeader() (int, error) {
+	c, err := d.byte()
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	switch {
+	case c&0xf0 == 0x90:
+		n = uint64(c & 0x0f)
+	case c == 0xdc:
+		n, err = d.size(2)
+	case c == 0xdd:
+		n, err = d.size(4)
+	default:
+		return 0, fmt.Errorf("msgpack: expected an array, got type byte 0x%02x", c)
+	}
+	return d.checkLength(n, err)
+}
+
+func (d *msgpackDecoder) mapHeader() (int, error) {
+	c, err := d.byte()
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	switch {
+	case c&0xf0 == 0x80:
+		n = uint64(c & 0x0f)
+	case c == 0xde:
+		n, err = d.size(2)
+	case c == 0xdf:
+		n, err = d.size(4)
+	default:
+		return 0, fmt.Errorf("msgpack: expected a map, got type byte 0x%02x", c)
+	}
+	return d.checkLength(n, err)
+}
+
+// checkLength rejects element counts that can't possibly fit in what is
+// left of the data (each element takes at least a byte), so a corrupt
+// header can't make us allocate gigabytes.
+func (d *msgpackDecoder) checkLength(n uint64, err error) (int, error) {
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)-d.pos) {
+		return 0, errMsgpackShort
+	}
+	return int(n), nil
+}
+
+// decodeExt reads an extension value and returns its type and data.
+func (d *msgpackDecoder) decodeExt() (int8, []byte, error) {
+	c, err := d.byte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var n uint64
+	switch c {
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		n = 1 << (c - 0xd4)
+	case 0xc7:
+		n, err = d.size(1)
+	case 0xc8:
+		n, err = d.size(2)
+	case 0xc9:
+		n, err = d.size(4)
+	default:
+		return 0, nil, fmt.Errorf("msgpack: expected an extension, got type byte 0x%02x", c)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	typ, err := d.byte()
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := d.next(int(n))
+	return int8(typ), data, err
+}
+
+func (d *msgpackDecoder) decodeTime() (time.Time, error) {
+	typ, data, err := d.decodeExt()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if typ != timestampExt {
+		return time.Time{}, fmt.Errorf("msgpack: expected a timestamp, got extension type %d", typ)
+	}
+	return parseTimestamp(data)
+}
+
+// parseTimestamp reads any of the three timestamp layouts.
+func parseTimestamp(data []byte) (time.Time, error) {
+	switch len(data) {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0), nil
+	case 8:
+		v := binary.BigEndian.Uint64(data)
+		return time.Unix(int64(v&(1<<34-1)), int64(v>>34)), nil
+	case 12:
+		nsec := binary.BigEndian.Uint32(data[:4])
+		sec := int64(binary.BigEndian.Uint64(data[4:]))
+		return time.Unix(sec, int64(nsec)), nil
+	}
+	return time.Time{}, fmt.Errorf("msgpack: invalid timestamp length %d", len(data))
+}
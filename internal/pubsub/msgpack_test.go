@@ -0,0 +1,364 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// TestMsgpackFormats checks each value is written in the smallest format
+// the spec allows, and reads back the same.
+func TestMsgpackFormats(t *testing.T) {
+	tests := []struct {
+		name string
+		v    any
+		hex  string // the encoding, or just its first bytes for long values
+	}{
+		{"nil", (*int)(nil), "c0"},
+		{"false", false, "c2"},
+		{"true", true, "c3"},
+		{"positive fixint", 5, "05"},
+		{"largest positive fixint", 127, "7f"},
+		{"negative fixint", -1, "ff"},
+		{"smallest negative fixint", -32, "e0"},
+		{"int8", -33, "d0df"},
+		{"int16", -129, "d1ff7f"},
+		{"int32", -32769, "d2ffff7fff"},
+		{"int64", int64(math.MinInt64), "d38000000000000000"},
+		{"uint8", 128, "cc80"},
+		{"uint16", 256, "cd0100"},
+		{"uint32", 65536, "ce00010000"},
+		{"uint64", uint64(math.MaxUint64), "cfffffffffffffffff"},
+		{"largest int64", int64(math.MaxInt64), "cf7fffffffffffffff"},
+		{"int8 type", int8(-100), "d09c"},
+		{"uint16 type", uint16(7), "07"},
+		{"float32", float32(1.5), "ca3fc00000"},
+		{"float64", 1.5, "cb3ff8000000000000"},
+		{"fixstr", "war", "a3776172"},
+		{"empty string", "", "a0"},
+		{"str8", strings.Repeat("a", 32), "d920"},
+		{"str16", strings.Repeat("a", 256), "da0100"},
+		{"str32", strings.Repeat("a", 65536), "db00010000"},
+		{"bin8", []byte{1, 2}, "c4020102"},
+		{"bin16", make([]byte, 256), "c50100"},
+		{"bin32", make([]byte, 65536), "c600010000"},
+		{"fixarray", []int{1, 2}, "920102"},
+		{"empty array", []string{}, "90"},
+		{"nil slice", []int(nil), "c0"},
+		{"array16", make([]bool, 16), "dc0010"},
+		{"array32", make([]bool, 65536), "dd00010000"},
+		{"go array", [2]int8{-1, 1}, "92ff01"},
+		{"fixmap", map[string]int{"a": 1}, "81a16101"},
+		{"map16", intMap(16), "de0010"},
+		{"map32", intMap(65536), "df00010000"},
+		{"nil map", map[string]int(nil), "c0"},
+		{"timestamp", time.Unix(1, 2).UTC(), "c70cff000000020000000000000001"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := MsgPack.Marshal(tt.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(data); !strings.HasPrefix(got, tt.hex) {
+				t.Fatalf("encoded as %.40s, want %s", got, tt.hex)
+			}
+			got := reflect.New(reflect.TypeOf(tt.v))
+			if err := MsgPack.Unmarshal(data, got.Interface()); err != nil {
+				t.Fatal(err)
+			}
+			if !msgpackEqual(got.Elem().Interface(), tt.v) {
+				t.Fatalf("read back %.60v, want %.60v", got.Elem().Interface(), tt.v)
+			}
+		})
+	}
+}
+
+func intMap(n int) map[int]int {
+	m := make(map[int]int, n)
+	for i := range n {
+		m[i] = i
+	}
+	return m
+}
+
+// msgpackEqual is reflect.DeepEqual, except that times only need to be
+// the same instant.
+func msgpackEqual(a, b any) bool {
+	if ta, ok := a.(time.Time); ok {
+		tb, ok := b.(time.Time)
+		return ok && ta.Equal(tb)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+type msgpackInner struct {
+	Name  string
+	Ranks []gamelogic.UnitRank
+}
+
+type msgpackOuter struct {
+	ID       int64  `msgpack:"id"`
+	Skipped  string `msgpack:"-"`
+	Inner    msgpackInner
+	Ptr      *msgpackInner
+	NilPtr   *int
+	Counts   map[string]uint32
+	When     time.Time
+	Any      any
+	Tags     [2]string
+	Ratio    float32
+	internal int
+}
+
+// Nested structs, pointers, maps and times survive a round trip, and the
+// field tags are honoured.
+func TestMsgpackStructRoundTrip(t *testing.T) {
+	in := msgpackOuter{
+		ID:      -42,
+		Skipped: "not sent",
+		Inner:   msgpackInner{Name: "alice", Ranks: []gamelogic.UnitRank{gamelogic.RankInfantry, gamelogic.RankArtillery}},
+		Ptr:     &msgpackInner{Name: "bob"},
+		Counts:  map[string]uint32{"asia": 3, "europe": 0},
+		When:    time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC),
+		Any:     "anything",
+		Tags:    [2]string{"a", "b"},
+		Ratio:   0.25,
+	}
+	data, err := MsgPack.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("not sent")) || bytes.Contains(data, []byte("Skipped")) {
+		t.Fatal(`a field tagged "-" was encoded`)
+	}
+	if !bytes.Contains(data, []byte("\xa2id")) {
+		t.Fatal("ID wasn't encoded under its tag name")
+	}
+	var out msgpackOuter
+	if err := MsgPack.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !out.When.Equal(in.When) {
+		t.Fatalf("time read back as %v, want %v", out.When, in.When)
+	}
+	out.When, in.When = time.Time{}, time.Time{}
+	in.Skipped = ""
+	if !reflect.DeepEqual(out, in) {
+		t.Fatalf("read back %+v, want %+v", out, in)
+	}
+
+	// A message the game publishes
+	mv := gamelogic.ArmyMove{
+		Player:     gamelogic.Player{Username: "alice", Units: map[int]gamelogic.Unit{1: {ID: 1, Rank: gamelogic.RankCavalry, Location: "asia"}}},
+		Units:      []gamelogic.Unit{{ID: 1, Rank: gamelogic.RankCavalry, Location: "asia"}},
+		ToLocation: "europe",
+	}
+	data, err = MsgPack.Marshal(mv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotMove gamelogic.ArmyMove
+	if err := MsgPack.Unmarshal(data, &gotMove); err != nil || !reflect.DeepEqual(gotMove, mv) {
+		t.Fatalf("move read back as %+v (%v), want %+v", gotMove, err, mv)
+	}
+}
+
+// Other encoders use the shorter timestamp layouts when they can.
+func TestMsgpackTimestampLayouts(t *testing.T) {
+	for layout, want := range map[string]time.Time{
+		"d6ff00000001":                   time.Unix(1, 0),
+		"d7ff0000000800000001":           time.Unix(1, 2),
+		"c70cff000000020000000000000001": time.Unix(1, 2),
+	} {
+		data, _ := hex.DecodeString(layout)
+		var got time.Time
+		if err := MsgPack.Unmarshal(data, &got); err != nil || !got.Equal(want) {
+			t.Errorf("%s decoded as %v (%v), want %v", layout, got, err, want)
+		}
+	}
+}
+
+// Into an interface, values come back as the closest Go type.
+func TestMsgpackDecodeAny(t *testing.T) {
+	data, err := MsgPack.Marshal(map[string]any{
+		"n":     -3,
+		"u":     uint64(math.MaxUint64),
+		"f":     2.5,
+		"s":     "x",
+		"b":     []byte{1},
+		"list":  []any{true, nil},
+		"state": routing.PlayingState{IsPaused: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got any
+	if err := MsgPack.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[any]any{
+		"n":     int64(-3),
+		"u":     uint64(math.MaxUint64),
+		"f":     2.5,
+		"s":     "x",
+		"b":     []byte{1},
+		"list":  []any{true, nil},
+		"state": map[any]any{"IsPaused": true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("decoded %#v, want %#v", got, want)
+	}
+}
+
+// A field added by a newer publisher is skipped, and fields a newer
+// consumer expects but the message lacks keep their zero values.
+func TestMsgpackUnknownFields(t *testing.T) {
+	data, err := MsgPack.Marshal(map[string]any{"Name": "alice", "Extra": []any{map[string]any{"deep": 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got msgpackInner
+	if err := MsgPack.Unmarshal(data, &got); err != nil || got.Name != "alice" || got.Ranks != nil {
+		t.Fatalf("decoded %+v, %v", got, err)
+	}
+}
+
+func TestMsgpackTypeErrors(t *testing.T) {
+	mustEncode := func(v any) []byte {
+		data, err := MsgPack.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	tests := []struct {
+		name   string
+		data   []byte
+		target any
+	}{
+		{"overflowing int8", mustEncode(300), new(int8)},
+		{"negative into uint", mustEncode(-1), new(uint)},
+		{"too big for int64", mustEncode(uint64(math.MaxUint64)), new(int64)},
+		{"string into int", mustEncode("1"), new(int)},
+		{"number into string", mustEncode(1), new(string)},
+		{"bool into int", mustEncode(true), new(int)},
+		{"array into map", mustEncode([]int{1}), new(map[string]int)},
+		{"map into slice", mustEncode(map[string]int{}), new([]int)},
+		{"string into time", mustEncode("2026-01-01"), new(time.Time)},
+		{"non-string struct key", mustEncode(map[int]int{1: 1}), new(msgpackInner)},
+		{"into an interface with methods", mustEncode(1), new(error)},
+		{"left over bytes", append(mustEncode(1), 2), new(int)},
+		{"reserved type byte", []byte{0xc1}, new(any)},
+		{"unknown extension into time", []byte{0xd4, 0x01, 0x00}, new(time.Time)},
+		{"bad timestamp length", []byte{0xd5, 0xff, 0, 0}, new(time.Time)},
+	}
+	for _, tt := range tests {
+		if err := MsgPack.Unmarshal(tt.data, tt.target); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+	if err := MsgPack.Unmarshal([]byte{1}, 0); err == nil {
+		t.Error("unmarshalling into a non-pointer succeeded")
+	}
+	if _, err := MsgPack.Marshal(make(chan int)); err == nil {
+		t.Error("marshalling a channel succeeded")
+	}
+}
+
+// Every prefix of a valid message is an error, not a panic or a value.
+func TestMsgpackTruncated(t *testing.T) {
+	data, err := MsgPack.Marshal(msgpackOuter{
+		Inner:  msgpackInner{Name: strings.Repeat("n", 40), Ranks: []gamelogic.UnitRank{"infantry"}},
+		Ptr:    &msgpackInner{},
+		Counts: map[string]uint32{"x": 70000},
+		When:   time.Now(),
+		Any:    []any{1.5, float32(2), int64(-70000), []byte("bin")},
+		Ratio:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cut := range len(data) {
+		var out msgpackOuter
+		if err := MsgPack.Unmarshal(data[:cut], &out); err == nil {
+			t.Fatalf("decoding the first %d of %d bytes succeeded", cut, len(data))
+		}
+		var anything any
+		if err := MsgPack.Unmarshal(data[:cut], &anything); err == nil {
+			t.Fatalf("decoding the first %d of %d bytes into any succeeded", cut, len(data))
+		}
+	}
+}
+
+// Length prefixes bigger than what's left are rejected before anything is
+// allocated for them.
+func TestMsgpackOversizedLengths(t *testing.T) {
+	for _, prefix := range []string{
+		"dbffffffff",   // str32
+		"c6ffffffff",   // bin32
+		"ddffffffff",   // array32
+		"dfffffffff",   // map32
+		"dcffff",       // array16
+		"deffff",       // map16
+		"c9ffffffffff", // ext32
+	} {
+		data, _ := hex.DecodeString(prefix)
+		data = append(data, 0, 0, 0)
+		for _, target := range []any{new(any), new(string), new([]byte), new([]int), new(map[string]int), new(time.Time)} {
+			allocs := testing.AllocsPerRun(1, func() {
+				if err := MsgPack.Unmarshal(data, target); err == nil {
+					t.Errorf("%s into %T succeeded", prefix, target)
+				}
+			})
+			if allocs > 10 {
+				t.Errorf("%s into %T made %v allocations", prefix, target, allocs)
+			}
+		}
+	}
+}
+
+// Deeply nested input is refused rather than overflowing the stack.
+func TestMsgpackNestingLimit(t *testing.T) {
+	data := bytes.Repeat([]byte{0x91}, 1<<20)
+	var v any
+	if err := MsgPack.Unmarshal(append(data, 0xc0), &v); err == nil {
+		t.Fatal("a million nested arrays decoded")
+	}
+	var nested [][][]int
+	if err := MsgPack.Unmarshal([]byte{0x91, 0x91, 0x91, 0x01}, &nested); err != nil || nested[0][0][0] != 1 {
+		t.Fatalf("shallow nesting: %v, %v", nested, err)
+	}
+}
+
+// Random bytes never panic the decoder.
+func TestMsgpackRandomInput(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	valid, err := MsgPack.Marshal(msgpackOuter{Inner: msgpackInner{Name: "x"}, Counts: map[string]uint32{"a": 1}, When: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 20000 {
+		var data []byte
+		if i%2 == 0 {
+			data = make([]byte, rng.Intn(32))
+			rng.Read(data)
+		} else {
+			// Corrupt a byte of a valid message
+			data = append([]byte(nil), valid...)
+			data[rng.Intn(len(data))] = byte(rng.Intn(256))
+		}
+		var out msgpackOuter
+		MsgPack.Unmarshal(data, &out)
+		var anything any
+		MsgPack.Unmarshal(data, &anything)
+	}
+}
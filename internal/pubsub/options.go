@@ -0,0 +1,205 @@
+package pubsub
+
+import (
+	"fmt"
+	"log/slog"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// SubscribeOption tunes a subscription. Pass any number of them as the
+// last arguments of the Subscribe functions.
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	prefetch int
+	workers  int
+	retry    RetryPolicy
+	codec    Codec
+
+	decodeFailure   DecodeFailurePolicy
+	quarantine      string
+	onDecodeFailure func(amqp.Delivery, error) Acktype
+
+	deliveryLimit int           // quorum queues only, 0 for none
+	streamOffset  *StreamOffset // streams only
+	queue         QueueOptions
+	logger        *slog.Logger
+}
+
+// DefaultPrefetch is how many unacknowledged deliveries a subscription
+// takes at once unless WithPrefetch says otherwise.
+const DefaultPrefetch = 10
+
+func defaultSubscribeOptions() subscribeOptions {
+	return subscribeOptions{
+		prefetch: DefaultPrefetch,
+		workers:  1,
+		retry:    RetryPolicy{}.withDefaults(),
+		codec:    JSON,
+		logger:   slog.Default(),
+	}
+}
+
+func newSubscribeOptions(opts []SubscribeOption) (subscribeOptions, error) {
+	o := defaultSubscribeOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.prefetch < 0 {
+		return o, fmt.Errorf("prefetch must not be negative, got %d", o.prefetch)
+	}
+	if o.logger == nil {
+		return o, fmt.Errorf("logger must not be nil")
+	}
+	if o.codec == nil {
+		return o, fmt.Errorf("codec must not be nil")
+	}
+	if o.decodeFailure == DecodeFailureQuarantine && o.quarantine == "" {
+		return o, fmt.Errorf("quarantine exchange must not be empty")
+	}
+	if o.decodeFailure == DecodeFailureCallback && o.onDecodeFailure == nil {
+		return o, fmt.Errorf("decode failure callback must not be nil")
+	}
+	if o.workers < 1 {
+		return o, fmt.Errorf("workers must be at least 1, got %d", o.workers)
+	}
+	if o.deliveryLimit < 0 {
+		return o, fmt.Errorf("delivery limit must not be negative, got %d", o.deliveryLimit)
+	}
+	return o, nil
+}
+
+// checkQueueType makes sure the options suit the type of queue.
+func (o subscribeOptions) checkQueueType(queueType SimpleQueueType) error {
+	if o.deliveryLimit > 0 && queueType != SimpleQueueQuorum {
+		return fmt.Errorf("a delivery limit needs a quorum queue")
+	}
+	if o.streamOffset != nil && queueType != SimpleQueueStream {
+		return fmt.Errorf("a stream offset needs a stream")
+	}
+	if queueType == SimpleQueueStream && o.prefetch == 0 {
+		return fmt.Errorf("a stream needs a prefetch limit")
+	}
+	return o.queue.validate(queueType)
+}
+
+// queueArgs are the queue arguments the options call for, on top of the
+// ones for the queue type.
+func (o subscribeOptions) queueArgs() amqp.Table {
+	args := o.queue.args()
+	if o.deliveryLimit > 0 {
+		for k, v := range deliveryLimitArgs(o.deliveryLimit) {
+			args[k] = v
+		}
+	}
+	return args
+}
+
+// consumeArgs are the arguments to start consuming with. A stream consumer
+// that has been running before picks up after the last message it acked.
+func (o subscribeOptions) consumeArgs(resume *streamPosition) amqp.Table {
+	if next, ok := resume.resume(); ok {
+		return amqp.Table{streamOffsetHeader: next}
+	}
+	if o.streamOffset == nil {
+		return nil
+	}
+	return amqp.Table{streamOffsetHeader: o.streamOffset.arg}
+}
+
+// WithCodec sets the codec for deliveries that have no content type. Ones
+// that do are always decoded with the codec registered for it.
+func WithCodec(c Codec) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.codec = c
+	}
+}
+
+// WithQuarantine sends deliveries that can't be decoded to exchange (a
+// durable topic exchange, declared if need be) under their original routing
+// key, with the decode error in the x-decode-error header, and acks them.
+// The default is to dead-letter them.
+func WithQuarantine(exchange string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.decodeFailure = DecodeFailureQuarantine
+		o.quarantine = exchange
+	}
+}
+
+// WithDecodeFailureHandler hands deliveries that can't be decoded to fn,
+// and settles them according to the Acktype it returns. The default is to
+// dead-letter them.
+func WithDecodeFailureHandler(fn func(msg amqp.Delivery, err error) Acktype) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.decodeFailure = DecodeFailureCallback
+		o.onDecodeFailure = fn
+	}
+}
+
+// WithPrefetch sets how many unacknowledged deliveries the broker may send
+// the consumer at once (10 by default, 0 for no limit). It should be at
+// least the number of workers, or some of them will sit idle.
+func WithPrefetch(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.prefetch = n
+	}
+}
+
+// WithRetryPolicy sets what NackRetryLater does. Without it, handlers that
+// return NackRetryLater get the RetryPolicy defaults.
+func WithRetryPolicy(p RetryPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.retry = p.withDefaults()
+	}
+}
+
+// WithWorkers sets how many handlers may run at the same time (1 by
+// default). Each delivery is acked or nacked on its own as soon as its
+// handler returns, so messages can complete out of order.
+func WithWorkers(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.workers = n
+	}
+}
+
+func deliveryLimitArgs(n int) amqp.Table {
+	return amqp.Table{"x-delivery-limit": int64(n)}
+}
+
+// WithDeliveryLimit dead-letters a message once it has come back to a
+// quorum queue unsettled (nacked with requeue, or left unacked when its
+// consumer went away) more than n times, so that a message that keeps
+// failing can't go round forever. It is a queue argument, so every
+// subscriber of the queue must use the same limit.
+func WithDeliveryLimit(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.deliveryLimit = n
+	}
+}
+
+// WithStreamOffset sets where in a stream the subscription starts reading.
+// Without it, only messages that arrive after it starts are delivered.
+func WithStreamOffset(offset StreamOffset) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.streamOffset = &offset
+	}
+}
+
+// WithQueueOptions declares the subscription's queue with the given
+// policies: a message TTL, an expiry, a length limit and so on.
+func WithQueueOptions(q QueueOptions) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.queue = q
+	}
+}
+
+// WithLogger sets where the subscription reports what happens to its
+// deliveries: each one's ack or nack at debug level, ones it can't decode
+// or gives up retrying at warn level, and the consumer stopping at error
+// level. Every record has the queue's name. The default is slog.Default().
+func WithLogger(logger *slog.Logger) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.logger = logger
+	}
+}
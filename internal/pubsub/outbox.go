@@ -0,0 +1,377 @@
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrOutboxClosed is returned when publishing to an Outbox that has been
+// closed.
+var ErrOutboxClosed = errors.New("outbox is closed")
+
+// OutboxConfig tunes an Outbox. Zero values get the defaults noted on each
+// field.
+type OutboxConfig struct {
+	// RetryInterval is how long the relay waits before trying a message
+	// again after failing to publish it, default 1s.
+	RetryInterval time.Duration
+	// Logger hears about messages the relay couldn't publish yet, default
+	// slog.Default().
+	Logger *slog.Logger
+}
+
+func (c OutboxConfig) withDefaults() OutboxConfig {
+	if c.RetryInterval <= 0 {
+		c.RetryInterval = time.Second
+	}
+	if c.Logger == nil {
+		c.Logger = slog.Default()
+	}
+	return c
+}
+
+// Outbox is a Sender that writes messages to a journal on disk rather than
+// to the broker, and returns once they're safely there. A relay running in
+// the background then publishes them through another Sender, one at a time
+// and in order, and marks each one sent once that Sender says it has gone.
+// Give it a confirming Sender (a ConfirmingSender, or a Publisher with a
+// ConfirmTimeout) so that sent means the broker has it.
+//
+// A message that can't be published yet, because the broker is down or
+// refuses it, holds up the ones behind it and is tried again every
+// RetryInterval. One the broker returns as unroutable is marked sent: no
+// queue wanted it, and trying again won't change that.
+//
+// Whatever hasn't been sent when the outbox is closed, or when the process
+// dies, is still in the journal and is published when the outbox is next
+// opened. Each message keeps the ID it was first given, so a message that
+// was published but not yet marked sent when the process died goes out
+// again with the same ID, and consumers can tell it's a repeat.
+//
+// The journal is a file of JSON lines, one per message and one per message
+// sent, which is compacted whenever everything in it has been sent. Header
+// values go through JSON, so numbers in them come back as float64.
+type Outbox struct {
+	path   string
+	sender Sender
+	config OutboxConfig
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	unlock func() error
+
+	mu      sync.Mutex
+	f       *os.File
+	pending []outboxEntry // in the order they were written
+	nextSeq uint64
+	closed  bool
+	failed  error // why the relay stopped, if it has
+}
+
+var _ Sender = (*Outbox)(nil)
+
+// outboxEntry is a line of the journal: a message to publish, or, with
+// Sent set, the news that the message with the same Seq has been.
+type outboxEntry struct {
+	Seq       uint64           `json:"seq"`
+	Sent      bool             `json:"sent,omitempty"`
+	Exchange  string           `json:"exchange,omitempty"`
+	Key       string           `json:"key,omitempty"`
+	Mandatory bool             `json:"mandatory,omitempty"`
+	Msg       *amqp.Publishing `json:"msg,omitempty"`
+}
+
+// OpenOutbox opens the journal at path, creating it if need be, and starts
+// relaying what's in it through sender. Only one Outbox can have a journal
+// open at a time.
+func OpenOutbox(path string, sender Sender, config OutboxConfig) (*Outbox, error) {
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("outbox %s is in use: %w", path, err)
+	}
+	pending, nextSeq, err := readOutbox(path)
+	if err == nil {
+		err = writeOutbox(path, pending)
+	}
+	var f *os.File
+	if err == nil {
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	}
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	o := &Outbox{
+		path:    path,
+		sender:  sender,
+		config:  config.withDefaults(),
+		wake:    make(chan struct{}, 1),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		unlock:  unlock,
+		f:       f,
+		pending: pending,
+		nextSeq: nextSeq,
+	}
+	go o.relay()
+	return o, nil
+}
+
+// readOutbox returns the messages in a journal that haven't been sent, and
+// the sequence number to carry on from. A last line without a newline was
+// cut short by a crash while it was being written, and is ignored.
+func readOutbox(path string) ([]outboxEntry, uint64, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 1, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read outbox: %w", err)
+	}
+	var entries []outboxEntry
+	sent := map[uint64]bool{}
+	nextSeq := uint64(1)
+	r := bufio.NewReader(bytes.NewReader(data))
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		var e outboxEntry
+		if err := json.Unmarshal(line, &e); err != nil || e.Seq == 0 || (!e.Sent && e.Msg == nil) {
+			return nil, 0, fmt.Errorf("outbox %s is corrupt at line %d", path, n)
+		}
+		if e.Sent {
+			sent[e.Seq] = true
+		} else {
+			entries = append(entries, e)
+		}
+		nextSeq = max(nextSeq, e.Seq+1)
+	}
+	var pending []outboxEntry
+	for _, e := range entries {
+		if !sent[e.Seq] {
+			pending = append(pending, e)
+		}
+	}
+	return pending, nextSeq, nil
+}
+
+// writeOutbox replaces the journal with one holding just pending. The new
+// one is written alongside and renamed over the old, so a crash part way
+// through leaves one or the other.
+func writeOutbox(path string, pending []outboxEntry) error {
+	var buf bytes.Buffer
+	for _, e := range pending {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, buf.Bytes()); err != nil {
+		return fmt.Errorf("could not compact outbox: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("could not compact outbox: %w", err)
+	}
+	// Make the rename itself durable. Not every platform can sync a
+	// directory, and the old journal is just as good, so this is best effort
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// PublishWithContext writes the message to the journal, and returns once
+// it's on disk. It's published later, by the relay. immediate is ignored.
+// Once the relay has stopped it refuses the message, with the error Err
+// returns.
+func (o *Outbox) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return ErrOutboxClosed
+	}
+	if o.failed != nil {
+		return o.failed
+	}
+	e := outboxEntry{Seq: o.nextSeq, Exchange: exchange, Key: key, Mandatory: mandatory, Msg: &msg}
+	if err := o.append(e); err != nil {
+		return fmt.Errorf("could not write to outbox: %w", err)
+	}
+	o.nextSeq++
+	o.pending = append(o.pending, e)
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// append writes an entry to the end of the journal and syncs it. The caller
+// holds o.mu.
+func (o *Outbox) append(e outboxEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// One write per line, so that a crash can only cut the last one short
+	if _, err := o.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return o.f.Sync()
+}
+
+// Err returns why the relay has stopped, or nil while it's running. Once it
+// has stopped, PublishWithContext returns the same error.
+func (o *Outbox) Err() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.failed
+}
+
+// Pending is how many messages are waiting to be published.
+func (o *Outbox) Pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// relay publishes the pending messages in order until the outbox is closed.
+func (o *Outbox) relay() {
+	defer close(o.done)
+	for {
+		o.mu.Lock()
+		var next outboxEntry
+		waiting := len(o.pending) > 0
+		if waiting {
+			next = o.pending[0]
+		}
+		o.mu.Unlock()
+		if !waiting {
+			select {
+			case <-o.wake:
+				continue
+			case <-o.ctx.Done():
+				return
+			}
+		}
+
+		err := o.sender.PublishWithContext(o.ctx, next.Exchange, next.Key, next.Mandatory, false, *next.Msg)
+		var unroutable *UnroutableError
+		switch {
+		case err == nil:
+		case errors.As(err, &unroutable):
+			o.config.Logger.Warn("outbox message was unroutable, dropping it", outboxAttrs(next), slog.Any("err", err))
+		case o.ctx.Err() != nil:
+			return
+		default:
+			o.config.Logger.Warn("could not publish outbox message, will retry",
+				outboxAttrs(next),
+				slog.Int("pending", o.Pending()),
+				slog.Duration("retry_in", o.config.RetryInterval),
+				slog.Any("err", err),
+			)
+			select {
+			case <-time.After(o.config.RetryInterval):
+			case <-o.ctx.Done():
+				return
+			}
+			continue
+		}
+		if err := o.markSent(next.Seq); err != nil {
+			// The journal is no use if it can't be written, so stop relaying rather than
+			// publish messages that will be sent again, and refuse new ones rather than let
+			// them pile up unsent
+			o.config.Logger.Error("could not mark outbox message sent, stopping the relay", outboxAttrs(next), slog.Any("err", err))
+			o.mu.Lock()
+			o.failed = fmt.Errorf("outbox relay stopped: could not write to the journal: %w", err)
+			o.mu.Unlock()
+			return
+		}
+	}
+}
+
+// markSent records that the first pending message has been published. Once
+// nothing is pending the journal is emptied, which keeps it from growing.
+func (o *Outbox) markSent(seq uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var err error
+	if len(o.pending) == 1 {
+		// Writes are appended, so the next one goes at the start again
+		if err = o.f.Truncate(0); err == nil {
+			err = o.f.Sync()
+		}
+	} else {
+		err = o.append(outboxEntry{Seq: seq, Sent: true})
+	}
+	if err != nil {
+		// As far as the journal knows it's still pending, so it is
+		return err
+	}
+	o.pending = o.pending[1:]
+	return nil
+}
+
+// Close stops the relay, waiting for a publish that's under way, and
+// closes the journal. Messages still pending stay in it for next time.
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return ErrOutboxClosed
+	}
+	o.closed = true
+	o.mu.Unlock()
+	o.cancel()
+	<-o.done
+	err := o.f.Close()
+	o.unlock()
+	return err
+}
+
+func outboxAttrs(e outboxEntry) slog.Attr {
+	return slog.Group("message",
+		slog.String("id", e.Msg.MessageId),
+		slog.String("exchange", e.Exchange),
+		slog.String("routing_key", e.Key),
+	)
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package pubsub
+
+// lockFile does nothing where there's no flock, so it's up to the user not
+// to open the same outbox twice there.
+func lockFile(path string) (unlock func() error, err error) {
+	return func() error { return nil }, nil
+}
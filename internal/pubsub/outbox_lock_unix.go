@@ -0,0 +1,27 @@
+//go:build unix
+
+package pubsub
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on path, creating it if need be. The
+// lock goes when the returned function is called or the process exits,
+// however it exits.
+func lockFile(path string) (unlock func() error, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errors.New("another process has it open")
+		}
+		return nil, err
+	}
+	return f.Close, nil
+}
@@ -0,0 +1,355 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// recordingSender records what's published through it, failing while
+// fail returns an error.
+type recordingSender struct {
+	mu   sync.Mutex
+	sent []amqp.Publishing
+	keys []string
+	fail func() error
+}
+
+func (s *recordingSender) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != nil {
+		if err := s.fail(); err != nil {
+			return err
+		}
+	}
+	s.sent = append(s.sent, msg)
+	s.keys = append(s.keys, key)
+	return nil
+}
+
+func (s *recordingSender) published() ([]amqp.Publishing, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]amqp.Publishing(nil), s.sent...), append([]string(nil), s.keys...)
+}
+
+func openTestOutbox(t *testing.T, path string, sender Sender) *Outbox {
+	t.Helper()
+	o, err := OpenOutbox(path, sender, OutboxConfig{RetryInterval: 10 * time.Millisecond, Logger: discardLogger})
+	if err != nil {
+		t.Fatalf("OpenOutbox: %v", err)
+	}
+	return o
+}
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestOutboxRelaysInOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.outbox")
+	sender := &recordingSender{}
+	o := openTestOutbox(t, path, sender)
+	defer o.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := PublishJSON(o, "ex", key, key); err != nil {
+			t.Fatalf("publish %s: %v", key, err)
+		}
+	}
+	waitFor(t, "the relay", func() bool { return o.Pending() == 0 })
+	_, keys := sender.published()
+	if strings.Join(keys, ",") != "a,b,c" {
+		t.Fatalf("published %v, want a,b,c", keys)
+	}
+	// With nothing pending, the journal is emptied
+	if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+		t.Fatalf("journal after relaying everything: %v, %v", info, err)
+	}
+}
+
+func TestOutboxKeepsPendingAcrossRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.outbox")
+	down := &recordingSender{fail: func() error { return errors.New("broker is down") }}
+	o := openTestOutbox(t, path, down)
+	for _, key := range []string{"a", "b"} {
+		if err := PublishJSON(o, "ex", key, key, WithHeader("n", 1)); err != nil {
+			t.Fatalf("publish %s: %v", key, err)
+		}
+	}
+	if n := o.Pending(); n != 2 {
+		t.Fatalf("Pending() = %d, want 2", n)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := PublishJSON(o, "ex", "c", "c"); !errors.Is(err, ErrOutboxClosed) {
+		t.Fatalf("publish after Close = %v, want ErrOutboxClosed", err)
+	}
+
+	up := &recordingSender{}
+	o = openTestOutbox(t, path, up)
+	defer o.Close()
+	waitFor(t, "the relay", func() bool { return o.Pending() == 0 })
+	sent, keys := up.published()
+	if strings.Join(keys, ",") != "a,b" {
+		t.Fatalf("published %v after reopening, want a,b", keys)
+	}
+	for _, msg := range sent {
+		if msg.MessageId == "" || string(msg.Body) == "" {
+			t.Fatalf("replayed message lost its ID or body: %+v", msg)
+		}
+		// Header numbers come back from the journal as float64
+		if msg.Headers["n"] != float64(1) {
+			t.Fatalf("replayed header n = %#v", msg.Headers["n"])
+		}
+	}
+}
+
+func TestOutboxReplaysUnmarkedWithSameID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.outbox")
+	// The first publish goes through but the process dies before it's
+	// marked sent: the journal still has it pending
+	crashed := &recordingSender{fail: func() error { return errors.New("crash") }}
+	o := openTestOutbox(t, path, crashed)
+	if err := PublishJSON(o, "ex", "a", "a"); err != nil {
+		t.Fatal(err)
+	}
+	o.Close()
+	journal, err := readJournalIDs(path)
+	if err != nil || len(journal) != 1 {
+		t.Fatalf("journal: %v, %v", journal, err)
+	}
+
+	up := &recordingSender{}
+	o = openTestOutbox(t, path, up)
+	defer o.Close()
+	waitFor(t, "the relay", func() bool { return o.Pending() == 0 })
+	sent, _ := up.published()
+	if len(sent) != 1 || sent[0].MessageId != journal[0] {
+		t.Fatalf("replayed %v, want the message with ID %s", sent, journal[0])
+	}
+}
+
+func readJournalIDs(path string) ([]string, error) {
+	pending, _, err := readOutbox(path)
+	var ids []string
+	for _, e := range pending {
+		ids = append(ids, e.Msg.MessageId)
+	}
+	return ids, err
+}
+
+func TestOutboxIgnoresTornLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.outbox")
+	down := &recordingSender{fail: func() error { return errors.New("broker is down") }}
+	o := openTestOutbox(t, path, down)
+	PublishJSON(o, "ex", "a", "a")
+	o.Close()
+	// A crash in the middle of writing the next line
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":2,"exchange":"ex","ke`)
+	f.Close()
+
+	up := &recordingSender{}
+	o = openTestOutbox(t, path, up)
+	defer o.Close()
+	waitFor(t, "the relay", func() bool { return o.Pending() == 0 })
+	if _, keys := up.published(); strings.Join(keys, ",") != "a" {
+		t.Fatalf("published %v, want just a", keys)
+	}
+	// The torn line never made it, so its sequence number is free again
+	if o.nextSeq != 2 {
+		t.Fatalf("nextSeq = %d, want 2", o.nextSeq)
+	}
+}
+
+func TestOutboxRejectsCorruptJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.outbox")
+	os.WriteFile(path, []byte("not json\n"), 0644)
+	if _, err := OpenOutbox(path, &recordingSender{}, OutboxConfig{}); err == nil || !strings.Contains(err.Error(), "corrupt at line 1") {
+		t.Fatalf("OpenOutbox on a corrupt journal = %v", err)
+	}
+	// It let go of the lock, so it can be opened once the journal is fixed
+	os.WriteFile(path, nil, 0644)
+	o := openTestOutbox(t, path, &recordingSender{})
+	o.Close()
+}
+
+func TestOutboxCompactsOnOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.outbox")
+	// Messages 1 and 3 have been sent, 2 hasn't
+	var lines []string
+	for seq := 1; seq <= 3; seq++ {
+		lines = append(lines, fmt.Sprintf(`{"seq":%d,"exchange":"ex","key":"k%[1]d","msg":{"MessageId":"id%[1]d"}}`, seq))
+	}
+	lines = append(lines, `{"seq":1,"sent":true}`, `{"seq":3,"sent":true}`)
+	os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+
+	blocked := &recordingSender{fail: func() error { return errors.New("broker is down") }}
+	o := openTestOutbox(t, path, blocked)
+	defer o.Close()
+	if n := o.Pending(); n != 1 {
+		t.Fatalf("Pending() = %d, want 1", n)
+	}
+	data, _ := os.ReadFile(path)
+	if got := strings.Count(string(data), "\n"); got != 1 || !strings.Contains(string(data), `"id2"`) {
+		t.Fatalf("compacted journal = %q, want just message 2", data)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("compaction left its temporary file behind: %v", err)
+	}
+	if o.nextSeq != 4 {
+		t.Fatalf("nextSeq = %d, want 4", o.nextSeq)
+	}
+}
+
+func TestOutboxSkipsUnroutable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.outbox")
+	sender := &recordingSender{}
+	first := true
+	sender.fail = func() error {
+		if first {
+			first = false
+			return &UnroutableError{Exchange: "ex", Key: "a", ReplyCode: 312, ReplyText: "NO_ROUTE"}
+		}
+		return nil
+	}
+	o := openTestOutbox(t, path, sender)
+	defer o.Close()
+	PublishJSON(o, "ex", "a", "a")
+	PublishJSON(o, "ex", "b", "b")
+	waitFor(t, "the relay", func() bool { return o.Pending() == 0 })
+	if _, keys := sender.published(); strings.Join(keys, ",") != "b" {
+		t.Fatalf("published %v, want b after dropping a", keys)
+	}
+}
+
+func TestOutboxStopsOnJournalError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.outbox")
+	sender := &recordingSender{}
+	o := openTestOutbox(t, path, sender)
+	defer o.Close()
+	// The journal goes away underneath the relay while it's publishing, so
+	// it can't mark the message sent
+	sender.fail = func() error {
+		o.mu.Lock()
+		o.f.Close()
+		o.mu.Unlock()
+		return nil
+	}
+	if err := PublishJSON(o, "ex", "a", "a"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the relay to stop", func() bool { return o.Err() != nil })
+	if err := PublishJSON(o, "ex", "b", "b"); err == nil || err != o.Err() {
+		t.Fatalf("publish after the relay stopped = %v, want %v", err, o.Err())
+	}
+	if n := o.Pending(); n != 1 {
+		t.Fatalf("Pending() = %d, want 1", n)
+	}
+}
+
+func TestOutboxIsLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.outbox")
+	o := openTestOutbox(t, path, &recordingSender{})
+	if _, err := OpenOutbox(path, &recordingSender{}, OutboxConfig{}); err == nil {
+		t.Skip("no file locking on this platform")
+	}
+	o.Close()
+	o = openTestOutbox(t, path, &recordingSender{})
+	o.Close()
+}
+
+// TestOutboxReplayIsHandledOnce publishes through an outbox whose first
+// confirm is lost, as if the client died before marking the message sent,
+// and checks that Dedup stops the consumer handling it twice.
+func TestOutboxReplayIsHandledOnce(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var handled []int
+	sub, err := SubscribeMessages(ctx, conn, "amq.topic", "moves", "moves.*", SimpleQueueDurable,
+		Chain(func(msg Message[int]) Acktype {
+			mu.Lock()
+			defer mu.Unlock()
+			handled = append(handled, msg.Body)
+			return Ack
+		}, Dedup[int](100, discardLogger)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	confirmed, err := NewConfirmingSender(conn, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer confirmed.Close()
+	lost := false
+	sender := senderFunc(func(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+		if err := confirmed.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg); err != nil {
+			return err
+		}
+		if !lost {
+			lost = true
+			return ErrConfirmTimeout
+		}
+		return nil
+	})
+
+	o := openTestOutbox(t, filepath.Join(t.TempDir(), "test.outbox"), sender)
+	defer o.Close()
+	PublishJSON(o, "amq.topic", "moves.a", 1)
+	PublishJSON(o, "amq.topic", "moves.a", 2)
+	waitFor(t, "the relay", func() bool { return o.Pending() == 0 })
+	waitFor(t, "the consumer", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled) >= 2
+	})
+	// Give the duplicate time to arrive
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(handled) != 2 || handled[0] != 1 || handled[1] != 2 {
+		t.Fatalf("handled %v, want [1 2]", handled)
+	}
+}
+
+type senderFunc func(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+
+func (f senderFunc) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	return f(ctx, exchange, key, mandatory, immediate, msg)
+}
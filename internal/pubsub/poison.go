@@ -0,0 +1,161 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Headers set on messages sent to a quarantine exchange, on top of the
+// x-original-exchange and x-original-routing-key of the message itself.
+const (
+	decodeErrorHeader   = "x-decode-error"
+	originalQueueHeader = "x-original-queue"
+)
+
+// DecodeFailurePolicy says what a subscription does with a delivery whose
+// body can't be decoded. Such a message will never decode, however often it
+// is retried, so it must not go back to the queue.
+type DecodeFailurePolicy int
+
+const (
+	// Nack it without requeueing, which sends it to the queue's
+	// dead-letter exchange. This is the default.
+	DecodeFailureDeadLetter DecodeFailurePolicy = iota
+	// Publish the raw body to a quarantine exchange, with the decode error
+	// and where the message came from in its headers, then ack it.
+	DecodeFailureQuarantine
+	// Pass the delivery and the error to a callback, and settle the
+	// delivery the way it says.
+	DecodeFailureCallback
+)
+
+func (p DecodeFailurePolicy) String() string {
+	switch p {
+	case DecodeFailureDeadLetter:
+		return "dead-letter"
+	case DecodeFailureQuarantine:
+		return "quarantine"
+	case DecodeFailureCallback:
+		return "callback"
+	}
+	return fmt.Sprintf("DecodeFailurePolicy(%d)", int(p))
+}
+
+// DecodeFailureCounts counts the undecodable deliveries that were dealt
+// with under each policy.
+type DecodeFailureCounts struct {
+	DeadLettered uint64
+	Quarantined  uint64
+	Callback     uint64
+}
+
+// decodeFailureCounters are the live counters behind DecodeFailureCounts.
+type decodeFailureCounters struct {
+	deadLettered atomic.Uint64
+	quarantined  atomic.Uint64
+	callback     atomic.Uint64
+}
+
+func (c *decodeFailureCounters) snapshot() DecodeFailureCounts {
+	return DecodeFailureCounts{
+		DeadLettered: c.deadLettered.Load(),
+		Quarantined:  c.quarantined.Load(),
+		Callback:     c.callback.Load(),
+	}
+}
+
+// totalDecodeFailures adds up every subscription in the process.
+var totalDecodeFailures decodeFailureCounters
+
+// DecodeFailures returns the decode failure counts of every subscription in
+// the process, added together. Subscription.DecodeFailures has them for a
+// single subscription.
+func DecodeFailures() DecodeFailureCounts {
+	return totalDecodeFailures.snapshot()
+}
+
+// poisonHandler carries out a DecodeFailurePolicy for one consumer.
+type poisonHandler struct {
+	ch       Channel // the consumer's channel
+	queue    string
+	policy   DecodeFailurePolicy
+	exchange string                             // for DecodeFailureQuarantine
+	callback func(amqp.Delivery, error) Acktype // for DecodeFailureCallback
+	retry    *retrier
+	counts   *decodeFailureCounters
+	logger   *slog.Logger
+}
+
+// handle deals with a delivery that failed to decode with err.
+func (p *poisonHandler) handle(msg amqp.Delivery, err error) {
+	switch p.policy {
+	case DecodeFailureQuarantine:
+		if qerr := p.quarantine(msg, err); qerr != nil {
+			// Dead-lettering is the next best place for it
+			p.logger.Error("could not quarantine delivery, dead-lettering it", deliveryAttrs(msg), slog.Any("err", qerr))
+			p.deadLetter(msg)
+			return
+		}
+		p.counts.quarantined.Add(1)
+		totalDecodeFailures.quarantined.Add(1)
+		msg.Ack(false)
+	case DecodeFailureCallback:
+		p.counts.callback.Add(1)
+		totalDecodeFailures.callback.Add(1)
+		settle(p.logger, msg, p.callback(msg, err), p.retry)
+	default:
+		p.deadLetter(msg)
+	}
+}
+
+func (p *poisonHandler) deadLetter(msg amqp.Delivery) {
+	p.counts.deadLettered.Add(1)
+	totalDecodeFailures.deadLettered.Add(1)
+	msg.Nack(false, false)
+}
+
+// quarantine publishes the raw message to the quarantine exchange under its
+// original routing key.
+func (p *poisonHandler) quarantine(msg amqp.Delivery, err error) error {
+	pub := publishingFromDelivery(msg)
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[decodeErrorHeader] = err.Error()
+	headers[originalQueueHeader] = p.queue
+	if _, ok := headers[originalExchangeHeader]; !ok {
+		headers[originalExchangeHeader] = msg.Exchange
+		headers[originalRoutingKeyHeader] = msg.RoutingKey
+	}
+	pub.Headers = headers
+	return p.ch.PublishWithContext(context.Background(), p.exchange, msg.RoutingKey, false, false, pub)
+}
+
+// DeclareQuarantineQueue declares the peril_quarantine exchange, for
+// WithQuarantine(routing.ExchangePerilQuarantine), and a durable queue
+// bound to it that keeps everything sent there. Like
+// DeclareDeadLetterQueue, it is safe to call more than once and is
+// redeclared after every reconnect.
+func DeclareQuarantineQueue(conn Connection) error {
+	return provision(conn, func(ch Channel) error {
+		err := ch.ExchangeDeclare(routing.ExchangePerilQuarantine, amqp.ExchangeTopic, true, false, false, false, nil)
+		if err != nil {
+			return fmt.Errorf("could not declare exchange %s: %v", routing.ExchangePerilQuarantine, err)
+		}
+		_, err = ch.QueueDeclare(routing.QueuePerilQuarantine, true, false, false, false, nil)
+		if err != nil {
+			return fmt.Errorf("could not declare queue %s: %v", routing.QueuePerilQuarantine, err)
+		}
+		err = ch.QueueBind(routing.QueuePerilQuarantine, "#", routing.ExchangePerilQuarantine, false, nil)
+		if err != nil {
+			return fmt.Errorf("could not bind queue %s: %v", routing.QueuePerilQuarantine, err)
+		}
+		return nil
+	})
+}
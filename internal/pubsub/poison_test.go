@@ -0,0 +1,161 @@
+package pubsub
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// poisonTest subscribes to a quorum queue with a delivery limit of 2 under
+// opts, and publishes a body that won't decode to it. It returns the
+// broker, a channel on it, and the subscription once the message has been
+// dealt with.
+func poisonTest(t *testing.T, opts ...SubscribeOption) (*MemoryBroker, *memChannel, *Subscription) {
+	t.Helper()
+	broker := NewMemoryBroker()
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := DeclareDeadLetterQueue(conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeclareQuarantineQueue(conn); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := Subscribe(context.Background(), conn, "amq.topic", "moves", "moves.*", SimpleQueueQuorum,
+		func(int) Acktype {
+			t.Error("the handler was called for a message that didn't decode")
+			return Ack
+		},
+		append([]SubscribeOption{WithDeliveryLimit(2), WithLogger(discardLogger)}, opts...)...,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+
+	ch := memTestChannel(t, broker)
+	err = ch.PublishWithContext(context.Background(), "amq.topic", "moves.alice", false, false, amqp.Publishing{
+		ContentType: "application/json",
+		MessageId:   "poison-1",
+		Body:        []byte("not json"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the message to leave its queue", func() bool {
+		n, _ := broker.QueueLength("moves")
+		dead, _ := broker.QueueLength(routing.QueuePerilDLQ)
+		quarantined, _ := broker.QueueLength(routing.QueuePerilQuarantine)
+		return n == 0 && dead+quarantined == 1
+	})
+	return broker, ch, sub
+}
+
+func decodeFailuresSince(before DecodeFailureCounts) DecodeFailureCounts {
+	now := DecodeFailures()
+	return DecodeFailureCounts{
+		DeadLettered: now.DeadLettered - before.DeadLettered,
+		Quarantined:  now.Quarantined - before.Quarantined,
+		Callback:     now.Callback - before.Callback,
+	}
+}
+
+func TestDecodeFailureDeadLetter(t *testing.T) {
+	before := DecodeFailures()
+	broker, ch, sub := poisonTest(t)
+
+	if n := queueLength(t, broker, routing.QueuePerilQuarantine); n != 0 {
+		t.Fatalf("%d messages quarantined without WithQuarantine", n)
+	}
+	d := get(t, ch, routing.QueuePerilDLQ)
+	if reason := d.Headers["x-first-death-reason"]; reason != "rejected" {
+		t.Fatalf("dead-lettered as %v, want rejected, the first time round", reason)
+	}
+	want := DecodeFailureCounts{DeadLettered: 1}
+	if got := sub.DecodeFailures(); got != want {
+		t.Fatalf("subscription counts %+v, want %+v", got, want)
+	}
+	if got := decodeFailuresSince(before); got != want {
+		t.Fatalf("process counts went up by %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeFailureQuarantine(t *testing.T) {
+	before := DecodeFailures()
+	broker, ch, sub := poisonTest(t, WithQuarantine(routing.ExchangePerilQuarantine))
+
+	if n := queueLength(t, broker, routing.QueuePerilDLQ); n != 0 {
+		t.Fatalf("%d messages dead-lettered as well as quarantined", n)
+	}
+	d := get(t, ch, routing.QueuePerilQuarantine)
+	if string(d.Body) != "not json" || d.MessageId != "poison-1" || d.RoutingKey != "moves.alice" {
+		t.Fatalf("quarantined %q with ID %q and key %q, want the original", d.Body, d.MessageId, d.RoutingKey)
+	}
+	for header, want := range map[string]string{
+		originalQueueHeader:      "moves",
+		originalExchangeHeader:   "amq.topic",
+		originalRoutingKeyHeader: "moves.alice",
+	} {
+		if got := d.Headers[header]; got != want {
+			t.Errorf("%s is %v, want %s", header, got, want)
+		}
+	}
+	if _, ok := d.Headers[decodeErrorHeader].(string); !ok {
+		t.Errorf("no %s header", decodeErrorHeader)
+	}
+	want := DecodeFailureCounts{Quarantined: 1}
+	if got := sub.DecodeFailures(); got != want {
+		t.Fatalf("subscription counts %+v, want %+v", got, want)
+	}
+	if got := decodeFailuresSince(before); got != want {
+		t.Fatalf("process counts went up by %+v, want %+v", got, want)
+	}
+}
+
+// A callback that keeps requeueing the message sees it until the delivery
+// limit dead-letters it.
+func TestDecodeFailureCallback(t *testing.T) {
+	before := DecodeFailures()
+	var calls atomic.Int32
+	broker, ch, sub := poisonTest(t, WithDecodeFailureHandler(func(msg amqp.Delivery, err error) Acktype {
+		if err == nil || string(msg.Body) != "not json" {
+			t.Errorf("callback given %q and error %v", msg.Body, err)
+		}
+		calls.Add(1)
+		return NackRequeue
+	}))
+
+	if n := queueLength(t, broker, routing.QueuePerilQuarantine); n != 0 {
+		t.Fatalf("%d messages quarantined without WithQuarantine", n)
+	}
+	d := get(t, ch, routing.QueuePerilDLQ)
+	if reason := d.Headers["x-first-death-reason"]; reason != "delivery_limit" {
+		t.Fatalf("dead-lettered as %v, want delivery_limit", reason)
+	}
+	// The first delivery and two redeliveries
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("callback called %d times, want 3", n)
+	}
+	want := DecodeFailureCounts{Callback: 3}
+	if got := sub.DecodeFailures(); got != want {
+		t.Fatalf("subscription counts %+v, want %+v", got, want)
+	}
+	if got := decodeFailuresSince(before); got != want {
+		t.Fatalf("process counts went up by %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeFailureOptions(t *testing.T) {
+	if _, err := newSubscribeOptions([]SubscribeOption{WithQuarantine("")}); err == nil {
+		t.Error("quarantine without an exchange accepted")
+	}
+	if _, err := newSubscribeOptions([]SubscribeOption{WithDecodeFailureHandler(nil)}); err == nil {
+		t.Error("callback policy without a callback accepted")
+	}
+}
@@ -0,0 +1,219 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// PublisherConfig tunes a Publisher. Zero values get the defaults noted on
+// each field.
+type PublisherConfig struct {
+	// Channels is the most channels the pool opens, default 4. Publishes
+	// beyond that many at once wait for a channel to come free.
+	Channels int
+	// ConfirmTimeout, if set, puts every channel in confirm mode: each
+	// publish then waits this long for the broker's verdict and reports it
+	// the way ConfirmingSender does.
+	ConfirmTimeout time.Duration
+}
+
+func (c PublisherConfig) withDefaults() PublisherConfig {
+	if c.Channels <= 0 {
+		c.Channels = 4
+	}
+	return c
+}
+
+// Publisher is a Sender that is safe to use from any number of goroutines.
+// A single channel isn't, so it keeps a pool of them and gives each publish
+// one to itself. Channels are opened as needed, up to the configured limit.
+//
+// A channel that the broker closes, as it does after a channel-level error
+// such as publishing to an exchange that doesn't exist, is dropped from the
+// pool and replaced. A publish that finds its channel already closed, so
+// that the message was never sent, is tried once more on a fresh channel.
+type Publisher struct {
+	conn   Connection
+	config PublisherConfig
+
+	idle  chan *pooledChannel // open channels nobody is using
+	slots chan struct{}       // one per open channel, to cap how many there are
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// pooledChannel is a channel in a Publisher's pool: a plain channel, or a
+// ConfirmingSender in confirm mode.
+type pooledChannel struct {
+	Sender
+	close func() error
+	// Fires when the broker closes the channel. ConfirmingSender replaces
+	// its own channel, so it has none.
+	closes chan *amqp.Error
+}
+
+var _ Sender = (*Publisher)(nil)
+
+// NewPublisher returns a Publisher for conn. It opens the first channel
+// straight away so that a broken connection fails here rather than on the
+// first publish. On a ReconnectingConnection its plain channels buffer
+// publishes during an outage, like any channel from Channel; in confirm
+// mode those publishes fail with ErrDisconnected instead.
+func NewPublisher(conn Connection, config PublisherConfig) (*Publisher, error) {
+	config = config.withDefaults()
+	p := &Publisher{
+		conn:   conn,
+		config: config,
+		idle:   make(chan *pooledChannel, config.Channels),
+		slots:  make(chan struct{}, config.Channels),
+	}
+	p.slots <- struct{}{}
+	pc, err := p.open()
+	if err != nil {
+		return nil, err
+	}
+	p.idle <- pc
+	return p, nil
+}
+
+// PublishWithContext publishes msg on a channel of its own. ctx also bounds
+// the wait for a free channel when they are all in use.
+func (p *Publisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	for attempt := 0; ; attempt++ {
+		pc, err := p.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		err = pc.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+		// Only the bare error means the channel was closed before anything was sent. Wrapped,
+		// it can come from a ConfirmingSender whose channel closed while waiting for a confirm
+		if err == amqp.ErrClosed && !p.isClosed() {
+			p.discard(pc)
+			if attempt == 0 {
+				continue
+			}
+			return err
+		}
+		p.release(pc)
+		return err
+	}
+}
+
+// Close closes the channels in the pool. Ones in use are closed as their
+// publishes finish, and publishing afterwards fails with amqp.ErrClosed.
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	p.closed = true
+	p.mu.Unlock()
+	for {
+		select {
+		case pc := <-p.idle:
+			p.discard(pc)
+		default:
+			return nil
+		}
+	}
+}
+
+func (p *Publisher) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// acquire takes an idle channel, or opens a new one if the pool has room,
+// or waits for one to be released.
+func (p *Publisher) acquire(ctx context.Context) (*pooledChannel, error) {
+	for {
+		if p.isClosed() {
+			return nil, amqp.ErrClosed
+		}
+		// Reuse an open channel rather than open another, if there is one
+		select {
+		case pc := <-p.idle:
+			if pc.dead() {
+				p.discard(pc)
+				continue
+			}
+			return pc, nil
+		default:
+		}
+		select {
+		case pc := <-p.idle:
+			if pc.dead() {
+				p.discard(pc)
+				continue
+			}
+			return pc, nil
+		case p.slots <- struct{}{}:
+			pc, err := p.open()
+			if err != nil {
+				<-p.slots
+				return nil, err
+			}
+			return pc, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release puts a channel back in the pool after a publish.
+func (p *Publisher) release(pc *pooledChannel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		pc.close()
+		<-p.slots
+		return
+	}
+	// Never blocks: there are never more channels than slots
+	p.idle <- pc
+}
+
+// discard closes a channel and frees its slot.
+func (p *Publisher) discard(pc *pooledChannel) {
+	pc.close()
+	<-p.slots
+}
+
+// open opens a channel for the pool. The caller has taken a slot for it.
+func (p *Publisher) open() (*pooledChannel, error) {
+	if p.config.ConfirmTimeout > 0 {
+		s, err := NewConfirmingSender(p.conn, p.config.ConfirmTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return &pooledChannel{Sender: s, close: s.Close}, nil
+	}
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return &pooledChannel{
+		Sender: ch,
+		close:  ch.Close,
+		closes: ch.NotifyClose(make(chan *amqp.Error, 1)),
+	}, nil
+}
+
+// dead reports whether the broker has closed the channel.
+func (pc *pooledChannel) dead() bool {
+	if pc.closes == nil {
+		return false
+	}
+	select {
+	case <-pc.closes:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,233 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// countingConnection counts the channels opened on it, and lets a test
+// decide how their publishes go.
+type countingConnection struct {
+	Connection
+
+	mu       sync.Mutex
+	opened   int
+	attempts int
+	// publish, if set, runs before each publish on channel number n
+	// (counting from 1), and an error from it is returned instead.
+	publish func(n int) error
+}
+
+func (c *countingConnection) Channel() (Channel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.opened++
+	return &countingChannel{Channel: ch, conn: c, n: c.opened}, nil
+}
+
+func (c *countingConnection) counts() (opened, attempts int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.opened, c.attempts
+}
+
+type countingChannel struct {
+	Channel
+	conn *countingConnection
+	n    int
+}
+
+func (ch *countingChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.conn.mu.Lock()
+	ch.conn.attempts++
+	publish := ch.conn.publish
+	ch.conn.mu.Unlock()
+	if publish != nil {
+		if err := publish(ch.n); err != nil {
+			return err
+		}
+	}
+	return ch.Channel.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+func newCountingPublisher(t *testing.T, config PublisherConfig) (*MemoryBroker, *countingConnection, *Publisher) {
+	t.Helper()
+	broker := NewMemoryBroker()
+	declareQueue(t, memTestChannel(t, broker), "q", nil)
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	counting := &countingConnection{Connection: conn}
+	p, err := NewPublisher(counting, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return broker, counting, p
+}
+
+func TestPublisherReusesChannels(t *testing.T) {
+	broker, conn, p := newCountingPublisher(t, PublisherConfig{Channels: 2})
+	for range 5 {
+		if err := PublishJSON(p, "", "q", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if opened, _ := conn.counts(); opened != 1 {
+		t.Fatalf("opened %d channels for publishes one after another, want 1", opened)
+	}
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := PublishJSON(p, "", "q", 1); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if opened, _ := conn.counts(); opened > 2 {
+		t.Fatalf("opened %d channels, more than the pool's 2", opened)
+	}
+	if n := queueLength(t, broker, "q"); n != 25 {
+		t.Fatalf("q has %d messages, want 25", n)
+	}
+}
+
+// With every channel busy, a publish waits for one, for as long as its
+// context allows.
+func TestPublisherWaitsForChannel(t *testing.T) {
+	_, conn, p := newCountingPublisher(t, PublisherConfig{Channels: 1})
+	gate := make(chan struct{})
+	conn.publish = func(int) error {
+		<-gate
+		return nil
+	}
+	done := make(chan error)
+	go func() { done <- PublishJSON(p, "", "q", 1) }()
+	waitFor(t, "the first publish to start", func() bool {
+		_, attempts := conn.counts()
+		return attempts == 1
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := PublishJSONWithContext(ctx, p, "", "q", 2); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("publish with the pool busy = %v, want DeadlineExceeded", err)
+	}
+	close(gate)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if opened, _ := conn.counts(); opened != 1 {
+		t.Fatalf("opened %d channels, want 1", opened)
+	}
+}
+
+// A publish that finds its channel closed, so nothing was sent, is tried
+// once more on a new channel.
+func TestPublisherRetriesOnClosedChannel(t *testing.T) {
+	broker, conn, p := newCountingPublisher(t, PublisherConfig{})
+	conn.publish = func(n int) error {
+		if n == 1 {
+			return amqp.ErrClosed
+		}
+		return nil
+	}
+	if err := PublishJSON(p, "", "q", 1); err != nil {
+		t.Fatalf("publish on a closed channel wasn't retried: %v", err)
+	}
+	if opened, attempts := conn.counts(); opened != 2 || attempts != 2 {
+		t.Fatalf("opened %d channels and made %d attempts, want 2 and 2", opened, attempts)
+	}
+	if n := queueLength(t, broker, "q"); n != 1 {
+		t.Fatalf("q has %d messages, want 1", n)
+	}
+}
+
+func TestPublisherRetriesOnlyOnce(t *testing.T) {
+	_, conn, p := newCountingPublisher(t, PublisherConfig{})
+	conn.publish = func(int) error { return amqp.ErrClosed }
+	if err := PublishJSON(p, "", "q", 1); err != amqp.ErrClosed {
+		t.Fatalf("publish = %v, want ErrClosed", err)
+	}
+	if _, attempts := conn.counts(); attempts != 2 {
+		t.Fatalf("made %d attempts, want 2", attempts)
+	}
+}
+
+// Other errors, including a closed channel reported after the message may
+// have gone out, aren't retried, as that could publish it twice.
+func TestPublisherDoesNotRetryOtherErrors(t *testing.T) {
+	_, conn, p := newCountingPublisher(t, PublisherConfig{})
+	failure := fmt.Errorf("channel closed before the publish was confirmed: %w", amqp.ErrClosed)
+	conn.publish = func(int) error { return failure }
+	if err := PublishJSON(p, "", "q", 1); err != failure {
+		t.Fatalf("publish = %v, want the channel's error", err)
+	}
+	if _, attempts := conn.counts(); attempts != 1 {
+		t.Fatalf("made %d attempts, want 1", attempts)
+	}
+}
+
+// A channel the broker closed after an error is replaced on the next
+// publish.
+func TestPublisherReplacesDeadChannel(t *testing.T) {
+	broker, conn, p := newCountingPublisher(t, PublisherConfig{})
+	if err := PublishJSON(p, "no-such-exchange", "q", 1); err == nil {
+		t.Fatal("publish to a missing exchange succeeded")
+	}
+	if err := PublishJSON(p, "", "q", 1); err != nil {
+		t.Fatalf("publish after the channel was closed: %v", err)
+	}
+	if opened, attempts := conn.counts(); opened != 2 || attempts != 2 {
+		t.Fatalf("opened %d channels and made %d attempts, want 2 and 2", opened, attempts)
+	}
+	if n := queueLength(t, broker, "q"); n != 1 {
+		t.Fatalf("q has %d messages, want 1", n)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := PublishJSON(p, "", "q", 1); err != amqp.ErrClosed {
+		t.Fatalf("publish after Close = %v, want ErrClosed", err)
+	}
+}
+
+// In confirm mode, publishes report what the broker did with them.
+func TestPublisherConfirms(t *testing.T) {
+	broker := NewMemoryBroker()
+	declareQueue(t, memTestChannel(t, broker), "q", nil)
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p, err := NewPublisher(conn, PublisherConfig{ConfirmTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := PublishJSON(p, "", "q", 1); err != nil {
+		t.Fatal(err)
+	}
+	var unroutable *UnroutableError
+	if err := PublishJSON(p, "", "no-such-queue", 1); !errors.As(err, &unroutable) {
+		t.Fatalf("unroutable publish = %v, want an UnroutableError", err)
+	}
+}
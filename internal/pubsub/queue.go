@@ -0,0 +1,140 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Overflow is what a queue does with a message that would take it past
+// its MaxLength or MaxLengthBytes.
+type Overflow string
+
+const (
+	// OverflowDropHead makes room by dropping the oldest messages, which
+	// are dead-lettered with reason "maxlen". This is the default.
+	OverflowDropHead Overflow = "drop-head"
+	// OverflowRejectPublish drops the new message instead. A publisher in
+	// confirm mode gets a nack for it.
+	OverflowRejectPublish Overflow = "reject-publish"
+	// OverflowRejectPublishDLX is OverflowRejectPublish, but the rejected
+	// message is dead-lettered too. Quorum queues don't support it.
+	OverflowRejectPublishDLX Overflow = "reject-publish-dlx"
+)
+
+// QueueOptions are policies for the queue a subscription declares, set
+// with WithQueueOptions. They become queue arguments, so everyone who
+// declares a shared queue must use the same ones, or the broker refuses
+// the declare with PRECONDITION_FAILED. The zero value sets none of them.
+//
+// Streams only take MaxLengthBytes, which is how much of the stream the
+// broker keeps.
+type QueueOptions struct {
+	// MessageTTL dead-letters messages that have waited this long, with
+	// reason "expired". Messages only expire once they reach the head of
+	// the queue.
+	MessageTTL time.Duration
+	// Expires deletes the queue once it has gone this long without a
+	// consumer, a declare or a Get.
+	Expires time.Duration
+	// MaxLength and MaxLengthBytes limit how many ready messages, and how
+	// many bytes of message bodies, the queue holds. Overflow says what
+	// happens beyond them.
+	MaxLength      int
+	MaxLengthBytes int
+	Overflow       Overflow
+	// SingleActiveConsumer delivers to one consumer at a time, in order,
+	// and fails over to the next when it goes away. Other consumers sit
+	// idle until then.
+	SingleActiveConsumer bool
+	// Lazy keeps a classic queue's messages on disk rather than in
+	// memory. RabbitMQ 3.12 and later do this anyway and ignore it.
+	Lazy bool
+}
+
+// validate checks that the options make sense for the type of queue.
+func (q QueueOptions) validate(queueType SimpleQueueType) error {
+	var errs []error
+	if q.MessageTTL < 0 {
+		errs = append(errs, fmt.Errorf("message TTL must not be negative, got %v", q.MessageTTL))
+	}
+	// The broker counts in milliseconds, and a queue can't expire straight away
+	if q.Expires < 0 || (q.Expires > 0 && q.Expires < time.Millisecond) {
+		errs = append(errs, fmt.Errorf("queue expiry must be at least 1ms, got %v", q.Expires))
+	}
+	if q.MaxLength < 0 {
+		errs = append(errs, fmt.Errorf("max length must not be negative, got %d", q.MaxLength))
+	}
+	if q.MaxLengthBytes < 0 {
+		errs = append(errs, fmt.Errorf("max length in bytes must not be negative, got %d", q.MaxLengthBytes))
+	}
+	switch q.Overflow {
+	case "":
+	case OverflowDropHead, OverflowRejectPublish, OverflowRejectPublishDLX:
+		if q.MaxLength == 0 && q.MaxLengthBytes == 0 {
+			errs = append(errs, fmt.Errorf("overflow %s needs a max length", q.Overflow))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown overflow %q", q.Overflow))
+	}
+
+	switch queueType {
+	case SimpleQueueQuorum:
+		if q.Overflow == OverflowRejectPublishDLX {
+			errs = append(errs, fmt.Errorf("quorum queues don't support overflow %s", q.Overflow))
+		}
+		if q.Lazy {
+			errs = append(errs, errors.New("only classic queues can be lazy"))
+		}
+	case SimpleQueueStream:
+		if q.MessageTTL != 0 || q.Expires != 0 || q.MaxLength != 0 || q.Overflow != "" || q.SingleActiveConsumer || q.Lazy {
+			errs = append(errs, errors.New("streams only support a max length in bytes"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// args are the queue arguments for the options that are set.
+func (q QueueOptions) args() amqp.Table {
+	args := amqp.Table{}
+	if q.MessageTTL > 0 {
+		args["x-message-ttl"] = q.MessageTTL.Milliseconds()
+	}
+	if q.Expires > 0 {
+		args["x-expires"] = q.Expires.Milliseconds()
+	}
+	if q.MaxLength > 0 {
+		args["x-max-length"] = int64(q.MaxLength)
+	}
+	if q.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = int64(q.MaxLengthBytes)
+	}
+	if q.Overflow != "" {
+		args["x-overflow"] = string(q.Overflow)
+	}
+	if q.SingleActiveConsumer {
+		args["x-single-active-consumer"] = true
+	}
+	if q.Lazy {
+		args["x-queue-mode"] = "lazy"
+	}
+	return args
+}
+
+// declareQueueError explains a failed declare of queue. The game_logs and
+// war queues started out as classic queues and are now quorum queues, and
+// the RPC request queues were durable and now aren't. RabbitMQ can't change
+// either, so a broker that still has the old ones refuses to declare them.
+// That needs the operator, so say what to do.
+func declareQueueError(queue string, err error) error {
+	var aerr *amqp.Error
+	if errors.As(err, &aerr) && aerr.Code == amqp.PreconditionFailed && (strings.Contains(aerr.Reason, "'x-queue-type'") || strings.Contains(aerr.Reason, "'durable'")) {
+		return fmt.Errorf("could not declare queue %s: it already exists as a different kind of queue, "+
+			"which RabbitMQ can't change. Stop everything using it, move off any messages you want to keep, "+
+			"delete it (rabbitmqctl delete_queue %s) and start again: %w", queue, queue, err)
+	}
+	return fmt.Errorf("could not declare queue %s: %w", queue, err)
+}
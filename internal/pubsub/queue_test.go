@@ -0,0 +1,227 @@
+package pubsub
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestQueueOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      QueueOptions
+		queueType SimpleQueueType
+		err       string // empty if the options are fine
+	}{
+		{name: "none", queueType: SimpleQueueDurable},
+		{name: "none on a stream", queueType: SimpleQueueStream},
+		{name: "everything on a classic queue", queueType: SimpleQueueDurable, opts: QueueOptions{
+			MessageTTL: time.Minute, Expires: time.Hour, MaxLength: 10, MaxLengthBytes: 1 << 20,
+			Overflow: OverflowRejectPublishDLX, SingleActiveConsumer: true, Lazy: true,
+		}},
+		{name: "max length on a stream", queueType: SimpleQueueStream, opts: QueueOptions{MaxLengthBytes: 1 << 30}},
+		{name: "reject-publish on a quorum queue", queueType: SimpleQueueQuorum, opts: QueueOptions{MaxLength: 10, Overflow: OverflowRejectPublish}},
+		{name: "shortest expiry", queueType: SimpleQueueTransient, opts: QueueOptions{Expires: time.Millisecond}},
+
+		{name: "negative TTL", queueType: SimpleQueueDurable, opts: QueueOptions{MessageTTL: -time.Second}, err: "message TTL must not be negative"},
+		{name: "negative expiry", queueType: SimpleQueueDurable, opts: QueueOptions{Expires: -time.Second}, err: "queue expiry must be at least 1ms"},
+		{name: "expiry under 1ms", queueType: SimpleQueueDurable, opts: QueueOptions{Expires: time.Microsecond}, err: "queue expiry must be at least 1ms"},
+		{name: "negative max length", queueType: SimpleQueueDurable, opts: QueueOptions{MaxLength: -1}, err: "max length must not be negative"},
+		{name: "negative max bytes", queueType: SimpleQueueDurable, opts: QueueOptions{MaxLengthBytes: -1}, err: "max length in bytes must not be negative"},
+		{name: "overflow without a limit", queueType: SimpleQueueDurable, opts: QueueOptions{Overflow: OverflowDropHead}, err: "overflow drop-head needs a max length"},
+		{name: "unknown overflow", queueType: SimpleQueueDurable, opts: QueueOptions{MaxLength: 1, Overflow: "drop-tail"}, err: `unknown overflow "drop-tail"`},
+		{name: "reject-publish-dlx on a quorum queue", queueType: SimpleQueueQuorum, opts: QueueOptions{MaxLength: 10, Overflow: OverflowRejectPublishDLX}, err: "quorum queues don't support overflow reject-publish-dlx"},
+		{name: "lazy quorum queue", queueType: SimpleQueueQuorum, opts: QueueOptions{Lazy: true}, err: "only classic queues can be lazy"},
+		{name: "TTL on a stream", queueType: SimpleQueueStream, opts: QueueOptions{MessageTTL: time.Minute}, err: "streams only support a max length in bytes"},
+		{name: "max length on a stream", queueType: SimpleQueueStream, opts: QueueOptions{MaxLength: 10}, err: "streams only support a max length in bytes"},
+		{name: "single active consumer on a stream", queueType: SimpleQueueStream, opts: QueueOptions{SingleActiveConsumer: true}, err: "streams only support a max length in bytes"},
+		{name: "lazy stream", queueType: SimpleQueueStream, opts: QueueOptions{Lazy: true}, err: "streams only support a max length in bytes"},
+	}
+	for _, tt := range tests {
+		err := tt.opts.validate(tt.queueType)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: validate = %v, want an error mentioning %q", tt.name, err, tt.err)
+		}
+	}
+	// Every problem is reported, not just the first
+	err := QueueOptions{MessageTTL: -1, MaxLength: -1}.validate(SimpleQueueDurable)
+	if err == nil || !strings.Contains(err.Error(), "TTL") || !strings.Contains(err.Error(), "max length") {
+		t.Errorf("validate = %v, want both problems", err)
+	}
+}
+
+func TestQueueOptionsArgs(t *testing.T) {
+	tests := []struct {
+		opts QueueOptions
+		want amqp.Table
+	}{
+		{QueueOptions{}, amqp.Table{}},
+		// Durations go in whole milliseconds
+		{QueueOptions{MessageTTL: 90 * time.Second, Expires: 1500 * time.Microsecond}, amqp.Table{
+			"x-message-ttl": int64(90000), "x-expires": int64(1),
+		}},
+		{QueueOptions{MaxLength: 10, MaxLengthBytes: 4096, Overflow: OverflowRejectPublish}, amqp.Table{
+			"x-max-length": int64(10), "x-max-length-bytes": int64(4096), "x-overflow": "reject-publish",
+		}},
+		{QueueOptions{SingleActiveConsumer: true, Lazy: true}, amqp.Table{
+			"x-single-active-consumer": true, "x-queue-mode": "lazy",
+		}},
+	}
+	for _, tt := range tests {
+		if got := tt.opts.args(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: args = %v, want %v", tt.opts, got, tt.want)
+		}
+	}
+}
+
+// The options are checked before anything is declared, and the queue gets
+// them as arguments.
+func TestSubscribeWithQueueOptions(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	handler := func(int) Acktype { return Ack }
+
+	ctx := context.Background()
+	_, err = Subscribe(ctx, conn, "amq.topic", "war", "war.*", SimpleQueueQuorum, handler,
+		WithQueueOptions(QueueOptions{Lazy: true}))
+	if err == nil || !strings.Contains(err.Error(), "lazy") {
+		t.Fatalf("subscribing with a lazy quorum queue = %v, want an error", err)
+	}
+	if _, ok := broker.QueueLength("war"); ok {
+		t.Fatal("war was declared with invalid options")
+	}
+
+	opts := QueueOptions{MaxLength: 1, Overflow: OverflowRejectPublish}
+	sub, err := Subscribe(ctx, conn, "amq.topic", "war", "war.*", SimpleQueueDurable, handler, WithQueueOptions(opts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	// Declaring it again without them is refused by the broker
+	ch := memTestChannel(t, broker)
+	if _, err := ch.QueueDeclare("war", true, false, false, false, queueArgs(SimpleQueueDurable, nil)); err == nil {
+		t.Fatal("declaring war without its options succeeded")
+	}
+}
+
+func TestDeclareQueueTypeChange(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// war as a broker from before it became a quorum queue has it
+	ch, _, err := DeclareAndBind(conn, "amq.topic", "war", "war.*", SimpleQueueDurable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.Close()
+
+	_, _, err = DeclareAndBind(conn, "amq.topic", "war", "war.*", SimpleQueueQuorum)
+	if err == nil || !strings.Contains(err.Error(), "rabbitmqctl delete_queue war") {
+		t.Fatalf("declaring a classic queue as quorum = %v, want advice to delete it", err)
+	}
+	err = ApplyTopology(conn, Topology{Queues: []QueueSpec{{Name: "war", Durable: true, Args: queueArgs(SimpleQueueQuorum, nil)}}})
+	if err == nil || !strings.Contains(err.Error(), "rabbitmqctl delete_queue war") {
+		t.Fatalf("applying a topology with war as quorum = %v, want advice to delete it", err)
+	}
+}
+
+func TestDeclareQueueDurabilityChange(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// rpc.who as a broker from before request queues went away with their servers has it
+	ch, _, err := DeclareAndBind(conn, "amq.direct", "rpc.who", "rpc.who", SimpleQueueDurable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.Close()
+
+	_, _, err = DeclareAndBind(conn, "amq.direct", "rpc.who", "rpc.who", SimpleQueueShared)
+	if err == nil || !strings.Contains(err.Error(), "rabbitmqctl delete_queue rpc.who") {
+		t.Fatalf("declaring a durable queue as shared = %v, want advice to delete it", err)
+	}
+}
+
+// closeCountingConnection counts the channels opened on it that haven't
+// been closed.
+type closeCountingConnection struct {
+	Connection
+	open atomic.Int32
+}
+
+func (c *closeCountingConnection) Channel() (Channel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	c.open.Add(1)
+	return &closeCountingChannel{Channel: ch, conn: c}, nil
+}
+
+type closeCountingChannel struct {
+	Channel
+	conn   *closeCountingConnection
+	closed bool
+}
+
+func (ch *closeCountingChannel) Close() error {
+	if !ch.closed {
+		ch.closed = true
+		ch.conn.open.Add(-1)
+	}
+	return ch.Channel.Close()
+}
+
+// A failed declare or bind doesn't leave its channel open.
+func TestDeclareAndBindClosesChannel(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	counting := &closeCountingConnection{Connection: conn}
+
+	if _, _, err := DeclareAndBind(counting, "no-such-exchange", "moves", "moves.*", SimpleQueueDurable); err == nil {
+		t.Fatal("binding to a missing exchange succeeded")
+	}
+	if n := counting.open.Load(); n != 0 {
+		t.Fatalf("%d channels left open after a failed bind", n)
+	}
+	if _, _, err := DeclareAndBind(counting, "amq.topic", "moves", "moves.*", SimpleQueueQuorum); err == nil {
+		t.Fatal("declaring a classic queue as quorum succeeded")
+	}
+	if n := counting.open.Load(); n != 0 {
+		t.Fatalf("%d channels left open after a failed declare", n)
+	}
+
+	ch, _, err := DeclareAndBind(counting, "amq.topic", "moves", "moves.*", SimpleQueueDurable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := counting.open.Load(); n != 1 {
+		t.Fatalf("%d channels open after declaring, want the one returned", n)
+	}
+	ch.Close()
+}
@@ -0,0 +1,524 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrDisconnected is returned by channel operations that need the broker
+// while a ReconnectingConnection is waiting for it to come back.
+var ErrDisconnected = errors.New("not connected to the broker")
+
+// ErrPublishBufferFull is returned when a publish arrives during an outage
+// and the outage buffer has no room left for it.
+var ErrPublishBufferFull = errors.New("publish buffer is full")
+
+// ReconnectConfig tunes a ReconnectingConnection. Zero values get the
+// defaults noted on each field.
+type ReconnectConfig struct {
+	InitialBackoff time.Duration // first wait before redialing, default 500ms
+	MaxBackoff     time.Duration // the wait doubles up to this, default 30s
+	BufferSize     int           // publishes held during an outage, default 1000
+	// Logger hears about the broker going away and coming back, default
+	// slog.Default().
+	Logger *slog.Logger
+}
+
+func (c ReconnectConfig) withDefaults() ReconnectConfig {
+	if c.InitialBackoff <= 0 {
+		c.InitialBackoff = 500 * time.Millisecond
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = 30 * time.Second
+	}
+	if c.BufferSize <= 0 {
+		c.BufferSize = 1000
+	}
+	if c.Logger == nil {
+		c.Logger = slog.Default()
+	}
+	return c
+}
+
+// ReconnectingConnection is a Connection that outlives the broker
+// connection underneath it. When the broker goes away it redials with
+// exponential backoff, then:
+//  1. re-runs every subscription made through it, which re-declares and
+//     re-binds their queues with DeclareAndBind and starts consuming again
+//  2. reopens the channels it handed out
+//  3. replays, in order, whatever was published while it was disconnected
+type ReconnectingConnection struct {
+	dial   func() (Connection, error)
+	config ReconnectConfig
+	done   chan struct{}
+
+	mu            sync.Mutex
+	conn          Connection // nil while the broker is unreachable
+	online        bool       // conn is set and the outage buffer has drained
+	closed        bool
+	subscriptions map[int]func(Connection) error
+	nextID        int
+	channels      map[*managedChannel]struct{}
+	buffer        []bufferedPublish
+	notify        []chan *amqp.Error
+}
+
+type bufferedPublish struct {
+	exchange  string
+	key       string
+	mandatory bool
+	immediate bool
+	msg       amqp.Publishing
+}
+
+var _ Connection = (*ReconnectingConnection)(nil)
+
+// DialReconnecting connects to RabbitMQ at url with the default
+// ReconnectConfig. The first dial has to succeed; after that the connection
+// takes care of itself.
+func DialReconnecting(url string) (*ReconnectingConnection, error) {
+	return DialReconnectingWith(url, DialOptions{})
+}
+
+// DialReconnectingWith is DialReconnecting, connecting with opts every time.
+func DialReconnectingWith(url string, opts DialOptions) (*ReconnectingConnection, error) {
+	return NewReconnectingConnection(func() (Connection, error) {
+		return DialWith(url, opts)
+	}, ReconnectConfig{Logger: opts.Logger})
+}
+
+// NewReconnectingConnection dials once with dial and keeps using it to
+// reconnect whenever the connection is lost.
+func NewReconnectingConnection(dial func() (Connection, error), config ReconnectConfig) (*ReconnectingConnection, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	rc := &ReconnectingConnection{
+		dial:          dial,
+		config:        config.withDefaults(),
+		done:          make(chan struct{}),
+		conn:          conn,
+		online:        true,
+		subscriptions: map[int]func(Connection) error{},
+		channels:      map[*managedChannel]struct{}{},
+	}
+	go rc.watch(conn)
+	return rc, nil
+}
+
+// Channel returns a channel that is reopened after every reconnect. Its
+// Qos setting is reapplied, and publishes made on it during an outage are
+// buffered instead of failing. Consumers started directly with its Consume
+// method are not restarted; use the Subscribe functions for that.
+func (rc *ReconnectingConnection) Channel() (Channel, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return nil, amqp.ErrClosed
+	}
+	m := &managedChannel{rc: rc}
+	if rc.conn != nil {
+		if err := m.attach(rc.conn); err != nil {
+			return nil, err
+		}
+	}
+	rc.channels[m] = struct{}{}
+	return m, nil
+}
+
+// NotifyClose only fires when Close is called. Losing the broker is not
+// reported here, since the connection recovers from that by itself.
+func (rc *ReconnectingConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		close(receiver)
+		return receiver
+	}
+	rc.notify = append(rc.notify, receiver)
+	return receiver
+}
+
+// IsClosed reports whether Close has been called.
+func (rc *ReconnectingConnection) IsClosed() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.closed
+}
+
+// Close stops reconnecting, closes the current connection and drops
+// anything still waiting in the outage buffer.
+func (rc *ReconnectingConnection) Close() error {
+	rc.mu.Lock()
+	if rc.closed {
+		rc.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	rc.closed = true
+	close(rc.done)
+	conn := rc.conn
+	dropped := len(rc.buffer)
+	rc.conn, rc.online, rc.buffer = nil, false, nil
+	notifyClose(rc.notify, nil)
+	rc.notify = nil
+	rc.mu.Unlock()
+
+	if dropped > 0 {
+		rc.config.Logger.Warn("dropping publishes buffered while disconnected", slog.Int("dropped", dropped))
+	}
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+// directChannel opens a plain channel on the current underlying
+// connection, or fails with ErrDisconnected during an outage.
+func (rc *ReconnectingConnection) directChannel() (Channel, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return nil, amqp.ErrClosed
+	}
+	if rc.conn == nil {
+		return nil, ErrDisconnected
+	}
+	return rc.conn.Channel()
+}
+
+// register runs start against the current connection (if there is one) and
+// remembers it so it runs again after every reconnect, until the returned
+// unregister function is called.
+func (rc *ReconnectingConnection) register(start func(Connection) error) (unregister func(), err error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return nil, amqp.ErrClosed
+	}
+	if rc.conn != nil {
+		if err := start(rc.conn); err != nil {
+			return nil, err
+		}
+	}
+	rc.nextID++
+	id := rc.nextID
+	rc.subscriptions[id] = start
+	return func() {
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		delete(rc.subscriptions, id)
+	}, nil
+}
+
+// watch waits for the connection to drop and reconnects, for as long as
+// rc is open.
+func (rc *ReconnectingConnection) watch(conn Connection) {
+	for {
+		reason := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+
+		rc.mu.Lock()
+		if rc.closed {
+			rc.mu.Unlock()
+			return
+		}
+		rc.conn, rc.online = nil, false
+		for m := range rc.channels {
+			m.detach()
+		}
+		rc.mu.Unlock()
+		rc.config.Logger.Warn("lost connection to the broker", slog.Any("err", reason))
+
+		conn = rc.reconnect()
+		if conn == nil {
+			return
+		}
+		rc.config.Logger.Info("reconnected to the broker")
+	}
+}
+
+// reconnect redials with exponential backoff until it has a connection
+// with everything restored, or rc is closed (in which case it returns nil).
+func (rc *ReconnectingConnection) reconnect() Connection {
+	delay := rc.config.InitialBackoff
+	for {
+		select {
+		case <-rc.done:
+			return nil
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, rc.config.MaxBackoff)
+
+		conn, err := rc.dial()
+		if err != nil {
+			rc.config.Logger.Warn("could not reconnect to the broker", slog.Any("err", err), slog.Duration("retry_in", delay))
+			continue
+		}
+		if err := rc.restore(conn); err != nil {
+			rc.config.Logger.Warn("could not restore broker state", slog.Any("err", err), slog.Duration("retry_in", delay))
+			conn.Close()
+			continue
+		}
+		return conn
+	}
+}
+
+// restore brings a fresh connection up to where the old one was:
+// subscriptions first, so that queues exist and are bound before anything
+// buffered is published to them, then channels, then the buffer itself.
+func (rc *ReconnectingConnection) restore(conn Connection) error {
+	// Subscriptions can come and go while we work through them, so keep
+	// going until every one that is registered has been started
+	started := map[int]bool{}
+	for {
+		rc.mu.Lock()
+		if rc.closed {
+			rc.mu.Unlock()
+			return amqp.ErrClosed
+		}
+		id, start := -1, (func(Connection) error)(nil)
+		for i, fn := range rc.subscriptions {
+			if !started[i] && (id == -1 || i < id) {
+				id, start = i, fn
+			}
+		}
+		if start == nil {
+			// Still holding the lock: from here on register and Channel
+			// use conn directly
+			break
+		}
+		rc.mu.Unlock()
+		started[id] = true
+		if err := start(conn); err != nil {
+			return fmt.Errorf("could not restart subscription: %v", err)
+		}
+	}
+	for m := range rc.channels {
+		if err := m.attach(conn); err != nil {
+			rc.mu.Unlock()
+			return err
+		}
+	}
+	rc.conn = conn
+	rc.mu.Unlock()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	for {
+		rc.mu.Lock()
+		if rc.closed {
+			rc.mu.Unlock()
+			return amqp.ErrClosed
+		}
+		if len(rc.buffer) == 0 {
+			rc.online = true
+			rc.mu.Unlock()
+			return nil
+		}
+		p := rc.buffer[0]
+		rc.mu.Unlock()
+		err := ch.PublishWithContext(context.Background(), p.exchange, p.key, p.mandatory, p.immediate, p.msg)
+		if err != nil {
+			return fmt.Errorf("could not replay buffered publish: %v", err)
+		}
+		rc.mu.Lock()
+		rc.buffer = rc.buffer[1:]
+		rc.mu.Unlock()
+	}
+}
+
+// publish sends through m's current channel, or buffers the message if
+// the broker is unavailable (or the buffer is still being replayed, so
+// that ordering is kept).
+func (rc *ReconnectingConnection) publish(ctx context.Context, m *managedChannel, p bufferedPublish) error {
+	rc.mu.Lock()
+	if rc.closed {
+		rc.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	if !rc.online {
+		defer rc.mu.Unlock()
+		return rc.bufferLocked(p)
+	}
+	conn := rc.conn
+	rc.mu.Unlock()
+
+	ch, err := m.current()
+	if err == nil {
+		err = ch.PublishWithContext(ctx, p.exchange, p.key, p.mandatory, p.immediate, p.msg)
+	}
+	if err != nil && conn.IsClosed() {
+		// The connection died under us and watch hasn't caught up yet
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		if rc.closed {
+			return amqp.ErrClosed
+		}
+		return rc.bufferLocked(p)
+	}
+	return err
+}
+
+func (rc *ReconnectingConnection) bufferLocked(p bufferedPublish) error {
+	if len(rc.buffer) >= rc.config.BufferSize {
+		return ErrPublishBufferFull
+	}
+	rc.buffer = append(rc.buffer, p)
+	return nil
+}
+
+// managedChannel is the Channel handed out by ReconnectingConnection.
+type managedChannel struct {
+	rc *ReconnectingConnection
+
+	mu       sync.Mutex
+	ch       Channel // nil while disconnected
+	prefetch *int    // last Qos prefetch, reapplied on reconnect
+	closed   bool
+	notify   []chan *amqp.Error
+}
+
+var _ Channel = (*managedChannel)(nil)
+
+func (m *managedChannel) attach(conn Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("could not reopen channel: %v", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.prefetch != nil {
+		if err := ch.Qos(*m.prefetch, 0, false); err != nil {
+			return fmt.Errorf("could not restore qos: %v", err)
+		}
+	}
+	m.ch = ch
+	return nil
+}
+
+func (m *managedChannel) detach() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ch = nil
+}
+
+func (m *managedChannel) current() (Channel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, amqp.ErrClosed
+	}
+	if m.ch == nil {
+		return nil, ErrDisconnected
+	}
+	return m.ch, nil
+}
+
+func (m *managedChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if _, err := m.current(); errors.Is(err, amqp.ErrClosed) {
+		return err
+	}
+	return m.rc.publish(ctx, m, bufferedPublish{
+		exchange:  exchange,
+		key:       key,
+		mandatory: mandatory,
+		immediate: immediate,
+		msg:       msg,
+	})
+}
+
+func (m *managedChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	ch, err := m.current()
+	if err != nil {
+		return err
+	}
+	return ch.ExchangeDeclare(name, kind, durable, autoDelete, internal, noWait, args)
+}
+
+func (m *managedChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	ch, err := m.current()
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	return ch.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+}
+
+func (m *managedChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	ch, err := m.current()
+	if err != nil {
+		return err
+	}
+	return ch.QueueBind(name, key, exchange, noWait, args)
+}
+
+func (m *managedChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	m.mu.Lock()
+	m.prefetch = &prefetchCount
+	m.mu.Unlock()
+	ch, err := m.current()
+	if err != nil {
+		if errors.Is(err, ErrDisconnected) {
+			// It will be applied when the channel is reopened
+			return nil
+		}
+		return err
+	}
+	return ch.Qos(prefetchCount, prefetchSize, global)
+}
+
+func (m *managedChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	ch, err := m.current()
+	if err != nil {
+		return nil, err
+	}
+	return ch.Consume(queue, consumer, autoAck, exclusive, noLocal, noWait, args)
+}
+
+func (m *managedChannel) Cancel(consumer string, noWait bool) error {
+	ch, err := m.current()
+	if err != nil {
+		return err
+	}
+	return ch.Cancel(consumer, noWait)
+}
+
+// NotifyClose fires when the managed channel is closed with Close. The
+// channel underneath coming and going with the connection is not reported.
+func (m *managedChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		close(receiver)
+		return receiver
+	}
+	m.notify = append(m.notify, receiver)
+	return receiver
+}
+
+func (m *managedChannel) Close() error {
+	m.rc.mu.Lock()
+	delete(m.rc.channels, m)
+	m.rc.mu.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return amqp.ErrClosed
+	}
+	m.closed = true
+	notifyClose(m.notify, nil)
+	m.notify = nil
+	if m.ch != nil {
+		return m.ch.Close()
+	}
+	return nil
+}
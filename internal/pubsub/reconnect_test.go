@@ -0,0 +1,271 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func dialTestReconnecting(t *testing.T, broker *MemoryBroker, config ReconnectConfig) *ReconnectingConnection {
+	t.Helper()
+	if config.InitialBackoff == 0 {
+		config.InitialBackoff = 5 * time.Millisecond
+		config.MaxBackoff = 20 * time.Millisecond
+	}
+	config.Logger = discardLogger
+	rc, err := NewReconnectingConnection(broker.Dial, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rc.Close() })
+	return rc
+}
+
+// waitDisconnected waits for rc to notice the broker has gone.
+func waitDisconnected(t *testing.T, rc *ReconnectingConnection) {
+	t.Helper()
+	waitFor(t, "the connection to notice the broker stopping", func() bool {
+		_, err := rc.directChannel()
+		return errors.Is(err, ErrDisconnected)
+	})
+}
+
+// received collects the bodies a subscription is handed, in order.
+type received struct {
+	mu     sync.Mutex
+	bodies []int
+}
+
+func (r *received) handle(n int) Acktype {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bodies = append(r.bodies, n)
+	return Ack
+}
+
+func (r *received) get() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int(nil), r.bodies...)
+}
+
+func TestReconnectResumesSubscriptions(t *testing.T) {
+	broker := NewMemoryBroker()
+	rc := dialTestReconnecting(t, broker, ReconnectConfig{})
+	var got received
+	// A transient queue goes away with the broker, so it has to be declared
+	// and bound again
+	sub, err := Subscribe(context.Background(), rc, "amq.topic", "moves", "moves.*", SimpleQueueTransient, got.handle,
+		WithLogger(discardLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	ch, err := rc.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+
+	if err := PublishJSON(ch, "amq.topic", "moves.alice", 1); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the first message", func() bool { return len(got.get()) == 1 })
+
+	broker.Restart()
+	waitFor(t, "the queue to be declared again", func() bool {
+		_, ok := broker.QueueLength("moves")
+		return ok
+	})
+	if err := PublishJSON(ch, "amq.topic", "moves.alice", 2); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a message after the reconnect", func() bool { return len(got.get()) == 2 })
+	if bodies := got.get(); bodies[1] != 2 {
+		t.Fatalf("received %v, want [1 2]", bodies)
+	}
+}
+
+func TestReconnectReplaysBufferedPublishes(t *testing.T) {
+	broker := NewMemoryBroker()
+	rc := dialTestReconnecting(t, broker, ReconnectConfig{BufferSize: 5})
+	var got received
+	sub, err := Subscribe(context.Background(), rc, "amq.topic", "moves", "moves.*", SimpleQueueDurable, got.handle,
+		WithLogger(discardLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	ch, err := rc.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+
+	broker.Stop()
+	waitDisconnected(t, rc)
+	for n := range 5 {
+		if err := PublishJSON(ch, "amq.topic", "moves.alice", n); err != nil {
+			t.Fatalf("publish %d during the outage: %v", n, err)
+		}
+	}
+	if err := PublishJSON(ch, "amq.topic", "moves.alice", 5); !errors.Is(err, ErrPublishBufferFull) {
+		t.Fatalf("publish with the buffer full = %v, want ErrPublishBufferFull", err)
+	}
+	if len(got.get()) != 0 {
+		t.Fatal("a message was delivered during the outage")
+	}
+
+	broker.Start()
+	waitFor(t, "the buffered messages", func() bool { return len(got.get()) == 5 })
+	for i, n := range got.get() {
+		if n != i {
+			t.Fatalf("received %v, want them in the order they were published", got.get())
+		}
+	}
+	// Once the buffer is drained, publishes go straight through again
+	if err := PublishJSON(ch, "amq.topic", "moves.alice", 5); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a message after the replay", func() bool { return len(got.get()) == 6 })
+}
+
+func TestReconnectCloseDuringBackoff(t *testing.T) {
+	broker := NewMemoryBroker()
+	rc := dialTestReconnecting(t, broker, ReconnectConfig{InitialBackoff: time.Hour})
+	ch, err := rc.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := rc.NotifyClose(make(chan *amqp.Error, 1))
+
+	broker.Stop()
+	waitDisconnected(t, rc)
+	if err := ch.PublishWithContext(context.Background(), "", "q", false, false, amqp.Publishing{}); err != nil {
+		t.Fatalf("publish during the outage: %v", err)
+	}
+
+	start := time.Now()
+	if err := rc.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("Close took %v while waiting to redial", took)
+	}
+	select {
+	case <-closed:
+	default:
+		t.Fatal("NotifyClose didn't fire on Close")
+	}
+	if err := ch.PublishWithContext(context.Background(), "", "q", false, false, amqp.Publishing{}); !errors.Is(err, amqp.ErrClosed) {
+		t.Fatalf("publish after Close = %v, want ErrClosed", err)
+	}
+	if _, err := rc.Channel(); !errors.Is(err, amqp.ErrClosed) {
+		t.Fatalf("Channel after Close = %v, want ErrClosed", err)
+	}
+	// It doesn't come back when the broker does
+	broker.Start()
+	time.Sleep(20 * time.Millisecond)
+	if !rc.IsClosed() {
+		t.Fatal("the connection reopened after Close")
+	}
+}
+
+// A channel's prefetch is applied again when it is reopened, and Qos
+// during an outage is kept for then.
+func TestReconnectRestoresQos(t *testing.T) {
+	broker := NewMemoryBroker()
+	rc := dialTestReconnecting(t, broker, ReconnectConfig{})
+	ch, err := rc.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	broker.Stop()
+	waitDisconnected(t, rc)
+	if err := ch.Qos(1, 0, false); err != nil {
+		t.Fatalf("Qos during the outage: %v", err)
+	}
+	if _, err := ch.QueueDeclare("q", true, false, false, false, nil); !errors.Is(err, ErrDisconnected) {
+		t.Fatalf("declare during the outage = %v, want ErrDisconnected", err)
+	}
+	broker.Start()
+	waitFor(t, "the channel to be reopened", func() bool {
+		_, err := ch.QueueDeclare("q", true, false, false, false, nil)
+		return err == nil
+	})
+
+	for range 2 {
+		publishText(t, ch, "", "q", "x")
+	}
+	deliveries, err := ch.Consume("q", "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-deliveries
+	select {
+	case <-deliveries:
+		t.Fatal("got a second delivery with prefetch 1")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+// A stream consumer picks up after the last message it acked when it
+// starts again, so one it didn't ack is read again.
+func TestReconnectResumesStreamAfterAck(t *testing.T) {
+	broker := NewMemoryBroker()
+	rc := dialTestReconnecting(t, broker, ReconnectConfig{})
+	var mu sync.Mutex
+	var bodies []int
+	nacked := false
+	sub, err := Subscribe(context.Background(), rc, "amq.topic", "log", "log.*", SimpleQueueStream,
+		func(n int) Acktype {
+			mu.Lock()
+			defer mu.Unlock()
+			bodies = append(bodies, n)
+			if n == 2 && !nacked {
+				nacked = true
+				return NackRequeue
+			}
+			return Ack
+		},
+		WithPrefetch(10),
+		WithLogger(discardLogger),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	got := func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]int(nil), bodies...)
+	}
+	ch, err := rc.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+
+	for n := 1; n <= 2; n++ {
+		if err := PublishJSON(ch, "amq.topic", "log.alice", n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "both messages", func() bool { return len(got()) == 2 })
+
+	broker.Restart()
+	waitFor(t, "the unacked message again", func() bool { return len(got()) == 3 })
+	if err := PublishJSON(ch, "amq.topic", "log.alice", 3); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a message after the reconnect", func() bool { return len(got()) == 4 })
+	if want := []int{1, 2, 2, 3}; !slices.Equal(got(), want) {
+		t.Fatalf("received %v, want %v", got(), want)
+	}
+}
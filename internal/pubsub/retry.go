@@ -0,0 +1,131 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// retryCountHeader counts how many times a message has been sent back for
+// another try by NackRetryLater.
+const retryCountHeader = "x-retry-count"
+
+// A retried message goes through the default exchange, so these headers
+// keep track of where it was first published.
+const (
+	originalExchangeHeader   = "x-original-exchange"
+	originalRoutingKeyHeader = "x-original-routing-key"
+)
+
+// RetryPolicy decides what happens to a message whose handler returns
+// NackRetryLater. It is parked in a delay queue, whose TTL sends it back to
+// the original queue once the delay has passed. Each retry doubles the
+// delay, up to MaxDelay. After MaxRetries retries the message is
+// dead-lettered instead. Zero values get the defaults noted on each field.
+type RetryPolicy struct {
+	MaxRetries   int           // default 5
+	InitialDelay time.Duration // default 1s
+	MaxDelay     time.Duration // default 1m
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxRetries <= 0 {
+		p.MaxRetries = 5
+	}
+	if p.InitialDelay <= 0 {
+		p.InitialDelay = time.Second
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = time.Minute
+	}
+	if p.MaxDelay < p.InitialDelay {
+		p.MaxDelay = p.InitialDelay
+	}
+	return p
+}
+
+// delay is how long to wait before retry number n (counting from 1).
+func (p RetryPolicy) delay(n int) time.Duration {
+	d := p.InitialDelay
+	for i := 1; i < n && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// retrier carries out a RetryPolicy for the messages of one consumer.
+type retrier struct {
+	ch      Channel // the consumer's channel
+	queue   string
+	durable bool
+	policy  RetryPolicy
+	logger  *slog.Logger
+}
+
+// retry schedules msg for another try, or dead-letters it once it has run
+// out of retries. The original delivery is only acked once the copy is in
+// the delay queue; if that fails it is requeued instead.
+func (r *retrier) retry(msg amqp.Delivery) {
+	retries := retryCount(msg.Headers)
+	if retries >= r.policy.MaxRetries {
+		r.logger.Warn("giving up on delivery", deliveryAttrs(msg), slog.Int("retries", retries))
+		msg.Nack(false, false)
+		return
+	}
+	if err := r.schedule(msg, retries+1); err != nil {
+		r.logger.Error("could not schedule retry, requeueing", deliveryAttrs(msg), slog.Int("retry", retries+1), slog.Any("err", err))
+		msg.Nack(false, true)
+		return
+	}
+	msg.Ack(false)
+}
+
+// schedule publishes a copy of msg to the delay queue for retry number n.
+func (r *retrier) schedule(msg amqp.Delivery, n int) error {
+	delay := r.policy.delay(n)
+	// One delay queue per queue and delay. It dead-letters expired messages through the
+	// default exchange, which routes them straight back to the original queue. It is
+	// declared every time, which also keeps it from expiring while in use.
+	delayQueue := fmt.Sprintf("%s.retry.%dms", r.queue, delay.Milliseconds())
+	_, err := r.ch.QueueDeclare(
+		delayQueue,
+		r.durable, // durable
+		false,     // delete when unused
+		false,     // exclusive
+		false,     // no-wait
+		amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": r.queue,
+			// Clean up once it has been idle for a while
+			"x-expires": (delay + time.Minute).Milliseconds(),
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("could not declare delay queue %s: %v", delayQueue, err)
+	}
+	pub := publishingFromDelivery(msg)
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[retryCountHeader] = int64(n)
+	if _, ok := headers[originalExchangeHeader]; !ok {
+		headers[originalExchangeHeader] = msg.Exchange
+		headers[originalRoutingKeyHeader] = msg.RoutingKey
+	}
+	pub.Headers = headers
+	return r.ch.PublishWithContext(context.Background(), "", delayQueue, false, false, pub)
+}
+
+// retryCount reads the retry count header, which is 0 for a first delivery.
+func retryCount(headers amqp.Table) int {
+	n, _ := tableInt(headers, retryCountHeader)
+	return int(n)
+}
@@ -0,0 +1,108 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{InitialDelay: time.Second, MaxDelay: 5 * time.Second}.withDefaults()
+	if p.MaxRetries != 5 {
+		t.Fatalf("MaxRetries defaulted to %d, want 5", p.MaxRetries)
+	}
+	for n, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		if got := p.delay(n); got != want {
+			t.Errorf("delay(%d) = %v, want %v", n, got, want)
+		}
+	}
+	// MaxDelay is never less than the first delay
+	p = RetryPolicy{InitialDelay: 2 * time.Minute}.withDefaults()
+	if got := p.delay(3); got != 2*time.Minute {
+		t.Errorf("delay(3) with only InitialDelay set = %v, want 2m", got)
+	}
+}
+
+// A message the handler wants to retry later comes back after the delay,
+// with its retry count up by one and the exchange and routing key it was
+// published with, until it runs out of retries and is dead-lettered.
+func TestRetryLater(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := DeclareDeadLetterQueue(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	type delivery struct {
+		msg Message[int]
+		at  time.Time
+	}
+	var mu sync.Mutex
+	var deliveries []delivery
+	sub, err := SubscribeMessages(context.Background(), conn, "amq.topic", "moves", "moves.*", SimpleQueueDurable,
+		func(msg Message[int]) Acktype {
+			mu.Lock()
+			defer mu.Unlock()
+			deliveries = append(deliveries, delivery{msg, time.Now()})
+			return NackRetryLater
+		},
+		WithRetryPolicy(RetryPolicy{MaxRetries: 2, InitialDelay: 50 * time.Millisecond, MaxDelay: 80 * time.Millisecond}),
+		WithLogger(discardLogger),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	ch := memTestChannel(t, broker)
+	if err := PublishJSON(ch, "amq.topic", "moves.alice", 7, WithMessageID("move-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the message to be dead-lettered", func() bool {
+		n, _ := broker.QueueLength(routing.QueuePerilDLQ)
+		return n == 1
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if len(deliveries) != 3 {
+		t.Fatalf("delivered %d times, want the first try and 2 retries", len(deliveries))
+	}
+	for i, d := range deliveries {
+		msg := d.msg
+		if msg.Retries != i || msg.Body != 7 || msg.MessageID != "move-1" ||
+			msg.Exchange != "amq.topic" || msg.RoutingKey != "moves.alice" {
+			t.Errorf("delivery %d: retries %d, body %d, ID %s, via %s/%s", i, msg.Retries, msg.Body, msg.MessageID, msg.Exchange, msg.RoutingKey)
+		}
+		if i == 0 {
+			if _, ok := msg.Headers[retryCountHeader]; ok {
+				t.Errorf("first delivery has a %s header", retryCountHeader)
+			}
+			continue
+		}
+		if n, _ := tableInt(msg.Headers, retryCountHeader); n != int64(i) {
+			t.Errorf("delivery %d has %s %d", i, retryCountHeader, n)
+		}
+	}
+	// The second delay is double the first, capped at MaxDelay
+	for i, want := range []time.Duration{50 * time.Millisecond, 80 * time.Millisecond} {
+		if gap := deliveries[i+1].at.Sub(deliveries[i].at); gap < want {
+			t.Errorf("retry %d came back after %v, want at least %v", i+1, gap, want)
+		}
+	}
+	if _, ok := broker.QueueLength("moves.retry.50ms"); !ok {
+		t.Error("no delay queue for the first retry")
+	}
+
+	d := get(t, ch, routing.QueuePerilDLQ)
+	letter := newDeadLetter(d)
+	if letter.Queue != "moves" || letter.Exchange != "amq.topic" || letter.RoutingKey != "moves.alice" {
+		t.Fatalf("dead letter from %s via %s/%s, want from moves via amq.topic/moves.alice", letter.Queue, letter.Exchange, letter.RoutingKey)
+	}
+}
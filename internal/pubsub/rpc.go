@@ -0,0 +1,321 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// rpcErrorHeader carries the error a ServeRPC handler returned, in place
+// of a response body.
+const rpcErrorHeader = "x-rpc-error"
+
+// ErrNoResponder means an RPC request could not be routed to any server.
+var ErrNoResponder = errors.New("no server is listening for this request")
+
+// ErrRPCTimeout means no reply came back before the call's deadline.
+var ErrRPCTimeout = errors.New("timed out waiting for a reply")
+
+// RPCError is an error returned by the server's handler.
+type RPCError struct {
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return "rpc: " + e.Message
+}
+
+// RPCClient makes request/reply calls with Call. Replies arrive on a
+// private, server-named queue that the client consumes for as long as it
+// is open; each request carries that queue's name as its reply-to and a
+// fresh correlation ID that the reply echoes back. On a
+// ReconnectingConnection the reply queue is recreated after a reconnect.
+// Calls that were waiting when the connection dropped fail with
+// ErrDisconnected.
+type RPCClient struct {
+	timeout    time.Duration
+	unregister func()
+
+	// Calls may come from any goroutine, but a channel can only take one
+	// publish at a time
+	publishMu sync.Mutex
+
+	mu      sync.Mutex
+	ch      Channel // nil while disconnected
+	replyTo string
+	pending map[string]chan rpcReply
+	closed  bool
+}
+
+type rpcReply struct {
+	delivery amqp.Delivery
+	err      error
+}
+
+// returnChannel is a channel that reports unroutable mandatory messages.
+type returnChannel interface {
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+}
+
+// NewRPCClient sets up the reply queue on conn. Calls give up after
+// timeout unless their context has an earlier deadline.
+func NewRPCClient(conn Connection, timeout time.Duration) (*RPCClient, error) {
+	c := &RPCClient{
+		timeout: timeout,
+		pending: map[string]chan rpcReply{},
+	}
+	if rc, ok := conn.(*ReconnectingConnection); ok {
+		unregister, err := rc.register(c.start)
+		if err != nil {
+			return nil, err
+		}
+		c.unregister = unregister
+	} else if err := c.start(conn); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// start declares a reply queue and starts consuming from it.
+func (c *RPCClient) start(conn Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("could not create channel: %v", err)
+	}
+	// Server-named, and gone as soon as we are
+	queue, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		ch.Close()
+		return fmt.Errorf("could not declare reply queue: %v", err)
+	}
+	replies, err := ch.Consume(queue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return fmt.Errorf("could not consume replies: %v", err)
+	}
+	var returns chan amqp.Return
+	if rch, ok := ch.(returnChannel); ok {
+		returns = rch.NotifyReturn(make(chan amqp.Return, 1))
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		ch.Close()
+		return nil
+	}
+	c.ch = ch
+	c.replyTo = queue.Name
+	c.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case d, ok := <-replies:
+				if !ok {
+					c.disconnected(ch)
+					return
+				}
+				c.deliver(d.CorrelationId, rpcReply{delivery: d})
+			case r, ok := <-returns:
+				if !ok {
+					returns = nil
+					continue
+				}
+				c.deliver(r.CorrelationId, rpcReply{err: ErrNoResponder})
+			}
+		}
+	}()
+	return nil
+}
+
+// deliver hands a reply to the call waiting for it. Replies nobody is
+// waiting for any more (because the call timed out) are dropped.
+func (c *RPCClient) deliver(correlationID string, reply rpcReply) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if waiting, ok := c.pending[correlationID]; ok {
+		delete(c.pending, correlationID)
+		waiting <- reply
+	}
+}
+
+// disconnected fails every waiting call once the reply queue is gone: its
+// replies would have nowhere to go.
+func (c *RPCClient) disconnected(ch Channel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ch != ch {
+		return
+	}
+	c.ch = nil
+	c.replyTo = ""
+	for id, waiting := range c.pending {
+		delete(c.pending, id)
+		waiting <- rpcReply{err: ErrDisconnected}
+	}
+}
+
+// Close stops consuming replies. Calls still waiting fail.
+func (c *RPCClient) Close() error {
+	if c.unregister != nil {
+		c.unregister()
+	}
+	c.mu.Lock()
+	c.closed = true
+	ch := c.ch
+	c.mu.Unlock()
+	if ch == nil {
+		return nil
+	}
+	return ch.Close()
+}
+
+// Call sends req, JSON-encoded, to exchange with routing key key and waits
+// for the reply, which is decoded into a Resp. It fails with ErrNoResponder
+// if nothing is bound to receive the request, an *RPCError if the server's
+// handler returned an error, and ErrRPCTimeout if no reply arrived in
+// time. opts are applied to the request, as for Publish.
+func Call[Req, Resp any](ctx context.Context, c *RPCClient, exchange, key string, req Req, opts ...PublishOption) (Resp, error) {
+	var resp Resp
+	body, err := JSON.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	correlationID := newMessageID()
+	waiting := make(chan rpcReply, 1)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return resp, amqp.ErrClosed
+	}
+	ch, replyTo := c.ch, c.replyTo
+	if ch == nil {
+		c.mu.Unlock()
+		return resp, ErrDisconnected
+	}
+	c.pending[correlationID] = waiting
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, correlationID)
+		c.mu.Unlock()
+	}()
+
+	pub := newPublishing(JSON.ContentType(), body, opts)
+	pub.ReplyTo = replyTo
+	pub.CorrelationId = correlationID
+	// Mandatory, so that a request nobody is listening for comes straight back instead of
+	// waiting out the timeout
+	c.publishMu.Lock()
+	err = ch.PublishWithContext(ctx, exchange, key, true, false, pub)
+	c.publishMu.Unlock()
+	if err != nil {
+		return resp, fmt.Errorf("could not send request: %w", err)
+	}
+
+	select {
+	case reply := <-waiting:
+		if reply.err != nil {
+			return resp, reply.err
+		}
+		d := reply.delivery
+		if msg, ok := d.Headers[rpcErrorHeader].(string); ok {
+			return resp, &RPCError{Message: msg}
+		}
+		return decode[Resp](d.ContentType, d.Body, JSON)
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return resp, ErrRPCTimeout
+		}
+		return resp, ctx.Err()
+	}
+}
+
+// ServeRPC answers requests sent with Call to exchange with routing key
+// key. They are consumed from a queue named after the key, so any number of
+// servers can share the work. The queue is deleted once the last server
+// goes, so requests don't pile up with nobody to answer them, and Call
+// returns ErrNoResponder straight away instead. Each reply is encoded with the
+// request's codec and sent to its reply-to queue; if handler returns an
+// error, the caller gets it as an *RPCError instead. opts are the same as
+// for Subscribe.
+func ServeRPC[Req, Resp any](
+	ctx context.Context,
+	conn Connection,
+	exchange,
+	key string,
+	handler func(Message[Req]) (Resp, error),
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	o, err := newSubscribeOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	logger := o.logger.With(slog.String("queue", key))
+	// A Publisher, as with WithWorkers several replies can be going out at once
+	replies, err := NewPublisher(conn, PublisherConfig{})
+	if err != nil {
+		return nil, fmt.Errorf("could not create publisher: %v", err)
+	}
+	sub, err := SubscribeMessages(ctx, conn, exchange, key, key, SimpleQueueShared, func(msg Message[Req]) Acktype {
+		if msg.ReplyTo == "" {
+			logger.Warn("rpc request has no reply-to queue", messageAttrs(msg))
+			return NackDiscard
+		}
+		codec, err := CodecFor(msg.ContentType)
+		if err != nil {
+			codec = JSON
+		}
+		var pub amqp.Publishing
+		resp, herr := callRPCHandler(logger, handler, msg)
+		if herr != nil {
+			pub = newPublishing(codec.ContentType(), nil, []PublishOption{WithHeader(rpcErrorHeader, herr.Error())})
+		} else {
+			body, err := codec.Marshal(resp)
+			if err != nil {
+				pub = newPublishing(codec.ContentType(), nil, []PublishOption{WithHeader(rpcErrorHeader, fmt.Sprintf("could not encode reply: %v", err))})
+			} else {
+				pub = newPublishing(codec.ContentType(), body, nil)
+			}
+		}
+		pub.CorrelationId = msg.CorrelationID
+		// The default exchange routes straight to the reply queue. If the caller has gone,
+		// the reply is simply dropped
+		if err := replies.PublishWithContext(context.Background(), "", msg.ReplyTo, false, false, pub); err != nil {
+			logger.Warn("could not send rpc reply", messageAttrs(msg), slog.String("reply_to", msg.ReplyTo), slog.Any("err", err))
+		}
+		return Ack
+	}, opts...)
+	if err != nil {
+		replies.Close()
+		return nil, err
+	}
+	sub.onStop(func() { replies.Close() })
+	return sub, nil
+}
+
+// callRPCHandler turns a panic in handler into an error, which at least
+// tells the caller what went wrong rather than leaving it to time out.
+func callRPCHandler[Req, Resp any](logger *slog.Logger, handler func(Message[Req]) (Resp, error), msg Message[Req]) (resp Resp, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("rpc handler panicked",
+				messageAttrs(msg),
+				slog.Any("panic", r),
+				slog.String("stack", string(debug.Stack())),
+			)
+			err = fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+	return handler(msg)
+}
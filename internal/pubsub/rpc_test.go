@@ -0,0 +1,48 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCallWithoutServer(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := NewRPCClient(conn, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	call := func() (string, error) {
+		return Call[string, string](context.Background(), client, "amq.direct", "rpc.echo", "hello")
+	}
+
+	if _, err := call(); !errors.Is(err, ErrNoResponder) {
+		t.Fatalf("call before anything serves it = %v, want ErrNoResponder", err)
+	}
+
+	sub, err := ServeRPC(context.Background(), conn, "amq.direct", "rpc.echo", func(msg Message[string]) (string, error) {
+		return msg.Body, nil
+	}, WithLogger(discardLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := call(); err != nil || got != "hello" {
+		t.Fatalf("call = %q, %v, want hello", got, err)
+	}
+
+	// Once the last server goes, so do its queue and anything left in it
+	sub.Close()
+	if _, ok := broker.QueueLength("rpc.echo"); ok {
+		t.Fatal("request queue outlived its last server")
+	}
+	if _, err := call(); !errors.Is(err, ErrNoResponder) {
+		t.Fatalf("call after the server stopped = %v, want ErrNoResponder", err)
+	}
+}
@@ -0,0 +1,264 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// deliverAtHeader holds when a scheduled message is due, in milliseconds
+// since the Unix epoch.
+const deliverAtHeader = "x-deliver-at"
+
+// WithDeliverAt asks for the message to be delivered at t rather than
+// straight away. Only a Scheduler honours it; other Senders publish the
+// message at once.
+func WithDeliverAt(t time.Time) PublishOption {
+	return WithHeader(deliverAtHeader, t.UnixMilli())
+}
+
+// WithDelay asks for the message to be delivered d from now. See
+// WithDeliverAt.
+func WithDelay(d time.Duration) PublishOption {
+	return WithDeliverAt(time.Now().Add(d))
+}
+
+// ScheduledMessage is a message waiting in a delay queue to be delivered.
+type ScheduledMessage struct {
+	ID          string
+	ContentType string
+	Body        []byte
+	Headers     amqp.Table
+
+	Exchange   string    // exchange it will be delivered to
+	RoutingKey string    // routing key it will be delivered with
+	At         time.Time // when it's due
+}
+
+// Decode unmarshals the body into v with the codec registered for its
+// content type.
+func (m ScheduledMessage) Decode(v any) error {
+	codec, err := CodecFor(m.ContentType)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(m.Body, v)
+}
+
+// Scheduler is a Sender that holds on to messages published with
+// WithDeliverAt or WithDelay until they're due. Messages without either go
+// straight through. Every publish is confirmed, as with a ConfirmingSender.
+//
+// A message is parked in a delay queue, one per exchange, routing key and
+// delay, whose TTL is the delay and which dead-letters into the exchange
+// with the routing key. So it's the broker that delivers it, whether or not
+// anything is still running by then. Delays are rounded up to the second,
+// so that there's a queue per second of delay rather than per millisecond,
+// and a message is never early. The broker only checks the exchange once
+// the message is due, and drops it if it no longer exists or nothing is
+// bound to the key.
+//
+// The delay queues in use are recorded in peril_scheduled, so that
+// Scheduled and Cancel can find them from any process.
+type Scheduler struct {
+	conn   Connection
+	sender *ConfirmingSender
+}
+
+var _ Sender = (*Scheduler)(nil)
+
+// NewScheduler returns a Scheduler that publishes on its own channel on
+// conn.
+func NewScheduler(conn Connection) (*Scheduler, error) {
+	sender, err := NewConfirmingSender(conn, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &Scheduler{conn: conn, sender: sender}, nil
+}
+
+// PublishWithContext publishes msg now, or parks it until the time in its
+// deliver-at header. mandatory only applies to messages published now.
+func (s *Scheduler) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ms, ok := tableInt(msg.Headers, deliverAtHeader)
+	if !ok {
+		return s.sender.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	}
+	delay := time.Until(time.UnixMilli(ms))
+	if delay <= 0 {
+		return s.sender.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	}
+	delay = (delay + time.Second - 1).Truncate(time.Second)
+
+	delayQueue := fmt.Sprintf("%s.%s.%s.%ds", routing.QueuePerilScheduled, exchange, key, int64(delay/time.Second))
+	// Clean up once it has been idle for a while. Declaring it again for every message keeps
+	// it from expiring while it's in use, and the index entry lasts as long
+	expires := (delay + time.Minute).Milliseconds()
+	err := s.declare(func(ch Channel) error {
+		_, err := ch.QueueDeclare(routing.QueuePerilScheduled, true, false, false, false, nil)
+		if err != nil {
+			return fmt.Errorf("could not declare queue %s: %v", routing.QueuePerilScheduled, err)
+		}
+		_, err = ch.QueueDeclare(
+			delayQueue,
+			true,  // durable
+			false, // delete when unused
+			false, // exclusive
+			false, // no-wait
+			amqp.Table{
+				"x-message-ttl":             delay.Milliseconds(),
+				"x-dead-letter-exchange":    exchange,
+				"x-dead-letter-routing-key": key,
+				"x-expires":                 expires,
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("could not declare delay queue %s: %v", delayQueue, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	entry := amqp.Publishing{
+		ContentType: "text/plain",
+		Body:        []byte(delayQueue),
+		Expiration:  fmt.Sprint(expires),
+	}
+	if err := s.sender.PublishWithContext(ctx, "", routing.QueuePerilScheduled, true, false, entry); err != nil {
+		return fmt.Errorf("could not record delay queue %s: %w", delayQueue, err)
+	}
+
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[originalExchangeHeader] = exchange
+	headers[originalRoutingKeyHeader] = key
+	msg.Headers = headers
+	msg.DeliveryMode = amqp.Persistent
+	return s.sender.PublishWithContext(ctx, "", delayQueue, true, false, msg)
+}
+
+// Close closes the scheduler's channel. Messages already scheduled are
+// still delivered.
+func (s *Scheduler) Close() error {
+	return s.sender.Close()
+}
+
+// declare runs fn on a channel of its own, as a failed declaration closes
+// the channel it was made on.
+func (s *Scheduler) declare(fn func(Channel) error) error {
+	ch, err := openDirectChannel(s.conn)
+	if err != nil {
+		return fmt.Errorf("could not open channel: %w", err)
+	}
+	defer ch.Close()
+	return fn(ch)
+}
+
+// Scheduled returns the messages that are waiting to be delivered, soonest
+// first. Reading them holds them up, so one that falls due meanwhile is
+// delivered a moment late.
+func (s *Scheduler) Scheduled() ([]ScheduledMessage, error) {
+	var scheduled []ScheduledMessage
+	err := s.scan(func(d amqp.Delivery) bool {
+		scheduled = append(scheduled, newScheduledMessage(d))
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(scheduled, func(i, j int) bool {
+		return scheduled[i].At.Before(scheduled[j].At)
+	})
+	return scheduled, nil
+}
+
+// Cancel removes the scheduled messages with the given IDs, so that they're
+// never delivered, and returns how many it found.
+func (s *Scheduler) Cancel(ids ...string) (int, error) {
+	cancel := map[string]bool{}
+	for _, id := range ids {
+		cancel[id] = true
+	}
+	n := 0
+	err := s.scan(func(d amqp.Delivery) bool {
+		if cancel[d.MessageId] {
+			n++
+			return true
+		}
+		return false
+	})
+	return n, err
+}
+
+// scan reads every message in the delay queues listed in peril_scheduled,
+// and removes the ones remove says to. The rest go back where they were.
+func (s *Scheduler) scan(remove func(amqp.Delivery) bool) error {
+	ch, entries, err := getAll(s.conn, routing.QueuePerilScheduled)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var queues []string
+	seen := map[string]bool{}
+	for _, e := range entries {
+		if q := string(e.Body); !seen[q] {
+			seen[q] = true
+			queues = append(queues, q)
+		}
+	}
+	ch.Close()
+
+	for _, queue := range queues {
+		ch, deliveries, err := getAll(s.conn, queue)
+		if isNotFound(err) {
+			// It expired once it had delivered everything
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, d := range deliveries {
+			if !remove(d) {
+				continue
+			}
+			if err := d.Ack(false); err != nil {
+				ch.Close()
+				return fmt.Errorf("could not remove message %s from %s: %v", d.MessageId, queue, err)
+			}
+		}
+		ch.Close()
+	}
+	return nil
+}
+
+func newScheduledMessage(d amqp.Delivery) ScheduledMessage {
+	m := ScheduledMessage{
+		ID:          d.MessageId,
+		ContentType: d.ContentType,
+		Body:        d.Body,
+		Headers:     d.Headers,
+	}
+	m.Exchange, _ = d.Headers[originalExchangeHeader].(string)
+	m.RoutingKey, _ = d.Headers[originalRoutingKeyHeader].(string)
+	if ms, ok := tableInt(d.Headers, deliverAtHeader); ok {
+		m.At = time.UnixMilli(ms)
+	}
+	return m
+}
+
+// isNotFound reports whether err is the broker saying that a queue or
+// exchange doesn't exist.
+func isNotFound(err error) bool {
+	var aerr *amqp.Error
+	return errors.As(err, &aerr) && aerr.Code == amqp.NotFound
+}
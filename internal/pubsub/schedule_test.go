@@ -0,0 +1,139 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestScheduler returns a Scheduler on a fresh broker, and a channel
+// with a queue "paused" bound to amq.direct with the key "pause".
+func newTestScheduler(t *testing.T) (*MemoryBroker, *memChannel, *Scheduler) {
+	t.Helper()
+	broker := NewMemoryBroker()
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s, err := NewScheduler(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	ch := memTestChannel(t, broker)
+	declareQueue(t, ch, "paused", nil, [2]string{"amq.direct", "pause"})
+	return broker, ch, s
+}
+
+func TestSchedulerDeliversAfterDelay(t *testing.T) {
+	broker, ch, s := newTestScheduler(t)
+	start := time.Now()
+	if err := PublishJSON(s, "amq.direct", "pause", true, WithMessageID("resume"), WithDelay(time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if n := queueLength(t, broker, "paused"); n != 0 {
+		t.Fatal("a scheduled message was delivered straight away")
+	}
+	waitFor(t, "the scheduled message", func() bool { return queueLength(t, broker, "paused") == 1 })
+	// Delays are rounded up to the second
+	if took := time.Since(start); took < time.Second {
+		t.Fatalf("delivered after %v, want at least a second", took)
+	}
+	d := get(t, ch, "paused")
+	if d.MessageId != "resume" || string(d.Body) != "true" || d.Exchange != "amq.direct" || d.RoutingKey != "pause" {
+		t.Fatalf("delivered %q with ID %q via %s/%s", d.Body, d.MessageId, d.Exchange, d.RoutingKey)
+	}
+}
+
+// A message that isn't scheduled, or is already due, goes straight
+// through.
+func TestSchedulerPublishesNow(t *testing.T) {
+	broker, _, s := newTestScheduler(t)
+	if err := PublishJSON(s, "amq.direct", "pause", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := PublishJSON(s, "amq.direct", "pause", true, WithDeliverAt(time.Now().Add(-time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	if n := queueLength(t, broker, "paused"); n != 2 {
+		t.Fatalf("%d messages delivered, want both straight away", n)
+	}
+	scheduled, err := s.Scheduled()
+	if err != nil || len(scheduled) != 0 {
+		t.Fatalf("scheduled %v (%v), want nothing", scheduled, err)
+	}
+}
+
+func TestSchedulerScheduled(t *testing.T) {
+	_, _, s := newTestScheduler(t)
+	// Nothing has been scheduled yet, so there's no index to read
+	if scheduled, err := s.Scheduled(); err != nil || len(scheduled) != 0 {
+		t.Fatalf("scheduled %v (%v) before anything was", scheduled, err)
+	}
+
+	later := time.Now().Add(2 * time.Hour).Truncate(time.Millisecond)
+	sooner := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	if err := PublishJSON(s, "amq.direct", "pause", false, WithMessageID("later"), WithDeliverAt(later)); err != nil {
+		t.Fatal(err)
+	}
+	if err := PublishJSON(s, "amq.direct", "pause", true, WithMessageID("sooner"), WithDeliverAt(sooner)); err != nil {
+		t.Fatal(err)
+	}
+	// Another in the same delay queue as the first is only indexed once
+	if err := PublishJSON(s, "amq.direct", "pause", false, WithMessageID("later-too"), WithDeliverAt(later)); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduled, err := s.Scheduled()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, m := range scheduled {
+		ids = append(ids, m.ID)
+	}
+	if len(ids) != 3 || ids[0] != "sooner" || ids[1] != "later" || ids[2] != "later-too" {
+		t.Fatalf("scheduled %v, want [sooner later later-too]", ids)
+	}
+	m := scheduled[0]
+	var paused bool
+	if err := m.Decode(&paused); err != nil || !paused {
+		t.Fatalf("decoded %v (%v), want true", paused, err)
+	}
+	if m.Exchange != "amq.direct" || m.RoutingKey != "pause" || !m.At.Equal(sooner) {
+		t.Fatalf("scheduled via %s/%s at %v, want amq.direct/pause at %v", m.Exchange, m.RoutingKey, m.At, sooner)
+	}
+
+	// Listing them again finds them where they were
+	again, err := s.Scheduled()
+	if err != nil || len(again) != 3 {
+		t.Fatalf("listed %d (%v) the second time, want 3", len(again), err)
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	broker, ch, s := newTestScheduler(t)
+	for _, id := range []string{"cancelled", "kept"} {
+		if err := PublishJSON(s, "amq.direct", "pause", id, WithMessageID(id), WithDelay(time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := s.Cancel("cancelled", "unknown")
+	if err != nil || n != 1 {
+		t.Fatalf("cancelled %d (%v), want 1", n, err)
+	}
+	scheduled, err := s.Scheduled()
+	if err != nil || len(scheduled) != 1 || scheduled[0].ID != "kept" {
+		t.Fatalf("scheduled %v (%v) after cancelling, want just kept", scheduled, err)
+	}
+
+	waitFor(t, "the message that wasn't cancelled", func() bool { return queueLength(t, broker, "paused") == 1 })
+	// Both were due at the same time, so the cancelled one would be here too
+	time.Sleep(50 * time.Millisecond)
+	if n := queueLength(t, broker, "paused"); n != 1 {
+		t.Fatalf("%d messages delivered, want 1", n)
+	}
+	if d := get(t, ch, "paused"); d.MessageId != "kept" {
+		t.Fatalf("delivered %s, want kept", d.MessageId)
+	}
+}
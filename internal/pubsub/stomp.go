@@ -0,0 +1,421 @@
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// STOMP 1.2 support. DialSTOMP connects to a STOMP server, such as
+// RabbitMQ with the rabbitmq_stomp plugin, and maps exchanges and queues
+// onto destinations the way RabbitMQ's plugin does (as does STOMPServer,
+// which the tests run it against):
+//
+//	/exchange/<exchange>/<key>   publish to an exchange (peril_topic,
+//	                             peril_direct, ...) with a routing key, or
+//	                             subscribe with a queue bound to it
+//	/queue/<name>                declare the queue, then publish to it or
+//	                             subscribe to it
+//	/amq/queue/<name>            publish to or subscribe to a queue that
+//	                             must already exist
+//	/topic/<key>                 the amq.topic exchange
+//
+// Message properties travel as headers of the same names (content-type,
+// correlation-id, reply-to, app-id and so on, with the message ID as
+// amqp-message-id), and so do a message's own headers. Header values are
+// always strings in STOMP, so on the way back only the headers this
+// package counts with (x-retry-count, x-delivery-count and
+// x-stream-offset) are turned back into numbers.
+
+// stompVersion is the only version of the protocol spoken here.
+const stompVersion = "1.2"
+
+// stompMaxBody caps the size of a frame body we are willing to read.
+const stompMaxBody = 16 << 20
+
+// stompFrame is one frame. Only the first occurrence of a repeated header
+// counts, as the spec says.
+type stompFrame struct {
+	command string
+	headers map[string]string
+	body    []byte
+}
+
+func newStompFrame(command string, headers ...string) *stompFrame {
+	f := &stompFrame{command: command, headers: map[string]string{}}
+	for i := 0; i+1 < len(headers); i += 2 {
+		f.headers[headers[i]] = headers[i+1]
+	}
+	return f
+}
+
+func (f *stompFrame) header(name string) string {
+	return f.headers[name]
+}
+
+// stompEscaper and stompUnescaper handle the characters headers can't
+// contain as they are. CONNECT and CONNECTED frames don't escape.
+var (
+	stompEscaper   = strings.NewReplacer(`\`, `\\`, "\r", `\r`, "\n", `\n`, ":", `\c`)
+	stompUnescaper = strings.NewReplacer(`\\`, `\`, `\r`, "\r", `\n`, "\n", `\c`, ":")
+)
+
+func (f *stompFrame) escapes() bool {
+	return f.command != "CONNECT" && f.command != "CONNECTED" && f.command != "STOMP"
+}
+
+// writeTo writes the frame, always with a content-length so that bodies
+// can hold NUL bytes (gob and msgpack ones often do).
+func (f *stompFrame) writeTo(w *bufio.Writer) error {
+	w.WriteString(f.command)
+	w.WriteByte('\n')
+	names := make([]string, 0, len(f.headers))
+	for name := range f.headers {
+		if name != "content-length" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := f.headers[name]
+		if f.escapes() {
+			name, value = stompEscaper.Replace(name), stompEscaper.Replace(value)
+		}
+		w.WriteString(name)
+		w.WriteByte(':')
+		w.WriteString(value)
+		w.WriteByte('\n')
+	}
+	if f.command == "SEND" || f.command == "MESSAGE" || f.command == "ERROR" || len(f.body) > 0 {
+		fmt.Fprintf(w, "content-length:%d\n", len(f.body))
+	}
+	w.WriteByte('\n')
+	w.Write(f.body)
+	w.WriteByte(0)
+	return w.Flush()
+}
+
+// readStompFrame reads the next frame. Heart-beats (bare end of lines)
+// between frames are skipped; beat, if not nil, is called for each.
+func readStompFrame(r *bufio.Reader, beat func()) (*stompFrame, error) {
+	var command string
+	for {
+		line, err := readStompLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line != "" {
+			command = line
+			break
+		}
+		if beat != nil {
+			beat()
+		}
+	}
+	f := &stompFrame{command: command, headers: map[string]string{}}
+	for {
+		line, err := readStompLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("stomp: malformed header %q", line)
+		}
+		if f.escapes() {
+			name, value = stompUnescaper.Replace(name), stompUnescaper.Replace(value)
+		}
+		if _, seen := f.headers[name]; !seen {
+			f.headers[name] = value
+		}
+	}
+	if s, ok := f.headers["content-length"]; ok {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > stompMaxBody {
+			return nil, fmt.Errorf("stomp: bad content-length %q", s)
+		}
+		f.body = make([]byte, n)
+		if _, err := io.ReadFull(r, f.body); err != nil {
+			return nil, err
+		}
+		if b, err := r.ReadByte(); err != nil {
+			return nil, err
+		} else if b != 0 {
+			return nil, errors.New("stomp: frame body is longer than its content-length")
+		}
+		return f, nil
+	}
+	body, err := r.ReadBytes(0)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > stompMaxBody {
+		return nil, errors.New("stomp: frame body is too long")
+	}
+	f.body = body[:len(body)-1]
+	return f, nil
+}
+
+// readStompLine reads a line ending in LF or CRLF, without the ending.
+func readStompLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// Destinations.
+
+const (
+	stompExchangePrefix   = "/exchange/"
+	stompQueuePrefix      = "/queue/"
+	stompAmqQueuePrefix   = "/amq/queue/"
+	stompTopicPrefix      = "/topic/"
+	stompTopicExchange    = "amq.topic"
+	stompDefaultExchange  = ""
+	stompDestinationError = "unknown destination"
+)
+
+// stompDestination is a parsed destination. For /queue/ and /amq/queue/
+// the exchange is the default one and the key is the queue name.
+type stompDestination struct {
+	prefix   string
+	exchange string
+	key      string
+}
+
+// escapeStompName and unescapeStompName percent-encode the slashes (and
+// percent signs) in a name, so that it fits in one segment of a
+// destination.
+func escapeStompName(s string) string {
+	return strings.NewReplacer("%", "%25", "/", "%2F").Replace(s)
+}
+
+func unescapeStompName(s string) string {
+	if u, err := url.PathUnescape(s); err == nil {
+		return u
+	}
+	return s
+}
+
+func parseStompDestination(dest string) (stompDestination, error) {
+	switch {
+	case strings.HasPrefix(dest, stompExchangePrefix):
+		exchange, key, _ := strings.Cut(strings.TrimPrefix(dest, stompExchangePrefix), "/")
+		if exchange == "" {
+			break
+		}
+		return stompDestination{stompExchangePrefix, unescapeStompName(exchange), unescapeStompName(key)}, nil
+	case strings.HasPrefix(dest, stompAmqQueuePrefix):
+		if name := strings.TrimPrefix(dest, stompAmqQueuePrefix); name != "" {
+			return stompDestination{stompAmqQueuePrefix, stompDefaultExchange, unescapeStompName(name)}, nil
+		}
+	case strings.HasPrefix(dest, stompQueuePrefix):
+		if name := strings.TrimPrefix(dest, stompQueuePrefix); name != "" {
+			return stompDestination{stompQueuePrefix, stompDefaultExchange, unescapeStompName(name)}, nil
+		}
+	case strings.HasPrefix(dest, stompTopicPrefix):
+		return stompDestination{stompTopicPrefix, stompTopicExchange, unescapeStompName(strings.TrimPrefix(dest, stompTopicPrefix))}, nil
+	}
+	return stompDestination{}, fmt.Errorf("%s %q", stompDestinationError, dest)
+}
+
+// stompDestinationFor is the destination for publishing to exchange with
+// key, as it appears on a MESSAGE frame. declare picks /queue/ over
+// /amq/queue/ for the default exchange.
+func stompDestinationFor(exchange, key string, declare bool) string {
+	switch {
+	case exchange == stompDefaultExchange && declare:
+		return stompQueuePrefix + escapeStompName(key)
+	case exchange == stompDefaultExchange:
+		return stompAmqQueuePrefix + escapeStompName(key)
+	case exchange == stompTopicExchange:
+		return stompTopicPrefix + escapeStompName(key)
+	}
+	return stompExchangePrefix + escapeStompName(exchange) + "/" + escapeStompName(key)
+}
+
+// Message properties.
+
+// stompReserved are headers with a meaning of their own in STOMP, which a
+// message's own headers can't use.
+var stompReserved = map[string]bool{
+	"destination": true, "content-length": true, "receipt": true, "receipt-id": true,
+	"id": true, "ack": true, "subscription": true, "message-id": true,
+	"transaction": true, "message": true, "redelivered": true,
+	"content-type": true, "content-encoding": true, "persistent": true,
+	"priority": true, "correlation-id": true, "reply-to": true, "expiration": true,
+	"amqp-message-id": true, "timestamp": true, "type": true, "user-id": true, "app-id": true,
+	"prefetch-count": true, "durable": true, "auto-delete": true, "exclusive": true,
+	"x-queue-name": true,
+}
+
+// stompNumericHeaders are the message headers that are numbers, which
+// STOMP turns into strings.
+var stompNumericHeaders = map[string]bool{
+	retryCountHeader:    true,
+	deliveryCountHeader: true,
+	streamOffsetHeader:  true,
+}
+
+// publishingHeaders adds msg's properties and headers to f.
+func publishingHeaders(f *stompFrame, msg amqp.Publishing) {
+	set := func(name, value string) {
+		if value != "" {
+			f.headers[name] = value
+		}
+	}
+	for k, v := range msg.Headers {
+		if !stompReserved[k] {
+			set(k, stompHeaderValue(v))
+		}
+	}
+	set("content-type", msg.ContentType)
+	set("content-encoding", msg.ContentEncoding)
+	if msg.DeliveryMode == amqp.Persistent {
+		set("persistent", "true")
+	}
+	if msg.Priority > 0 {
+		set("priority", strconv.Itoa(int(msg.Priority)))
+	}
+	set("correlation-id", msg.CorrelationId)
+	set("reply-to", msg.ReplyTo)
+	set("expiration", msg.Expiration)
+	set("amqp-message-id", msg.MessageId)
+	if !msg.Timestamp.IsZero() {
+		set("timestamp", strconv.FormatInt(msg.Timestamp.Unix(), 10))
+	}
+	set("type", msg.Type)
+	set("user-id", msg.UserId)
+	set("app-id", msg.AppId)
+}
+
+func stompHeaderValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case time.Time:
+		return strconv.FormatInt(v.Unix(), 10)
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(v)
+}
+
+// publishingFromStomp is the reverse of publishingHeaders.
+func publishingFromStomp(f *stompFrame) amqp.Publishing {
+	h := f.headers
+	pub := amqp.Publishing{
+		ContentType:     h["content-type"],
+		ContentEncoding: h["content-encoding"],
+		CorrelationId:   h["correlation-id"],
+		ReplyTo:         h["reply-to"],
+		Expiration:      h["expiration"],
+		MessageId:       h["amqp-message-id"],
+		Type:            h["type"],
+		UserId:          h["user-id"],
+		AppId:           h["app-id"],
+		Body:            f.body,
+	}
+	if h["persistent"] == "true" {
+		pub.DeliveryMode = amqp.Persistent
+	}
+	if p, err := strconv.ParseUint(h["priority"], 10, 8); err == nil {
+		pub.Priority = uint8(p)
+	}
+	if ts, err := strconv.ParseInt(h["timestamp"], 10, 64); err == nil {
+		pub.Timestamp = time.Unix(ts, 0)
+	}
+	for k, v := range h {
+		if stompReserved[k] || stompQueueArgs[k] != "" {
+			continue
+		}
+		if pub.Headers == nil {
+			pub.Headers = amqp.Table{}
+		}
+		pub.Headers[k] = v
+		if stompNumericHeaders[k] {
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				pub.Headers[k] = n
+			}
+		}
+	}
+	return pub
+}
+
+// Queue declarations.
+
+// stompQueueArgs are the queue arguments that can be passed as headers
+// when subscribing to, or publishing to, a destination that declares a
+// queue, with the type each one has.
+var stompQueueArgs = map[string]string{
+	"x-message-ttl":             "int",
+	"x-expires":                 "int",
+	"x-max-length":              "int",
+	"x-max-length-bytes":        "int",
+	"x-max-priority":            "int",
+	"x-delivery-limit":          "int",
+	"x-overflow":                "string",
+	"x-dead-letter-exchange":    "string",
+	"x-dead-letter-routing-key": "string",
+	"x-queue-type":              "string",
+	"x-queue-mode":              "string",
+	"x-single-active-consumer":  "bool",
+}
+
+// declareHeaders adds a queue's settings to f, for a destination that
+// declares it.
+func declareHeaders(f *stompFrame, durable, autoDelete, exclusive bool, args amqp.Table) error {
+	f.headers["durable"] = strconv.FormatBool(durable)
+	f.headers["auto-delete"] = strconv.FormatBool(autoDelete)
+	f.headers["exclusive"] = strconv.FormatBool(exclusive)
+	for k, v := range args {
+		if stompQueueArgs[k] == "" {
+			return fmt.Errorf("stomp: queue argument %s can't be sent over STOMP", k)
+		}
+		f.headers[k] = stompHeaderValue(v)
+	}
+	return nil
+}
+
+// stompHeartBeat parses a heart-beat header, in milliseconds.
+func stompHeartBeat(s string) (time.Duration, time.Duration) {
+	cx, cy, _ := strings.Cut(s, ",")
+	x, _ := strconv.Atoi(strings.TrimSpace(cx))
+	y, _ := strconv.Atoi(strings.TrimSpace(cy))
+	return time.Duration(x) * time.Millisecond, time.Duration(y) * time.Millisecond
+}
+
+// stompError turns an ERROR frame into an *amqp.Error, which is what the
+// rest of the package expects a broker to close things with.
+func stompError(f *stompFrame) *amqp.Error {
+	reason := f.header("message")
+	if body := bytes.TrimSpace(f.body); len(body) > 0 {
+		reason += ": " + string(body)
+	}
+	code := amqp.InternalError
+	switch {
+	case strings.Contains(reason, "not_found"), strings.Contains(reason, "NOT_FOUND"):
+		code = amqp.NotFound
+	case strings.Contains(reason, "PRECONDITION_FAILED"), strings.Contains(reason, "precondition_failed"):
+		code = amqp.PreconditionFailed
+	case strings.Contains(reason, "RESOURCE_LOCKED"), strings.Contains(reason, "resource_locked"):
+		code = amqp.ResourceLocked
+	case strings.Contains(strings.ToLower(reason), "access_refused"), strings.Contains(strings.ToLower(reason), "login"):
+		code = amqp.AccessRefused
+	}
+	return &amqp.Error{Code: code, Reason: reason, Server: true}
+}
@@ -0,0 +1,569 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrSTOMPServerClosed is returned by STOMPServer.Serve after Close.
+var ErrSTOMPServerClosed = errors.New("stomp server closed")
+
+// STOMPServer accepts STOMP 1.2 connections and carries out what they ask
+// for on a broker, through a Connection of its own for each of them. It
+// follows RabbitMQ's STOMP plugin (see stomp.go for the destinations) as
+// far as this package needs, so that the STOMP transport can be tested
+// without RabbitMQ, in front of a MemoryBroker:
+//
+//	broker := NewMemoryBroker()
+//	srv := NewSTOMPServer(broker.Dial)
+//	go srv.Serve(listener)
+//	conn, err := DialSTOMP("stomp://" + listener.Addr().String())
+//
+// It has no transactions and doesn't send heart-beats. Like RabbitMQ, it
+// answers any error with an ERROR frame and closes the connection.
+type STOMPServer struct {
+	// Login and Passcode, if set, are the only credentials accepted.
+	Login    string
+	Passcode string
+
+	dial func() (Connection, error)
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	sessions  map[*stompSession]struct{}
+}
+
+// NewSTOMPServer returns a server that connects to the broker with dial.
+func NewSTOMPServer(dial func() (Connection, error)) *STOMPServer {
+	return &STOMPServer{
+		dial:      dial,
+		listeners: map[net.Listener]struct{}{},
+		sessions:  map[*stompSession]struct{}{},
+	}
+}
+
+// Serve accepts connections on l until it fails or the server is closed.
+func (s *STOMPServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrSTOMPServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrSTOMPServerClosed
+			}
+			return err
+		}
+		sess := &stompSession{
+			server: s,
+			nc:     nc,
+			r:      bufio.NewReader(nc),
+			w:      bufio.NewWriter(nc),
+			subs:   map[string]*stompServerSub{},
+			acks:   map[string]stompServerAck{},
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			nc.Close()
+			return ErrSTOMPServerClosed
+		}
+		s.sessions[sess] = struct{}{}
+		s.mu.Unlock()
+		go sess.serve()
+	}
+}
+
+// Close stops the listeners and closes every connection.
+func (s *STOMPServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	listeners, sessions := s.listeners, s.sessions
+	s.listeners, s.sessions = map[net.Listener]struct{}{}, map[*stompSession]struct{}{}
+	s.mu.Unlock()
+	for l := range listeners {
+		l.Close()
+	}
+	for sess := range sessions {
+		sess.close()
+	}
+	return nil
+}
+
+// stompSession is one client connection.
+type stompSession struct {
+	server *STOMPServer
+	nc     net.Conn
+	r      *bufio.Reader
+
+	writeMu sync.Mutex
+	w       *bufio.Writer
+
+	conn Connection // to the broker
+	pub  Channel    // for SEND, opened on first use
+
+	mu     sync.Mutex
+	closed bool
+	subs   map[string]*stompServerSub
+	acks   map[string]stompServerAck // by ack ID
+	serial int
+}
+
+// stompServerSub is a subscription, consuming on a channel of its own.
+type stompServerSub struct {
+	id      string
+	ch      Channel
+	autoAck bool
+	unacked int // guarded by the session's mu
+}
+
+// stompServerAck is a delivery waiting for the client's ACK or NACK.
+type stompServerAck struct {
+	delivery amqp.Delivery
+	sub      *stompServerSub
+}
+
+// stompFailure is a problem to report in an ERROR frame.
+type stompFailure struct {
+	message string
+	detail  string
+}
+
+func (e *stompFailure) Error() string {
+	return e.message
+}
+
+func stompFail(message, format string, args ...any) *stompFailure {
+	return &stompFailure{message: message, detail: fmt.Sprintf(format, args...)}
+}
+
+func (sess *stompSession) serve() {
+	defer sess.close()
+	sess.nc.SetReadDeadline(time.Now().Add(stompReceiptTimeout))
+	f, err := readStompFrame(sess.r, nil)
+	if err != nil {
+		return
+	}
+	sess.nc.SetReadDeadline(time.Time{})
+	if err := sess.connect(f); err != nil {
+		sess.sendError(f, err)
+		return
+	}
+	for {
+		f, err := readStompFrame(sess.r, nil)
+		if err != nil {
+			return
+		}
+		if f.command == "DISCONNECT" {
+			sess.receipt(f)
+			return
+		}
+		if err := sess.handle(f); err != nil {
+			sess.sendError(f, err)
+			return
+		}
+		sess.receipt(f)
+	}
+}
+
+func (sess *stompSession) connect(f *stompFrame) error {
+	if f.command != "CONNECT" && f.command != "STOMP" {
+		return stompFail("not connected", "expected CONNECT, got %s", f.command)
+	}
+	if !strings.Contains(","+f.header("accept-version")+",", ","+stompVersion+",") {
+		return stompFail("version not supported", "this server only speaks STOMP %s", stompVersion)
+	}
+	s := sess.server
+	if s.Login != "" && (f.header("login") != s.Login || f.header("passcode") != s.Passcode) {
+		return stompFail("access_refused", "login or passcode not accepted")
+	}
+	conn, err := s.dial()
+	if err != nil {
+		return stompFail("could not connect to the broker", "%v", err)
+	}
+	sess.mu.Lock()
+	sess.conn = conn
+	closed := sess.closed
+	sess.mu.Unlock()
+	if closed {
+		conn.Close()
+		return stompFail("server closed", "")
+	}
+	// A broker that goes away takes its clients with it, who will reconnect
+	go func() {
+		if reason, ok := <-conn.NotifyClose(make(chan *amqp.Error, 1)); ok && reason != nil {
+			sess.sendError(nil, stompFail("connection to the broker lost", "%v", reason))
+			sess.close()
+		}
+	}()
+	return sess.send(newStompFrame("CONNECTED", "version", stompVersion, "heart-beat", "0,0", "server", "peril-stomp"))
+}
+
+func (sess *stompSession) handle(f *stompFrame) error {
+	switch f.command {
+	case "SEND":
+		return sess.handleSend(f)
+	case "SUBSCRIBE":
+		return sess.handleSubscribe(f)
+	case "UNSUBSCRIBE":
+		return sess.handleUnsubscribe(f)
+	case "ACK", "NACK":
+		return sess.handleAck(f)
+	case "BEGIN", "COMMIT", "ABORT":
+		return stompFail("not supported", "transactions are not supported")
+	}
+	return stompFail("bad command", "unknown command %s", f.command)
+}
+
+func (sess *stompSession) handleSend(f *stompFrame) error {
+	dest, err := parseStompDestination(f.header("destination"))
+	if err != nil {
+		return stompFail(stompDestinationError, "%v", err)
+	}
+	if sess.pub == nil {
+		ch, err := sess.conn.Channel()
+		if err != nil {
+			return stompFail("could not open a channel", "%v", err)
+		}
+		sess.pub = ch
+	}
+	if dest.prefix == stompQueuePrefix {
+		if err := sess.declare(sess.pub, dest.key, f, true, false, false); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stompReceiptTimeout)
+	defer cancel()
+	if err := sess.pub.PublishWithContext(ctx, dest.exchange, dest.key, false, false, publishingFromStomp(f)); err != nil {
+		return stompFail(brokerReason(err), "could not publish to %s", f.header("destination"))
+	}
+	return nil
+}
+
+// declare declares a queue with the settings in f's headers, or the given
+// defaults.
+func (sess *stompSession) declare(ch Channel, name string, f *stompFrame, durable, autoDelete, exclusive bool) error {
+	durable, autoDelete, exclusive, args, err := queueFromStomp(f, durable, autoDelete, exclusive)
+	if err != nil {
+		return stompFail("bad queue header", "%v", err)
+	}
+	if _, err := ch.QueueDeclare(name, durable, autoDelete, exclusive, false, args); err != nil {
+		return stompFail(brokerReason(err), "could not declare queue %s", name)
+	}
+	return nil
+}
+
+func (sess *stompSession) handleSubscribe(f *stompFrame) error {
+	id := f.header("id")
+	if id == "" {
+		return stompFail("missing id", "SUBSCRIBE needs an id header")
+	}
+	sess.mu.Lock()
+	_, taken := sess.subs[id]
+	sess.mu.Unlock()
+	if taken {
+		return stompFail("duplicate id", "subscription %s already exists", id)
+	}
+	dest, err := parseStompDestination(f.header("destination"))
+	if err != nil {
+		return stompFail(stompDestinationError, "%v", err)
+	}
+	ackMode := f.header("ack")
+	switch ackMode {
+	case "":
+		ackMode = "auto"
+	case "auto", "client", "client-individual":
+	default:
+		return stompFail("bad ack mode", "unknown ack mode %s", ackMode)
+	}
+	consumeArgs, err := stompServerConsumeArgs(f)
+	if err != nil {
+		return err
+	}
+
+	ch, err := sess.conn.Channel()
+	if err != nil {
+		return stompFail("could not open a channel", "%v", err)
+	}
+	fail := func(err error) error {
+		ch.Close()
+		return err
+	}
+	queue := dest.key
+	switch dest.prefix {
+	case stompQueuePrefix:
+		if err := sess.declare(ch, queue, f, true, false, false); err != nil {
+			return fail(err)
+		}
+	case stompExchangePrefix, stompTopicPrefix:
+		// A queue of its own bound to the exchange: named if asked, server-named and gone with
+		// the subscription if not
+		queue = f.header("x-queue-name")
+		durable, autoDelete, exclusive := false, true, queue == ""
+		if queue == "" {
+			queue = "stomp-subscription-" + newMessageID()
+		}
+		if err := sess.declare(ch, queue, f, durable, autoDelete, exclusive); err != nil {
+			return fail(err)
+		}
+		if err := ch.QueueBind(queue, dest.key, dest.exchange, false, nil); err != nil {
+			return fail(stompFail(brokerReason(err), "could not bind queue %s to %s", queue, dest.exchange))
+		}
+	}
+	if n := f.header("prefetch-count"); n != "" {
+		prefetch, err := strconv.Atoi(n)
+		if err != nil || prefetch < 0 {
+			return fail(stompFail("bad prefetch-count", "%q is not a prefetch count", n))
+		}
+		if err := ch.Qos(prefetch, 0, false); err != nil {
+			return fail(stompFail(brokerReason(err), "could not set prefetch"))
+		}
+	}
+	deliveries, err := ch.Consume(queue, id, ackMode == "auto", false, false, false, consumeArgs)
+	if err != nil {
+		return fail(stompFail(brokerReason(err), "could not subscribe to %s", f.header("destination")))
+	}
+	sub := &stompServerSub{id: id, ch: ch, autoAck: ackMode == "auto"}
+	sess.mu.Lock()
+	sess.subs[id] = sub
+	sess.mu.Unlock()
+	go sess.forward(sub, deliveries)
+	return nil
+}
+
+// stompServerConsumeArgs reads the consume arguments of a SUBSCRIBE.
+func stompServerConsumeArgs(f *stompFrame) (amqp.Table, error) {
+	v, ok := f.headers[streamOffsetHeader]
+	if !ok {
+		return nil, nil
+	}
+	var offset any = v
+	if s, ok := strings.CutPrefix(v, "offset="); ok {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, stompFail("bad "+streamOffsetHeader, "%q is not an offset", v)
+		}
+		offset = n
+	} else if s, ok := strings.CutPrefix(v, "timestamp="); ok {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, stompFail("bad "+streamOffsetHeader, "%q is not a timestamp", v)
+		}
+		offset = time.Unix(n, 0)
+	}
+	return amqp.Table{streamOffsetHeader: offset}, nil
+}
+
+// forward sends a subscription's deliveries to the client as MESSAGE
+// frames.
+func (sess *stompSession) forward(sub *stompServerSub, deliveries <-chan amqp.Delivery) {
+	for d := range deliveries {
+		sess.mu.Lock()
+		sess.serial++
+		ackID := strconv.Itoa(sess.serial)
+		if !sub.autoAck {
+			sess.acks[ackID] = stompServerAck{delivery: d, sub: sub}
+			sub.unacked++
+		}
+		sess.mu.Unlock()
+		f := newStompFrame("MESSAGE",
+			"subscription", sub.id,
+			"message-id", ackID,
+			"destination", stompDestinationFor(d.Exchange, d.RoutingKey, true),
+		)
+		if !sub.autoAck {
+			f.headers["ack"] = ackID
+		}
+		if d.Redelivered {
+			f.headers["redelivered"] = "true"
+		}
+		publishingHeaders(f, publishingFromDelivery(d))
+		f.body = d.Body
+		if err := sess.send(f); err != nil {
+			return
+		}
+	}
+}
+
+func (sess *stompSession) handleUnsubscribe(f *stompFrame) error {
+	id := f.header("id")
+	sess.mu.Lock()
+	sub, ok := sess.subs[id]
+	if ok {
+		delete(sess.subs, id)
+	}
+	sess.mu.Unlock()
+	if !ok {
+		return stompFail("no such subscription", "there is no subscription %s", id)
+	}
+	// Deliveries the client still holds can be acked afterwards, as on RabbitMQ, so the
+	// channel stays open until they are settled
+	sub.ch.Cancel(id, false)
+	sess.closeIfSettled(sub)
+	return nil
+}
+
+// closeIfSettled closes an unsubscribed subscription's channel once none
+// of its deliveries are waiting for an ack.
+func (sess *stompSession) closeIfSettled(sub *stompServerSub) {
+	sess.mu.Lock()
+	_, subscribed := sess.subs[sub.id]
+	settled := sub.unacked == 0
+	sess.mu.Unlock()
+	if !subscribed && settled {
+		sub.ch.Close()
+	}
+}
+
+func (sess *stompSession) handleAck(f *stompFrame) error {
+	id := f.header("id")
+	sess.mu.Lock()
+	pending, ok := sess.acks[id]
+	if ok {
+		delete(sess.acks, id)
+		pending.sub.unacked--
+	}
+	sess.mu.Unlock()
+	if !ok {
+		return stompFail("unknown ack id", "no delivery is waiting for an ack with id %s", id)
+	}
+	var err error
+	if f.command == "ACK" {
+		err = pending.delivery.Ack(false)
+	} else {
+		err = pending.delivery.Nack(false, f.header("requeue") != "false")
+	}
+	if err != nil {
+		return stompFail(brokerReason(err), "could not %s message %s", strings.ToLower(f.command), id)
+	}
+	sess.closeIfSettled(pending.sub)
+	return nil
+}
+
+// send writes one frame to the client.
+func (sess *stompSession) send(f *stompFrame) error {
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
+	sess.nc.SetWriteDeadline(time.Now().Add(stompReceiptTimeout))
+	return f.writeTo(sess.w)
+}
+
+// receipt acknowledges a frame that asked for it.
+func (sess *stompSession) receipt(f *stompFrame) {
+	if id := f.header("receipt"); id != "" {
+		sess.send(newStompFrame("RECEIPT", "receipt-id", id))
+	}
+}
+
+// sendError reports err to the client, in reply to f if it isn't nil.
+func (sess *stompSession) sendError(f *stompFrame, err error) {
+	e := newStompFrame("ERROR", "message", err.Error())
+	var failure *stompFailure
+	if errors.As(err, &failure) && failure.detail != "" {
+		e.body = []byte(failure.detail)
+	}
+	if f != nil && f.header("receipt") != "" {
+		e.headers["receipt-id"] = f.header("receipt")
+	}
+	sess.send(e)
+}
+
+// close ends the session. Closing the broker connection sends back every
+// delivery that wasn't acked.
+func (sess *stompSession) close() {
+	sess.mu.Lock()
+	if sess.closed {
+		sess.mu.Unlock()
+		return
+	}
+	sess.closed = true
+	conn := sess.conn
+	sess.mu.Unlock()
+	sess.nc.Close()
+	if conn != nil {
+		conn.Close()
+	}
+	s := sess.server
+	s.mu.Lock()
+	delete(s.sessions, sess)
+	s.mu.Unlock()
+}
+
+// brokerReason is the message for an ERROR frame about a failed broker
+// operation: the broker's own reason if it gave one.
+func brokerReason(err error) string {
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) {
+		return amqpErr.Reason
+	}
+	return err.Error()
+}
+
+// queueFromStomp reads a queue's settings back from the headers of f, with
+// the given defaults for the ones that aren't there.
+func queueFromStomp(f *stompFrame, durable, autoDelete, exclusive bool) (bool, bool, bool, amqp.Table, error) {
+	flag := func(name string, def bool) (bool, error) {
+		v, ok := f.headers[name]
+		if !ok {
+			return def, nil
+		}
+		return strconv.ParseBool(v)
+	}
+	var errs []error
+	var err error
+	durable, err = flag("durable", durable)
+	errs = append(errs, err)
+	autoDelete, err = flag("auto-delete", autoDelete)
+	errs = append(errs, err)
+	exclusive, err = flag("exclusive", exclusive)
+	errs = append(errs, err)
+	var args amqp.Table
+	for name, kind := range stompQueueArgs {
+		v, ok := f.headers[name]
+		if !ok {
+			continue
+		}
+		if args == nil {
+			args = amqp.Table{}
+		}
+		switch kind {
+		case "int":
+			n, err := strconv.ParseInt(v, 10, 64)
+			errs = append(errs, err)
+			args[name] = n
+		case "bool":
+			b, err := strconv.ParseBool(v)
+			errs = append(errs, err)
+			args[name] = b
+		default:
+			args[name] = v
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return false, false, false, nil, fmt.Errorf("bad queue header: %w", err)
+	}
+	return durable, autoDelete, exclusive, args, nil
+}
@@ -0,0 +1,309 @@
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// startSTOMP runs a STOMPServer in front of a MemoryBroker with the
+// default topology, and returns the broker, an AMQP-style connection to
+// it and the URL to dial over STOMP.
+func startSTOMP(t *testing.T, configure ...func(*STOMPServer)) (*MemoryBroker, Connection, string) {
+	t.Helper()
+	broker := NewMemoryBroker()
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := ApplyTopology(conn, DefaultTopology()); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewSTOMPServer(broker.Dial)
+	for _, fn := range configure {
+		fn(srv)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return broker, conn, "stomp://" + l.Addr().String()
+}
+
+func dialSTOMP(t *testing.T, url string) Connection {
+	t.Helper()
+	conn, err := DialSTOMP(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestSTOMPDestinations(t *testing.T) {
+	tests := []struct {
+		exchange, key string
+		declare       bool
+		dest          string
+	}{
+		{routing.ExchangePerilTopic, "army_moves.alice", false, "/exchange/peril_topic/army_moves.alice"},
+		{routing.ExchangePerilDirect, "pause", false, "/exchange/peril_direct/pause"},
+		{"amq.topic", "game_logs.*", false, "/topic/game_logs.*"},
+		{"", "war", true, "/queue/war"},
+		{"", "war", false, "/amq/queue/war"},
+		{"", "a/b%c", true, "/queue/a%2Fb%25c"},
+		{"odd/exchange", "key/with/slashes", false, "/exchange/odd%2Fexchange/key%2Fwith%2Fslashes"},
+	}
+	for _, tt := range tests {
+		dest := stompDestinationFor(tt.exchange, tt.key, tt.declare)
+		if dest != tt.dest {
+			t.Errorf("stompDestinationFor(%q, %q, %v) = %q, want %q", tt.exchange, tt.key, tt.declare, dest, tt.dest)
+			continue
+		}
+		parsed, err := parseStompDestination(dest)
+		if err != nil || parsed.exchange != tt.exchange || parsed.key != tt.key {
+			t.Errorf("parseStompDestination(%q) = %+v, %v, want exchange %q and key %q", dest, parsed, err, tt.exchange, tt.key)
+		}
+	}
+	for _, dest := range []string{"", "/exchange/", "/queue/", "/amq/queue/", "/temp-queue/x", "war"} {
+		if _, err := parseStompDestination(dest); err == nil {
+			t.Errorf("parseStompDestination(%q) succeeded", dest)
+		}
+	}
+}
+
+func TestSTOMPFrameRoundTrip(t *testing.T) {
+	f := newStompFrame("SEND", "destination", "/queue/q", "x-odd", "colon: newline\n backslash\\")
+	f.body = []byte("binary\x00body")
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := f.writeTo(w); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readStompFrame(bufio.NewReader(&buf), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.command != "SEND" || got.header("x-odd") != f.header("x-odd") || !bytes.Equal(got.body, f.body) {
+		t.Fatalf("read back %s %v %q", got.command, got.headers, got.body)
+	}
+}
+
+// Subscribing to an exchange destination binds a queue of its own, which
+// gets what's published to the exchange over AMQP, with its properties.
+func TestSTOMPTopicSubscription(t *testing.T) {
+	_, amqpConn, url := startSTOMP(t)
+	conn := dialSTOMP(t, url)
+
+	got := make(chan Message[routing.PlayingState], 1)
+	sub, err := SubscribeMessages(context.Background(), conn, routing.ExchangePerilTopic,
+		"moves.alice", routing.ArmyMovesPrefix+".*", SimpleQueueTransient,
+		func(msg Message[routing.PlayingState]) Acktype {
+			got <- msg
+			return Ack
+		},
+		WithLogger(discardLogger),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	ch, err := amqpConn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	err = PublishJSON(ch, routing.ExchangePerilTopic, routing.ArmyMovesPrefix+".bob", routing.PlayingState{IsPaused: true},
+		WithMessageID("m-1"), WithHeader("x-player", "bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not bound, so never delivered
+	if err := PublishJSON(ch, routing.ExchangePerilTopic, "war.bob", routing.PlayingState{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-got:
+		if !msg.Body.IsPaused || msg.MessageID != "m-1" || msg.Header("x-player") != "bob" ||
+			msg.Exchange != routing.ExchangePerilTopic || msg.RoutingKey != routing.ArmyMovesPrefix+".bob" {
+			t.Fatalf("got %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing delivered over STOMP")
+	}
+	select {
+	case msg := <-got:
+		t.Fatalf("got %s, which the queue isn't bound to", msg.RoutingKey)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// A queue destination declares the queue with the settings it was given,
+// and publishing to an exchange over STOMP routes like AMQP does.
+func TestSTOMPQueue(t *testing.T) {
+	broker, _, url := startSTOMP(t)
+	conn := dialSTOMP(t, url)
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+
+	if _, err := ch.QueueDeclare("jobs", true, false, false, false, amqp.Table{"x-message-ttl": int64(60000)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.PublishWithContext(context.Background(), "", "jobs", false, false, amqp.Publishing{Body: []byte("job")}); err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := broker.QueueLength("jobs"); !ok || n != 1 {
+		t.Fatalf("jobs has %d messages (exists: %v), want 1", n, ok)
+	}
+	// The broker has it with the settings asked for, so declaring it differently fails
+	amqpConn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer amqpConn.Close()
+	amqpCh, err := amqpConn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := amqpCh.QueueDeclare("jobs", true, false, false, false, nil); err == nil {
+		t.Fatal("the queue was declared without its TTL")
+	}
+
+	err = ch.PublishWithContext(context.Background(), routing.ExchangePerilTopic, routing.GameLogSlug+".alice", false, false, amqp.Publishing{Body: []byte("log")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := broker.QueueLength(routing.GameLogSlug); n != 1 {
+		t.Fatalf("%s has %d messages after publishing to %s, want 1", routing.GameLogSlug, n, routing.ExchangePerilTopic)
+	}
+}
+
+// Ack, NackRequeue and NackDiscard become ACK, NACK with requeue and NACK
+// without, and the broker does with the message what AMQP would.
+func TestSTOMPAckNack(t *testing.T) {
+	broker, amqpConn, url := startSTOMP(t)
+	conn := dialSTOMP(t, url)
+
+	var mu sync.Mutex
+	seen := map[string][]bool{} // body: redelivered, per delivery
+	done := make(chan struct{}, 3)
+	sub, err := SubscribeMessages(context.Background(), conn, routing.ExchangePerilTopic,
+		routing.WarRecognitionsPrefix, routing.WarRecognitionsPrefix+".*", SimpleQueueQuorum,
+		func(msg Message[string]) Acktype {
+			mu.Lock()
+			seen[msg.Body] = append(seen[msg.Body], msg.Redelivered)
+			first := len(seen[msg.Body]) == 1
+			mu.Unlock()
+			switch {
+			case msg.Body == "requeue" && first:
+				return NackRequeue
+			case msg.Body == "discard":
+				done <- struct{}{}
+				return NackDiscard
+			}
+			done <- struct{}{}
+			return Ack
+		},
+		WithDeliveryLimit(routing.DeliveryLimit),
+		WithLogger(discardLogger),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := amqpConn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	for _, body := range []string{"ack", "requeue", "discard"} {
+		if err := PublishJSON(ch, routing.ExchangePerilTopic, routing.WarRecognitionsPrefix+".alice", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range 3 {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("not every message was settled: %v", seen)
+		}
+	}
+	// Closing the subscription waits for the last ack to be sent
+	sub.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if r := seen["requeue"]; len(r) != 2 || r[0] || !r[1] {
+		t.Errorf("requeued message delivered with redelivered %v, want [false true]", r)
+	}
+	if len(seen["ack"]) != 1 || len(seen["discard"]) != 1 {
+		t.Errorf("acked message delivered %d times and discarded one %d, want once each", len(seen["ack"]), len(seen["discard"]))
+	}
+	waitFor(t, "the acks to reach the broker", func() bool {
+		n, _ := broker.QueueLength(routing.WarRecognitionsPrefix)
+		dead, _ := broker.QueueLength(routing.QueuePerilDLQ)
+		return n == 0 && dead == 1
+	})
+	amqpCh := ch.(*memChannel)
+	d, ok, err := amqpCh.Get(routing.QueuePerilDLQ, true)
+	if err != nil || !ok || string(d.Body) != `"discard"` {
+		t.Fatalf("dead-lettered %q (%v, %v), want the discarded message", d.Body, ok, err)
+	}
+}
+
+// Closing a channel that still holds deliveries gives them back, as it
+// would on AMQP.
+func TestSTOMPCloseRequeues(t *testing.T) {
+	broker, _, url := startSTOMP(t)
+	conn := dialSTOMP(t, url)
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("held", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.PublishWithContext(context.Background(), "", "held", false, false, amqp.Publishing{Body: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := ch.Consume("held", "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-deliveries:
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing delivered")
+	}
+	ch.Close()
+	waitFor(t, "the unacked message to go back", func() bool {
+		n, _ := broker.QueueLength("held")
+		return n == 1
+	})
+}
+
+func TestSTOMPLogin(t *testing.T) {
+	_, _, url := startSTOMP(t, func(s *STOMPServer) {
+		s.Login, s.Passcode = "peril", "secret"
+	})
+	host := url[len("stomp://"):]
+	if _, err := DialSTOMP("stomp://peril:wrong@" + host); err == nil {
+		t.Fatal("connected with the wrong passcode")
+	}
+	dialSTOMP(t, "stomp://peril:secret@"+host)
+}
@@ -0,0 +1,63 @@
+package pubsub
+
+import (
+	"sync"
+	"time"
+)
+
+// streamOffsetHeader is both the consume argument that says where to start
+// reading a stream and the header that says where a delivery came from.
+const streamOffsetHeader = "x-stream-offset"
+
+// StreamOffset is a position in a stream to start reading from, for
+// WithStreamOffset.
+type StreamOffset struct {
+	arg any // the x-stream-offset consume argument
+}
+
+var (
+	// StreamFirst starts from the oldest message the stream still holds.
+	StreamFirst = StreamOffset{"first"}
+	// StreamLast starts from the most recent messages. RabbitMQ stores
+	// streams in chunks and starts at the beginning of the last one, so
+	// this can be more than one message.
+	StreamLast = StreamOffset{"last"}
+	// StreamNext only delivers messages that arrive from now on. This is
+	// the default.
+	StreamNext = StreamOffset{"next"}
+)
+
+// StreamFrom starts from the first message the stream received at or
+// after t. The broker only has whole seconds to go on, and RabbitMQ starts
+// at the beginning of the chunk t falls in, so expect some messages from
+// just before t as well.
+func StreamFrom(t time.Time) StreamOffset {
+	return StreamOffset{t}
+}
+
+// StreamAt starts at a numeric offset, such as one taken from a message's
+// x-stream-offset header.
+func StreamAt(offset int64) StreamOffset {
+	return StreamOffset{offset}
+}
+
+// streamPosition remembers how far a stream consumer has got.
+type streamPosition struct {
+	mu   sync.Mutex
+	next int64 // -1 until a message has been acked
+}
+
+func (p *streamPosition) seen(offset int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if offset >= p.next {
+		p.next = offset + 1
+	}
+}
+
+// resume returns where to carry on from, if anything has been seen yet.
+func (p *streamPosition) resume() (int64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.next, p.next >= 0
+}
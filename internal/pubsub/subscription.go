@@ -0,0 +1,169 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Subscription is a handle on a running consumer, returned by the
+// SubscribeXxxWithContext functions. It stops when its context is
+// cancelled, when Close is called, or when the consumer dies (for example
+// because its queue was deleted). On a ReconnectingConnection, losing the
+// broker does not stop it; it carries on once the connection is back.
+type Subscription struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	queue  string
+	done   chan struct{}
+	logger *slog.Logger // with the queue's name
+
+	decodeFailures decodeFailureCounters
+
+	mu       sync.Mutex
+	err      error
+	active   int  // consumer goroutines still running
+	stopping bool // no new consumers may start
+	cleanup  []func()
+}
+
+func newSubscription(parent context.Context, queue string, logger *slog.Logger) *Subscription {
+	ctx, cancel := context.WithCancel(parent)
+	s := &Subscription{
+		ctx:    ctx,
+		cancel: cancel,
+		queue:  queue,
+		done:   make(chan struct{}),
+		logger: logger.With(slog.String("queue", queue)),
+	}
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		s.stopping = true
+		s.mu.Unlock()
+		s.finish()
+	}()
+	return s
+}
+
+// Close stops the subscription and waits for it to finish: consuming
+// stops, handlers that are running complete, their acks or nacks are sent,
+// and only then is the channel closed. It returns the same error as Err.
+func (s *Subscription) Close() error {
+	s.cancel()
+	return s.Wait()
+}
+
+// Wait blocks until the subscription has stopped and returns Err.
+func (s *Subscription) Wait() error {
+	<-s.done
+	return s.Err()
+}
+
+// Done is closed once the subscription has stopped.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the consumer died, or nil if it is still running or was
+// stopped on purpose.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// DecodeFailures counts the deliveries this subscription could not decode,
+// by how they were dealt with.
+func (s *Subscription) DecodeFailures() DecodeFailureCounts {
+	return s.decodeFailures.snapshot()
+}
+
+// Queue is the name of the queue being consumed.
+func (s *Subscription) Queue() string {
+	return s.queue
+}
+
+// enter registers a consumer goroutine about to start. It reports false
+// if the subscription is already stopping.
+func (s *Subscription) enter() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping {
+		return false
+	}
+	s.active++
+	return true
+}
+
+// exit is the counterpart of enter, called when the goroutine is done.
+func (s *Subscription) exit() {
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+	s.finish()
+}
+
+// fail records err as the reason the subscription died and stops it.
+func (s *Subscription) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.logger.Error("subscription stopped", slog.Any("err", err))
+	s.cancel()
+}
+
+// onStop runs fn once the subscription has fully stopped, or right away
+// if it already has.
+func (s *Subscription) onStop(fn func()) {
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		fn()
+	default:
+		s.cleanup = append(s.cleanup, fn)
+		s.mu.Unlock()
+	}
+}
+
+// finish closes done once the subscription is stopping and its last
+// consumer goroutine has exited. Cleanup runs without s.mu held, since it
+// may need the connection's lock.
+func (s *Subscription) finish() {
+	s.mu.Lock()
+	if !s.stopping || s.active > 0 {
+		s.mu.Unlock()
+		return
+	}
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return
+	default:
+	}
+	cleanup := s.cleanup
+	s.cleanup = nil
+	close(s.done)
+	s.mu.Unlock()
+	for _, fn := range cleanup {
+		fn()
+	}
+}
+
+// consumerStopped explains why a delivery channel closed on its own.
+func consumerStopped(queue string, closes <-chan *amqp.Error) error {
+	select {
+	case reason, ok := <-closes:
+		if ok && reason != nil {
+			return fmt.Errorf("channel for queue %s closed: %w", queue, reason)
+		}
+	default:
+	}
+	return fmt.Errorf("consumer for queue %s was cancelled by the broker", queue)
+}
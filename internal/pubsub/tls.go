@@ -0,0 +1,54 @@
+package pubsub
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// TLSFiles are PEM files that make up a TLS client configuration, for
+// DialOptions.TLS.
+type TLSFiles struct {
+	// CAFile is a bundle of CA certificates to trust instead of the
+	// system's, for a broker with a private CA.
+	CAFile string
+	// CertFile and KeyFile are a client certificate and its key, sent to a
+	// broker that asks for one (mutual TLS).
+	CertFile string
+	KeyFile  string
+	// ServerName is the name the broker's certificate must be for, when it
+	// isn't the host in the URL (when connecting by IP address, say).
+	ServerName string
+}
+
+// Config loads the files into a TLS configuration. The broker's
+// certificate is always verified.
+func (f TLSFiles) Config() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: f.ServerName,
+	}
+	if f.CAFile != "" {
+		pem, err := os.ReadFile(f.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates in CA bundle %s", f.CAFile)
+		}
+	}
+	if (f.CertFile == "") != (f.KeyFile == "") {
+		return nil, errors.New("a client certificate needs both a certificate and a key file")
+	}
+	if f.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
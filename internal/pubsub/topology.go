@@ -0,0 +1,314 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Topology describes the exchanges, queues and bindings that Peril expects
+// the broker to have. It is usually DefaultTopology, or read from a JSON
+// file with LoadTopology.
+type Topology struct {
+	Exchanges []ExchangeSpec `json:"exchanges"`
+	Queues    []QueueSpec    `json:"queues"`
+	Bindings  []BindingSpec  `json:"bindings"`
+}
+
+type ExchangeSpec struct {
+	Name       string     `json:"name"`
+	Kind       string     `json:"kind"` // direct, topic, fanout or headers
+	Durable    bool       `json:"durable,omitempty"`
+	AutoDelete bool       `json:"auto_delete,omitempty"`
+	Internal   bool       `json:"internal,omitempty"`
+	Args       amqp.Table `json:"arguments,omitempty"`
+}
+
+type QueueSpec struct {
+	Name       string     `json:"name"`
+	Durable    bool       `json:"durable,omitempty"`
+	AutoDelete bool       `json:"auto_delete,omitempty"`
+	Exclusive  bool       `json:"exclusive,omitempty"`
+	Args       amqp.Table `json:"arguments,omitempty"`
+}
+
+type BindingSpec struct {
+	Queue    string     `json:"queue"`
+	Exchange string     `json:"exchange"`
+	Key      string     `json:"key"`
+	Args     amqp.Table `json:"arguments,omitempty"`
+}
+
+// DefaultTopology is what the server and clients rely on: the exchanges
+// from the routing package, the dead-letter and quarantine queues, the
+// queues that several processes share and the game log stream. Queues are
+// declared with the same arguments DeclareAndBind uses, or it would fail
+// on them later. Per-player transient queues are left to the clients that
+// own them, and the RPC request queues to the servers that answer them.
+func DefaultTopology() Topology {
+	shared := func(name string, queueType SimpleQueueType, extra amqp.Table) QueueSpec {
+		return QueueSpec{Name: name, Durable: true, Args: queueArgs(queueType, extra)}
+	}
+	limit := deliveryLimitArgs(routing.DeliveryLimit)
+	return Topology{
+		Exchanges: []ExchangeSpec{
+			{Name: routing.ExchangePerilDirect, Kind: amqp.ExchangeDirect, Durable: true},
+			{Name: routing.ExchangePerilTopic, Kind: amqp.ExchangeTopic, Durable: true},
+			{Name: routing.ExchangePerilDLX, Kind: amqp.ExchangeFanout, Durable: true},
+			{Name: routing.ExchangePerilQuarantine, Kind: amqp.ExchangeTopic, Durable: true},
+		},
+		Queues: []QueueSpec{
+			{Name: routing.QueuePerilDLQ, Durable: true},
+			{Name: routing.QueuePerilQuarantine, Durable: true},
+			shared(routing.GameLogSlug, SimpleQueueQuorum, limit),
+			shared(routing.WarRecognitionsPrefix, SimpleQueueQuorum, limit),
+			shared(routing.QueueGameLogStream, SimpleQueueStream, nil),
+		},
+		Bindings: []BindingSpec{
+			{Queue: routing.QueuePerilDLQ, Exchange: routing.ExchangePerilDLX, Key: ""},
+			{Queue: routing.QueuePerilQuarantine, Exchange: routing.ExchangePerilQuarantine, Key: "#"},
+			{Queue: routing.GameLogSlug, Exchange: routing.ExchangePerilTopic, Key: routing.GameLogSlug + ".*"},
+			{Queue: routing.WarRecognitionsPrefix, Exchange: routing.ExchangePerilTopic, Key: routing.WarRecognitionsPrefix + ".*"},
+			{Queue: routing.QueueGameLogStream, Exchange: routing.ExchangePerilTopic, Key: routing.GameLogSlug + ".*"},
+		},
+	}
+}
+
+// LoadTopology reads a topology from a JSON file laid out like Topology's
+// fields, for example:
+//
+//	{
+//	  "exchanges": [{"name": "peril_topic", "kind": "topic", "durable": true}],
+//	  "queues": [{"name": "game_logs", "durable": true,
+//	              "arguments": {"x-dead-letter-exchange": "peril_dlx"}}],
+//	  "bindings": [{"queue": "game_logs", "exchange": "peril_topic", "key": "game_logs.*"}]
+//	}
+//
+// Unknown fields are an error, so that a typo doesn't silently drop a
+// setting.
+func LoadTopology(path string) (Topology, error) {
+	var t Topology
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return t, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&t); err != nil {
+		return t, fmt.Errorf("could not parse topology %s: %w", path, err)
+	}
+	t.normalize()
+	if err := t.Validate(); err != nil {
+		return t, fmt.Errorf("invalid topology %s: %w", path, err)
+	}
+	return t, nil
+}
+
+// normalize turns the whole numbers JSON decodes as float64 back into
+// integers: RabbitMQ rejects arguments such as x-message-ttl sent as
+// doubles.
+func (t *Topology) normalize() {
+	fix := func(args amqp.Table) {
+		for k, v := range args {
+			if f, ok := v.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+				args[k] = int64(f)
+			}
+		}
+	}
+	for _, e := range t.Exchanges {
+		fix(e.Args)
+	}
+	for _, q := range t.Queues {
+		fix(q.Args)
+	}
+	for _, b := range t.Bindings {
+		fix(b.Args)
+	}
+}
+
+// Validate checks that the topology could be declared: everything is
+// named, nothing takes a name with the amq. prefix the broker reserves,
+// exchange kinds are known and nothing is declared twice.
+func (t Topology) Validate() error {
+	var errs []error
+	exchanges := map[string]bool{}
+	for _, e := range t.Exchanges {
+		switch {
+		case e.Name == "":
+			errs = append(errs, errors.New("exchange with no name"))
+			continue
+		case strings.HasPrefix(e.Name, "amq."):
+			errs = append(errs, fmt.Errorf("exchange %s: the amq. prefix is reserved", e.Name))
+		case exchanges[e.Name]:
+			errs = append(errs, fmt.Errorf("exchange %s is declared twice", e.Name))
+		}
+		switch e.Kind {
+		case amqp.ExchangeDirect, amqp.ExchangeTopic, amqp.ExchangeFanout, amqp.ExchangeHeaders:
+		default:
+			errs = append(errs, fmt.Errorf("exchange %s: unknown kind %q", e.Name, e.Kind))
+		}
+		exchanges[e.Name] = true
+	}
+	queues := map[string]bool{}
+	for _, q := range t.Queues {
+		switch {
+		case q.Name == "":
+			// A server-named queue would be a new one every time
+			errs = append(errs, errors.New("queue with no name"))
+		case strings.HasPrefix(q.Name, "amq."):
+			errs = append(errs, fmt.Errorf("queue %s: the amq. prefix is reserved", q.Name))
+		case queues[q.Name]:
+			errs = append(errs, fmt.Errorf("queue %s is declared twice", q.Name))
+		}
+		queues[q.Name] = true
+	}
+	for _, b := range t.Bindings {
+		if b.Queue == "" || b.Exchange == "" {
+			errs = append(errs, fmt.Errorf("binding of queue %q to exchange %q: both must be named", b.Queue, b.Exchange))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ApplyTopology declares everything in t: exchanges first, then queues,
+// then bindings. Declaring is idempotent, so it is safe to run on a broker
+// that already has some or all of it, but something that exists with
+// different settings fails with PRECONDITION_FAILED rather than being
+// changed. On a ReconnectingConnection it is applied again after every
+// reconnect, before the subscriptions are restored.
+func ApplyTopology(conn Connection, t Topology) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	return provision(conn, func(ch Channel) error {
+		for _, e := range t.Exchanges {
+			if err := ch.ExchangeDeclare(e.Name, e.Kind, e.Durable, e.AutoDelete, e.Internal, false, e.Args); err != nil {
+				return fmt.Errorf("could not declare exchange %s: %v", e.Name, err)
+			}
+		}
+		for _, q := range t.Queues {
+			if _, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Args); err != nil {
+				return declareQueueError(q.Name, err)
+			}
+		}
+		for _, b := range t.Bindings {
+			if err := ch.QueueBind(b.Queue, b.Key, b.Exchange, false, b.Args); err != nil {
+				return fmt.Errorf("could not bind queue %s to %s with key %q: %v", b.Queue, b.Exchange, b.Key, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Drift is a difference between a topology and the broker.
+type Drift struct {
+	Kind    string // "exchange" or "queue"
+	Name    string
+	Problem string
+}
+
+func (d Drift) String() string {
+	return fmt.Sprintf("%s %s: %s", d.Kind, d.Name, d.Problem)
+}
+
+// passiveChannel is a channel that can check for an exchange or queue
+// without declaring it. Both *amqp.Channel and the memory broker's
+// channels provide it.
+type passiveChannel interface {
+	Channel
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+}
+
+// VerifyTopology compares t with the broker without changing anything,
+// and returns what differs: exchanges and queues that are missing, and
+// ones that exist with different settings. Existence is checked with a
+// passive declare; settings by declaring again with t's, which the broker
+// refuses (rather than applies) when they don't match what is there.
+// Bindings are not checked, as AMQP has no way to list them. The error is
+// for failing to check at all, such as losing the connection.
+func VerifyTopology(conn Connection, t Topology) ([]Drift, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	var drift []Drift
+	for _, e := range t.Exchanges {
+		problem, err := verify(conn, func(ch passiveChannel) error {
+			return ch.ExchangeDeclarePassive(e.Name, e.Kind, e.Durable, e.AutoDelete, e.Internal, false, e.Args)
+		}, func(ch passiveChannel) error {
+			return ch.ExchangeDeclare(e.Name, e.Kind, e.Durable, e.AutoDelete, e.Internal, false, e.Args)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not check exchange %s: %w", e.Name, err)
+		}
+		if problem != "" {
+			drift = append(drift, Drift{Kind: "exchange", Name: e.Name, Problem: problem})
+		}
+	}
+	for _, q := range t.Queues {
+		problem, err := verify(conn, func(ch passiveChannel) error {
+			_, err := ch.QueueDeclarePassive(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Args)
+			return err
+		}, func(ch passiveChannel) error {
+			_, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Args)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not check queue %s: %w", q.Name, err)
+		}
+		if problem != "" {
+			drift = append(drift, Drift{Kind: "queue", Name: q.Name, Problem: problem})
+		}
+	}
+	return drift, nil
+}
+
+// verify runs exists and then, if that passes, matches, each on a channel
+// of its own since a failed declare closes the channel. It describes the
+// problem if either is refused by the broker.
+func verify(conn Connection, exists, matches func(passiveChannel) error) (string, error) {
+	run := func(check func(passiveChannel) error) (*amqp.Error, error) {
+		raw, err := openDirectChannel(conn)
+		if err != nil {
+			return nil, err
+		}
+		ch, ok := raw.(passiveChannel)
+		if !ok {
+			raw.Close()
+			return nil, fmt.Errorf("channel type %T does not support passive declares", raw)
+		}
+		err = check(ch)
+		var aerr *amqp.Error
+		if errors.As(err, &aerr) && aerr.Server {
+			// The broker has closed the channel already
+			return aerr, nil
+		}
+		ch.Close()
+		return nil, err
+	}
+	refused, err := run(exists)
+	if err != nil {
+		return "", err
+	}
+	if refused != nil {
+		if refused.Code == amqp.NotFound {
+			return "missing", nil
+		}
+		return refused.Reason, nil
+	}
+	refused, err = run(matches)
+	if err != nil {
+		return "", err
+	}
+	if refused != nil {
+		return "exists with different settings: " + refused.Reason, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,176 @@
+package pubsub
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func writeTopology(t *testing.T, json string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "topology.json")
+	if err := os.WriteFile(path, []byte(json), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Whole numbers in arguments are sent as integers, as RabbitMQ refuses
+// x-message-ttl and friends as doubles.
+func TestLoadTopology(t *testing.T) {
+	path := writeTopology(t, `{
+		"exchanges": [{"name": "peril_alt", "kind": "fanout", "durable": true, "arguments": {"x-weight": 3}}],
+		"queues": [{"name": "moves", "durable": true, "arguments": {
+			"x-message-ttl": 60000, "x-ratio": 0.5, "x-queue-type": "quorum"
+		}}],
+		"bindings": [{"queue": "moves", "exchange": "peril_alt", "key": "", "arguments": {"x-priority": -1}}]
+	}`)
+	topo, err := LoadTopology(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := topo.Queues[0].Args
+	if v, ok := args["x-message-ttl"].(int64); !ok || v != 60000 {
+		t.Errorf("x-message-ttl is %T %v, want int64 60000", args["x-message-ttl"], args["x-message-ttl"])
+	}
+	if v, ok := args["x-ratio"].(float64); !ok || v != 0.5 {
+		t.Errorf("x-ratio is %T %v, want float64 0.5", args["x-ratio"], args["x-ratio"])
+	}
+	if args["x-queue-type"] != "quorum" {
+		t.Errorf("x-queue-type is %v, want quorum", args["x-queue-type"])
+	}
+	if v, ok := topo.Exchanges[0].Args["x-weight"].(int64); !ok || v != 3 {
+		t.Errorf("exchange x-weight is %T %v, want int64 3", topo.Exchanges[0].Args["x-weight"], topo.Exchanges[0].Args["x-weight"])
+	}
+	if v, ok := topo.Bindings[0].Args["x-priority"].(int64); !ok || v != -1 {
+		t.Errorf("binding x-priority is %T %v, want int64 -1", topo.Bindings[0].Args["x-priority"], topo.Bindings[0].Args["x-priority"])
+	}
+}
+
+func TestLoadTopologyErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		err  string
+	}{
+		{"unknown field", `{"queues": [{"name": "moves", "durabel": true}]}`, "unknown field"},
+		{"not JSON", `queues: [moves]`, "could not parse"},
+		{"invalid", `{"exchanges": [{"name": "amq.mine", "kind": "topic"}]}`, "reserved"},
+	}
+	for _, tt := range tests {
+		_, err := LoadTopology(writeTopology(t, tt.json))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: LoadTopology = %v, want an error mentioning %q", tt.name, err, tt.err)
+		}
+	}
+	if _, err := LoadTopology(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("loading a file that doesn't exist succeeded")
+	}
+}
+
+func TestTopologyValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		topo Topology
+		err  string
+	}{
+		{"duplicate exchange", Topology{Exchanges: []ExchangeSpec{{Name: "x", Kind: "topic"}, {Name: "x", Kind: "topic"}}}, "exchange x is declared twice"},
+		{"reserved exchange", Topology{Exchanges: []ExchangeSpec{{Name: "amq.topic", Kind: "topic"}}}, "amq. prefix is reserved"},
+		{"unnamed exchange", Topology{Exchanges: []ExchangeSpec{{Kind: "topic"}}}, "exchange with no name"},
+		{"unknown kind", Topology{Exchanges: []ExchangeSpec{{Name: "x", Kind: "x-delayed-message"}}}, `unknown kind "x-delayed-message"`},
+		{"duplicate queue", Topology{Queues: []QueueSpec{{Name: "q"}, {Name: "q"}}}, "queue q is declared twice"},
+		{"reserved queue", Topology{Queues: []QueueSpec{{Name: "amq.gen-1"}}}, "queue amq.gen-1: the amq. prefix is reserved"},
+		{"unnamed queue", Topology{Queues: []QueueSpec{{}}}, "queue with no name"},
+		{"unnamed binding", Topology{Bindings: []BindingSpec{{Queue: "q", Key: "k"}}}, "both must be named"},
+	}
+	for _, tt := range tests {
+		err := tt.topo.Validate()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: Validate = %v, want an error mentioning %q", tt.name, err, tt.err)
+		}
+	}
+	// Every problem is reported, not just the first
+	topo := Topology{Queues: []QueueSpec{{}, {Name: "amq.q"}}}
+	if err := topo.Validate(); err == nil || !strings.Contains(err.Error(), "no name") || !strings.Contains(err.Error(), "reserved") {
+		t.Errorf("Validate = %v, want both problems", err)
+	}
+	// A binding may use one of the broker's own exchanges
+	topo = Topology{Queues: []QueueSpec{{Name: "q"}}, Bindings: []BindingSpec{{Queue: "q", Exchange: "amq.topic", Key: "#"}}}
+	if err := topo.Validate(); err != nil {
+		t.Errorf("binding to amq.topic: %v", err)
+	}
+	if err := DefaultTopology().Validate(); err != nil {
+		t.Errorf("the default topology is invalid: %v", err)
+	}
+}
+
+func TestVerifyTopology(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	topo := DefaultTopology()
+	drift, err := VerifyTopology(conn, topo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift) != len(topo.Exchanges)+len(topo.Queues) {
+		t.Fatalf("got %d drifts on an empty broker, want everything missing: %v", len(drift), drift)
+	}
+	for _, d := range drift {
+		if d.Problem != "missing" {
+			t.Errorf("%v, want missing", d)
+		}
+	}
+	// Checking doesn't declare anything
+	if _, ok := broker.QueueLength(topo.Queues[0].Name); ok {
+		t.Fatalf("VerifyTopology declared queue %s", topo.Queues[0].Name)
+	}
+
+	if err := ApplyTopology(conn, topo); err != nil {
+		t.Fatal(err)
+	}
+	if drift, err := VerifyTopology(conn, topo); err != nil || len(drift) != 0 {
+		t.Fatalf("drift %v (%v) after applying the topology, want none", drift, err)
+	}
+	// Applying again is harmless
+	if err := ApplyTopology(conn, topo); err != nil {
+		t.Fatalf("applying the topology twice: %v", err)
+	}
+
+	changed := Topology{
+		Exchanges: []ExchangeSpec{{Name: topo.Exchanges[0].Name, Kind: amqp.ExchangeHeaders, Durable: true}},
+		Queues: []QueueSpec{
+			{Name: topo.Queues[0].Name, Durable: true, Args: amqp.Table{"x-message-ttl": int64(1000)}},
+			{Name: "not-there", Durable: true},
+		},
+	}
+	drift, err = VerifyTopology(conn, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"exchange " + changed.Exchanges[0].Name: "exists with different settings: ",
+		"queue " + changed.Queues[0].Name:       "exists with different settings: ",
+		"queue not-there":                       "missing",
+	}
+	if len(drift) != len(want) {
+		t.Fatalf("drift %v, want %d", drift, len(want))
+	}
+	for _, d := range drift {
+		prefix, ok := want[d.Kind+" "+d.Name]
+		if !ok || !strings.HasPrefix(d.Problem, prefix) {
+			t.Errorf("%v, want %q", d, prefix)
+		}
+	}
+	// Nothing was changed by the check
+	if drift, err := VerifyTopology(conn, topo); err != nil || len(drift) != 0 {
+		t.Fatalf("drift %v (%v) after verifying a different topology, want none", drift, err)
+	}
+}
@@ -11,3 +11,22 @@ type GameLog struct {
 	Message     string
 	Username    string
 }
+
+// WhoRequest asks the server who is playing. The reply is a WhoResponse.
+type WhoRequest struct{}
+
+type WhoResponse struct {
+	Players []PlayerSummary
+}
+
+// PlayerSummary is what the server knows about a player: how many units
+// they had in their last move, and when it last heard from them.
+type PlayerSummary struct {
+	Username string
+	Units    int
+	LastSeen time.Time
+}
+
+// PauseStateRequest asks the server whether the game is paused. The reply
+// is a PlayingState.
+type PauseStateRequest struct{}
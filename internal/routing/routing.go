@@ -1,5 +1,10 @@
 package routing
 
+import (
+	"regexp"
+	"time"
+)
+
 const (
 	ArmyMovesPrefix = "army_moves"
 
@@ -10,7 +15,59 @@ const (
 	GameLogSlug = "game_logs"
 )
 
+// The exchanges everything is published to. They can be renamed in the
+// configuration, which sets these at startup, before anything connects.
+var (
+	ExchangePerilDirect     = "peril_direct"
+	ExchangePerilTopic      = "peril_topic"
+	ExchangePerilDLX        = "peril_dlx"
+	ExchangePerilQuarantine = "peril_quarantine"
+)
+
+// App IDs the client, gateway, server and perilctl stamp on what they
+// publish, and the header a client puts its player's name in.
 const (
-	ExchangePerilDirect = "peril_direct"
-	ExchangePerilTopic  = "peril_topic"
+	AppClient  = "peril-client"
+	AppGateway = "peril-gateway"
+	AppServer  = "peril-server"
+	AppCtl     = "perilctl"
+
+	HeaderPlayer = "x-peril-player"
 )
+
+const (
+	QueuePerilDLQ        = "peril_dlq"
+	QueuePerilQuarantine = "peril_quarantine"
+	// Every game log ever published, for re-reading from a point in time
+	QueueGameLogStream = "game_logs_stream"
+	// Which delay queues are holding scheduled messages. The delay queues
+	// themselves are named after it
+	QueuePerilScheduled = "peril_scheduled"
+)
+
+// DeliveryLimit is how many times the game_logs and war quorum queues let a
+// message come back unsettled before they dead-letter it.
+const DeliveryLimit = 20
+
+// An army_moves queue only holds on to moves that still matter: ones that
+// have waited longer than ArmyMovesTTL, or are older than the newest
+// ArmyMovesMaxLength, are dead-lettered rather than applied late.
+const (
+	ArmyMovesTTL       = 30 * time.Second
+	ArmyMovesMaxLength = 100
+)
+
+// Routing keys of the RPC queries the server answers, on peril_direct.
+const (
+	RPCWhoKey        = "rpc.who"
+	RPCPauseStateKey = "rpc.pausestate"
+)
+
+var validUsername = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// ValidUsername reports whether a player's name can go in their queue names
+// and routing keys: 1 to 32 letters, digits, - or _, so that it never means
+// anything to a topic exchange.
+func ValidUsername(name string) bool {
+	return validUsername.MatchString(name)
+}